@@ -9,174 +9,10950 @@ import (
 	"log"
 	"time"
 	"strings"
+	"bytes"
+	"strconv"
+	"sync/atomic"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"context"
+	"errors"
+	"os/exec"
+	"math/rand"
+	"sort"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"path"
+	"io"
+	"crypto/sha256"
+	"encoding/hex"
+	"runtime"
+	"flag"
+	"cmp"
+	"encoding/base64"
+	"bufio"
+	"encoding/binary"
+	"net/http/httptrace"
+	"slices"
+	"maps"
+	"path/filepath"
+	"os/signal"
+	"syscall"
+	"regexp"
+	"math"
+	"crypto/hmac"
 	"github.com/joho/godotenv"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 )
 
+// version is the build's version, set with -ldflags "-X main.version=...".
+var version = "dev"
+
+type Config struct {
+	Port      string           `json:"port" yaml:"port" env:"PORT" doc:"Port the load balancer listens on when no listeners are configured."`
+	Listeners []ListenerConfig `json:"listeners" yaml:"listeners" env:"LB_LISTEN" doc:"Addresses to serve on, e.g. 127.0.0.1:8080 or [::1]:8080. LB_LISTEN takes a comma-separated list; CONFIG_FILE can also set a default pool per listener and mark it internal."`
+	Backends  []BackendConfig  `json:"backends" yaml:"backends" env:"Backend_URLs" doc:"Backends to balance across. Backend_URLs takes comma-separated URLs; CONFIG_FILE takes objects with per-backend settings."`
+
+	Strategy      string            `json:"strategy" yaml:"strategy" env:"LB_STRATEGY" default:"round_robin" doc:"Selection strategy: round_robin, weighted_round_robin, auto_latency (weights derived from recent latency), consistent_hash_path (the same URL path always goes to the same backend) or consistent_hash_header (keyed on hash_header)."`
+	HashHeader    string            `json:"hash_header" yaml:"hash_header" env:"HASH_HEADER" default:"X-Tenant-ID" doc:"Request header consistent_hash_header routes on; requests without it are spread round-robin."`
+	HashOverrides map[string]string `json:"hash_overrides" yaml:"hash_overrides" doc:"Header values pinned to a backend URL, checked before the hash ring; editable at runtime under /admin/hash-overrides (CONFIG_FILE only)."`
+	DebugHeader   bool              `json:"debug_header" yaml:"debug_header" env:"LB_DEBUG_HEADER" default:"false" doc:"Add an X-LB-Debug response header describing each routing decision."`
+	AdminToken    string            `json:"admin_token" yaml:"admin_token" env:"ADMIN_TOKEN" secret:"true" doc:"Bearer token for the admin API under /admin/; the API is disabled when empty."`
+
+	ExcludeBackendsForPath map[string][]string `json:"exclude_backends_for_path" yaml:"exclude_backends_for_path" doc:"Backend URLs never sent requests whose path starts with the given prefix, e.g. {\"/admin/\": [\"http://10.0.0.3:8080\"]}; a path matching several prefixes excludes them all (CONFIG_FILE only)."`
+
+	AutoLatencyInterval time.Duration `json:"auto_latency_interval" yaml:"auto_latency_interval" env:"AUTO_LATENCY_INTERVAL" default:"10s" doc:"How often the auto_latency strategy recomputes weights from each backend's rolling average latency."`
+
+	StickySessions   bool   `json:"sticky_sessions" yaml:"sticky_sessions" env:"STICKY_SESSIONS" default:"false" doc:"Pin clients to a backend with a cookie naming its id; they move only when it can't take the request."`
+	StickyCookieName string `json:"sticky_cookie_name" yaml:"sticky_cookie_name" env:"STICKY_COOKIE_NAME" default:"lb_backend" doc:"Name of the sticky session cookie."`
+
+	Routes               []RouteConfig   `json:"routes" yaml:"routes" doc:"Per-path routing rules, first match wins (CONFIG_FILE only)."`
+	FeatureFlagUserClaim string          `json:"feature_flag_user_claim" yaml:"feature_flag_user_claim" env:"FEATURE_FLAG_USER_CLAIM" default:"sub" doc:"JWT claim holding the user ID that feature flags are evaluated for; X-User-ID is used when there is no bearer JWT."`
+	JWTSecret            string          `json:"jwt_secret" yaml:"jwt_secret" env:"JWT_SECRET" secret:"true" doc:"HS256 key bearer JWTs must be signed with before feature flags use their claims; signatures aren't checked when empty."`
+	FeatureFlagProvider  FeatureFlagFunc `json:"-" yaml:"-"`
+
+	ForwardAuthTimeout         time.Duration `json:"forward_auth_timeout" yaml:"forward_auth_timeout" env:"FORWARD_AUTH_TIMEOUT" default:"2s" doc:"Timeout for subrequests to a route's forward_auth_url."`
+	ForwardAuthFailOpen        bool          `json:"forward_auth_fail_open" yaml:"forward_auth_fail_open" env:"FORWARD_AUTH_FAIL_OPEN" default:"false" doc:"Let requests through when the auth service fails or times out instead of answering 503."`
+	ForwardAuthResponseHeaders []string      `json:"forward_auth_response_headers" yaml:"forward_auth_response_headers" env:"FORWARD_AUTH_RESPONSE_HEADERS" default:"X-Auth-User" doc:"Headers copied from a 2xx auth response onto the upstream request; clients cannot set them."`
+	ForwardAuthCacheTTL        time.Duration `json:"forward_auth_cache_ttl" yaml:"forward_auth_cache_ttl" env:"FORWARD_AUTH_CACHE_TTL" default:"0" doc:"Cache auth decisions per Authorization header for this long (0 disables)."`
+
+	ZoneAwareRouting bool   `json:"zone_aware_routing" yaml:"zone_aware_routing" env:"ZONE_AWARE_ROUTING" default:"false" doc:"Prefer backends in local_zone, using other zones only when none is available."`
+	LocalZone        string `json:"local_zone" yaml:"local_zone" env:"LB_ZONE" doc:"Zone this instance runs in."`
+
+	CrossZoneLatencyPenaltyMs int `json:"cross_zone_latency_penalty_ms" yaml:"cross_zone_latency_penalty_ms" env:"CROSS_ZONE_LATENCY_PENALTY_MS" default:"0" doc:"Milliseconds added to the latency of backends outside local_zone under auto_latency; they only take traffic while faster than every local backend even so."`
+
+	DefaultPool             string        `json:"default_pool" yaml:"default_pool" env:"DEFAULT_POOL" default:"default" doc:"Pool for backends that don't name one; it serves the stable traffic."`
+	CanaryPool              string        `json:"canary_pool" yaml:"canary_pool" env:"CANARY_POOL" default:"canary" doc:"Pool that receives the canary share of traffic."`
+	IdlePool                string        `json:"idle_pool" yaml:"idle_pool" env:"IDLE_POOL" doc:"Pool held in reserve: it is health checked but only takes traffic when every other candidate is at its max_concurrent_requests limit or down."`
+	CanaryWeight            float64       `json:"canary_weight" yaml:"canary_weight" env:"CANARY_WEIGHT" default:"0" doc:"Percentage (0-100) of traffic sent to the canary pool."`
+	CanaryReportWindow      time.Duration `json:"canary_report_window" yaml:"canary_report_window" env:"CANARY_REPORT_WINDOW" default:"5m" doc:"Window compared by GET /admin/canary/report."`
+	CanaryMaxErrorRateDelta float64       `json:"canary_max_error_rate_delta" yaml:"canary_max_error_rate_delta" env:"CANARY_MAX_ERROR_RATE_DELTA" default:"1" doc:"Error rate margin, in percentage points over stable, at which the canary report fails."`
+
+	CanaryAutoRollback           bool          `json:"canary_auto_rollback" yaml:"canary_auto_rollback" env:"CANARY_AUTO_ROLLBACK" default:"false" doc:"Drop the canary weight to 0 when its error rate stays above stable's."`
+	CanaryRollbackDryRun         bool          `json:"canary_rollback_dry_run" yaml:"canary_rollback_dry_run" env:"CANARY_ROLLBACK_DRY_RUN" default:"false" doc:"Only record what automatic rollback would do."`
+	CanaryRollbackErrorRateDelta float64       `json:"canary_rollback_error_rate_delta" yaml:"canary_rollback_error_rate_delta" env:"CANARY_ROLLBACK_ERROR_RATE_DELTA" default:"5" doc:"Error rate margin, in percentage points over stable, that counts as failing for rollback."`
+	CanaryRollbackWindow         time.Duration `json:"canary_rollback_window" yaml:"canary_rollback_window" env:"CANARY_ROLLBACK_WINDOW" default:"1m" doc:"Window each rollback evaluation looks at."`
+	CanaryRollbackSustain        time.Duration `json:"canary_rollback_sustain" yaml:"canary_rollback_sustain" env:"CANARY_ROLLBACK_SUSTAIN" default:"2m" doc:"How long the canary must keep failing before it is rolled back."`
+	CanaryRollbackInterval       time.Duration `json:"canary_rollback_interval" yaml:"canary_rollback_interval" env:"CANARY_ROLLBACK_INTERVAL" default:"10s" doc:"How often the canary is evaluated."`
+	CanaryRollbackMinRequests    int           `json:"canary_rollback_min_requests" yaml:"canary_rollback_min_requests" env:"CANARY_ROLLBACK_MIN_REQUESTS" default:"20" doc:"Requests each pool needs in the window before the canary is evaluated."`
+	AlertWebhookURL              string        `json:"alert_webhook_url" yaml:"alert_webhook_url" env:"ALERT_WEBHOOK_URL" secret:"true" doc:"URL that alerts (rollbacks, high-priority backends going down) are POSTed to."`
+
+	HealthCheckInterval       time.Duration `json:"health_check_interval" yaml:"health_check_interval" env:"HEALTH_CHECK_INTERVAL" default:"10s" doc:"Time between health checks of each backend."`
+	HealthCheckType           string        `json:"health_check_type" yaml:"health_check_type" env:"HEALTH_CHECK_TYPE" default:"http" doc:"Health check type: http (GET the backend URL, expect 200), external or grpc (grpc.health.v1.Health/Check, expect SERVING)."`
+	HealthCheckGRPCService    string        `json:"health_check_grpc_service" yaml:"health_check_grpc_service" env:"HEALTH_CHECK_GRPC_SERVICE" doc:"Service name sent in gRPC health checks; empty asks about the server as a whole."`
+	HealthCheckCommand        string        `json:"health_check_command" yaml:"health_check_command" env:"HEALTH_CHECK_COMMAND" doc:"Command for external checks, run with the backend URL appended; exit 0 means healthy."`
+	HealthCheckCommandTimeout time.Duration `json:"health_check_command_timeout" yaml:"health_check_command_timeout" env:"HEALTH_CHECK_COMMAND_TIMEOUT" default:"5s" doc:"Timeout for external health check commands."`
+	HealthCheckTimeout        time.Duration `json:"health_check_timeout" yaml:"health_check_timeout" env:"HEALTH_CHECK_TIMEOUT" default:"5s" doc:"Timeout for HTTP health checks."`
+	HealthCheckJitter         float64       `json:"health_check_jitter" yaml:"health_check_jitter" env:"HEALTH_CHECK_JITTER" default:"0.1" doc:"Randomize each wait between probes by up to this fraction of the interval, either way."`
+	HealthCheckPath           string        `json:"health_check_path" yaml:"health_check_path" env:"HEALTH_CHECK_PATH" doc:"Path of the shallow HTTP probe, e.g. /healthz, that decides whether a backend is in rotation; the backend URL itself when empty."`
+	DeepHealthCheckPath       string        `json:"deep_health_check_path" yaml:"deep_health_check_path" env:"DEEP_HEALTH_CHECK_PATH" doc:"Path of the deep HTTP probe, e.g. /readyz; backends failing it stay in rotation but are only used when no backend passes (empty disables)."`
+	DeepHealthCheckInterval   time.Duration `json:"deep_health_check_interval" yaml:"deep_health_check_interval" env:"DEEP_HEALTH_CHECK_INTERVAL" default:"1m" doc:"Time between deep probes of each backend."`
+	HealthCheckMaxLatency     time.Duration `json:"health_check_max_latency" yaml:"health_check_max_latency" env:"HEALTH_CHECK_MAX_LATENCY" default:"0" doc:"Fail probes slower than this even if they succeed (0 disables)."`
+
+	LatencySLO                 time.Duration `json:"latency_slo" yaml:"latency_slo" env:"LATENCY_SLO" default:"0" doc:"Request latency target used for ejection (0 disables)."`
+	LatencyEjectionThreshold   float64       `json:"latency_ejection_threshold" yaml:"latency_ejection_threshold" env:"LATENCY_EJECTION_THRESHOLD" default:"50" doc:"Percentage of requests over the SLO at which a backend is ejected."`
+	LatencyEjectionWindow      time.Duration `json:"latency_ejection_window" yaml:"latency_ejection_window" env:"LATENCY_EJECTION_WINDOW" default:"30s" doc:"Window over which slow requests are counted."`
+	LatencyEjectionMinRequests int           `json:"latency_ejection_min_requests" yaml:"latency_ejection_min_requests" env:"LATENCY_EJECTION_MIN_REQUESTS" default:"10" doc:"Requests needed in the window before a backend can be ejected."`
+	LatencyEjectionCooldown    time.Duration `json:"latency_ejection_cooldown" yaml:"latency_ejection_cooldown" env:"LATENCY_EJECTION_COOLDOWN" default:"30s" doc:"How long an ejected backend stays out of rotation."`
+
+	RetryAfterMaxBackoff time.Duration `json:"retry_after_max_backoff" yaml:"retry_after_max_backoff" env:"RETRY_AFTER_MAX_BACKOFF" default:"30s" doc:"Longest a backend answering 429 or 503 with Retry-After is passed over for; it still takes requests no other backend can (0 ignores Retry-After)."`
+
+	Schedules []ScheduleRule `json:"schedules" yaml:"schedules" doc:"Daily time windows that change a backend's weight or take it out of rotation; windows for one backend may not overlap (CONFIG_FILE only)."`
+
+	UtilityPathsEnabled bool          `json:"utility_paths_enabled" yaml:"utility_paths_enabled" env:"UTILITY_PATHS_ENABLED" default:"true" doc:"Answer utility paths such as /favicon.ico (204) and /robots.txt (deny all) without a backend; /.well-known/acme-challenge/ is always proxied."`
+	UtilityPaths        []UtilityPath `json:"utility_paths" yaml:"utility_paths" doc:"Utility path responses checked before the built-in ones; set proxy to send a path to the backends (CONFIG_FILE only)."`
+
+	MockEnabled bool       `json:"mock_enabled" yaml:"mock_enabled" env:"MOCK_ENABLED" default:"false" doc:"Answer requests matching mock_rules directly."`
+	MockRules   []MockRule `json:"mock_rules" yaml:"mock_rules" doc:"Canned responses by path pattern and method (CONFIG_FILE only)."`
+
+	ChaosEnabled bool        `json:"chaos_enabled" yaml:"chaos_enabled" env:"CHAOS_ENABLED" default:"false" doc:"Apply chaos_rules."`
+	ChaosRules   []ChaosRule `json:"chaos_rules" yaml:"chaos_rules" doc:"Latency and error injection by path pattern (CONFIG_FILE only)."`
+
+	TLSCertFile  string `json:"tls_cert_file" yaml:"tls_cert_file" env:"TLS_CERT_FILE" doc:"PEM certificate chain to terminate TLS with on every listener; listeners serve plain HTTP when empty."`
+	TLSKeyFile   string `json:"tls_key_file" yaml:"tls_key_file" env:"TLS_KEY_FILE" doc:"PEM private key for tls_cert_file."`
+	TLSCert      string `json:"tls_cert" yaml:"tls_cert" env:"TLS_CERT" secret:"true" doc:"PEM certificate chain itself, e.g. from Vault, instead of tls_cert_file."`
+	TLSKey       string `json:"tls_key" yaml:"tls_key" env:"TLS_KEY" secret:"true" doc:"PEM private key for tls_cert."`
+	HTTP3Enabled bool   `json:"http3_enabled" yaml:"http3_enabled" env:"HTTP3_ENABLED" default:"false" doc:"Experimental: also serve HTTP/3 over QUIC on each listener's port (UDP) and advertise it with Alt-Svc; needs tls_cert_file. No UDP socket is opened when off."`
+
+	ProxyProtocol             bool     `json:"proxy_protocol" yaml:"proxy_protocol" env:"PROXY_PROTOCOL" default:"false" doc:"Require a PROXY protocol v1/v2 header on every listener and use the client address it carries."`
+	ProxyProtocolTrustedCIDRs []string `json:"proxy_protocol_trusted_cidrs" yaml:"proxy_protocol_trusted_cidrs" env:"PROXY_PROTOCOL_TRUSTED_CIDRS" doc:"Peers allowed to connect to PROXY protocol listeners, e.g. the network load balancer's subnet."`
+
+	MaxConnsPerClient    int      `json:"max_conns_per_client" yaml:"max_conns_per_client" env:"MAX_CONNS_PER_CLIENT" default:"0" doc:"Concurrent connections allowed per client IP (0 disables)."`
+	ConnLimitExemptCIDRs []string `json:"conn_limit_exempt_cidrs" yaml:"conn_limit_exempt_cidrs" env:"CONN_LIMIT_EXEMPT_CIDRS" doc:"Client CIDRs exempt from the connection limit."`
+
+	RateLimitRPS   int `json:"rate_limit_rps" yaml:"rate_limit_rps" env:"RATE_LIMIT_RPS" default:"0" doc:"Requests per second allowed per client IP; more get 429 with Retry-After and X-RateLimit-* headers (0 disables)."`
+	RateLimitBurst int `json:"rate_limit_burst" yaml:"rate_limit_burst" env:"RATE_LIMIT_BURST" default:"0" doc:"Requests a client may make in a burst before rate_limit_rps applies; also the X-RateLimit-Limit sent (0 means rate_limit_rps)."`
+
+	ConcurrencyLimit        int           `json:"concurrency_limit" yaml:"concurrency_limit" env:"CONCURRENCY_LIMIT" default:"0" doc:"Requests proxied at once across all backends; the rest queue by priority class (0 disables)."`
+	PriorityHeader          string        `json:"priority_header" yaml:"priority_header" env:"PRIORITY_HEADER" default:"X-Priority" doc:"Request header marking high-priority requests, which are let through before normal ones when the concurrency limit is reached. Clients can set it too, so strip it at the edge if that matters."`
+	PriorityHeaderValues    []string      `json:"priority_header_values" yaml:"priority_header_values" env:"PRIORITY_HEADER_VALUES" default:"high" doc:"Values of priority_header that make a request high priority."`
+	HighPriorityQueueSize   int           `json:"high_priority_queue_size" yaml:"high_priority_queue_size" env:"HIGH_PRIORITY_QUEUE_SIZE" default:"100" doc:"High-priority requests that may wait for a slot; more get 503."`
+	NormalPriorityQueueSize int           `json:"normal_priority_queue_size" yaml:"normal_priority_queue_size" env:"NORMAL_PRIORITY_QUEUE_SIZE" default:"100" doc:"Normal requests that may wait for a slot; more get 503."`
+	ConcurrencyQueueTimeout time.Duration `json:"concurrency_queue_timeout" yaml:"concurrency_queue_timeout" env:"CONCURRENCY_QUEUE_TIMEOUT" default:"5s" doc:"Longest a request waits for a slot before getting 503."`
+
+	RewriteLocationHeaders bool     `json:"rewrite_location_headers" yaml:"rewrite_location_headers" env:"REWRITE_LOCATION_HEADERS" default:"false" doc:"Rewrite 3xx Location headers that point at a backend to the origin the client used."`
+	LocationInternalHosts  []string `json:"location_internal_hosts" yaml:"location_internal_hosts" env:"LOCATION_INTERNAL_HOSTS" doc:"Extra hosts treated as internal when rewriting Location headers."`
+
+	MaxURLLength int `json:"max_url_length" yaml:"max_url_length" env:"MAX_URL_LENGTH" default:"0" doc:"Longest request URL (path and query, as sent) accepted; longer ones get 414 before a backend is chosen (0 disables)."`
+
+	MaxResponseBodyBytes     int64    `json:"max_response_body_bytes" yaml:"max_response_body_bytes" env:"MAX_RESPONSE_BODY_BYTES" default:"0" doc:"Largest backend response body passed to clients (0 disables)."`
+	ResponseLimitExemptTypes []string `json:"response_limit_exempt_types" yaml:"response_limit_exempt_types" env:"RESPONSE_LIMIT_EXEMPT_TYPES" default:"text/event-stream,video/,audio/" doc:"Content type prefixes exempt from the response body limit."`
+	ResponseLimitExemptPaths []string `json:"response_limit_exempt_paths" yaml:"response_limit_exempt_paths" env:"RESPONSE_LIMIT_EXEMPT_PATHS" doc:"Path patterns exempt from the response body limit."`
+	MaxResponseHeaderBytes   int64    `json:"max_response_header_bytes" yaml:"max_response_header_bytes" env:"MAX_RESPONSE_HEADER_BYTES" default:"0" doc:"Largest backend response header block; bigger ones fail with 502 (0 keeps Go's 1MB transport limit)."`
+
+	MaxRetries            int           `json:"max_retries" yaml:"max_retries" env:"MAX_RETRIES" default:"0" doc:"Retries on another backend for requests without a body."`
+	RetryBudgetPercent    float64       `json:"retry_budget_percent" yaml:"retry_budget_percent" env:"RETRY_BUDGET_PERCENT" default:"20" doc:"Most retries allowed per 10s window, as a percentage of the window's requests; once over it, failures are returned without retrying until the window ends (0 disables)."`
+	DialFailureCacheTTL   time.Duration `json:"dial_failure_cache_ttl" yaml:"dial_failure_cache_ttl" env:"DIAL_FAILURE_CACHE_TTL" default:"2s" doc:"How long a backend is skipped after a failed connect (0 disables)."`
+	BackendTimeout        time.Duration `json:"backend_timeout" yaml:"backend_timeout" env:"BACKEND_TIMEOUT" default:"0" doc:"Timeout for each attempt against a backend (0 disables)."`
+	TotalRequestTimeout   time.Duration `json:"total_request_timeout" yaml:"total_request_timeout" env:"LB_TOTAL_REQUEST_TIMEOUT" default:"0" doc:"Deadline covering selection and all attempts (0 disables)."`
+	ExpectContinueTimeout time.Duration `json:"expect_continue_timeout" yaml:"expect_continue_timeout" env:"EXPECT_CONTINUE_TIMEOUT" default:"1s" doc:"How long to wait for a backend's 100 Continue before sending the request body."`
+	DialTimeout           time.Duration `json:"dial_timeout" yaml:"dial_timeout" env:"DIAL_TIMEOUT" default:"0" doc:"How long connecting to a backend may take (0 keeps Go's 30s)."`
+	TLSHandshakeTimeout   time.Duration `json:"tls_handshake_timeout" yaml:"tls_handshake_timeout" env:"TLS_HANDSHAKE_TIMEOUT" default:"0" doc:"How long the TLS handshake with a backend may take (0 keeps Go's 10s)."`
+	ResponseHeaderTimeout time.Duration `json:"response_header_timeout" yaml:"response_header_timeout" env:"RESPONSE_HEADER_TIMEOUT" default:"0" doc:"How long to wait for a backend's response headers once the request is sent (0 disables)."`
+	BodyIdleTimeout       time.Duration `json:"body_idle_timeout" yaml:"body_idle_timeout" env:"BODY_IDLE_TIMEOUT" default:"0" doc:"How long a backend may go without sending response body bytes before the response is aborted (0 disables)."`
+
+	ViaHeaderEnabled bool   `json:"via_header_enabled" yaml:"via_header_enabled" env:"VIA_HEADER_ENABLED" default:"false" doc:"Add this proxy to the Via header of proxied responses (RFC 7230 section 5.7.1), after any entries already there."`
+	ViaHeaderValue   string `json:"via_header_value" yaml:"via_header_value" env:"VIA_HEADER_VALUE" default:"go-lb/<version>" doc:"Name this proxy uses in the Via header."`
+	ViaHeaderVersion string `json:"via_header_version" yaml:"via_header_version" env:"VIA_HEADER_VERSION" default:"1.1" doc:"Protocol version in the Via header, e.g. 2 when clients use HTTP/2."`
+
+	BandwidthAggregateLimit int64 `json:"bandwidth_aggregate_limit" yaml:"bandwidth_aggregate_limit" env:"BANDWIDTH_AGGREGATE_LIMIT" default:"0" doc:"Bytes per second shared by all throttled responses, on top of their own limits (0 disables)."`
+	BandwidthAggregateBurst int64 `json:"bandwidth_aggregate_burst" yaml:"bandwidth_aggregate_burst" env:"BANDWIDTH_AGGREGATE_BURST" default:"0" doc:"Burst size in bytes for the aggregate limit; one second's worth when 0."`
+
+	BackendConnectionClose bool `json:"backend_connection_close" yaml:"backend_connection_close" env:"BACKEND_CONNECTION_CLOSE" default:"false" doc:"Use a new backend connection per request (Connection: close), working around backends with keep-alive bugs."`
+	ClientConnectionClose  bool `json:"client_connection_close" yaml:"client_connection_close" env:"CLIENT_CONNECTION_CLOSE" default:"false" doc:"Close client connections after each response so clients don't stay pinned to one instance across deploys."`
+
+	StripHopByHopHeaders bool `json:"strip_hop_by_hop_headers" yaml:"strip_hop_by_hop_headers" env:"STRIP_HOP_BY_HOP_HEADERS" default:"true" doc:"Remove RFC 7230 hop-by-hop headers, and any named in Connection, from backend responses; httputil.ReverseProxy already does so, this makes it explicit."`
+
+	NormalizeDuplicateHeaders bool              `json:"normalize_duplicate_headers" yaml:"normalize_duplicate_headers" env:"NORMALIZE_DUPLICATE_HEADERS" default:"false" doc:"Resolve request headers sent more than once by their duplicate_header_policies entry or the built-in list; headers in neither are left alone."`
+	DuplicateHeaderPolicies   map[string]string `json:"duplicate_header_policies" yaml:"duplicate_header_policies" doc:"Header name to merge (comma-join the values), first, last or reject (400), overriding the built-in list; Content-Length and Host are always rejected (CONFIG_FILE only)."`
+
+	DNSRefreshInterval time.Duration `json:"dns_refresh_interval" yaml:"dns_refresh_interval" env:"DNS_REFRESH_INTERVAL" default:"0" doc:"How often backend hostnames are re-resolved; connections to addresses they no longer resolve to are closed after their current request (0 disables)."`
+
+	TransportMode string `json:"transport_mode" yaml:"transport_mode" env:"TRANSPORT_MODE" default:"shared" doc:"shared: backends with the same transport settings share one connection pool; isolated: every backend gets a transport of its own."`
+
+	CoalesceEnabled      bool     `json:"coalesce_enabled" yaml:"coalesce_enabled" env:"COALESCE_ENABLED" default:"false" doc:"Share one backend request among identical in-flight GET/HEAD requests."`
+	CoalesceMaxWaiters   int      `json:"coalesce_max_waiters" yaml:"coalesce_max_waiters" env:"COALESCE_MAX_WAITERS" default:"100" doc:"Requests that may wait on one in-flight request."`
+	CoalesceMaxBodyBytes int64    `json:"coalesce_max_body_bytes" yaml:"coalesce_max_body_bytes" env:"COALESCE_MAX_BODY_BYTES" default:"1048576" doc:"Largest response shared between coalesced requests."`
+	CoalesceKeyHeaders   []string `json:"coalesce_key_headers" yaml:"coalesce_key_headers" env:"COALESCE_KEY_HEADERS" default:"Accept,Accept-Encoding,Accept-Language,Authorization,Cookie,Range" doc:"Request headers that must match for requests to be coalesced."`
+
+	IdempotencyTTL              time.Duration `json:"idempotency_ttl" yaml:"idempotency_ttl" env:"IDEMPOTENCY_TTL" default:"1h" doc:"How long responses to requests with an Idempotency-Key are replayed, on routes with idempotency set."`
+	IdempotencyMaxResponseBytes int64         `json:"idempotency_max_response_bytes" yaml:"idempotency_max_response_bytes" env:"IDEMPOTENCY_MAX_RESPONSE_BYTES" default:"1048576" doc:"Largest response body stored for replay; repeats of bigger ones get 409."`
+	IdempotencyCacheBytes       int64         `json:"idempotency_cache_bytes" yaml:"idempotency_cache_bytes" env:"IDEMPOTENCY_CACHE_BYTES" default:"67108864" doc:"Total size of stored idempotent responses; the oldest are dropped beyond it."`
+
+	GRPCTranscoding        bool   `json:"grpc_transcoding" yaml:"grpc_transcoding" env:"GRPC_TRANSCODING" default:"false" doc:"Serve HTTP/JSON requests for the methods in protobuf_descriptor_path as unary gRPC calls to the backends."`
+	ProtobufDescriptorPath string `json:"protobuf_descriptor_path" yaml:"protobuf_descriptor_path" env:"PROTOBUF_DESCRIPTOR_PATH" doc:"FileDescriptorSet, from protoc --include_imports --descriptor_set_out, describing the services to transcode."`
+
+	MetricsEnabled bool   `json:"metrics_enabled" yaml:"metrics_enabled" env:"METRICS_ENABLED" default:"false" doc:"Serve Prometheus metrics on metrics_path."`
+	MetricsPath    string `json:"metrics_path" yaml:"metrics_path" env:"METRICS_PATH" default:"/metrics" doc:"Path of the Prometheus metrics endpoint."`
+
+	StatsEnabled bool   `json:"stats_enabled" yaml:"stats_enabled" env:"STATS_ENABLED" default:"false" doc:"Serve the /admin/stats JSON, lb section included, without the admin token on stats_path; it names every backend."`
+	StatsPath    string `json:"stats_path" yaml:"stats_path" env:"STATS_PATH" default:"/stats" doc:"Path of the unauthenticated stats endpoint."`
+
+	MaintenanceMode       bool          `json:"maintenance_mode" yaml:"maintenance_mode" env:"MAINTENANCE_MODE" default:"false" doc:"Start in maintenance mode; toggle at runtime with POST /admin/maintenance."`
+	MaintenancePage       string        `json:"maintenance_page" yaml:"maintenance_page" env:"MAINTENANCE_PAGE" doc:"HTML file served with 503 in maintenance mode; a built-in page is used when empty."`
+	MaintenanceRetryAfter time.Duration `json:"maintenance_retry_after" yaml:"maintenance_retry_after" env:"MAINTENANCE_RETRY_AFTER" default:"5m" doc:"Retry-After sent with maintenance responses."`
+
+	CaptureDir           string   `json:"capture_dir" yaml:"capture_dir" env:"CAPTURE_DIR" doc:"Directory POST /admin/capture writes request capture files to; the system temp directory when empty."`
+	CaptureRedactHeaders []string `json:"capture_redact_headers" yaml:"capture_redact_headers" env:"CAPTURE_REDACT_HEADERS" default:"Authorization,Cookie,Proxy-Authorization" doc:"Request headers whose values are replaced with [REDACTED] in capture files."`
+
+	ErrorResponseJSON bool `json:"error_response_json" yaml:"error_response_json" env:"ERROR_RESPONSE_JSON" default:"false" doc:"Return balancer-generated errors as JSON carrying the request and trace IDs."`
+
+	ReplaceErrorBodies   bool     `json:"replace_error_bodies" yaml:"replace_error_bodies" env:"REPLACE_ERROR_BODIES" default:"false" doc:"Replace the bodies of backend error responses with the JSON error envelope, keeping the status; routes can override this."`
+	ReplaceErrorStatuses []string `json:"replace_error_statuses" yaml:"replace_error_statuses" env:"REPLACE_ERROR_STATUSES" default:"500-599" doc:"Statuses and ranges whose bodies are replaced, e.g. 500-599 or 502,503."`
+
+	StateFile         string        `json:"state_file" yaml:"state_file" env:"LB_STATE_FILE" doc:"File cumulative counters are saved to and restored from, so they survive restarts; disabled when empty."`
+	StateSaveInterval time.Duration `json:"state_save_interval" yaml:"state_save_interval" env:"LB_STATE_SAVE_INTERVAL" default:"1m" doc:"How often counters are written to state_file; at least 1s."`
+
+	SlowRequestThreshold time.Duration `json:"slow_request_threshold" yaml:"slow_request_threshold" env:"SLOW_REQUEST_THRESHOLD" default:"0" doc:"Log requests taking longer than this at WARN with their method, path, backend, status and duration (0 disables)."`
+
+	RequestTraceEnabled   bool   `json:"request_trace_enabled" yaml:"request_trace_enabled" env:"REQUEST_TRACE_ENABLED" default:"false" doc:"Append a JSON line per request (ID, method, path, client, backend, status, duration, retries, cache hit) to request_trace_file."`
+	RequestTraceFile      string `json:"request_trace_file" yaml:"request_trace_file" env:"REQUEST_TRACE_FILE" doc:"File request trace records are appended to."`
+	RequestTraceMaxSizeMB int    `json:"request_trace_max_size_mb" yaml:"request_trace_max_size_mb" env:"REQUEST_TRACE_MAX_SIZE_MB" default:"100" doc:"Size at which the request trace file is moved to <file>.1 and a new one started (0 never rotates)."`
+
+	TraceProxyDirector    bool `json:"trace_proxy_director" yaml:"trace_proxy_director" env:"TRACE_PROXY_DIRECTOR" default:"false" doc:"Log each proxied request's URL, headers and body digest at DEBUG before and after the proxy rewrites it, to debug header injection and path rewriting."`
+	TraceSensitiveHeaders bool `json:"trace_sensitive_headers" yaml:"trace_sensitive_headers" env:"TRACE_SENSITIVE_HEADERS" default:"false" doc:"Log Authorization, Proxy-Authorization and Cookie values in director traces instead of redacting them."`
+
+	DebugTraceWindow   time.Duration `json:"debug_trace_window" yaml:"debug_trace_window" env:"DEBUG_TRACE_WINDOW" default:"1m" doc:"How long per-request log lines are kept for GET /admin/requests/{request_id}."`
+	DebugTraceCapacity int           `json:"debug_trace_capacity" yaml:"debug_trace_capacity" env:"DEBUG_TRACE_CAPACITY" default:"10000" doc:"Most per-request log lines kept in memory."`
+
+	VaultEnabled  bool        `json:"vault_enabled" yaml:"vault_enabled" env:"VAULT_ENABLED" default:"false" doc:"Read secret fields (admin_token, alert_webhook_url, consul_token, jwt_secret, tls_cert, tls_key) from Vault at startup and keep the Vault token renewed."`
+	VaultAddr     string      `json:"vault_addr" yaml:"vault_addr" env:"VAULT_ADDR" doc:"Vault server address, e.g. https://vault.internal:8200."`
+	VaultPath     string      `json:"vault_path" yaml:"vault_path" env:"VAULT_PATH" doc:"API path of the secret, e.g. secret/data/load-balancer for KV v2; its keys are JSON config keys."`
+	VaultToken    string      `json:"vault_token" yaml:"vault_token" env:"VAULT_TOKEN" doc:"Vault token; AppRole login is used when empty."`
+	VaultRoleID   string      `json:"vault_role_id" yaml:"vault_role_id" env:"VAULT_ROLE_ID" doc:"AppRole role ID, used when vault_token is empty."`
+	VaultSecretID string      `json:"vault_secret_id" yaml:"vault_secret_id" env:"VAULT_SECRET_ID" doc:"AppRole secret ID, used when vault_token is empty."`
+	VaultClient   VaultClient `json:"-" yaml:"-"`
+
+	SelfRegister              string        `json:"self_register" yaml:"self_register" env:"SELF_REGISTER" doc:"Announce this instance to a registry while it runs: consul or webhook; disabled when empty."`
+	RegisterServiceName       string        `json:"register_service_name" yaml:"register_service_name" env:"REGISTER_SERVICE_NAME" default:"load-balancer" doc:"Service name this instance registers under."`
+	RegisterAddress           string        `json:"register_address" yaml:"register_address" env:"REGISTER_ADDRESS" doc:"Address registered for this instance; the hostname when empty."`
+	RegisterPort              int           `json:"register_port" yaml:"register_port" env:"REGISTER_PORT" default:"0" doc:"Port registered for this instance; the port of the first listener when 0."`
+	RegisterTags              []string      `json:"register_tags" yaml:"register_tags" env:"REGISTER_TAGS" doc:"Tags registered with this instance."`
+	RegisterHeartbeatInterval time.Duration `json:"register_heartbeat_interval" yaml:"register_heartbeat_interval" env:"REGISTER_HEARTBEAT_INTERVAL" default:"10s" doc:"How often the registration is refreshed, or retried after a failure."`
+	RegisterWebhookURL        string        `json:"register_webhook_url" yaml:"register_webhook_url" env:"REGISTER_WEBHOOK_URL" doc:"URL register, heartbeat and deregister events are POSTed to with self_register=webhook."`
+	ConsulAddr                string        `json:"consul_addr" yaml:"consul_addr" env:"CONSUL_ADDR" default:"http://127.0.0.1:8500" doc:"Consul agent address used with self_register=consul."`
+	ConsulToken               string        `json:"consul_token" yaml:"consul_token" env:"CONSUL_TOKEN" secret:"true" doc:"Consul ACL token."`
+}
+
+// GenerateConfigDocs documents every Config field from its json, yaml, env,
+// default and doc tags. format is "markdown" (a reference table) or
+// "json-schema" (a schema for CONFIG_FILE); any other format yields "".
+func GenerateConfigDocs(format string) string {
+	switch format {
+	case "markdown":
+		return configDocsMarkdown()
+	case "json-schema":
+		schema := configSchema(reflect.TypeOf(Config{}))
+		schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+		schema["title"] = "Load balancer configuration"
+		data, err := json.MarshalIndent(schema, "", "  ")
+		if err != nil {
+			return ""
+		}
+		return string(data) + "\n"
+	default:
+		return ""
+	}
+}
+
+func configDocsMarkdown() string {
+	var b strings.Builder
+	b.WriteString("# Configuration\n\n")
+	b.WriteString("Settings are read from the environment, then overlaid by the JSON file named in CONFIG_FILE. ")
+	b.WriteString("Durations take Go syntax such as `500ms` or `5m`; lists are comma-separated in the environment.\n\n")
+	b.WriteString("| JSON key | YAML key | Environment | Type | Default | Description |\n")
+	b.WriteString("|---|---|---|---|---|---|\n")
+	
+	cell := func(s string) string {
+		return strings.ReplaceAll(s, "|", "\\|")
+	}
+	code := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return "`" + cell(s) + "`"
+	}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := jsonFieldName(field)
+		if name == "" {
+			continue
+		}
+		yamlName, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s |\n", code(name), code(yamlName), code(field.Tag.Get("env")),
+			configTypeName(field.Type), code(field.Tag.Get("default")), cell(field.Tag.Get("doc")))
+	}
+	return b.String()
+}
+
+// jsonFieldName returns the JSON key of an exported field, or "" if it is
+// not part of the JSON config.
+func jsonFieldName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+func configTypeName(t reflect.Type) string {
+	if t == durationType {
+		return "duration"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		return "list of " + configTypeName(t.Elem()) + "s"
+	case reflect.Map:
+		return "map of " + configTypeName(t.Elem()) + "s"
+	case reflect.Struct:
+		return "object"
+	default:
+		return t.Kind().String()
+	}
+}
+
+// configSchema builds the JSON Schema for a config value of type t. Unknown
+// keys are rejected when decoding, hence additionalProperties is false.
+func configSchema(t reflect.Type) map[string]any {
+	if t == durationType {
+		return map[string]any{"type": []string{"string", "integer"}}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": configSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": configSchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]any{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := jsonFieldName(field)
+			if name == "" {
+				continue
+			}
+			schema := configSchema(field.Type)
+			if doc := field.Tag.Get("doc"); doc != "" {
+				schema["description"] = doc
+			}
+			if def, ok := field.Tag.Lookup("default"); ok {
+				schema["default"] = schemaDefault(field.Type, def)
+			}
+			properties[name] = schema
+		}
+		return map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+	default:
+		return map[string]any{"type": "string"}
+	}
+}
+
+// schemaDefault converts a default tag to the JSON value it stands for.
+func schemaDefault(t reflect.Type, value string) any {
+	if t == durationType {
+		return value
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String {
+			return strings.Split(value, ",")
+		}
+	}
+	return value
+}
+
+// FeatureFlagFunc reports whether flagName is on for userID. Set
+// Config.FeatureFlagProvider to connect the load balancer to a flag service.
+type FeatureFlagFunc func(flagName string, userID string) bool
+
+// RouteConfig applies routing rules to requests whose path matches
+// PathPattern (a path.Match pattern, or a prefix ending in "*").
+type RouteConfig struct {
+	PathPattern string `json:"path_pattern"`
+	// FeatureFlag sends users for whom the flag is on to FeatureFlagPool
+	// and everyone else to the default pool.
+	FeatureFlag     string `json:"feature_flag"`
+	FeatureFlagPool string `json:"feature_flag_pool"`
+	// ForwardAuthURL, if set, is asked about every matching request before
+	// it is proxied; see LoadBalancer.authorize.
+	ForwardAuthURL string `json:"forward_auth_url"`
+	// ReplaceErrorBodies and ReplaceErrorStatuses override the global
+	// settings of the same name for matching requests.
+	ReplaceErrorBodies   *bool    `json:"replace_error_bodies"`
+	ReplaceErrorStatuses []string `json:"replace_error_statuses"`
+	// BandwidthLimit throttles each matching response to this many bytes
+	// per second, with bursts of BandwidthBurst bytes (one second's worth
+	// when 0). It takes precedence over the backend's limit.
+	BandwidthLimit int64 `json:"bandwidth_limit"`
+	BandwidthBurst int64 `json:"bandwidth_burst"`
+	// Idempotency makes requests carrying an Idempotency-Key header reach
+	// the backend once per key; see idempotencyCache.
+	Idempotency bool `json:"idempotency"`
+	// Pool sends matching requests to this pool rather than the default
+	// or canary one. A feature flag takes precedence.
+	Pool string `json:"pool"`
+	// BodyMatch restricts the route to requests whose body matches; see
+	// BodyMatch. Other routes never look at the body.
+	BodyMatch *BodyMatch `json:"body_match"`
+}
+
+// defaultBodyMatchBytes is how much of a body a BodyMatch buffers when it
+// doesn't set MaxBytes.
+const defaultBodyMatchBytes = 8 << 10
+
+// BodyMatch is a route condition on the request body. Up to MaxBytes are
+// buffered to decide and then forwarded along with the rest. Requests with
+// a longer body, or one that isn't JSON when JSONPath is set, skip the
+// route, so a later route for the same path serves as the fallback.
+type BodyMatch struct {
+	// JSONPath selects a value in a JSON body, e.g. "$.operation" or
+	// "items[0].type". Without Regex the value only has to exist.
+	JSONPath string `json:"json_path"`
+	// Regex must match the JSONPath value (strings without their quotes,
+	// anything else as JSON), or the raw body when JSONPath is empty.
+	Regex    string `json:"regex"`
+	MaxBytes int64  `json:"max_bytes"`
+	
+	re *regexp.Regexp
+}
+
+func (m *BodyMatch) maxBytes() int64 {
+	if m.MaxBytes > 0 {
+		return m.MaxBytes
+	}
+	return defaultBodyMatchBytes
+}
+
+func (m *BodyMatch) matches(body []byte) bool {
+	if m.JSONPath == "" {
+		return m.re.Match(body)
+	}
+	
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return false
+	}
+	value, ok := lookupJSONPath(doc, m.JSONPath)
+	if !ok {
+		return false
+	}
+	if m.re == nil {
+		return true
+	}
+	if s, isString := value.(string); isString {
+		return m.re.MatchString(s)
+	}
+	encoded, err := json.Marshal(value)
+	return err == nil && m.re.Match(encoded)
+}
+
+// lookupJSONPath follows a dotted path with optional [n] array indexes and
+// leading "$." through a decoded JSON document.
+func lookupJSONPath(doc any, path string) (any, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			continue
+		}
+		switch node := doc.(type) {
+		case map[string]any:
+			next, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			doc = next
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// ListenerConfig is one address the load balancer serves on. Every listener
+// shares the same backends.
+type ListenerConfig struct {
+	Address string `json:"address"`
+	// DefaultPool sends this listener's traffic to a pool of its own,
+	// bypassing the canary split.
+	DefaultPool string `json:"default_pool"`
+	// Internal listeners serve the admin API without the ADMIN_TOKEN check.
+	Internal bool `json:"internal"`
+	// ProxyProtocol requires a PROXY protocol header on this listener even
+	// when PROXY_PROTOCOL is off.
+	ProxyProtocol bool `json:"proxy_protocol"`
+}
+
+// MockRule answers matching requests directly when MockEnabled is set. An
+// empty Method matches any method.
+type MockRule struct {
+	PathPattern     string            `json:"path_pattern"`
+	Method          string            `json:"method"`
+	ResponseStatus  int               `json:"response_status"`
+	ResponseHeaders map[string]string `json:"response_headers"`
+	ResponseBody    string            `json:"response_body"`
+}
+
+// ScheduleRule changes a backend's weight and/or administrative state during
+// a daily window, e.g. {"backend": "http://batch:8080", "start": "06:00",
+// "end": "22:00", "timezone": "Europe/Berlin", "enabled": false} keeps the
+// backend out of rotation during the day. A window whose end is before its
+// start runs past midnight; Days (mon..sun, default every day) names the
+// days it starts on. Outside its windows a backend has its configured weight
+// and is enabled.
+type ScheduleRule struct {
+	Backend  string   `json:"backend"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Days     []string `json:"days"`
+	Timezone string   `json:"timezone"`
+	Weight   *int     `json:"weight"`
+	Enabled  *bool    `json:"enabled"`
+	
+	start, end int // minutes after midnight
+	days       [7]bool
+	loc        *time.Location
+}
+
+// parse validates the rule and fills in its parsed form.
+func (s *ScheduleRule) parse() error {
+	var err error
+	if s.start, err = parseClock(s.Start); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	if s.end, err = parseClock(s.End); err != nil {
+		return fmt.Errorf("end: %w", err)
+	}
+	if s.start == s.end {
+		return errors.New("start and end are equal")
+	}
+	if s.loc, err = time.LoadLocation(s.Timezone); err != nil {
+		return err
+	}
+	if s.Weight == nil && s.Enabled == nil {
+		return errors.New("sets neither weight nor enabled")
+	}
+	if s.Weight != nil && *s.Weight < 1 {
+		return fmt.Errorf("weight must be at least 1, got %d", *s.Weight)
+	}
+	
+	if len(s.Days) == 0 {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, day := range s.Days {
+		index := slices.Index(weekdayNames, strings.ToLower(day))
+		if index < 0 {
+			return fmt.Errorf("unknown day %q", day)
+		}
+		s.days[index] = true
+	}
+	return nil
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether t falls inside one of the rule's windows.
+func (s *ScheduleRule) active(t time.Time) bool {
+	local := t.In(s.loc)
+	minute := local.Hour()*60 + local.Minute()
+	today := local.Weekday()
+	if s.start < s.end {
+		return s.days[today] && minute >= s.start && minute < s.end
+	}
+	yesterday := (today + 6) % 7
+	return (s.days[today] && minute >= s.start) || (s.days[yesterday] && minute < s.end)
+}
+
+// validateSchedules rejects schedules for one backend that are active at the
+// same minute at any point in the coming week.
+func validateSchedules(rules []ScheduleRule, now time.Time) error {
+	start := now.Truncate(time.Minute)
+	for t := start; t.Before(start.Add(7 * 24 * time.Hour)); t = t.Add(time.Minute) {
+		active := make(map[string]int)
+		for i := range rules {
+			if !rules[i].active(t) {
+				continue
+			}
+			if other, ok := active[rules[i].Backend]; ok {
+				return fmt.Errorf("schedules %d and %d for %s overlap at %s", other, i, rules[i].Backend, t.In(rules[i].loc).Format("Mon 15:04 MST"))
+			}
+			active[rules[i].Backend] = i
+		}
+	}
+	return nil
+}
+
+// UtilityPath answers requests for a utility path such as /favicon.ico
+// without involving a backend, or, with Proxy set, explicitly sends them to
+// the backends.
+type UtilityPath struct {
+	PathPattern     string            `json:"path_pattern"`
+	Proxy           bool              `json:"proxy"`
+	ResponseStatus  int               `json:"response_status"`
+	ResponseHeaders map[string]string `json:"response_headers"`
+	ResponseBody    string            `json:"response_body"`
+}
+
+// acmeChallengePrefix is never answered from the utility path table so
+// certificate issuance keeps working.
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+var defaultUtilityPaths = []UtilityPath{
+	{
+		PathPattern:     "/favicon.ico",
+		ResponseStatus:  http.StatusNoContent,
+		ResponseHeaders: map[string]string{"Cache-Control": "public, max-age=86400"},
+	},
+	{
+		PathPattern:     "/robots.txt",
+		ResponseStatus:  http.StatusOK,
+		ResponseHeaders: map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+		ResponseBody:    "User-agent: *\nDisallow: /\n",
+	},
+}
+
+// ChaosRule injects latency and/or an error response into matching requests
+// with the given probability (0-1) when ChaosEnabled is set.
+type ChaosRule struct {
+	PathPattern string  `json:"path_pattern"`
+	Probability float64 `json:"probability"`
+	LatencyMs   int     `json:"latency_ms"`
+	ErrorCode   int     `json:"error_code"`
+}
+
+// BackendConfig holds per-backend settings. Zero values inherit the global
+// setting from Config.
+type BackendConfig struct {
+	URL                 string        `json:"url"`
+	Pool                string        `json:"pool"`
+	Zone                string        `json:"zone"`
+	Weight              int           `json:"weight"`
+	SlowStartDuration   time.Duration `json:"slow_start_duration"`
+	HealthCheckInterval time.Duration `json:"health_check_interval"`
+	HealthCheckPriority string        `json:"health_check_priority"`
+	HealthCheckType     string        `json:"health_check_type"`
+	HealthCheckCommand  string        `json:"health_check_command"`
+	HealthTimeout       time.Duration `json:"health_timeout"`
+
+	// BackendID identifies the backend in sticky session cookies and
+	// defaults to URL. Setting it keeps sessions on the backend when its URL
+	// changes.
+	BackendID string `json:"backend_id"`
+
+	// Fallback makes the backend its pool's last resort, e.g. a static
+	// copy of the site: it is kept out of rotation and only used when no
+	// backend in the pool is available. Instead of the health check it
+	// gets a GET of its URL, any status below 500 counting as up.
+	Fallback bool `json:"fallback"`
+
+	// MaxConcurrentRequests is how many requests the backend takes at once
+	// before others are preferred; 0 means no limit. Once every candidate
+	// is at its limit, requests go to IdlePool, or over the limit without
+	// one unless MaxQueueLength is set.
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+
+	// MaxQueueLength requests may wait up to QueueTimeout, in arrival
+	// order, for a slot once the backend is at MaxConcurrentRequests
+	// instead of going over it. Requests beyond that, or that wait too
+	// long, get a 503. 0 disables the queue.
+	MaxQueueLength int           `json:"max_queue_length"`
+	QueueTimeout   time.Duration `json:"queue_timeout"`
+
+	// HealthCheckPath, HealthCheckGRPCService, DeepHealthCheckPath and
+	// DeepHealthCheckInterval override the global settings of the same name.
+	HealthCheckPath         string        `json:"health_check_path"`
+	HealthCheckGRPCService  string        `json:"health_check_grpc_service"`
+	DeepHealthCheckPath     string        `json:"deep_health_check_path"`
+	DeepHealthCheckInterval time.Duration `json:"deep_health_check_interval"`
+
+	// WarmupRequestCount GET requests to WarmupRequestPath must all succeed
+	// before a recovered backend gets real traffic again, giving runtimes
+	// such as the JVM time to compile hot paths.
+	WarmupRequestCount int    `json:"warmup_request_count"`
+	WarmupRequestPath  string `json:"warmup_request_path"`
+
+	// BandwidthLimit throttles each response from the backend to this many
+	// bytes per second, with bursts of BandwidthBurst bytes.
+	BandwidthLimit int64 `json:"bandwidth_limit"`
+	BandwidthBurst int64 `json:"bandwidth_burst"`
+
+	// RateLimitRPS caps the requests per second sent to the backend, from
+	// all clients together, in bursts of RateLimitBurst (default
+	// RateLimitRPS). Requests over it get 429 with the same headers as
+	// RATE_LIMIT_RPS. 0 disables it.
+	RateLimitRPS   int `json:"rate_limit_rps"`
+	RateLimitBurst int `json:"rate_limit_burst"`
+
+	// DeregisterOnDNSFailureCount removes the backend after its hostname
+	// fails to resolve (NXDOMAIN) this many health check cycles in a row;
+	// 0 disables it. Only the admin API brings it back.
+	DeregisterOnDNSFailureCount int `json:"deregister_on_dns_failure_count"`
+
+	Transport     string `json:"transport"`
+	TLSClientCert string `json:"tls_client_cert"`
+	TLSClientKey  string `json:"tls_client_key"`
+	TLSCACert     string `json:"tls_ca_cert"`
+
+	// MethodTimeouts overrides BACKEND_TIMEOUT per HTTP method, e.g.
+	// {"POST": "2m", "GET": "5s"}.
+	MethodTimeouts map[string]time.Duration `json:"method_timeouts"`
+
+	// ExpectContinueTimeout overrides Config.ExpectContinueTimeout.
+	ExpectContinueTimeout time.Duration `json:"expect_continue_timeout"`
+
+	// MaxResponseHeaderBytes overrides Config.MaxResponseHeaderBytes.
+	MaxResponseHeaderBytes int64 `json:"max_response_header_bytes"`
+
+	// BackendMaxConnAge closes HTTP/1.1 connections to the backend once
+	// they are this old, before a NAT or firewall idle timeout can silently
+	// break them.
+	BackendMaxConnAge time.Duration `json:"backend_max_conn_age"`
+
+	// Transport tuning on top of http.DefaultTransport's settings; zero
+	// keeps those, or the global setting of the same name where there is
+	// one. In shared TRANSPORT_MODE a backend only shares its transport
+	// with backends whose transport settings all match.
+	DialTimeout           time.Duration `json:"dial_timeout"`
+	TLSHandshakeTimeout   time.Duration `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration `json:"response_header_timeout"`
+	IdleConnTimeout       time.Duration `json:"idle_conn_timeout"`
+	MaxIdleConnsPerHost   int           `json:"max_idle_conns_per_host"`
+
+	// BodyIdleTimeout overrides Config.BodyIdleTimeout.
+	BodyIdleTimeout time.Duration `json:"body_idle_timeout"`
+
+	// ConnectionClose disables keep-alive to the backend; it defaults to
+	// Config.BackendConnectionClose.
+	ConnectionClose bool `json:"connection_close"`
+
+	// ForwardedPath replaces the path sent to the backend, e.g.
+	// "/api/v2/webhook". ${path} and ${query} expand to the incoming path and
+	// query string; the incoming query is kept unless the template has its
+	// own, as in "/api/v2${path}?source=lb&${query}". A path in the backend
+	// URL itself still prefixes the result.
+	ForwardedPath string `json:"forwarded_path"`
+
+	// BackendHostHeader is the Host header sent to the backend, for
+	// backends behind a CDN or proxy that routes on virtual host. Without
+	// it the backend URL's host is sent.
+	BackendHostHeader string `json:"backend_host_header"`
+}
+
+func (c *Config) UnmarshalJSON(data []byte) error {
+	return unmarshalWithDurations(data, c)
+}
+
+func (bc *BackendConfig) UnmarshalJSON(data []byte) error {
+	return unmarshalWithDurations(data, bc)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// unmarshalWithDurations decodes a JSON object field by field into the struct
+// pointed to by v, accepting Go duration strings ("2s", "500ms") for
+// time.Duration values. Keys not present in the JSON leave fields untouched,
+// so a config file only overrides what it sets.
+func unmarshalWithDurations(data []byte, v any) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+	known := make(map[string]bool)
+	for i := 0; i < rt.NumField(); i++ {
+		name := strings.Split(rt.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		known[name] = true
+		msg, ok := raw[name]
+		if !ok {
+			continue
+		}
+		if err := decodeConfigValue(msg, rv.Field(i)); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	
+	for name := range raw {
+		if !known[name] {
+			return fmt.Errorf("unknown config key %q", name)
+		}
+	}
+	return nil
+}
+
+func decodeConfigValue(msg json.RawMessage, fv reflect.Value) error {
+	switch {
+	case fv.Type() == durationType:
+		d, err := parseJSONDuration(msg)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+	case fv.Kind() == reflect.Map && fv.Type().Elem() == durationType:
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(msg, &raw); err != nil {
+			return err
+		}
+		m := reflect.MakeMapWithSize(fv.Type(), len(raw))
+		for k, v := range raw {
+			d, err := parseJSONDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			m.SetMapIndex(reflect.ValueOf(k).Convert(fv.Type().Key()), reflect.ValueOf(d))
+		}
+		fv.Set(m)
+	default:
+		return json.Unmarshal(msg, fv.Addr().Interface())
+	}
+	return nil
+}
+
+func parseJSONDuration(msg json.RawMessage) (time.Duration, error) {
+	var s string
+	if err := json.Unmarshal(msg, &s); err == nil {
+		return time.ParseDuration(s)
+	}
+	var n int64
+	if err := json.Unmarshal(msg, &n); err != nil {
+		return 0, fmt.Errorf("invalid duration %s", msg)
+	}
+	return time.Duration(n), nil
+}
+
+func envString(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("[FATAL] Invalid %s %q: %v\n", name, v, err)
+	}
+	return b
+}
+
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("[FATAL] Invalid %s %q: %v\n", name, v, err)
+	}
+	return n
+}
+
+func envInt64(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Fatalf("[FATAL] Invalid %s %q: %v\n", name, v, err)
+	}
+	return n
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("[FATAL] Invalid %s %q: %v\n", name, v, err)
+	}
+	return d
+}
+
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Fatalf("[FATAL] Invalid %s %q: %v\n", name, v, err)
+	}
+	return f
+}
+
+func envList(name string, def []string) []string {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+var defaultCoalesceKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie", "Range"}
+
+func loadConfig() *Config {
+	cfg := envConfig()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("[FATAL] Failed to read config file %s: %v\n", path, err)
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			log.Fatalf("[FATAL] Failed to parse config file %s: %v\n", path, err)
+		}
+		log.Printf("[INFO] Loaded config file %s\n", path)
+	}
+	if cfg.VaultEnabled {
+		if err := loadVaultSecrets(cfg); err != nil {
+			log.Fatalf("[FATAL] Failed to load secrets from Vault: %v\n", err)
+		}
+	}
+	
+	report := cfg.validate()
+	for _, warning := range report.Warnings {
+		log.Printf("[WARN] %s\n", warning)
+	}
+	if !report.Valid {
+		log.Fatalf("[FATAL] Invalid configuration: %s\n", strings.Join(report.Errors, "; "))
+	}
+	return cfg
+}
+
+// envConfig builds the config from the environment alone, before the
+// CONFIG_FILE overlay.
+func envConfig() *Config {
+	cfg := &Config{
+		Port:        os.Getenv("PORT"),
+		Strategy:    envString("LB_STRATEGY", "round_robin"),
+		HashHeader:  envString("HASH_HEADER", "X-Tenant-ID"),
+		DebugHeader: envBool("LB_DEBUG_HEADER", false),
+		AdminToken:  os.Getenv("ADMIN_TOKEN"),
+
+		AutoLatencyInterval: envDuration("AUTO_LATENCY_INTERVAL", 10*time.Second),
+
+		StickySessions:   envBool("STICKY_SESSIONS", false),
+		StickyCookieName: envString("STICKY_COOKIE_NAME", "lb_backend"),
+
+		FeatureFlagUserClaim: envString("FEATURE_FLAG_USER_CLAIM", "sub"),
+		JWTSecret:            os.Getenv("JWT_SECRET"),
+
+		ForwardAuthTimeout:         envDuration("FORWARD_AUTH_TIMEOUT", 2*time.Second),
+		ForwardAuthFailOpen:        envBool("FORWARD_AUTH_FAIL_OPEN", false),
+		ForwardAuthResponseHeaders: envList("FORWARD_AUTH_RESPONSE_HEADERS", []string{"X-Auth-User"}),
+		ForwardAuthCacheTTL:        envDuration("FORWARD_AUTH_CACHE_TTL", 0),
+
+		ZoneAwareRouting: envBool("ZONE_AWARE_ROUTING", false),
+		LocalZone:        os.Getenv("LB_ZONE"),
+
+		CrossZoneLatencyPenaltyMs: envInt("CROSS_ZONE_LATENCY_PENALTY_MS", 0),
+
+		DefaultPool:             envString("DEFAULT_POOL", "default"),
+		CanaryPool:              envString("CANARY_POOL", "canary"),
+		IdlePool:                os.Getenv("IDLE_POOL"),
+		CanaryWeight:            envFloat("CANARY_WEIGHT", 0),
+		CanaryReportWindow:      envDuration("CANARY_REPORT_WINDOW", 5*time.Minute),
+		CanaryMaxErrorRateDelta: envFloat("CANARY_MAX_ERROR_RATE_DELTA", 1),
+
+		CanaryAutoRollback:           envBool("CANARY_AUTO_ROLLBACK", false),
+		CanaryRollbackDryRun:         envBool("CANARY_ROLLBACK_DRY_RUN", false),
+		CanaryRollbackErrorRateDelta: envFloat("CANARY_ROLLBACK_ERROR_RATE_DELTA", 5),
+		CanaryRollbackWindow:         envDuration("CANARY_ROLLBACK_WINDOW", time.Minute),
+		CanaryRollbackSustain:        envDuration("CANARY_ROLLBACK_SUSTAIN", 2*time.Minute),
+		CanaryRollbackInterval:       envDuration("CANARY_ROLLBACK_INTERVAL", 10*time.Second),
+		CanaryRollbackMinRequests:    envInt("CANARY_ROLLBACK_MIN_REQUESTS", 20),
+		AlertWebhookURL:              os.Getenv("ALERT_WEBHOOK_URL"),
+
+		HealthCheckInterval:       envDuration("HEALTH_CHECK_INTERVAL", 10*time.Second),
+		HealthCheckType:           envString("HEALTH_CHECK_TYPE", "http"),
+		HealthCheckGRPCService:    os.Getenv("HEALTH_CHECK_GRPC_SERVICE"),
+		HealthCheckCommand:        os.Getenv("HEALTH_CHECK_COMMAND"),
+		HealthCheckCommandTimeout: envDuration("HEALTH_CHECK_COMMAND_TIMEOUT", 5*time.Second),
+		HealthCheckTimeout:        envDuration("HEALTH_CHECK_TIMEOUT", 5*time.Second),
+		HealthCheckJitter:         envFloat("HEALTH_CHECK_JITTER", 0.1),
+		HealthCheckPath:           os.Getenv("HEALTH_CHECK_PATH"),
+		DeepHealthCheckPath:       os.Getenv("DEEP_HEALTH_CHECK_PATH"),
+		DeepHealthCheckInterval:   envDuration("DEEP_HEALTH_CHECK_INTERVAL", time.Minute),
+		HealthCheckMaxLatency:     envDuration("HEALTH_CHECK_MAX_LATENCY", 0),
+
+		LatencySLO:                 envDuration("LATENCY_SLO", 0),
+		LatencyEjectionThreshold:   envFloat("LATENCY_EJECTION_THRESHOLD", 50),
+		LatencyEjectionWindow:      envDuration("LATENCY_EJECTION_WINDOW", 30*time.Second),
+		LatencyEjectionMinRequests: envInt("LATENCY_EJECTION_MIN_REQUESTS", 10),
+		LatencyEjectionCooldown:    envDuration("LATENCY_EJECTION_COOLDOWN", 30*time.Second),
+
+		RetryAfterMaxBackoff: envDuration("RETRY_AFTER_MAX_BACKOFF", 30*time.Second),
+
+		UtilityPathsEnabled: envBool("UTILITY_PATHS_ENABLED", true),
+
+		MockEnabled: envBool("MOCK_ENABLED", false),
+
+		ChaosEnabled: envBool("CHAOS_ENABLED", false),
+
+		TLSCertFile:  os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:   os.Getenv("TLS_KEY_FILE"),
+		TLSCert:      os.Getenv("TLS_CERT"),
+		TLSKey:       os.Getenv("TLS_KEY"),
+		HTTP3Enabled: envBool("HTTP3_ENABLED", false),
+
+		ProxyProtocol:             envBool("PROXY_PROTOCOL", false),
+		ProxyProtocolTrustedCIDRs: envList("PROXY_PROTOCOL_TRUSTED_CIDRS", nil),
+
+		MaxConnsPerClient:    envInt("MAX_CONNS_PER_CLIENT", 0),
+		ConnLimitExemptCIDRs: envList("CONN_LIMIT_EXEMPT_CIDRS", nil),
+
+		RateLimitRPS:   envInt("RATE_LIMIT_RPS", 0),
+		RateLimitBurst: envInt("RATE_LIMIT_BURST", 0),
+
+		ConcurrencyLimit:        envInt("CONCURRENCY_LIMIT", 0),
+		PriorityHeader:          envString("PRIORITY_HEADER", "X-Priority"),
+		PriorityHeaderValues:    envList("PRIORITY_HEADER_VALUES", []string{"high"}),
+		HighPriorityQueueSize:   envInt("HIGH_PRIORITY_QUEUE_SIZE", 100),
+		NormalPriorityQueueSize: envInt("NORMAL_PRIORITY_QUEUE_SIZE", 100),
+		ConcurrencyQueueTimeout: envDuration("CONCURRENCY_QUEUE_TIMEOUT", 5*time.Second),
+
+		RewriteLocationHeaders: envBool("REWRITE_LOCATION_HEADERS", false),
+		LocationInternalHosts:  envList("LOCATION_INTERNAL_HOSTS", nil),
+
+		MaxURLLength: envInt("MAX_URL_LENGTH", 0),
+
+		MaxResponseBodyBytes:     envInt64("MAX_RESPONSE_BODY_BYTES", 0),
+		ResponseLimitExemptTypes: envList("RESPONSE_LIMIT_EXEMPT_TYPES", []string{"text/event-stream", "video/", "audio/"}),
+		ResponseLimitExemptPaths: envList("RESPONSE_LIMIT_EXEMPT_PATHS", nil),
+		MaxResponseHeaderBytes:   envInt64("MAX_RESPONSE_HEADER_BYTES", 0),
+
+		MaxRetries:            envInt("MAX_RETRIES", 0),
+		RetryBudgetPercent:    envFloat("RETRY_BUDGET_PERCENT", 20),
+		DialFailureCacheTTL:   envDuration("DIAL_FAILURE_CACHE_TTL", 2*time.Second),
+		BackendTimeout:        envDuration("BACKEND_TIMEOUT", 0),
+		TotalRequestTimeout:   envDuration("LB_TOTAL_REQUEST_TIMEOUT", 0),
+		ExpectContinueTimeout: envDuration("EXPECT_CONTINUE_TIMEOUT", time.Second),
+		DialTimeout:           envDuration("DIAL_TIMEOUT", 0),
+		TLSHandshakeTimeout:   envDuration("TLS_HANDSHAKE_TIMEOUT", 0),
+		ResponseHeaderTimeout: envDuration("RESPONSE_HEADER_TIMEOUT", 0),
+		BodyIdleTimeout:       envDuration("BODY_IDLE_TIMEOUT", 0),
+
+		ViaHeaderEnabled: envBool("VIA_HEADER_ENABLED", false),
+		ViaHeaderValue:   envString("VIA_HEADER_VALUE", "go-lb/"+version),
+		ViaHeaderVersion: envString("VIA_HEADER_VERSION", "1.1"),
+
+		BandwidthAggregateLimit: envInt64("BANDWIDTH_AGGREGATE_LIMIT", 0),
+		BandwidthAggregateBurst: envInt64("BANDWIDTH_AGGREGATE_BURST", 0),
+
+		BackendConnectionClose: envBool("BACKEND_CONNECTION_CLOSE", false),
+		ClientConnectionClose:  envBool("CLIENT_CONNECTION_CLOSE", false),
+
+		StripHopByHopHeaders: envBool("STRIP_HOP_BY_HOP_HEADERS", true),
+
+		NormalizeDuplicateHeaders: envBool("NORMALIZE_DUPLICATE_HEADERS", false),
+
+		DNSRefreshInterval: envDuration("DNS_REFRESH_INTERVAL", 0),
+
+		TransportMode: envString("TRANSPORT_MODE", "shared"),
+
+		CoalesceEnabled:      envBool("COALESCE_ENABLED", false),
+		CoalesceMaxWaiters:   envInt("COALESCE_MAX_WAITERS", 100),
+		CoalesceMaxBodyBytes: envInt64("COALESCE_MAX_BODY_BYTES", 1<<20),
+		CoalesceKeyHeaders:   envList("COALESCE_KEY_HEADERS", defaultCoalesceKeyHeaders),
+
+		IdempotencyTTL:              envDuration("IDEMPOTENCY_TTL", time.Hour),
+		IdempotencyMaxResponseBytes: envInt64("IDEMPOTENCY_MAX_RESPONSE_BYTES", 1<<20),
+		IdempotencyCacheBytes:       envInt64("IDEMPOTENCY_CACHE_BYTES", 64<<20),
+
+		GRPCTranscoding:        envBool("GRPC_TRANSCODING", false),
+		ProtobufDescriptorPath: envString("PROTOBUF_DESCRIPTOR_PATH", ""),
+
+		MetricsEnabled: envBool("METRICS_ENABLED", false),
+		MetricsPath:    envString("METRICS_PATH", "/metrics"),
+
+		StatsEnabled: envBool("STATS_ENABLED", false),
+		StatsPath:    envString("STATS_PATH", "/stats"),
+
+		MaintenanceMode:       envBool("MAINTENANCE_MODE", false),
+		MaintenancePage:       os.Getenv("MAINTENANCE_PAGE"),
+		MaintenanceRetryAfter: envDuration("MAINTENANCE_RETRY_AFTER", 5*time.Minute),
+
+		CaptureDir:           os.Getenv("CAPTURE_DIR"),
+		CaptureRedactHeaders: envList("CAPTURE_REDACT_HEADERS", []string{"Authorization", "Cookie", "Proxy-Authorization"}),
+
+		ErrorResponseJSON: envBool("ERROR_RESPONSE_JSON", false),
+
+		ReplaceErrorBodies:   envBool("REPLACE_ERROR_BODIES", false),
+		ReplaceErrorStatuses: envList("REPLACE_ERROR_STATUSES", []string{"500-599"}),
+
+		StateFile:         os.Getenv("LB_STATE_FILE"),
+		StateSaveInterval: envDuration("LB_STATE_SAVE_INTERVAL", time.Minute),
+
+		SlowRequestThreshold: envDuration("SLOW_REQUEST_THRESHOLD", 0),
+
+		RequestTraceEnabled:   envBool("REQUEST_TRACE_ENABLED", false),
+		RequestTraceFile:      os.Getenv("REQUEST_TRACE_FILE"),
+		RequestTraceMaxSizeMB: envInt("REQUEST_TRACE_MAX_SIZE_MB", 100),
+
+		TraceProxyDirector:    envBool("TRACE_PROXY_DIRECTOR", false),
+		TraceSensitiveHeaders: envBool("TRACE_SENSITIVE_HEADERS", false),
+
+		DebugTraceWindow:   envDuration("DEBUG_TRACE_WINDOW", time.Minute),
+		DebugTraceCapacity: envInt("DEBUG_TRACE_CAPACITY", 10000),
+
+		VaultEnabled:  envBool("VAULT_ENABLED", false),
+		VaultAddr:     os.Getenv("VAULT_ADDR"),
+		VaultPath:     os.Getenv("VAULT_PATH"),
+		VaultToken:    os.Getenv("VAULT_TOKEN"),
+		VaultRoleID:   os.Getenv("VAULT_ROLE_ID"),
+		VaultSecretID: os.Getenv("VAULT_SECRET_ID"),
+
+		SelfRegister:              os.Getenv("SELF_REGISTER"),
+		RegisterServiceName:       envString("REGISTER_SERVICE_NAME", "load-balancer"),
+		RegisterAddress:           os.Getenv("REGISTER_ADDRESS"),
+		RegisterPort:              envInt("REGISTER_PORT", 0),
+		RegisterTags:              envList("REGISTER_TAGS", nil),
+		RegisterHeartbeatInterval: envDuration("REGISTER_HEARTBEAT_INTERVAL", 10*time.Second),
+		RegisterWebhookURL:        os.Getenv("REGISTER_WEBHOOK_URL"),
+		ConsulAddr:                envString("CONSUL_ADDR", "http://127.0.0.1:8500"),
+		ConsulToken:               os.Getenv("CONSUL_TOKEN"),
+	}
+
+	for _, address := range envList("LB_LISTEN", nil) {
+		cfg.Listeners = append(cfg.Listeners, ListenerConfig{Address: address})
+	}
+	for _, backendURL := range envList("Backend_URLs", nil) {
+		cfg.Backends = append(cfg.Backends, BackendConfig{URL: backendURL})
+	}
+	return cfg
+}
+
+// ConfigReport is the outcome of validating a config. Errors make it
+// unusable; warnings are worth a look but don't stop it from loading.
+type ConfigReport struct {
+	Valid    bool     `json:"valid"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+	Probed   []string `json:"probed,omitempty"` // new backends health checked by the admin API
+}
+
+func (r *ConfigReport) errorf(format string, args ...any) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (r *ConfigReport) warnf(format string, args ...any) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// validate checks the whole config, reporting every problem rather than
+// stopping at the first, and fills in defaults that depend on other fields.
+func (cfg *Config) validate() *ConfigReport {
+	report := &ConfigReport{Errors: []string{}, Warnings: []string{}}
+	if len(cfg.Backends) == 0 {
+		report.errorf("Backend_URLs environment variable not set")
+	}
+	switch cfg.Strategy {
+	case "round_robin", "weighted_round_robin", "auto_latency", "consistent_hash_path", "consistent_hash_header":
+	default:
+		report.errorf("Unknown LB_STRATEGY %q", cfg.Strategy)
+	}
+	if cfg.Strategy == "auto_latency" && cfg.AutoLatencyInterval <= 0 {
+		report.errorf("AUTO_LATENCY_INTERVAL must be positive")
+	}
+	for key, backendURL := range cfg.HashOverrides {
+		if !slices.ContainsFunc(cfg.Backends, func(bc BackendConfig) bool { return bc.URL == backendURL }) {
+			report.errorf("Hash override %q pins unknown backend %s", key, backendURL)
+		}
+	}
+	for prefix, backendURLs := range cfg.ExcludeBackendsForPath {
+		if !strings.HasPrefix(prefix, "/") {
+			report.errorf("Exclusion path prefix %q must start with /", prefix)
+		}
+		for _, backendURL := range backendURLs {
+			if !slices.ContainsFunc(cfg.Backends, func(bc BackendConfig) bool { return bc.URL == backendURL }) {
+				report.warnf("Exclusion for %s names backend %s, which isn't configured", prefix, backendURL)
+			}
+		}
+	}
+	fallbacks := make(map[string]string)
+	for _, backendCfg := range cfg.Backends {
+		if !backendCfg.Fallback {
+			continue
+		}
+		pool := cmp.Or(backendCfg.Pool, cfg.DefaultPool)
+		if other, ok := fallbacks[pool]; ok {
+			report.errorf("Pool %s has two fallback backends, %s and %s", pool, other, backendCfg.URL)
+		}
+		fallbacks[pool] = backendCfg.URL
+	}
+	ids := make(map[string]string)
+	for _, backendCfg := range cfg.Backends {
+		if backendCfg.BackendID == "" {
+			continue
+		}
+		if other, ok := ids[backendCfg.BackendID]; ok {
+			report.errorf("Backends %s and %s share the backend_id %q", other, backendCfg.URL, backendCfg.BackendID)
+		}
+		ids[backendCfg.BackendID] = backendCfg.URL
+	}
+	if cfg.StickySessions && cfg.StickyCookieName == "" {
+		report.errorf("STICKY_SESSIONS needs a STICKY_COOKIE_NAME")
+	}
+	if len(cfg.HashOverrides) > 0 && cfg.Strategy != "consistent_hash_header" {
+		report.warnf("Hash overrides only apply to the consistent_hash_header strategy, not %s", cfg.Strategy)
+	}
+	if cfg.ViaHeaderEnabled && (cfg.ViaHeaderValue == "" || cfg.ViaHeaderVersion == "") {
+		report.errorf("VIA_HEADER_ENABLED requires VIA_HEADER_VALUE and VIA_HEADER_VERSION")
+	}
+	if cfg.BandwidthAggregateLimit < 0 || cfg.BandwidthAggregateBurst < 0 {
+		report.errorf("BANDWIDTH_AGGREGATE_LIMIT and BANDWIDTH_AGGREGATE_BURST must not be negative")
+	}
+	if cfg.RequestTraceEnabled && cfg.RequestTraceFile == "" {
+		report.errorf("REQUEST_TRACE_ENABLED needs a REQUEST_TRACE_FILE")
+	}
+	if cfg.RequestTraceMaxSizeMB < 0 {
+		report.errorf("REQUEST_TRACE_MAX_SIZE_MB must not be negative")
+	}
+	if cfg.StateFile != "" && cfg.StateSaveInterval < time.Second {
+		report.errorf("LB_STATE_SAVE_INTERVAL must be at least 1s, got %v", cfg.StateSaveInterval)
+	}
+	switch cfg.SelfRegister {
+	case "", "consul":
+	case "webhook":
+		if cfg.RegisterWebhookURL == "" {
+			report.errorf("SELF_REGISTER=webhook requires REGISTER_WEBHOOK_URL")
+		}
+	default:
+		report.errorf("Unknown SELF_REGISTER %q", cfg.SelfRegister)
+	}
+	if cfg.SelfRegister != "" && cfg.RegisterHeartbeatInterval <= 0 {
+		report.errorf("REGISTER_HEARTBEAT_INTERVAL must be positive")
+	}
+	if cfg.IdempotencyTTL <= 0 || cfg.IdempotencyMaxResponseBytes < 0 || cfg.IdempotencyCacheBytes < 0 {
+		report.errorf("IDEMPOTENCY_TTL must be positive and the idempotency size limits must not be negative")
+	}
+	if cfg.ConcurrencyLimit < 0 || cfg.HighPriorityQueueSize < 0 || cfg.NormalPriorityQueueSize < 0 {
+		report.errorf("CONCURRENCY_LIMIT and the priority queue sizes must not be negative")
+	}
+	for name, policy := range cfg.DuplicateHeaderPolicies {
+		switch policy {
+		case "merge", "first", "last", "reject":
+		default:
+			report.errorf("Duplicate header policy for %s must be merge, first, last or reject, got %q", name, policy)
+		}
+		if _, ok := forcedDuplicateHeaderPolicies[http.CanonicalHeaderKey(name)]; ok && policy != "reject" {
+			report.warnf("Duplicate %s headers are always rejected; ignoring policy %q", name, policy)
+		}
+	}
+	if len(cfg.DuplicateHeaderPolicies) > 0 && !cfg.NormalizeDuplicateHeaders {
+		report.warnf("duplicate_header_policies has no effect without NORMALIZE_DUPLICATE_HEADERS")
+	}
+	if cfg.RetryAfterMaxBackoff < 0 {
+		report.errorf("RETRY_AFTER_MAX_BACKOFF must not be negative")
+	}
+	if cfg.DNSRefreshInterval < 0 {
+		report.errorf("DNS_REFRESH_INTERVAL must not be negative")
+	}
+	if cfg.RetryBudgetPercent < 0 {
+		report.errorf("RETRY_BUDGET_PERCENT must not be negative")
+	}
+	if cfg.MaxURLLength < 0 {
+		report.errorf("MAX_URL_LENGTH must not be negative")
+	}
+	if cfg.RateLimitRPS < 0 || cfg.RateLimitBurst < 0 {
+		report.errorf("RATE_LIMIT_RPS and RATE_LIMIT_BURST must not be negative")
+	}
+	if cfg.ConcurrencyLimit > 0 && cfg.ConcurrencyQueueTimeout <= 0 {
+		report.errorf("CONCURRENCY_QUEUE_TIMEOUT must be positive")
+	}
+	if cfg.TransportMode != "shared" && cfg.TransportMode != "isolated" {
+		report.errorf("TRANSPORT_MODE must be shared or isolated, got %q", cfg.TransportMode)
+	}
+	if cfg.DialTimeout < 0 || cfg.TLSHandshakeTimeout < 0 || cfg.ResponseHeaderTimeout < 0 || cfg.BodyIdleTimeout < 0 {
+		report.errorf("DIAL_TIMEOUT, TLS_HANDSHAKE_TIMEOUT, RESPONSE_HEADER_TIMEOUT and BODY_IDLE_TIMEOUT must not be negative")
+	}
+	if cfg.GRPCTranscoding {
+		if cfg.ProtobufDescriptorPath == "" {
+			report.errorf("GRPC_TRANSCODING needs PROTOBUF_DESCRIPTOR_PATH")
+		} else if _, err := loadGRPCTranscoder(cfg.ProtobufDescriptorPath); err != nil {
+			report.errorf("Invalid PROTOBUF_DESCRIPTOR_PATH: %v", err)
+		}
+	}
+	if cfg.MaxResponseHeaderBytes < 0 {
+		report.errorf("MAX_RESPONSE_HEADER_BYTES must not be negative")
+	}
+	if cfg.ZoneAwareRouting && cfg.LocalZone == "" {
+		report.errorf("ZONE_AWARE_ROUTING requires LB_ZONE")
+	}
+	if cfg.CrossZoneLatencyPenaltyMs < 0 {
+		report.errorf("CROSS_ZONE_LATENCY_PENALTY_MS must not be negative")
+	} else if cfg.CrossZoneLatencyPenaltyMs > 0 && (cfg.LocalZone == "" || cfg.Strategy != "auto_latency") {
+		report.warnf("CROSS_ZONE_LATENCY_PENALTY_MS only applies to the auto_latency strategy with LB_ZONE set")
+	}
+	if cfg.HealthCheckJitter < 0 || cfg.HealthCheckJitter >= 1 {
+		report.errorf("HEALTH_CHECK_JITTER must be at least 0 and below 1, got %v", cfg.HealthCheckJitter)
+	}
+	if cfg.CanaryWeight < 0 || cfg.CanaryWeight > 100 {
+		report.errorf("CANARY_WEIGHT must be between 0 and 100, got %v", cfg.CanaryWeight)
+	}
+	if cfg.IdlePool != "" && (cfg.IdlePool == cfg.DefaultPool || cfg.IdlePool == cfg.CanaryPool) {
+		report.errorf("IDLE_POOL must differ from DEFAULT_POOL and CANARY_POOL, got %q", cfg.IdlePool)
+	}
+	for i, rule := range cfg.MockRules {
+		if rule.PathPattern == "" {
+			report.errorf("Mock rule %d has no path_pattern", i)
+		} else if err := checkPathPattern(rule.PathPattern); err != nil {
+			report.errorf("Mock rule %d: %v", i, err)
+		}
+		if rule.ResponseStatus == 0 {
+			cfg.MockRules[i].ResponseStatus = http.StatusOK
+		}
+	}
+	for i, utility := range cfg.UtilityPaths {
+		if utility.PathPattern == "" {
+			report.errorf("Utility path %d has no path_pattern", i)
+		} else if err := checkPathPattern(utility.PathPattern); err != nil {
+			report.errorf("Utility path %d: %v", i, err)
+		}
+		if strings.HasPrefix(utility.PathPattern, acmeChallengePrefix) {
+			report.errorf("Utility path %s is reserved for ACME challenges", utility.PathPattern)
+		}
+		if utility.ResponseStatus == 0 {
+			cfg.UtilityPaths[i].ResponseStatus = http.StatusOK
+		}
+	}
+	schedulesParsed := true
+	for i := range cfg.Schedules {
+		rule := &cfg.Schedules[i]
+		if !slices.ContainsFunc(cfg.Backends, func(bc BackendConfig) bool { return bc.URL == rule.Backend }) {
+			report.errorf("Schedule %d is for unknown backend %q", i, rule.Backend)
+		}
+		if err := rule.parse(); err != nil {
+			report.errorf("Schedule %d for %s is invalid: %v", i, rule.Backend, err)
+			schedulesParsed = false
+		}
+	}
+	if schedulesParsed {
+		if err := validateSchedules(cfg.Schedules, time.Now()); err != nil {
+			report.errorf("Conflicting schedules: %v", err)
+		}
+	}
+	for _, statuses := range cfg.ReplaceErrorStatuses {
+		if _, _, err := parseStatusRange(statuses); err != nil {
+			report.errorf("Invalid REPLACE_ERROR_STATUSES: %v", err)
+		}
+	}
+	routePatterns := make(map[string]bool)
+	for i, route := range cfg.Routes {
+		if route.PathPattern == "" {
+			report.errorf("Route %d has no path_pattern", i)
+		} else if err := checkPathPattern(route.PathPattern); err != nil {
+			report.errorf("Route %d: %v", i, err)
+		} else if routePatterns[route.PathPattern] {
+			report.warnf("Route %d repeats path_pattern %s; only the first such route is used", i, route.PathPattern)
+		}
+		// Routes with a body condition fall through to later ones.
+		if route.BodyMatch == nil {
+			routePatterns[route.PathPattern] = true
+		}
+		if m := route.BodyMatch; m != nil {
+			if m.JSONPath == "" && m.Regex == "" {
+				report.errorf("Route %s has a body_match without json_path or regex", route.PathPattern)
+			}
+			if _, err := regexp.Compile(m.Regex); err != nil {
+				report.errorf("Route %s has invalid body_match regex: %v", route.PathPattern, err)
+			}
+			if m.MaxBytes < 0 {
+				report.errorf("Route %s has negative body_match max_bytes", route.PathPattern)
+			}
+		}
+		if route.BandwidthLimit < 0 || route.BandwidthBurst < 0 {
+			report.errorf("Route %s has a negative bandwidth limit or burst", route.PathPattern)
+		}
+		for _, statuses := range route.ReplaceErrorStatuses {
+			if _, _, err := parseStatusRange(statuses); err != nil {
+				report.errorf("Route %s has invalid replace_error_statuses: %v", route.PathPattern, err)
+			}
+		}
+		if route.FeatureFlag != "" && route.FeatureFlagPool == "" {
+			report.errorf("Route %s uses feature flag %q but has no feature_flag_pool", route.PathPattern, route.FeatureFlag)
+		}
+		if route.ForwardAuthURL != "" {
+			if u, err := url.Parse(route.ForwardAuthURL); err != nil || u.Scheme == "" || u.Host == "" {
+				report.errorf("Route %s has invalid forward_auth_url %q", route.PathPattern, route.ForwardAuthURL)
+			}
+		}
+	}
+	for i, rule := range cfg.ChaosRules {
+		if rule.PathPattern == "" {
+			report.errorf("Chaos rule %d has no path_pattern", i)
+		} else if err := checkPathPattern(rule.PathPattern); err != nil {
+			report.errorf("Chaos rule %d: %v", i, err)
+		}
+		if rule.Probability < 0 || rule.Probability > 1 {
+			report.errorf("Chaos rule %d probability must be between 0 and 1, got %v", i, rule.Probability)
+		}
+	}
+	backendURLs := make(map[string]bool)
+	for _, backendCfg := range cfg.Backends {
+		if backendURLs[backendCfg.URL] {
+			report.errorf("Backend %s is listed more than once", backendCfg.URL)
+		}
+		backendURLs[backendCfg.URL] = true
+		cfg.validateBackend(report, backendCfg)
+	}
+	if len(cfg.Listeners) == 0 {
+		if cfg.Port == "" {
+			report.errorf("PORT environment variable not set")
+		} else {
+			cfg.Listeners = []ListenerConfig{{Address: ":" + cfg.Port}}
+		}
+	}
+	addresses := make(map[string]bool)
+	for i, listener := range cfg.Listeners {
+		if listener.Address == "" {
+			report.errorf("Listener %d has no address", i)
+		} else if addresses[listener.Address] {
+			report.errorf("Listener address %s is used more than once", listener.Address)
+		}
+		addresses[listener.Address] = true
+		if (cfg.ProxyProtocol || listener.ProxyProtocol) && len(cfg.ProxyProtocolTrustedCIDRs) == 0 {
+			report.errorf("Listener %s uses PROXY protocol but PROXY_PROTOCOL_TRUSTED_CIDRS is empty", listener.Address)
+		}
+		if cfg.HTTP3Enabled && (cfg.ProxyProtocol || listener.ProxyProtocol) {
+			report.warnf("Listener %s uses PROXY protocol, which HTTP/3 can't carry; HTTP/3 clients are seen at their QUIC source address", listener.Address)
+		}
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		report.errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		report.errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+	if cfg.TLSCert != "" && cfg.TLSCertFile != "" {
+		report.errorf("Set TLS_CERT or TLS_CERT_FILE, not both")
+	} else if (cfg.TLSCertFile != "" && cfg.TLSKeyFile != "") || (cfg.TLSCert != "" && cfg.TLSKey != "") {
+		// Missing or mismatched files would otherwise only show at startup.
+		if _, err := cfg.serverTLSConfig(); err != nil {
+			report.errorf("%v", err)
+		}
+	}
+	if cfg.HTTP3Enabled && cfg.TLSCertFile == "" && cfg.TLSCert == "" {
+		report.errorf("HTTP3_ENABLED needs TLS_CERT_FILE and TLS_KEY_FILE, or TLS_CERT and TLS_KEY, as HTTP/3 always runs over TLS")
+	}
+	
+	report.Valid = len(report.Errors) == 0
+	return report
+}
+
+// validateBackend checks one backend's settings; validate covers how it
+// relates to the rest of the config.
+func (cfg *Config) validateBackend(report *ConfigReport, backendCfg BackendConfig) {
+	if _, err := parseBackendURL(backendCfg.URL); err != nil {
+		report.errorf("%v", err)
+	}
+	switch backendCfg.HealthCheckPriority {
+	case "", "low", "normal", "high":
+	default:
+		report.errorf("Backend %s has unknown health check priority %q", backendCfg.URL, backendCfg.HealthCheckPriority)
+	}
+	if strings.ContainsAny(backendCfg.BackendHostHeader, " \t\r\n/") {
+		report.errorf("Backend %s has invalid backend_host_header %q", backendCfg.URL, backendCfg.BackendHostHeader)
+	}
+	switch backendCfg.Transport {
+	case "", "default", "http2", "mtls", "http1.0":
+	default:
+		report.errorf("Backend %s has unknown transport %q", backendCfg.URL, backendCfg.Transport)
+	}
+	if backendCfg.Transport == "mtls" || backendCfg.Transport == "http1.0" && (backendCfg.TLSClientCert != "" || backendCfg.TLSCACert != "") {
+		if _, err := loadClientTLSConfig(backendCfg); err != nil {
+			report.errorf("Backend %s: %v", backendCfg.URL, err)
+		}
+	}
+	for method, timeout := range backendCfg.MethodTimeouts {
+		if timeout <= 0 {
+			report.errorf("Backend %s has non-positive %s method timeout", backendCfg.URL, method)
+		}
+	}
+	if backendCfg.HealthTimeout < 0 {
+		report.errorf("Backend %s has negative health_timeout", backendCfg.URL)
+	}
+	if backendCfg.ExpectContinueTimeout < 0 {
+		report.errorf("Backend %s has negative expect_continue_timeout", backendCfg.URL)
+	}
+	if backendCfg.MaxResponseHeaderBytes < 0 {
+		report.errorf("Backend %s has negative max_response_header_bytes", backendCfg.URL)
+	}
+	if backendCfg.BackendMaxConnAge < 0 {
+		report.errorf("Backend %s has negative backend_max_conn_age", backendCfg.URL)
+	}
+	if backendCfg.DialTimeout < 0 || backendCfg.TLSHandshakeTimeout < 0 || backendCfg.ResponseHeaderTimeout < 0 || backendCfg.IdleConnTimeout < 0 || backendCfg.BodyIdleTimeout < 0 {
+		report.errorf("Backend %s has a negative transport timeout", backendCfg.URL)
+	}
+	if backendCfg.MaxIdleConnsPerHost < 0 {
+		report.errorf("Backend %s has negative max_idle_conns_per_host", backendCfg.URL)
+	}
+	if backendCfg.BackendMaxConnAge > 0 && backendCfg.Transport == "http2" {
+		report.errorf("Backend %s sets backend_max_conn_age, which only applies to HTTP/1.1 transports", backendCfg.URL)
+	}
+	if backendCfg.BandwidthLimit < 0 || backendCfg.BandwidthBurst < 0 {
+		report.errorf("Backend %s has a negative bandwidth limit or burst", backendCfg.URL)
+	}
+	if backendCfg.RateLimitRPS < 0 || backendCfg.RateLimitBurst < 0 {
+		report.errorf("Backend %s has a negative rate_limit_rps or rate_limit_burst", backendCfg.URL)
+	}
+	if backendCfg.DeregisterOnDNSFailureCount < 0 {
+		report.errorf("Backend %s has negative deregister_on_dns_failure_count", backendCfg.URL)
+	}
+	if backendCfg.MaxConcurrentRequests < 0 {
+		report.errorf("Backend %s has negative max_concurrent_requests", backendCfg.URL)
+	}
+	if backendCfg.MaxQueueLength < 0 {
+		report.errorf("Backend %s has negative max_queue_length", backendCfg.URL)
+	}
+	if backendCfg.MaxQueueLength > 0 && backendCfg.MaxConcurrentRequests == 0 {
+		report.errorf("Backend %s sets max_queue_length without max_concurrent_requests", backendCfg.URL)
+	}
+	if backendCfg.MaxQueueLength > 0 && backendCfg.QueueTimeout <= 0 {
+		report.errorf("Backend %s sets max_queue_length but no positive queue_timeout", backendCfg.URL)
+	}
+	if backendCfg.WarmupRequestCount < 0 {
+		report.errorf("Backend %s has negative warmup_request_count", backendCfg.URL)
+	}
+	if backendCfg.Weight < 0 {
+		report.errorf("Backend %s has negative weight %d", backendCfg.URL, backendCfg.Weight)
+	}
+	if cfg.healthCheckType(backendCfg) == "external" && cfg.healthCheckCommand(backendCfg) == "" {
+		report.errorf("Backend %s uses external health checks but no HEALTH_CHECK_COMMAND is set", backendCfg.URL)
+	}
+}
+
+// VaultClient reads secrets from Vault and keeps its token alive. Set
+// Config.VaultClient to replace the HTTP client, e.g. with a
+// StaticVaultClient in tests.
+type VaultClient interface {
+	// ReadSecret returns the key/value pairs stored at path.
+	ReadSecret(path string) (map[string]string, error)
+	// RenewToken extends the token's lease and returns its new TTL; 0 means
+	// the token does not expire.
+	RenewToken() (time.Duration, error)
+}
+
+// StaticVaultClient is a VaultClient serving fixed secrets, keyed by path.
+type StaticVaultClient map[string]map[string]string
+
+func (c StaticVaultClient) ReadSecret(path string) (map[string]string, error) {
+	secrets, ok := c[path]
+	if !ok {
+		return nil, fmt.Errorf("no secret at %s", path)
+	}
+	return secrets, nil
+}
+
+func (c StaticVaultClient) RenewToken() (time.Duration, error) {
+	return 0, nil
+}
+
+// loadVaultSecrets reads cfg.VaultPath and overwrites the Config fields
+// tagged secret:"true" with the values stored under their JSON keys.
+func loadVaultSecrets(cfg *Config) error {
+	if cfg.VaultClient == nil {
+		client, err := newVaultHTTPClient(cfg)
+		if err != nil {
+			return err
+		}
+		cfg.VaultClient = client
+	}
+	if cfg.VaultPath == "" {
+		return errors.New("VAULT_PATH is not set")
+	}
+	secrets, err := cfg.VaultClient.ReadSecret(cfg.VaultPath)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", cfg.VaultPath, err)
+	}
+	
+	v := reflect.ValueOf(cfg).Elem()
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Tag.Get("secret") == "true" {
+			fields[jsonFieldName(field)] = v.Field(i)
+		}
+	}
+	applied := 0
+	for key, value := range secrets {
+		field, ok := fields[key]
+		if !ok {
+			log.Printf("[WARN] Ignoring Vault key %q: not a secret config field\n", key)
+			continue
+		}
+		field.SetString(value)
+		applied++
+	}
+	log.Printf("[INFO] Loaded %d secrets from Vault path %s\n", applied, cfg.VaultPath)
+	return nil
+}
+
+// startVaultRenewal renews the Vault token at half of each lease so it never
+// expires while the load balancer runs, stopping once ctx is done.
+func startVaultRenewal(ctx context.Context, client VaultClient) {
+	go func() {
+		for {
+			ttl, err := client.RenewToken()
+			wait := ttl / 2
+			if err != nil {
+				log.Printf("[ERROR] Failed to renew Vault token: %v\n", err)
+				wait = 30 * time.Second
+			} else if ttl <= 0 {
+				log.Println("[INFO] Vault token does not expire, not renewing")
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+	}()
+}
+
+// vaultHTTPClient talks to the Vault HTTP API. It authenticates with a
+// static token or, when none is given, an AppRole login that is repeated
+// once the token can no longer be renewed.
+type vaultHTTPClient struct {
+	addr     string
+	roleID   string
+	secretID string
+	client   *http.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+type vaultResponse struct {
+	Data map[string]any `json:"data"`
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+func newVaultHTTPClient(cfg *Config) (*vaultHTTPClient, error) {
+	if cfg.VaultAddr == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	c := &vaultHTTPClient{
+		addr:     strings.TrimRight(cfg.VaultAddr, "/"),
+		roleID:   cfg.VaultRoleID,
+		secretID: cfg.VaultSecretID,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		token:    cfg.VaultToken,
+	}
+	if c.token == "" {
+		if c.roleID == "" {
+			return nil, errors.New("VAULT_TOKEN or VAULT_ROLE_ID must be set")
+		}
+		if _, err := c.login(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *vaultHTTPClient) login() (time.Duration, error) {
+	var resp vaultResponse
+	body := map[string]string{"role_id": c.roleID, "secret_id": c.secretID}
+	if err := c.do(http.MethodPost, "auth/approle/login", body, &resp); err != nil {
+		return 0, fmt.Errorf("AppRole login: %w", err)
+	}
+	c.mu.Lock()
+	c.token = resp.Auth.ClientToken
+	c.mu.Unlock()
+	return time.Duration(resp.Auth.LeaseDuration) * time.Second, nil
+}
+
+func (c *vaultHTTPClient) ReadSecret(path string) (map[string]string, error) {
+	var resp vaultResponse
+	if err := c.do(http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	data := resp.Data
+	// KV v2 nests the secret under data.data, next to its metadata.
+	if inner, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = inner
+	}
+	secrets := make(map[string]string, len(data))
+	for key, value := range data {
+		secrets[key] = fmt.Sprint(value)
+	}
+	return secrets, nil
+}
+
+func (c *vaultHTTPClient) RenewToken() (time.Duration, error) {
+	var resp vaultResponse
+	err := c.do(http.MethodPost, "auth/token/renew-self", struct{}{}, &resp)
+	if err != nil && c.roleID != "" {
+		log.Printf("[WARN] Vault token renewal failed, logging in again: %v\n", err)
+		return c.login()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(resp.Auth.LeaseDuration) * time.Second, nil
+}
+
+func (c *vaultHTTPClient) do(method, apiPath string, body any, out *vaultResponse) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.addr+"/v1/"+strings.TrimLeft(apiPath, "/"), reader)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decodeErr := json.NewDecoder(resp.Body).Decode(out)
+	if resp.StatusCode != http.StatusOK {
+		if len(out.Errors) > 0 {
+			return fmt.Errorf("%s: %s", resp.Status, strings.Join(out.Errors, "; "))
+		}
+		return errors.New(resp.Status)
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("decoding Vault response: %w", decodeErr)
+	}
+	return nil
+}
+
 type Backend struct {
 	URL     string
+	Config  BackendConfig
 	Proxy   *httputil.ReverseProxy
 	Alive   bool
 	mux     sync.RWMutex
+
+	checking      atomic.Bool
+	firstAliveAt  time.Time
+	currentWeight float64 // smooth weighted round-robin state, guarded by LoadBalancer.mux
+
+	latencyWindowStart time.Time
+	latencyRequests    int
+	latencySlow        int
+	ejectedUntil       time.Time
+	ejectionReason     string
+
+	latencySum    time.Duration // attempt latency since the last auto_latency update, guarded by mux
+	latencyCount  int
+	avgLatency    time.Duration // rolling average for auto_latency, guarded by mux
+	latencyWeight float64       // weight auto_latency derived from avgLatency, guarded by mux
+
+	dialFailedUntil time.Time
+	dialSkips       atomic.Int64
+
+	backoffUntil time.Time // passed over until then, as the backend's Retry-After asked; guarded by mux
+
+	draining atomic.Bool // set by an operator; takes no new requests
+
+	lastHealthError   string // why the latest health check failed; cleared on recovery
+	lastHealthErrorAt time.Time
+	deepFailing       atomic.Bool // failing the deep probe, so only used when no other backend can be
+
+	scheduledWeight atomic.Int64  // weight set by the active schedule, 0 if none
+	adminWeight     atomic.Int64  // weight set by an operator, 0 if none; beats the schedule
+	schedule        *ScheduleRule // active schedule, owned by the scheduler goroutine
+
+	requests   atomic.Int64 // attempts proxied to it
+	active     atomic.Int64 // attempts in progress
+	queueMu    sync.Mutex
+	waiters    []chan struct{}                           // attempts waiting for a slot, guarded by queueMu
+	inflight   map[*http.Request]context.CancelCauseFunc // attempts in progress, guarded by queueMu
+	statsMark  int64                                     // requests at the previous stats tick, owned by getStats
+	upToDown   atomic.Int64
+	downToUp   atomic.Int64
+	aliveFor   time.Duration // time alive before aliveSince, guarded by mux
+	aliveSince time.Time     // zero while down
+
+	removed     atomic.Bool  // removed at runtime; its health checks stop
+	dnsFailures atomic.Int64 // consecutive health check cycles its hostname didn't resolve
+	pool        *poolTransport
+	modifiers   []requestModifier // its Director, one step at a time for POST /admin/rewrite/test
+	rateLimit   *rateLimiter      // one bucket for all its requests; nil without rate_limit_rps
+}
+
+func (b *Backend) SetAlive(alive bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	now := time.Now()
+	if alive && b.firstAliveAt.IsZero() {
+		b.firstAliveAt = now
+	}
+	if alive && b.aliveSince.IsZero() {
+		b.aliveSince = now
+	} else if !alive && !b.aliveSince.IsZero() {
+		b.aliveFor += now.Sub(b.aliveSince)
+		b.aliveSince = time.Time{}
+	}
+	b.Alive = alive
+}
+
+// uptime is how long the backend has been alive in total.
+func (b *Backend) uptime() time.Duration {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	if b.aliveSince.IsZero() {
+		return b.aliveFor
+	}
+	return b.aliveFor + time.Since(b.aliveSince)
+}
+
+// available reports whether the backend may receive new requests: it must be
+// alive, not draining and not temporarily ejected.
+func (b *Backend) available() bool {
+	return b.IsAlive() && !b.draining.Load() && !b.isEjected()
+}
+
+func (b *Backend) isEjected() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return time.Now().Before(b.ejectedUntil)
+}
+
+// resetHealthState forgets latency ejections and dial failures so the
+// backend is judged on its next probe alone.
+func (b *Backend) resetHealthState() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.latencyWindowStart = time.Time{}
+	b.latencyRequests = 0
+	b.latencySlow = 0
+	b.ejectedUntil = time.Time{}
+	b.ejectionReason = ""
+	b.dialFailedUntil = time.Time{}
+	b.backoffUntil = time.Time{}
+}
+
+// setHealthError records why the latest health check failed, or clears it
+// when err is nil.
+func (b *Backend) setHealthError(err error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if err == nil {
+		b.lastHealthError, b.lastHealthErrorAt = "", time.Time{}
+		return
+	}
+	b.lastHealthError, b.lastHealthErrorAt = err.Error(), time.Now()
+}
+
+func (b *Backend) markDialFailure(ttl time.Duration) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.dialFailedUntil = time.Now().Add(ttl)
+}
+
+func (b *Backend) dialFailing(now time.Time) bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return now.Before(b.dialFailedUntil)
+}
+
+// backOff passes the backend over for d, unless it already is for longer.
+// It reports whether the backend wasn't backing off before.
+func (b *Backend) backOff(d time.Duration) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	now := time.Now()
+	started := !now.Before(b.backoffUntil)
+	if until := now.Add(d); until.After(b.backoffUntil) {
+		b.backoffUntil = until
+	}
+	return started
+}
+
+func (b *Backend) backingOff(now time.Time) bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return now.Before(b.backoffUntil)
+}
+
+// inPool reports whether the backend belongs to pool; an empty pool matches
+// every backend.
+func (b *Backend) inPool(pool string) bool {
+	return pool == "" || b.Config.Pool == pool
+}
+
+// saturated reports whether the backend is at its MaxConcurrentRequests.
+func (b *Backend) saturated() bool {
+	return b.Config.MaxConcurrentRequests > 0 && b.active.Load() >= int64(b.Config.MaxConcurrentRequests)
+}
+
+var errBackendQueueFull = errors.New("backend queue is full")
+
+// acquireSlot takes one of the backend's MaxConcurrentRequests slots,
+// waiting behind at most MaxQueueLength others until one frees up or ctx is
+// done. Backends with a queue count active attempts only through
+// acquireSlot and releaseSlot.
+func (b *Backend) acquireSlot(ctx context.Context) error {
+	b.queueMu.Lock()
+	if len(b.waiters) == 0 && !b.saturated() {
+		b.active.Add(1)
+		b.queueMu.Unlock()
+		return nil
+	}
+	if len(b.waiters) >= b.Config.MaxQueueLength {
+		b.queueMu.Unlock()
+		return errBackendQueueFull
+	}
+	ready := make(chan struct{})
+	b.waiters = append(b.waiters, ready)
+	b.queueMu.Unlock()
+	
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+	
+	b.queueMu.Lock()
+	if i := slices.Index(b.waiters, ready); i >= 0 {
+		b.waiters = slices.Delete(b.waiters, i, i+1)
+		b.queueMu.Unlock()
+		return ctx.Err()
+	}
+	b.queueMu.Unlock()
+	// Handed a slot just as the wait ended; pass it on.
+	b.releaseSlot()
+	return ctx.Err()
+}
+
+// releaseSlot hands the slot to the first waiter, or frees it.
+func (b *Backend) releaseSlot() {
+	b.queueMu.Lock()
+	defer b.queueMu.Unlock()
+	if len(b.waiters) > 0 {
+		close(b.waiters[0])
+		b.waiters = b.waiters[1:]
+		return
+	}
+	b.active.Add(-1)
+}
+
+// trackAttempt registers an attempt so abortAttempts can cancel it, and
+// returns the func that forgets it again.
+func (b *Backend) trackAttempt(r *http.Request, cancel context.CancelCauseFunc) func() {
+	b.queueMu.Lock()
+	defer b.queueMu.Unlock()
+	if b.inflight == nil {
+		b.inflight = make(map[*http.Request]context.CancelCauseFunc)
+	}
+	b.inflight[r] = cancel
+	return func() {
+		b.queueMu.Lock()
+		defer b.queueMu.Unlock()
+		delete(b.inflight, r)
+	}
+}
+
+// abortAttempts cancels every attempt in progress with errAttemptAborted
+// and returns how many there were.
+func (b *Backend) abortAttempts() int {
+	b.queueMu.Lock()
+	defer b.queueMu.Unlock()
+	for _, cancel := range b.inflight {
+		cancel(errAttemptAborted)
+	}
+	return len(b.inflight)
+}
+
+var errAttemptAborted = errors.New("aborted by an operator force-draining the backend")
+
+func (b *Backend) queued() int {
+	b.queueMu.Lock()
+	defer b.queueMu.Unlock()
+	return len(b.waiters)
+}
+
+func (b *Backend) weight() int {
+	if weight := b.adminWeight.Load(); weight > 0 {
+		return int(weight)
+	}
+	if weight := b.scheduledWeight.Load(); weight > 0 {
+		return int(weight)
+	}
+	if b.Config.Weight > 0 {
+		return b.Config.Weight
+	}
+	return 1
+}
+
+// rampFactor scales the backend's weight linearly from 0 to 1 over
+// SlowStartDuration after it was first marked alive.
+func (b *Backend) rampFactor() float64 {
+	if b.Config.SlowStartDuration <= 0 {
+		return 1
+	}
+	
+	b.mux.RLock()
+	aliveAt := b.firstAliveAt
+	b.mux.RUnlock()
+	
+	if aliveAt.IsZero() {
+		return 0
+	}
+	elapsed := time.Since(aliveAt)
+	if elapsed >= b.Config.SlowStartDuration {
+		return 1
+	}
+	return float64(elapsed) / float64(b.Config.SlowStartDuration)
+}
+
+// effectiveWeight is the weight used for selection: the auto_latency weight
+// once one is computed, unless an operator or schedule set one, otherwise
+// the configured weight, scaled by the slow-start ramp.
+func (b *Backend) effectiveWeight() float64 {
+	weight := float64(b.weight())
+	b.mux.RLock()
+	latencyWeight := b.latencyWeight
+	b.mux.RUnlock()
+	if latencyWeight > 0 && b.adminWeight.Load() == 0 && b.scheduledWeight.Load() == 0 {
+		weight = latencyWeight
+	}
+	return weight * b.rampFactor()
+}
+
+func (b *Backend) IsAlive() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.Alive
+}
+
+type LoadBalancer struct {
+	cfg         *Config
+	opts        LoadBalancerOptions
+	backends    []*Backend
+	current     int
+	ring        []ringPoint
+	pinned      map[string]string // hash key -> backend URL, guarded by mux
+	mux         sync.Mutex
+	coalescer   *coalescer
+	idempotency *idempotencyCache
+	transcoder  *grpcTranscoder
+	admin       *http.ServeMux
+	forwardAuth *forwardAuth
+	conns       *connTracker
+	rateLimits  *rateLimiter
+	fallbacks   map[string]*Backend // by pool; never in backends
+	retries     *retryBudget
+	duplicates  map[string]string // policy by canonical header name, nil unless NormalizeDuplicateHeaders
+
+	poolStatsMu sync.Mutex
+	poolStats   map[string]*poolWindow
+
+	canaryMu             sync.Mutex
+	canaryWeight         float64
+	canaryLocked         bool // set by automatic rollback, cleared only by an admin
+	canaryFailingSince   time.Time
+	canaryPreviousWeight float64
+
+	auditMu  sync.Mutex
+	auditLog []AuditEntry
+	events   *eventBus
+
+	runtimeMu sync.Mutex
+	runtime   RuntimeStats // cached for runtimeStatsTTL
+
+	requestTrace *requestTraceLog
+
+	maintenanceMu   sync.RWMutex
+	maintenance     bool
+	maintenancePage []byte
+
+	captureMu sync.Mutex              // serializes starting and stopping captures
+	capture   atomic.Pointer[capture] // latest capture, active or not
+
+	traceMu     sync.Mutex
+	traceEvents []TraceEvent
+
+	proxyTrusted []*net.IPNet
+	limiter      *priorityLimiter
+	bodyRoutes   bool // some route has a body_match
+
+	builtinTransports bool // no custom BackendRoundTripperFactory
+	transportsMu      sync.Mutex
+	transports        map[string]http.RoundTripper // by transportKey, in shared mode
+
+	healthChecksStarted bool
+	sweeping            atomic.Bool
+
+	startTime      time.Time
+	configChecksum string
+	totalRequests  atomic.Int64
+	inFlight       atomic.Int64
+
+	oversizedResponses atomic.Int64
+	statsTickAt        time.Time // previous stats tick, owned by getStats
+	metrics            *metrics
+	bandwidth          *tokenBucket    // aggregate cap over throttled responses, if any
+	restored           *persistedState // counters from LB_STATE_FILE; set before serving
+	registrar          *registrar
+}
+
+// RoundTripperFactory builds the transport a backend's reverse proxy uses.
+type RoundTripperFactory func(cfg BackendConfig) http.RoundTripper
+
+// HostResolver resolves backend hostnames; *net.Resolver implements it.
+type HostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type LoadBalancerOptions struct {
+	// BackendRoundTripperFactory overrides the transport for every backend,
+	// e.g. to sign requests or inject faults. Defaults to
+	// ConfiguredTransportFactory.
+	BackendRoundTripperFactory RoundTripperFactory
+	// Resolver is used for DeregisterOnDNSFailureCount and DNSRefreshInterval
+	// lookups. Defaults to net.DefaultResolver.
+	Resolver HostResolver
+}
+
+func NewLoadBalancer(cfg *Config) *LoadBalancer {
+	return NewLoadBalancerWithOptions(cfg, LoadBalancerOptions{})
+}
+
+func NewLoadBalancerWithOptions(cfg *Config, opts LoadBalancerOptions) *LoadBalancer {
+	builtinTransports := opts.BackendRoundTripperFactory == nil
+	if builtinTransports {
+		opts.BackendRoundTripperFactory = ConfiguredTransportFactory
+	}
+	if opts.Resolver == nil {
+		opts.Resolver = net.DefaultResolver
+	}
+	
+	lb := &LoadBalancer{
+		cfg:               cfg,
+		opts:              opts,
+		backends:          []*Backend{},
+		current:           0,
+		poolStats:         make(map[string]*poolWindow),
+		startTime:         time.Now(),
+		metrics:           newMetrics(),
+		builtinTransports: builtinTransports,
+		transports:        make(map[string]http.RoundTripper),
+		events:            newEventBus(),
+		fallbacks:         make(map[string]*Backend),
+	}
+	lb.canaryWeight = cfg.CanaryWeight
+	lb.pinned = maps.Clone(cfg.HashOverrides)
+	if lb.pinned == nil {
+		lb.pinned = make(map[string]string)
+	}
+	lb.configChecksum = configChecksum(cfg)
+	
+	if cfg.AdminToken != "" || cfg.hasInternalListener() {
+		lb.admin = lb.adminRoutes()
+		log.Println("[INFO] Admin API enabled under /admin/")
+	}
+	
+	if cfg.MaintenanceMode {
+		if err := lb.setMaintenance(true); err != nil {
+			log.Fatalf("[FATAL] Failed to enable maintenance mode: %v\n", err)
+		}
+	}
+	
+	if len(cfg.ProxyProtocolTrustedCIDRs) > 0 {
+		trusted, err := parseCIDRs(cfg.ProxyProtocolTrustedCIDRs)
+		if err != nil {
+			log.Fatalf("[FATAL] Invalid PROXY_PROTOCOL_TRUSTED_CIDRS: %v\n", err)
+		}
+		lb.proxyTrusted = trusted
+	}
+	
+	if cfg.MaxConnsPerClient > 0 {
+		exempt, err := parseCIDRs(cfg.ConnLimitExemptCIDRs)
+		if err != nil {
+			log.Fatalf("[FATAL] Invalid CONN_LIMIT_EXEMPT_CIDRS: %v\n", err)
+		}
+		lb.conns = newConnTracker(cfg.MaxConnsPerClient, exempt)
+		log.Printf("[INFO] Limiting clients to %d concurrent connections\n", cfg.MaxConnsPerClient)
+	}
+	
+	if cfg.NormalizeDuplicateHeaders {
+		lb.duplicates = duplicateHeaderPolicies(cfg.DuplicateHeaderPolicies)
+	}
+	
+	if cfg.RetryBudgetPercent > 0 {
+		lb.retries = &retryBudget{percent: cfg.RetryBudgetPercent, events: lb.events}
+		go lb.retries.run()
+	}
+	
+	if cfg.RateLimitRPS > 0 {
+		lb.rateLimits = newRateLimiter(int64(cfg.RateLimitRPS), int64(cfg.RateLimitBurst))
+		log.Printf("[INFO] Limiting clients to %d requests per second (burst %d)\n", cfg.RateLimitRPS, int(lb.rateLimits.burst))
+	}
+	
+	if cfg.ConcurrencyLimit > 0 {
+		lb.limiter = newPriorityLimiter(cfg.ConcurrencyLimit, cfg.HighPriorityQueueSize, cfg.NormalPriorityQueueSize, lb.metrics)
+		log.Printf("[INFO] Limiting to %d concurrent requests, high priority when %s is one of %v\n",
+			cfg.ConcurrencyLimit, cfg.PriorityHeader, cfg.PriorityHeaderValues)
+	}
+	
+	for _, route := range cfg.Routes {
+		if route.BodyMatch == nil {
+			continue
+		}
+		lb.bodyRoutes = true
+		if route.BodyMatch.Regex != "" {
+			re, err := regexp.Compile(route.BodyMatch.Regex)
+			if err != nil {
+				log.Fatalf("[FATAL] Invalid body_match regex for route %s: %v\n", route.PathPattern, err)
+			}
+			route.BodyMatch.re = re
+		}
+	}
+	
+	for _, route := range cfg.Routes {
+		if route.ForwardAuthURL != "" {
+			lb.forwardAuth = newForwardAuth(cfg)
+			break
+		}
+	}
+	
+	if cfg.BandwidthAggregateLimit > 0 {
+		lb.bandwidth = newTokenBucket(cfg.BandwidthAggregateLimit, cfg.BandwidthAggregateBurst)
+		lb.metrics.bandwidthLimit.set(float64(cfg.BandwidthAggregateLimit), "aggregate")
+		log.Printf("[INFO] Throttled responses share %d bytes/s\n", cfg.BandwidthAggregateLimit)
+	}
+	
+	for _, route := range cfg.Routes {
+		if route.Idempotency {
+			lb.idempotency = newIdempotencyCache(cfg.IdempotencyTTL, cfg.IdempotencyMaxResponseBytes, cfg.IdempotencyCacheBytes)
+			log.Printf("[INFO] Idempotency-Key support enabled (TTL: %v, max response: %d bytes)\n",
+				cfg.IdempotencyTTL, cfg.IdempotencyMaxResponseBytes)
+			break
+		}
+	}
+	
+	if cfg.RequestTraceEnabled {
+		trace, err := newRequestTraceLog(cfg.RequestTraceFile, int64(cfg.RequestTraceMaxSizeMB)<<20)
+		if err != nil {
+			log.Printf("[ERROR] Request trace disabled: %v\n", err)
+		} else {
+			lb.requestTrace = trace
+			log.Printf("[INFO] Writing request trace to %s\n", cfg.RequestTraceFile)
+		}
+	}
+	
+	if cfg.CoalesceEnabled {
+		lb.coalescer = newCoalescer(cfg.CoalesceMaxWaiters, cfg.CoalesceMaxBodyBytes, cfg.CoalesceKeyHeaders)
+		log.Printf("[INFO] Request coalescing enabled (max waiters: %d, max body: %d bytes)\n",
+			cfg.CoalesceMaxWaiters, cfg.CoalesceMaxBodyBytes)
+	}
+	
+	if cfg.GRPCTranscoding {
+		transcoder, err := loadGRPCTranscoder(cfg.ProtobufDescriptorPath)
+		if err != nil {
+			log.Fatalf("[FATAL] Invalid PROTOBUF_DESCRIPTOR_PATH: %v\n", err)
+		}
+		lb.transcoder = transcoder
+		log.Printf("[INFO] gRPC transcoding enabled for %d HTTP bindings from %s\n", len(transcoder.rules), cfg.ProtobufDescriptorPath)
+		for _, method := range transcoder.streaming {
+			log.Printf("[WARN] Not transcoding streaming method %s\n", method)
+		}
+	}
+	
+	for _, backendCfg := range cfg.Backends {
+		backend, err := lb.newBackend(backendCfg)
+		if err != nil {
+			log.Printf("[ERROR] Skipping backend: %v\n", err)
+			continue
+		}
+		if backendCfg.Fallback {
+			lb.fallbacks[backend.Config.Pool] = backend
+			log.Printf("[INFO] Added fallback backend for pool %s: %s\n", backend.Config.Pool, backend.URL)
+			continue
+		}
+		lb.backends = append(lb.backends, backend)
+		if backendCfg.BandwidthLimit > 0 {
+			lb.metrics.bandwidthLimit.set(float64(backendCfg.BandwidthLimit), backend.URL)
+		}
+		log.Printf("[INFO] Added backend: %s\n", backend.URL)
+	}
+	lb.buildHashRing()
+	if builtinTransports && cfg.TransportMode == "shared" {
+		log.Printf("[INFO] %d backends share %d transports\n", len(lb.backends), len(lb.transports))
+	}
+	
+	return lb
+}
+
+// BackendValidationError explains why a backend URL was rejected. Field is
+// the part that failed: "url", "scheme", "host", "port" or "path".
+type BackendValidationError struct {
+	URL    string `json:"url"`
+	Field  string `json:"field"`
+	Value  string `json:"value"`
+	Reason string `json:"error"`
+}
+
+func (e *BackendValidationError) Error() string {
+	return fmt.Sprintf("Backend URL %q has invalid %s %q: %s", e.URL, e.Field, e.Value, e.Reason)
+}
+
+// parseBackendURL parses a backend URL, requiring an http or https scheme,
+// a host, a port in 1-65535 if one is given, and no ".." path segments.
+// Failures are *BackendValidationError.
+func parseBackendURL(rawURL string) (*url.URL, error) {
+	invalid := func(field, value, reason string) error {
+		return &BackendValidationError{URL: rawURL, Field: field, Value: value, Reason: reason}
+	}
+	u, err := url.Parse(rawURL)
+	if urlErr := (*url.Error)(nil); errors.As(err, &urlErr) {
+		return nil, invalid("url", rawURL, urlErr.Err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, invalid("scheme", u.Scheme, "must be http or https")
+	}
+	if u.Hostname() == "" {
+		return nil, invalid("host", u.Host, "must not be empty")
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, invalid("port", port, "must be between 1 and 65535")
+		}
+	}
+	if slices.Contains(strings.Split(u.Path, "/"), "..") {
+		return nil, invalid("path", u.Path, `must not contain ".." segments`)
+	}
+	return u, nil
+}
+
+func (lb *LoadBalancer) newBackend(backendCfg BackendConfig) (*Backend, error) {
+	parsedURL, err := parseBackendURL(backendCfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	
+	if backendCfg.Pool == "" {
+		backendCfg.Pool = lb.cfg.DefaultPool
+	}
+	if backendCfg.ExpectContinueTimeout == 0 {
+		backendCfg.ExpectContinueTimeout = lb.cfg.ExpectContinueTimeout
+	}
+	if backendCfg.MaxResponseHeaderBytes == 0 {
+		backendCfg.MaxResponseHeaderBytes = lb.cfg.MaxResponseHeaderBytes
+	}
+	if backendCfg.DialTimeout == 0 {
+		backendCfg.DialTimeout = lb.cfg.DialTimeout
+	}
+	if backendCfg.TLSHandshakeTimeout == 0 {
+		backendCfg.TLSHandshakeTimeout = lb.cfg.TLSHandshakeTimeout
+	}
+	if backendCfg.ResponseHeaderTimeout == 0 {
+		backendCfg.ResponseHeaderTimeout = lb.cfg.ResponseHeaderTimeout
+	}
+	if backendCfg.BodyIdleTimeout == 0 {
+		backendCfg.BodyIdleTimeout = lb.cfg.BodyIdleTimeout
+	}
+	if lb.cfg.BackendConnectionClose {
+		backendCfg.ConnectionClose = true
+	}
+	
+	proxy := httputil.NewSingleHostReverseProxy(parsedURL)
+	modifiers := requestModifiers(proxy.Director, parsedURL, backendCfg)
+	proxy.Director = directorChain(modifiers...)
+	if lb.cfg.TraceProxyDirector {
+		proxy.Director = lb.traceDirector(proxy.Director)
+	}
+	proxy.Transport = lb.backendTransport(backendCfg)
+	limits, _ := proxy.Transport.(*http.Transport)
+	if backendCfg.BackendMaxConnAge > 0 {
+		proxy.Transport = newMaxAgeTransport(proxy.Transport, backendCfg.BackendMaxConnAge)
+	}
+	pool := newPoolTransport(proxy.Transport, limits)
+	proxy.Transport = pool
+	
+	backend := &Backend{
+		URL:       backendCfg.URL,
+		Config:    backendCfg,
+		Proxy:     proxy,
+		pool:      pool,
+		modifiers: modifiers,
+	}
+	if backendCfg.RateLimitRPS > 0 {
+		backend.rateLimit = newRateLimiter(int64(backendCfg.RateLimitRPS), int64(backendCfg.RateLimitBurst))
+	}
+	backend.SetAlive(true)
+	proxy.ErrorHandler = lb.proxyErrorHandler(backend)
+	proxy.ModifyResponse = lb.modifyResponse(backend)
+	return backend, nil
+}
+
+// requestModifier makes one change to a request on its way to a backend.
+// modify gets the URL the client asked for, before any modifier ran, as
+// incoming.
+type requestModifier struct {
+	name   string
+	modify func(req *http.Request, incoming *url.URL)
+}
+
+// directorChain runs modifiers in order as a ReverseProxy Director.
+func directorChain(modifiers ...requestModifier) func(*http.Request) {
+	return func(req *http.Request) {
+		incoming := *req.URL
+		for _, m := range modifiers {
+			m.modify(req, &incoming)
+		}
+	}
+}
+
+// requestModifiers lists the modifiers a backend's requests go through,
+// starting with target, the stock director that points them at the backend
+// URL base.
+func requestModifiers(target func(*http.Request), base *url.URL, backendCfg BackendConfig) []requestModifier {
+	modifiers := []requestModifier{{name: "target", modify: func(req *http.Request, _ *url.URL) { target(req) }}}
+	if backendCfg.ForwardedPath != "" {
+		modifiers = append(modifiers, requestModifier{name: "forwarded_path", modify: forwardedPathModifier(base.Path, backendCfg.ForwardedPath)})
+	}
+	host := base.Host
+	if backendCfg.BackendHostHeader != "" {
+		host = backendCfg.BackendHostHeader
+	}
+	modifiers = append(modifiers, requestModifier{name: "host_header", modify: func(req *http.Request, _ *url.URL) { req.Host = host }})
+	return modifiers
+}
+
+// forwardedPathModifier replaces the path and query with a
+// BackendConfig.ForwardedPath template filled in from the incoming URL,
+// under the backend URL's basePath as the target director would have put it.
+func forwardedPathModifier(basePath, template string) func(*http.Request, *url.URL) {
+	basePath = strings.TrimSuffix(basePath, "/")
+	return func(req *http.Request, incoming *url.URL) {
+		forwardedPath, query := expandForwardedPath(template, incoming)
+		req.URL.Path, req.URL.RawQuery = basePath+forwardedPath, query
+		req.URL.RawPath = ""
+	}
+}
+
+// RewriteTest is a synthetic request for POST /admin/rewrite/test. Path may
+// carry a query string. Backend picks which backend's rules to run; it
+// defaults to the first available backend in the request's pool.
+type RewriteTest struct {
+	Method  string            `json:"method"`
+	Host    string            `json:"host"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Backend string            `json:"backend"`
+}
+
+// RewriteResult is what the request would be forwarded as.
+type RewriteResult struct {
+	Pool         string        `json:"pool"`
+	CanaryWeight float64       `json:"canary_weight,omitempty"` // share of the pool's requests going to the canary pool instead
+	Route        string        `json:"route,omitempty"`
+	Backend      string        `json:"backend"`
+	Method       string        `json:"method"`
+	URL          string        `json:"url"`
+	Host         string        `json:"host"`
+	Proto        string        `json:"proto"`
+	Headers      http.Header   `json:"headers"`
+	Steps        []RewriteStep `json:"steps"`
+}
+
+// RewriteStep is one modifier run on the request, in order, and whether it
+// changed anything.
+type RewriteStep struct {
+	Modifier string `json:"modifier"`
+	Changed  bool   `json:"changed"`
+	URL      string `json:"url"`
+}
+
+// handleRewriteTest runs a synthetic request through pool selection and a
+// backend's Director modifiers, the same ones proxied requests go through,
+// and reports the result without contacting the backend. The proxy itself
+// still adds X-Forwarded-For and drops hop-by-hop headers afterwards.
+func (lb *LoadBalancer) handleRewriteTest(w http.ResponseWriter, r *http.Request) {
+	var test RewriteTest
+	if err := json.NewDecoder(r.Body).Decode(&test); err != nil || test.Path == "" {
+		http.Error(w, "Body must describe a request with at least {\"path\": \"/...\"}", http.StatusBadRequest)
+		return
+	}
+	if test.Method == "" {
+		test.Method = http.MethodGet
+	}
+	req, err := http.NewRequest(test.Method, test.Path, nil)
+	if err != nil || !strings.HasPrefix(test.Path, "/") {
+		http.Error(w, "Invalid method or path", http.StatusBadRequest)
+		return
+	}
+	req.Host = test.Host
+	for name, value := range test.Headers {
+		req.Header.Set(name, value)
+	}
+	
+	result := RewriteResult{Pool: lb.cfg.DefaultPool}
+	if pool, ok := lb.routedPool(req); ok {
+		result.Pool = pool
+	} else if weight := lb.getCanaryWeight(); weight > 0 {
+		result.CanaryWeight = weight
+	}
+	if route := lb.matchRoute(req); route != nil {
+		result.Route = route.PathPattern
+	}
+	
+	var backend *Backend
+	for _, b := range lb.getBackends() {
+		if test.Backend != "" && b.URL == test.Backend || test.Backend == "" && b.inPool(result.Pool) && b.available() {
+			backend = b
+			break
+		}
+	}
+	if backend == nil && test.Backend != "" {
+		http.Error(w, "Unknown backend", http.StatusNotFound)
+		return
+	}
+	if backend == nil {
+		http.Error(w, "No available backend in pool "+result.Pool, http.StatusUnprocessableEntity)
+		return
+	}
+	result.Backend = backend.URL
+	
+	incoming := *req.URL
+	for _, m := range backend.modifiers {
+		before := fmt.Sprint(req.Method, req.URL, req.Host, req.Proto, req.Header)
+		m.modify(req, &incoming)
+		changed := fmt.Sprint(req.Method, req.URL, req.Host, req.Proto, req.Header) != before
+		result.Steps = append(result.Steps, RewriteStep{Modifier: m.name, Changed: changed, URL: req.URL.String()})
+	}
+	result.Method, result.URL, result.Host, result.Proto, result.Headers = req.Method, req.URL.String(), req.Host, req.Proto, req.Header
+	writeJSON(w, http.StatusOK, result)
+}
+
+// traceBodyLimit caps the request bodies a director trace buffers to digest;
+// larger and streamed bodies are only described.
+const traceBodyLimit = 64 << 10
+
+// sensitiveTraceHeaders are redacted from director traces unless
+// TraceSensitiveHeaders is set.
+var sensitiveTraceHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// traceDirector wraps director to log the outgoing request before and after
+// it runs, for TRACE_PROXY_DIRECTOR.
+func (lb *LoadBalancer) traceDirector(director func(*http.Request)) func(*http.Request) {
+	return func(req *http.Request) {
+		state := getRequestState(req)
+		lb.logRequest(state, "DEBUG", "Director before: %s", lb.describeOutgoing(req))
+		director(req)
+		lb.logRequest(state, "DEBUG", "Director after: %s", lb.describeOutgoing(req))
+	}
+}
+
+func (lb *LoadBalancer) describeOutgoing(req *http.Request) string {
+	names := slices.Sorted(maps.Keys(req.Header))
+	headers := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(req.Header[name], ", ")
+		if !lb.cfg.TraceSensitiveHeaders && slices.Contains(sensitiveTraceHeaders, name) {
+			value = "[REDACTED]"
+		}
+		headers = append(headers, name+": "+value)
+	}
+	return fmt.Sprintf("%s %s host=%s headers={%s} body=%s",
+		req.Method, req.URL, req.Host, strings.Join(headers, "; "), digestBody(req))
+}
+
+// digestBody returns the SHA-256 of a small request body, putting the bytes
+// it read back in front of the body so the proxy still sends all of it.
+func digestBody(req *http.Request) string {
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return "none"
+	}
+	if req.ContentLength < 0 || req.ContentLength > traceBodyLimit {
+		return fmt.Sprintf("not digested (content length %d)", req.ContentLength)
+	}
+	
+	body := req.Body
+	data, err := io.ReadAll(body)
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), body), body}
+	if err != nil {
+		return fmt.Sprintf("unreadable after %d bytes: %v", len(data), err)
+	}
+	return fmt.Sprintf("sha256:%x (%d bytes)", sha256.Sum256(data), len(data))
+}
+
+// expandForwardedPath fills in a BackendConfig.ForwardedPath template for the
+// incoming URL u, returning the path and query to forward. Empty query
+// parameters left by an empty ${query} and repeated slashes are dropped.
+func expandForwardedPath(template string, u *url.URL) (string, string) {
+	expanded := strings.NewReplacer("${path}", u.Path, "${query}", u.RawQuery).Replace(template)
+	forwardedPath, query, hasQuery := strings.Cut(expanded, "?")
+	if !hasQuery {
+		query = u.RawQuery
+	}
+	
+	for strings.Contains(forwardedPath, "//") {
+		forwardedPath = strings.ReplaceAll(forwardedPath, "//", "/")
+	}
+	if !strings.HasPrefix(forwardedPath, "/") {
+		forwardedPath = "/" + forwardedPath
+	}
+	var params []string
+	for _, param := range strings.Split(query, "&") {
+		if param != "" {
+			params = append(params, param)
+		}
+	}
+	return forwardedPath, strings.Join(params, "&")
+}
+
+// AddBackend registers a backend at runtime. With SlowStartDuration set it
+// starts at near-zero weight and ramps up to its configured share.
+func (lb *LoadBalancer) AddBackend(backendCfg BackendConfig) (*Backend, error) {
+	if backendCfg.Fallback {
+		return nil, errors.New("fallback backends can only be set in CONFIG_FILE")
+	}
+	backend, err := lb.newBackend(backendCfg)
+	if err != nil {
+		return nil, err
+	}
+	
+	lb.mux.Lock()
+	for _, existing := range lb.backends {
+		if existing.URL == backend.URL {
+			lb.mux.Unlock()
+			return nil, fmt.Errorf("backend %s already exists", backend.URL)
+		}
+		if existing.Config.stickyID() == backendCfg.stickyID() {
+			lb.mux.Unlock()
+			return nil, fmt.Errorf("backend %s already has id %q", existing.URL, backendCfg.stickyID())
+		}
+	}
+	backends := make([]*Backend, len(lb.backends), len(lb.backends)+1)
+	copy(backends, lb.backends)
+	lb.backends = append(backends, backend)
+	lb.buildHashRing()
+	startChecks := lb.healthChecksStarted
+	lb.mux.Unlock()
+	
+	log.Printf("[INFO] Added backend: %s (weight: %d, slow start: %v)\n",
+		backend.URL, backend.weight(), backendCfg.SlowStartDuration)
+	if startChecks {
+		lb.startBackendHealthCheck(backend)
+	}
+	return backend, nil
+}
+
+// RemoveBackend takes a backend out of rotation for good. Requests already
+// proxied to it finish normally; its health checks stop at their next tick.
+func (lb *LoadBalancer) RemoveBackend(backendURL string) (*Backend, error) {
+	lb.mux.Lock()
+	idx := slices.IndexFunc(lb.backends, func(b *Backend) bool { return b.URL == backendURL })
+	if idx < 0 {
+		lb.mux.Unlock()
+		return nil, fmt.Errorf("backend %s does not exist", backendURL)
+	}
+	backend := lb.backends[idx]
+	// Copy rather than splice: getBackends callers may still be ranging
+	// over the old slice.
+	lb.backends = slices.Delete(slices.Clone(lb.backends), idx, idx+1)
+	if idx < lb.current {
+		lb.current--
+	}
+	if lb.current >= len(lb.backends) {
+		lb.current = 0
+	}
+	lb.buildHashRing()
+	for key, pinned := range lb.pinned {
+		if pinned == backendURL {
+			delete(lb.pinned, key)
+		}
+	}
+	remaining := len(lb.backends)
+	lb.mux.Unlock()
+	
+	backend.removed.Store(true)
+	lb.closeIdleConnections(backend)
+	log.Printf("[INFO] Removed backend: %s\n", backend.URL)
+	if remaining == 0 {
+		log.Printf("[WARN] No backends left; requests will get 503 until one is added\n")
+	}
+	return backend, nil
+}
+
+// closeIdleConnections closes the backend's idle connections, leaving those
+// serving requests alone. Only an isolated transport can do this without
+// dropping other backends' connections too; a shared one retires them after
+// its idle timeout instead.
+func (lb *LoadBalancer) closeIdleConnections(backend *Backend) {
+	if lb.builtinTransports && lb.cfg.TransportMode == "isolated" && backend.pool.limits != nil {
+		backend.pool.limits.CloseIdleConnections()
+	}
+}
+
+// poolTransport traces a backend's requests to report on its connection
+// pool, which http.Transport doesn't expose. Idle connections the transport
+// closes without telling us (the backend hung up) are only forgotten once
+// they pass the idle timeout, so idle counts are an upper bound.
+type poolTransport struct {
+	http.RoundTripper
+	limits *http.Transport // nil when the factory returned some other RoundTripper
+	
+	active  atomic.Int64 // requests holding a connection
+	waiting atomic.Int64 // requests waiting for a connection, dialing included
+	
+	mu   sync.Mutex
+	idle map[net.Conn]time.Time // idle connections and when they went idle
+	
+	addrs atomic.Pointer[map[string]bool] // what the hostname last resolved to; nil until DNS_REFRESH_INTERVAL first does
+}
+
+// stale reports whether conn goes to an address the backend's hostname no
+// longer resolves to.
+func (t *poolTransport) stale(conn net.Conn) bool {
+	addrs := t.addrs.Load()
+	if addrs == nil {
+		return false
+	}
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	return ok && !(*addrs)[tcpAddr.IP.String()]
+}
+
+// retireIdle closes the transport's idle connections once a connection to
+// an address the hostname no longer resolves to has finished its request.
+// The transport takes them out of its pool before closing them, so no
+// request can pick one up in between; connections serving requests are left
+// alone. A transport shared with other backends loses their idle
+// connections too, which only costs them a redial.
+func (t *poolTransport) retireIdle() {
+	if t.limits == nil {
+		return
+	}
+	t.limits.CloseIdleConnections()
+	t.mu.Lock()
+	clear(t.idle)
+	t.mu.Unlock()
+}
+
+func newPoolTransport(next http.RoundTripper, limits *http.Transport) *poolTransport {
+	return &poolTransport{RoundTripper: next, limits: limits, idle: make(map[net.Conn]time.Time)}
+}
+
+func (t *poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var waiting, holding atomic.Bool
+	var conn net.Conn
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			waiting.Store(true)
+			t.waiting.Add(1)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if waiting.Swap(false) {
+				t.waiting.Add(-1)
+			}
+			holding.Store(true)
+			t.active.Add(1)
+			conn = info.Conn
+			t.mu.Lock()
+			delete(t.idle, conn)
+			t.mu.Unlock()
+		},
+		PutIdleConn: func(err error) {
+			if conn == nil {
+				return
+			}
+			t.mu.Lock()
+			if err == nil {
+				t.idle[conn] = time.Now()
+			} else {
+				delete(t.idle, conn)
+			}
+			t.mu.Unlock()
+			if err == nil && t.stale(conn) {
+				t.retireIdle()
+			}
+		},
+	}
+	
+	release := func() {
+		if waiting.Swap(false) {
+			t.waiting.Add(-1)
+		}
+		if holding.Swap(false) {
+			t.active.Add(-1)
+		}
+	}
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody calls release once the response body is closed, when the
+// connection goes back to the pool or is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// ConnectionStats is the connection pool report for one backend. The limits
+// come from its http.Transport and are omitted when it uses another kind of
+// RoundTripper.
+type ConnectionStats struct {
+	Backend     string `json:"backend"`
+	IdleConns   int    `json:"idle_conns"`
+	ActiveConns int64  `json:"active_conns"`
+	WaitCount   int64  `json:"wait_count"`
+	
+	// IdleConnsPerHost is how many idle connections the transport keeps
+	// to the backend, http.DefaultMaxIdleConnsPerHost when not set.
+	IdleConnsPerHost *int `json:"idle_conns_per_host,omitempty"`
+	MaxIdleConns     *int `json:"max_idle_conns,omitempty"`
+	MaxConnsPerHost  *int `json:"max_conns_per_host,omitempty"` // 0 means no limit
+}
+
+func (t *poolTransport) stats() ConnectionStats {
+	var idleTimeout time.Duration
+	if t.limits != nil {
+		idleTimeout = t.limits.IdleConnTimeout
+	}
+	
+	t.mu.Lock()
+	for conn, since := range t.idle {
+		if idleTimeout > 0 && time.Since(since) > idleTimeout {
+			delete(t.idle, conn)
+		}
+	}
+	stats := ConnectionStats{
+		IdleConns:   len(t.idle),
+		ActiveConns: t.active.Load(),
+		WaitCount:   t.waiting.Load(),
+	}
+	t.mu.Unlock()
+	
+	if t.limits != nil {
+		perHost := t.limits.MaxIdleConnsPerHost
+		if perHost == 0 {
+			perHost = http.DefaultMaxIdleConnsPerHost
+		}
+		stats.IdleConnsPerHost = &perHost
+		stats.MaxIdleConns = &t.limits.MaxIdleConns
+		stats.MaxConnsPerHost = &t.limits.MaxConnsPerHost
+	}
+	return stats
+}
+
+// ConfiguredTransportFactory picks one of the built-in factories based on
+// the backend's "transport" setting.
+func ConfiguredTransportFactory(cfg BackendConfig) http.RoundTripper {
+	switch cfg.Transport {
+	case "http2":
+		return HTTP2TransportFactory(cfg)
+	case "mtls":
+		return MTLSTransportFactory(cfg)
+	case "http1.0":
+		return HTTP10TransportFactory(cfg)
+	default:
+		return DefaultTransportFactory(cfg)
+	}
+}
+
+// DefaultTransportFactory shares http.DefaultTransport across backends
+// unless the backend needs different tuning.
+func DefaultTransportFactory(cfg BackendConfig) http.RoundTripper {
+	if cfg.tunesTransport() {
+		return baseTransport(cfg)
+	}
+	if cfg.ExpectContinueTimeout == 0 || cfg.ExpectContinueTimeout == http.DefaultTransport.(*http.Transport).ExpectContinueTimeout {
+		return http.DefaultTransport
+	}
+	return baseTransport(cfg)
+}
+
+// baseTransport clones http.DefaultTransport with the backend's tuning.
+// ExpectContinueTimeout makes requests carrying "Expect: 100-continue" wait
+// for the backend's interim response before sending the body; the reverse
+// proxy relays that 100 to the client, so large uploads only start once the
+// backend has agreed to take them.
+func baseTransport(cfg BackendConfig) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.ExpectContinueTimeout > 0 {
+		transport.ExpectContinueTimeout = cfg.ExpectContinueTimeout
+	}
+	transport.DisableKeepAlives = cfg.ConnectionClose
+	if cfg.MaxResponseHeaderBytes > 0 {
+		transport.MaxResponseHeaderBytes = cfg.MaxResponseHeaderBytes
+	}
+	if cfg.DialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if cfg.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	}
+	if cfg.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	}
+	if cfg.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	return transport
+}
+
+// tunesTransport reports whether cfg changes any http.DefaultTransport
+// setting other than ExpectContinueTimeout.
+func (cfg BackendConfig) tunesTransport() bool {
+	return cfg.ConnectionClose || cfg.MaxResponseHeaderBytes > 0 || cfg.DialTimeout > 0 || cfg.TLSHandshakeTimeout > 0 ||
+		cfg.ResponseHeaderTimeout > 0 || cfg.IdleConnTimeout > 0 || cfg.MaxIdleConnsPerHost > 0
+}
+
+// transportKey identifies everything ConfiguredTransportFactory builds a
+// transport from, so backends with equal keys can share one.
+func transportKey(cfg BackendConfig) string {
+	scheme, _, _ := strings.Cut(cfg.URL, "://")
+	return fmt.Sprintf("%s|%s|%v|%t|%d|%v|%v|%v|%v|%d|%s|%s|%s",
+		cfg.Transport, scheme, cfg.ExpectContinueTimeout, cfg.ConnectionClose, cfg.MaxResponseHeaderBytes,
+		cfg.DialTimeout, cfg.TLSHandshakeTimeout, cfg.ResponseHeaderTimeout, cfg.IdleConnTimeout, cfg.MaxIdleConnsPerHost,
+		cfg.TLSClientCert, cfg.TLSClientKey, cfg.TLSCACert)
+}
+
+// backendTransport returns the transport for a new backend. With the
+// built-in factories, shared TRANSPORT_MODE reuses the transport of any
+// backend with the same settings, and isolated mode builds a new one every
+// time, never http.DefaultTransport. A custom BackendRoundTripperFactory is
+// called for every backend and decides for itself.
+func (lb *LoadBalancer) backendTransport(cfg BackendConfig) http.RoundTripper {
+	if !lb.builtinTransports {
+		return lb.opts.BackendRoundTripperFactory(cfg)
+	}
+	if lb.cfg.TransportMode == "isolated" {
+		transport := ConfiguredTransportFactory(cfg)
+		if transport == http.DefaultTransport {
+			transport = baseTransport(cfg)
+		}
+		return transport
+	}
+	
+	key := transportKey(cfg)
+	lb.transportsMu.Lock()
+	defer lb.transportsMu.Unlock()
+	if transport, ok := lb.transports[key]; ok {
+		return transport
+	}
+	transport := ConfiguredTransportFactory(cfg)
+	// A failed mTLS setup is retried when the backend is added again.
+	if _, failed := transport.(failingRoundTripper); !failed {
+		lb.transports[key] = transport
+	}
+	return transport
+}
+
+// HTTP2TransportFactory speaks HTTP/2 to the backend, using prior-knowledge
+// h2c for plain http:// URLs.
+func HTTP2TransportFactory(cfg BackendConfig) http.RoundTripper {
+	transport := baseTransport(cfg)
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP2(true)
+	if strings.HasPrefix(cfg.URL, "http://") {
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return transport
+}
+
+// MTLSTransportFactory presents the backend's client certificate and trusts
+// its CA bundle. If the files can't be loaded every request to the backend
+// fails with the load error rather than silently falling back to plain TLS.
+func MTLSTransportFactory(cfg BackendConfig) http.RoundTripper {
+	tlsConfig, err := loadClientTLSConfig(cfg)
+	if err != nil {
+		log.Printf("[ERROR] Failed to set up mTLS for %s: %v\n", cfg.URL, err)
+		return failingRoundTripper{err: err}
+	}
+	
+	transport := baseTransport(cfg)
+	transport.TLSClientConfig = tlsConfig
+	return transport
+}
+
+// maxHTTP10RequestBody caps how much of a request body of unknown length
+// the http1.0 transport buffers to learn its Content-Length.
+const maxHTTP10RequestBody = 10 << 20
+
+var errHTTP10BodyTooLarge = fmt.Errorf("request body of unknown length exceeds the %d bytes buffered for an HTTP/1.0 backend", maxHTTP10RequestBody)
+
+// HTTP10TransportFactory speaks HTTP/1.0 to legacy backends that choke on
+// HTTP/1.1 features such as chunked encoding. It is the backend's tuned
+// http.Transport, with its client certificate and CA bundle if set, closing
+// each connection after one request. http.Transport always writes an
+// HTTP/1.1 request line, so the connections it dials rewrite it.
+func HTTP10TransportFactory(cfg BackendConfig) http.RoundTripper {
+	transport := baseTransport(cfg)
+	transport.DisableKeepAlives = true
+	if cfg.TLSClientCert != "" || cfg.TLSCACert != "" {
+		tlsConfig, err := loadClientTLSConfig(cfg)
+		if err != nil {
+			log.Printf("[ERROR] Failed to set up TLS for %s: %v\n", cfg.URL, err)
+			return failingRoundTripper{err: err}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &http10Conn{Conn: conn}, nil
+	}
+	// The rewrite has to happen above TLS, so https connections are
+	// handshaken here rather than by the transport.
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := &tls.Config{}
+		if transport.TLSClientConfig != nil {
+			tlsConfig = transport.TLSClientConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		handshakeCtx, cancel := ctx, context.CancelFunc(func() {})
+		if transport.TLSHandshakeTimeout > 0 {
+			handshakeCtx, cancel = context.WithTimeout(ctx, transport.TLSHandshakeTimeout)
+		}
+		defer cancel()
+		if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+			conn.Close()
+			// Match http.Transport's error so timeoutClass recognises it.
+			if ctx.Err() == nil && handshakeCtx.Err() != nil {
+				return nil, errors.New("net/http: TLS handshake timeout")
+			}
+			return nil, err
+		}
+		return &http10Conn{Conn: tlsConn}, nil
+	}
+	return &http10Transport{transport: transport}
+}
+
+// http10Transport buffers request bodies of unknown length, up to
+// maxHTTP10RequestBody, so they are sent with a Content-Length instead of
+// chunked.
+type http10Transport struct {
+	transport *http.Transport
+}
+
+func (t *http10Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.ContentLength < 0 && req.Body != nil && req.Body != http.NoBody {
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxHTTP10RequestBody+1))
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > maxHTTP10RequestBody {
+			return nil, errHTTP10BodyTooLarge
+		}
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	return t.transport.RoundTrip(req)
+}
+
+func (t *http10Transport) CloseIdleConnections() {
+	t.transport.CloseIdleConnections()
+}
+
+// http10Conn carries a single request, since keep-alives are off, and
+// rewrites its request line from HTTP/1.1 to HTTP/1.0. http.Transport
+// formats the request line in one call and writes it through a buffer
+// that is empty at that point, so the first Write holds all of it.
+type http10Conn struct {
+	net.Conn
+	rewritten bool
+}
+
+func (c *http10Conn) Write(p []byte) (int, error) {
+	if c.rewritten {
+		return c.Conn.Write(p)
+	}
+	c.rewritten = true
+	line, _, ok := bytes.Cut(p, []byte("\r\n"))
+	if !ok || !bytes.HasSuffix(line, []byte(" HTTP/1.1")) {
+		return c.Conn.Write(p)
+	}
+	p = bytes.Clone(p)
+	p[len(line)-1] = '0'
+	return c.Conn.Write(p)
+}
+
+// loadClientTLSConfig loads the backend's client certificate and CA bundle.
+// The mtls transport always needs the certificate; http1.0 presents one
+// only if it is set.
+func loadClientTLSConfig(cfg BackendConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if cfg.Transport == "mtls" || cfg.TLSClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSClientCert, cfg.TLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	
+	if cfg.TLSCACert != "" {
+		pem, err := os.ReadFile(cfg.TLSCACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.TLSCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// maxAgeTransport closes connections once they are older than maxAge.
+// Connections are followed through httptrace: an idle connection is closed
+// when it expires and a busy one as soon as its request finishes. A request
+// that picks up an expired connection in between has it closed under it, so
+// the transport returns an error for it, or retries it on a new connection
+// when the request can be replayed. HTTP/2 connections are shared between
+// requests and left alone.
+type maxAgeTransport struct {
+	http.RoundTripper
+	maxAge time.Duration
+	
+	mu    sync.Mutex
+	conns map[net.Conn]bool // tracked connections, true while serving a request
+}
+
+func newMaxAgeTransport(next http.RoundTripper, maxAge time.Duration) *maxAgeTransport {
+	return &maxAgeTransport{RoundTripper: next, maxAge: maxAge, conns: make(map[net.Conn]bool)}
+}
+
+func (t *maxAgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn net.Conn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if tlsConn, ok := info.Conn.(*tls.Conn); ok && tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+				return
+			}
+			conn = info.Conn
+			t.acquire(conn, info.Reused)
+		},
+		PutIdleConn: func(error) {
+			if conn != nil {
+				t.release(conn)
+			}
+		},
+	}
+	return t.RoundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+func (t *maxAgeTransport) acquire(conn net.Conn, reused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, tracked := t.conns[conn]; !tracked {
+		if reused {
+			// Expired while idle but picked up before it was closed.
+			closeConn(conn)
+			return
+		}
+		time.AfterFunc(t.maxAge, func() { t.expire(conn) })
+	}
+	t.conns[conn] = true
+}
+
+func (t *maxAgeTransport) release(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, tracked := t.conns[conn]; !tracked {
+		closeConn(conn)
+		return
+	}
+	t.conns[conn] = false
+}
+
+func (t *maxAgeTransport) expire(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if busy := t.conns[conn]; !busy {
+		closeConn(conn)
+	}
+	delete(t.conns, conn)
+}
+
+// closeConn closes the TCP connection under conn; the transport notices and
+// drops it from its idle pool.
+func closeConn(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	conn.Close()
+}
+
+type failingRoundTripper struct {
+	err error
+}
+
+func (f failingRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, f.err
+}
+
+// getBackends returns the current backend list. The slice is replaced, never
+// modified in place, so callers can range over it without holding the lock.
+func (lb *LoadBalancer) getBackends() []*Backend {
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	return lb.backends
+}
+
+func (lb *LoadBalancer) getNextBackend(r *http.Request) *Backend {
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	
+	pool := ""
+	state := getRequestState(r)
+	if state != nil {
+		pool = state.pool
+	}
+	if len(lb.backends) == 0 {
+		return nil
+	}
+	var tried []*Backend
+	if state != nil {
+		tried = state.tried
+	}
+	candidate, dialSkipped := lb.candidateFilter(pool, r.URL.Path, tried)
+	for _, backend := range dialSkipped {
+		backend.dialSkips.Add(1)
+		lb.metrics.dialFailureSkips.inc(backend.URL)
+	}
+	
+	if lb.cfg.StickySessions && (state == nil || state.attempts == 0) {
+		if backend := lb.stickyBackend(r, candidate); backend != nil {
+			if state != nil {
+				state.strategy = "sticky"
+				state.candidates = 1
+			}
+			return backend
+		}
+	}
+	if state != nil {
+		state.strategy = lb.cfg.Strategy
+		state.candidates = 0
+		state.skipped = state.skipped[:0]
+		for _, backend := range lb.backends {
+			if candidate(backend) {
+				state.candidates++
+			} else if state.debug {
+				reason := lb.skipReason(backend, pool, r.URL.Path)
+				if reason == "filtered" && slices.Contains(tried, backend) {
+					reason = "already tried"
+				}
+				state.skipped = append(state.skipped, backend.URL+" ("+reason+")")
+			}
+		}
+	}
+	
+	switch lb.cfg.Strategy {
+	case "weighted_round_robin", "auto_latency":
+		return lb.nextWeightedBackend(candidate)
+	case "consistent_hash_path":
+		return lb.hashRingBackend(r.URL.Path, candidate)
+	case "consistent_hash_header":
+		if key := r.Header.Get(lb.cfg.HashHeader); key != "" {
+			if backend := lb.pinnedBackend(key, candidate); backend != nil {
+				return backend
+			}
+			return lb.hashRingBackend(key, candidate)
+		}
+	}
+	
+	if lb.current >= len(lb.backends) {
+		lb.current = 0
+	}
+	for i := 0; i < len(lb.backends); i++ {
+		idx := (lb.current + i) % len(lb.backends)
+		
+		if candidate(lb.backends[idx]) {
+			lb.current = (idx + 1) % len(lb.backends)
+			return lb.backends[idx]
+		}
+	}
+	
+	return nil
+}
+
+// candidateFilter reports which backends may take a request for pool and
+// path right now, along with the backends passed over for a recent dial
+// failure. Backends excluded for path are ruled out before any of the
+// fallbacks, so none of them can bring one back. Backends in tried, which
+// already failed the request, are only left in when no other is available.
+// Caller must hold lb.mux.
+func (lb *LoadBalancer) candidateFilter(pool, path string, tried []*Backend) (func(*Backend) bool, []*Backend) {
+	candidate := func(b *Backend) bool {
+		return (b.inPool(pool) || lb.inIdlePool(b)) && b.available() && !lb.excludedForPath(b, path)
+	}
+	if len(tried) > 0 {
+		candidate = lb.avoidTried(candidate, tried)
+	}
+	var dialSkipped []*Backend
+	if lb.cfg.DialFailureCacheTTL > 0 {
+		candidate, dialSkipped = lb.skipDialFailures(candidate)
+	}
+	if lb.cfg.RetryAfterMaxBackoff > 0 {
+		candidate = lb.preferNotBackingOff(candidate)
+	}
+	candidate = lb.overflowToIdlePool(candidate)
+	candidate = lb.preferDeepHealthy(candidate)
+	if lb.cfg.ZoneAwareRouting {
+		candidate = lb.preferLocalZone(candidate)
+	}
+	if lb.zonePenalized() {
+		candidate = lb.preferZoneByLatency(candidate)
+	}
+	return candidate, dialSkipped
+}
+
+// selectionProbabilities estimates the share of a pool's requests each
+// backend gets under the current strategy, weights and candidate filters.
+// A backend in IDLE_POOL is counted against DEFAULT_POOL's requests. Hash
+// overrides aren't accounted for.
+func (lb *LoadBalancer) selectionProbabilities() map[*Backend]float64 {
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	
+	shares := make(map[*Backend]float64)
+	pools := make(map[string]bool)
+	for _, backend := range lb.backends {
+		if !lb.inIdlePool(backend) {
+			pools[backend.Config.Pool] = true
+		}
+	}
+	for pool := range pools {
+		candidate, _ := lb.candidateFilter(pool, "", nil)
+		for backend, share := range lb.poolShares(candidate) {
+			if backend.Config.Pool == pool || (lb.inIdlePool(backend) && pool == lb.cfg.DefaultPool) {
+				shares[backend] = share
+			}
+		}
+	}
+	return shares
+}
+
+// poolShares splits requests between the candidates the way the strategy
+// would. Caller must hold lb.mux.
+func (lb *LoadBalancer) poolShares(candidate func(*Backend) bool) map[*Backend]float64 {
+	shares := make(map[*Backend]float64)
+	switch lb.cfg.Strategy {
+	case "weighted_round_robin", "auto_latency":
+		total := 0.0
+		for _, backend := range lb.backends {
+			if candidate(backend) {
+				shares[backend] = backend.effectiveWeight()
+				total += shares[backend]
+			}
+		}
+		for backend := range shares {
+			if total > 0 {
+				shares[backend] /= total
+			}
+		}
+	case "consistent_hash_path", "consistent_hash_header":
+		// Each point owns the arc back to the previous point, and hands it to
+		// the first candidate at or after it, as hashRingBackend does.
+		n := len(lb.ring)
+		next := make([]*Backend, n)
+		var owner *Backend
+		for i := 2*n - 1; i >= 0; i-- {
+			if point := lb.ring[i%n]; candidate(point.backend) {
+				owner = point.backend
+			}
+			if i < n {
+				next[i] = owner
+			}
+		}
+		for i, backend := range next {
+			if backend == nil {
+				continue
+			}
+			if n == 1 {
+				shares[backend] = 1
+				continue
+			}
+			arc := lb.ring[i].hash - lb.ring[(i+n-1)%n].hash
+			shares[backend] += float64(arc) / math.MaxUint64
+		}
+	default:
+		count := 0
+		for _, backend := range lb.backends {
+			if candidate(backend) {
+				count++
+			}
+		}
+		for _, backend := range lb.backends {
+			if candidate(backend) {
+				shares[backend] = 1 / float64(count)
+			}
+		}
+	}
+	return shares
+}
+
+// skipReason explains why getNextBackend left b out, for debug headers only.
+// It mirrors the candidate filters but never feeds back into selection.
+// Caller must hold lb.mux.
+func (lb *LoadBalancer) skipReason(b *Backend, pool, path string) string {
+	switch {
+	case !b.inPool(pool) && !lb.inIdlePool(b):
+		return "pool " + b.Config.Pool
+	case lb.excludedForPath(b, path):
+		return "excluded for path"
+	case !b.IsAlive():
+		return "down"
+	case b.draining.Load():
+		return "draining"
+	case b.isEjected():
+		return "ejected"
+	case b.dialFailing(time.Now()):
+		return "recent dial failure"
+	case b.backingOff(time.Now()):
+		return "backing off"
+	case b.saturated():
+		return "over cap"
+	case lb.inIdlePool(b):
+		return "idle reserve"
+	case b.deepFailing.Load():
+		return "failing deep check"
+	case (lb.cfg.ZoneAwareRouting || lb.zonePenalized()) && b.Config.Zone != lb.cfg.LocalZone:
+		return "zone " + b.Config.Zone
+	}
+	return "filtered"
+}
+
+// excludedForPath reports whether exclude_backends_for_path keeps b from
+// serving path.
+func (lb *LoadBalancer) excludedForPath(b *Backend, path string) bool {
+	for prefix, backendURLs := range lb.cfg.ExcludeBackendsForPath {
+		if strings.HasPrefix(path, prefix) && slices.Contains(backendURLs, b.URL) {
+			return true
+		}
+	}
+	return false
+}
+
+func (lb *LoadBalancer) inIdlePool(b *Backend) bool {
+	return lb.cfg.IdlePool != "" && b.Config.Pool == lb.cfg.IdlePool
+}
+
+// overflowToIdlePool narrows candidate to the backends outside IdlePool with
+// room under MaxConcurrentRequests. When there are none it moves to the idle
+// pool instead, and when that has no available backend either, to every
+// candidate regardless of limits. Caller must hold lb.mux.
+func (lb *LoadBalancer) overflowToIdlePool(candidate func(*Backend) bool) func(*Backend) bool {
+	hasRoom, idleAvailable := false, false
+	for _, backend := range lb.backends {
+		if !candidate(backend) {
+			continue
+		}
+		if lb.inIdlePool(backend) {
+			idleAvailable = true
+		} else if !backend.saturated() {
+			hasRoom = true
+		}
+	}
+	
+	switch {
+	case hasRoom:
+		return func(b *Backend) bool {
+			return candidate(b) && !lb.inIdlePool(b) && !b.saturated()
+		}
+	case idleAvailable:
+		return func(b *Backend) bool {
+			return candidate(b) && lb.inIdlePool(b)
+		}
+	default:
+		return candidate
+	}
+}
+
+// skipDialFailures narrows candidate to backends without a recent dial
+// failure, so requests don't each wait out a connect timeout before health
+// checks catch up, and returns the backends it skipped. If every candidate
+// failed recently it is left unchanged. Caller must hold lb.mux.
+func (lb *LoadBalancer) skipDialFailures(candidate func(*Backend) bool) (func(*Backend) bool, []*Backend) {
+	now := time.Now()
+	var skipped []*Backend
+	remaining := 0
+	for _, backend := range lb.backends {
+		if !candidate(backend) {
+			continue
+		}
+		if backend.dialFailing(now) {
+			skipped = append(skipped, backend)
+		} else {
+			remaining++
+		}
+	}
+	if len(skipped) == 0 || remaining == 0 {
+		return candidate, nil
+	}
+	return func(b *Backend) bool {
+		return candidate(b) && !b.dialFailing(now)
+	}, skipped
+}
+
+// preferNotBackingOff narrows candidate to the backends that haven't asked
+// for a break with Retry-After, unless every one of them has. Caller must
+// hold lb.mux.
+func (lb *LoadBalancer) preferNotBackingOff(candidate func(*Backend) bool) func(*Backend) bool {
+	now := time.Now()
+	ready := func(b *Backend) bool {
+		return candidate(b) && !b.backingOff(now)
+	}
+	for _, backend := range lb.backends {
+		if ready(backend) {
+			return ready
+		}
+	}
+	return candidate
+}
+
+// avoidTried narrows candidate to the backends not in tried, unless that
+// leaves none. Caller must hold lb.mux.
+func (lb *LoadBalancer) avoidTried(candidate func(*Backend) bool, tried []*Backend) func(*Backend) bool {
+	untried := func(b *Backend) bool {
+		return candidate(b) && !slices.Contains(tried, b)
+	}
+	for _, backend := range lb.backends {
+		if untried(backend) {
+			return untried
+		}
+	}
+	return candidate
+}
+
+// preferDeepHealthy narrows candidate to the backends passing their deep
+// probe, unless none of them does.
+func (lb *LoadBalancer) preferDeepHealthy(candidate func(*Backend) bool) func(*Backend) bool {
+	healthy := func(b *Backend) bool {
+		return !b.deepFailing.Load() && candidate(b)
+	}
+	for _, backend := range lb.backends {
+		if healthy(backend) {
+			return healthy
+		}
+	}
+	return candidate
+}
+
+// preferLocalZone narrows candidate to backends in LB_ZONE, leaving it
+// unchanged when none of them can take the request so traffic fails over to
+// the other zones. Caller must hold lb.mux.
+func (lb *LoadBalancer) preferLocalZone(candidate func(*Backend) bool) func(*Backend) bool {
+	local := func(b *Backend) bool {
+		return b.Config.Zone == lb.cfg.LocalZone && candidate(b)
+	}
+	for _, backend := range lb.backends {
+		if local(backend) {
+			return local
+		}
+	}
+	return candidate
+}
+
+// zonePenalized reports whether auto_latency charges other zones extra.
+func (lb *LoadBalancer) zonePenalized() bool {
+	return lb.cfg.Strategy == "auto_latency" && lb.cfg.CrossZoneLatencyPenaltyMs > 0 && lb.cfg.LocalZone != ""
+}
+
+// zoneLatency is b's rolling average latency plus, outside LB_ZONE, the
+// cross-zone penalty. Unmeasured backends count as instant.
+func (lb *LoadBalancer) zoneLatency(b *Backend) time.Duration {
+	b.mux.RLock()
+	latency := b.avgLatency
+	b.mux.RUnlock()
+	if lb.zonePenalized() && b.Config.Zone != lb.cfg.LocalZone {
+		latency += time.Duration(lb.cfg.CrossZoneLatencyPenaltyMs) * time.Millisecond
+	}
+	return latency
+}
+
+// preferZoneByLatency narrows candidate to backends in LB_ZONE unless a
+// backend elsewhere is faster than all of them even with the cross-zone
+// penalty, in which case every candidate competes on its weight. With no
+// local candidate it is left unchanged. Caller must hold lb.mux.
+func (lb *LoadBalancer) preferZoneByLatency(candidate func(*Backend) bool) func(*Backend) bool {
+	local := func(b *Backend) bool {
+		return b.Config.Zone == lb.cfg.LocalZone && candidate(b)
+	}
+	bestLocal, bestRemote := time.Duration(-1), time.Duration(-1)
+	for _, backend := range lb.backends {
+		if !candidate(backend) {
+			continue
+		}
+		latency := lb.zoneLatency(backend)
+		if local(backend) {
+			if bestLocal < 0 || latency < bestLocal {
+				bestLocal = latency
+			}
+		} else if bestRemote < 0 || latency < bestRemote {
+			bestRemote = latency
+		}
+	}
+	if bestLocal >= 0 && (bestRemote < 0 || bestLocal <= bestRemote) {
+		return local
+	}
+	return candidate
+}
+
+// ringPoint is one of a backend's virtual nodes on the consistent hash ring.
+type ringPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+// hashRingReplicas is the number of virtual nodes per unit of weight; more
+// nodes spread keys more evenly between backends.
+const hashRingReplicas = 100
+
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// buildHashRing places every backend on the ring, weight times
+// hashRingReplicas points each. Points depend only on the backend URL, so
+// adding a backend moves only the keys its points take over, about 1/N of
+// them. Caller must hold lb.mux or own lb exclusively.
+func (lb *LoadBalancer) buildHashRing() {
+	if !strings.HasPrefix(lb.cfg.Strategy, "consistent_hash_") {
+		return
+	}
+	ring := make([]ringPoint, 0, len(lb.backends)*hashRingReplicas)
+	for _, backend := range lb.backends {
+		for i := 0; i < backend.weight()*hashRingReplicas; i++ {
+			ring = append(ring, ringPoint{hash: ringHash(backend.URL + "#" + strconv.Itoa(i)), backend: backend})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	lb.ring = ring
+}
+
+// hashRingBackend returns the backend owning key on the hash ring. If that
+// backend is not a candidate (down, draining, another pool...) the key moves
+// on to the next point's backend, so only the keys of unavailable backends
+// are remapped. Caller must hold lb.mux.
+func (lb *LoadBalancer) hashRingBackend(key string, candidate func(*Backend) bool) *Backend {
+	if len(lb.ring) == 0 {
+		return nil
+	}
+	h := ringHash(key)
+	start := sort.Search(len(lb.ring), func(i int) bool {
+		return lb.ring[i].hash >= h
+	})
+	for i := 0; i < len(lb.ring); i++ {
+		point := lb.ring[(start+i)%len(lb.ring)]
+		if candidate(point.backend) {
+			return point.backend
+		}
+	}
+	return nil
+}
+
+// stickyID is the backend's id in sticky session cookies.
+func (cfg BackendConfig) stickyID() string {
+	if cfg.BackendID != "" {
+		return cfg.BackendID
+	}
+	return cfg.URL
+}
+
+// stickyBackend returns the backend named by r's sticky session cookie, if
+// it can take the request. Caller must hold lb.mux.
+func (lb *LoadBalancer) stickyBackend(r *http.Request, candidate func(*Backend) bool) *Backend {
+	id, ok := stickyCookieID(r, lb.cfg.StickyCookieName)
+	if !ok {
+		return nil
+	}
+	for _, backend := range lb.backends {
+		if backend.Config.stickyID() == id && candidate(backend) {
+			return backend
+		}
+	}
+	return nil
+}
+
+func stickyCookieID(r *http.Request, name string) (string, bool) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+	id, err := url.QueryUnescape(cookie.Value)
+	return id, err == nil
+}
+
+// setStickyCookie pins the client to the backend that answered, unless its
+// cookie already does.
+func (lb *LoadBalancer) setStickyCookie(resp *http.Response, backend *Backend) {
+	id := backend.Config.stickyID()
+	if current, ok := stickyCookieID(resp.Request, lb.cfg.StickyCookieName); ok && current == id {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     lb.cfg.StickyCookieName,
+		Value:    url.QueryEscape(id),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
+
+// pinnedBackend returns the backend key is pinned to by a hash override, if
+// that backend can take the request. Caller must hold lb.mux.
+func (lb *LoadBalancer) pinnedBackend(key string, candidate func(*Backend) bool) *Backend {
+	backendURL, ok := lb.pinned[key]
+	if !ok {
+		return nil
+	}
+	for _, backend := range lb.backends {
+		if backend.URL == backendURL && candidate(backend) {
+			return backend
+		}
+	}
+	return nil
+}
+
+// nextWeightedBackend implements smooth weighted round-robin over the
+// candidate backends using their effective (slow-start adjusted) weights.
+// The total is recomputed over the candidates on every selection, so the
+// share of a draining, down or filtered backend goes to the others in
+// proportion to their weights. Caller must hold lb.mux.
+func (lb *LoadBalancer) nextWeightedBackend(candidate func(*Backend) bool) *Backend {
+	var best *Backend
+	total := 0.0
+	for _, backend := range lb.backends {
+		if !candidate(backend) {
+			// Don't let it return with credit or debt from before.
+			backend.currentWeight = 0
+			continue
+		}
+		w := backend.effectiveWeight()
+		backend.currentWeight += w
+		total += w
+		if best == nil || backend.currentWeight > best.currentWeight {
+			best = backend
+		}
+	}
+	
+	if best != nil {
+		best.currentWeight -= total
+	}
+	return best
+}
+
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lb.totalRequests.Add(1)
+	lb.inFlight.Add(1)
+	defer lb.inFlight.Add(-1)
+	
+	if overLimit, _ := r.Context().Value(connOverLimitKey).(bool); overLimit {
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Too many connections from your address", http.StatusTooManyRequests)
+		return
+	}
+	
+	if lb.cfg.MaxURLLength > 0 && len(r.RequestURI) > lb.cfg.MaxURLLength {
+		lb.writeError(w, nil, http.StatusRequestURITooLong, "URI too long")
+		return
+	}
+	
+	if lb.duplicates != nil {
+		if name := lb.normalizeDuplicateHeaders(r.Header); name != "" {
+			lb.writeError(w, nil, http.StatusBadRequest, "Duplicate "+name+" header")
+			return
+		}
+	}
+	
+	if lb.cfg.MetricsEnabled && r.URL.Path == lb.cfg.MetricsPath {
+		lb.handleMetrics(w, r)
+		return
+	}
+	
+	if lb.cfg.StatsEnabled && r.URL.Path == lb.cfg.StatsPath && r.Method == http.MethodGet {
+		lb.handleStats(w, r)
+		return
+	}
+	
+	if lb.admin != nil && strings.HasPrefix(r.URL.Path, "/admin/") && lb.adminEnabled(r) {
+		lb.serveAdmin(w, r)
+		return
+	}
+	
+	if lb.debugRequested(r) {
+		r = r.WithContext(context.WithValue(r.Context(), debugRequestKey, true))
+	}
+	
+	if lb.serveMaintenance(w) {
+		return
+	}
+	
+	if lb.rateLimits != nil && !lb.rateLimits.allow(w, clientIP(r.RemoteAddr)) {
+		lb.writeError(w, nil, http.StatusTooManyRequests, "Too many requests")
+		return
+	}
+	
+	if lb.cfg.MockEnabled && lb.serveMock(w, r) {
+		return
+	}
+	
+	if lb.cfg.UtilityPathsEnabled && lb.serveUtility(w, r) {
+		return
+	}
+	
+	if lb.cfg.ChaosEnabled && lb.injectChaos(w, r) {
+		return
+	}
+	
+	if lb.bodyRoutes {
+		r = lb.inspectBody(r)
+	}
+	
+	if lb.forwardAuth != nil && !lb.authorize(w, r) {
+		return
+	}
+	
+	if lb.limiter != nil {
+		if !lb.acquireSlot(w, r) {
+			return
+		}
+		defer lb.limiter.release()
+	}
+	
+	if c := lb.capture.Load(); c != nil && c.active.Load() {
+		c.record(r)
+	}
+	
+	if lb.requestTrace != nil {
+		// Settle the request ID now so cache hits, which never reach
+		// forward, carry the one the client sees.
+		r.Header.Set("X-Request-ID", requestID(r))
+		record := &requestTraceRecord{
+			TS:        time.Now(),
+			RequestID: r.Header.Get("X-Request-ID"),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			ClientIP:  clientIP(r.RemoteAddr),
+		}
+		r = r.WithContext(context.WithValue(r.Context(), requestTraceKey, record))
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		defer lb.requestTrace.finish(record, rec)
+	}
+	
+	if lb.idempotency != nil && r.Header.Get("Idempotency-Key") != "" {
+		if route := lb.matchRoute(r); route != nil && route.Idempotency {
+			lb.idempotency.serve(w, r, lb.forward)
+			return
+		}
+	}
+	
+	// Debug headers are for this client only, so never share its response.
+	if debug, _ := r.Context().Value(debugRequestKey).(bool); !debug && lb.coalescer != nil && lb.coalescer.eligible(r) {
+		lb.coalescer.serve(w, r, lb.forward)
+		return
+	}
+	
+	lb.forward(w, r)
+}
+
+// acquireSlot waits for a concurrency slot in r's priority class, writing
+// a 503 and returning false if the queue is full or the wait times out.
+func (lb *LoadBalancer) acquireSlot(w http.ResponseWriter, r *http.Request) bool {
+	class := priorityNormal
+	if lb.cfg.PriorityHeader != "" && slices.Contains(lb.cfg.PriorityHeaderValues, r.Header.Get(lb.cfg.PriorityHeader)) {
+		class = priorityHigh
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), lb.cfg.ConcurrencyQueueTimeout)
+	defer cancel()
+	
+	err := lb.limiter.acquire(ctx, class)
+	if err == nil {
+		return true
+	}
+	reason := "timeout"
+	if errors.Is(err, errQueueFull) {
+		reason = "queue_full"
+	}
+	lb.metrics.concurrencyRejections.inc(priorityClassNames[class], reason)
+	w.Header().Set("Retry-After", "1")
+	lb.writeError(w, nil, http.StatusServiceUnavailable, "Service busy - too many concurrent requests")
+	return false
+}
+
+type contextKey int
+
+const (
+	requestStateKey contextKey = iota
+	connOverLimitKey
+	listenerKey
+	debugRequestKey
+	bodyMatchKey
+	requestTraceKey
+)
+
+// debugRequested reports whether r asks for routing debug headers by sending
+// ADMIN_TOKEN in X-LB-Debug. The header is removed either way so it never
+// reaches a backend.
+func (lb *LoadBalancer) debugRequested(r *http.Request) bool {
+	token := r.Header.Get("X-LB-Debug")
+	if token == "" {
+		return false
+	}
+	r.Header.Del("X-LB-Debug")
+	if lb.cfg.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(lb.cfg.AdminToken)) != 1 {
+		log.Printf("[WARN] Ignoring X-LB-Debug with an invalid token: %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+		return false
+	}
+	return true
+}
+
+// requestState follows a request through backend selection, every proxy
+// attempt and the proxy's error handler.
+type requestState struct {
+	id          string
+	traceID     string   // from the client's W3C traceparent, if any
+	backend     *Backend // backend of the current attempt
+	start       time.Time
+	queueTime   time.Duration
+	attemptTime time.Duration
+	attempts    int
+	canRetry    bool
+	attemptErr  error
+	timeout     string // timeout class of attemptErr, if it was one
+	pool        string
+	route       *RouteConfig // first route matching the request, if any
+	strategy    string
+	candidates  int
+	fallback    bool // sent to the pool's fallback backend
+
+	// Set for requests carrying a valid X-LB-Debug token.
+	debug        bool
+	skipped      []string   // backends left out of the last selection, with the reason
+	attemptLog   []string   // failed attempts so far
+	tried        []*Backend // backends of the failed attempts, avoided by retries
+	attemptStart time.Time
+
+	// Origin the client addressed, before any rewriting for the backend.
+	clientScheme string
+	clientHost   string
+}
+
+// debugHeader explains the routing decision for the X-LB-Debug header.
+func (state *requestState) debugHeader(backend *Backend) string {
+	return fmt.Sprintf("strategy=%s; candidates=%d; backend=%s; attempt=%d; retry=%t",
+		state.strategy, state.candidates, backend.URL, state.attempts, state.attempts > 1)
+}
+
+// requestListener returns the listener r arrived on, if known.
+func requestListener(r *http.Request) *ListenerConfig {
+	listener, _ := r.Context().Value(listenerKey).(*ListenerConfig)
+	return listener
+}
+
+// setDebugHeaders describes the routing decision for the current attempt
+// on a debug request.
+func (state *requestState) setDebugHeaders(h http.Header, backend *Backend) {
+	route := "none"
+	if state.route != nil {
+		route = state.route.PathPattern
+	}
+	pool := state.pool
+	if pool == "" {
+		pool = "any"
+	}
+	skipped := "none"
+	if len(state.skipped) > 0 {
+		skipped = strings.Join(state.skipped, ", ")
+	}
+	attempts := append(slices.Clone(state.attemptLog), fmt.Sprintf("%d %s", state.attempts, backend.URL))
+	
+	h.Set("X-LB-Debug-Route", route)
+	h.Set("X-LB-Debug-Strategy", fmt.Sprintf("%s; pool=%s", state.strategy, pool))
+	h.Set("X-LB-Debug-Candidates", fmt.Sprintf("%d; selected=%s", state.candidates, backend.URL))
+	h.Set("X-LB-Debug-Skipped", skipped)
+	h.Set("X-LB-Debug-Attempts", strings.Join(attempts, ", "))
+}
+
+// debugTiming is the X-LB-Debug-Timing value once the current attempt has
+// ended, successfully or not.
+func (state *requestState) debugTiming() string {
+	return fmt.Sprintf("queue=%v; previous_attempts=%v; upstream=%v; total=%v",
+		state.queueTime, state.attemptTime, time.Since(state.attemptStart), time.Since(state.start))
+}
+
+func getRequestState(r *http.Request) *requestState {
+	state, _ := r.Context().Value(requestStateKey).(*requestState)
+	return state
+}
+
+// requestID reuses a sane client-supplied X-Request-ID so IDs line up with
+// upstream proxies, and generates one otherwise.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= 128 {
+		return id
+	}
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+// traceID extracts the trace ID from a W3C traceparent header
+// ("00-<trace-id>-<parent-id>-<flags>"), or returns "" if there is none.
+func traceID(traceparent string) string {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil || parts[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+	return parts[1]
+}
+
+// ErrorResponse is the body of errors generated by the load balancer itself
+// when ERROR_RESPONSE_JSON is set.
+type ErrorResponse struct {
+	Error     string `json:"error"`
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id,omitempty"`
+	TraceID   string `json:"trace_id,omitempty"`
+}
+
+// writeError answers with an error the load balancer generated, carrying
+// the request and trace IDs so clients can quote them when reporting it.
+func (lb *LoadBalancer) writeError(w http.ResponseWriter, state *requestState, status int, message string) {
+	resp := ErrorResponse{Error: message, Status: status}
+	if state != nil {
+		resp.RequestID = state.id
+		resp.TraceID = state.traceID
+		w.Header().Set("X-Request-ID", state.id)
+		if state.traceID != "" {
+			w.Header().Set("X-Trace-ID", state.traceID)
+		}
+		if state.debug && !state.attemptStart.IsZero() {
+			w.Header().Set("X-LB-Debug-Timing", state.debugTiming())
+		}
+	}
+	
+	if !lb.cfg.ErrorResponseJSON {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, resp)
+}
+
+// logRequest logs with the request ID, attempt number and backend so lines
+// from retried attempts can be told apart, and keeps the line in the debug
+// trace served by GET /admin/requests/{request_id}.
+func (lb *LoadBalancer) logRequest(state *requestState, level, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	if state == nil {
+		log.Printf("[%s] %s\n", level, message)
+		return
+	}
+	
+	event := TraceEvent{Time: time.Now(), RequestID: state.id, Attempt: state.attempts, Level: level, Message: message}
+	backendID := "-"
+	if state.backend != nil {
+		backendID = state.backend.URL
+		event.Backend = state.backend.URL
+	}
+	log.Printf("[%s] [request_id=%s attempt=%d backend=%s] %s\n", level, state.id, state.attempts, backendID, message)
+	lb.recordTrace(event)
+}
+
+func (lb *LoadBalancer) forward(w http.ResponseWriter, r *http.Request) {
+	state := &requestState{id: requestID(r), start: time.Now(), pool: lb.choosePool(r), clientScheme: "http", clientHost: r.Host}
+	state.debug, _ = r.Context().Value(debugRequestKey).(bool)
+	if r.TLS != nil {
+		state.clientScheme = "https"
+	}
+	r.Header.Set("X-Request-ID", state.id)
+	w.Header().Set("X-Request-ID", state.id)
+	if record, _ := r.Context().Value(requestTraceKey).(*requestTraceRecord); record != nil {
+		record.state = state
+	}
+	state.traceID = traceID(r.Header.Get("Traceparent"))
+	state.route = lb.matchRoute(r)
+	ctx := context.WithValue(r.Context(), requestStateKey, state)
+	if lb.cfg.TotalRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lb.cfg.TotalRequestTimeout)
+		defer cancel()
+	}
+	r = r.WithContext(ctx)
+	
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	
+	// Only requests without a body can be replayed against another backend.
+	retryable := r.ContentLength == 0 && r.Header.Get("Upgrade") == ""
+	
+	body := &countingBody{}
+	if r.Body != nil && r.Body != http.NoBody {
+		body.ReadCloser = r.Body
+		r.Body = body
+	}
+	
+	if lb.retries != nil {
+		lb.retries.requests.Add(1)
+	}
+	
+	var selectedBackend *Backend
+	defer func() {
+		// Also covers aborted requests, counting whatever was read. The
+		// last attempt's backend is used, as a retry may have found none.
+		if state.attempts > 0 {
+			lb.metrics.requestSize.observe(float64(body.n.Load()), state.backend.URL)
+		}
+	}()
+	for {
+		selectedBackend = lb.getNextBackend(r)
+		if state.attempts == 0 {
+			state.queueTime = time.Since(state.start)
+		}
+		
+		if selectedBackend == nil && !state.fallback {
+			if selectedBackend = lb.fallbackBackend(state.pool); selectedBackend != nil {
+				state.fallback = true
+				lb.metrics.fallbackResponses.inc(state.pool)
+				lb.logRequest(state, "WARN", "No backend available in pool %s, using its fallback", state.pool)
+				w.Header().Set("X-Served-By", "fallback")
+			}
+		}
+		if selectedBackend == nil && state.attemptErr != nil {
+			// The backends left were taken out while the failed attempt
+			// ran, so report its error rather than an outage.
+			lb.logRequest(state, "ERROR", "No backend left to retry %s %s on", r.Method, r.URL.Path)
+			lb.writeAttemptError(w, state, state.backend, state.attemptErr, state.timeout)
+			return
+		}
+		if selectedBackend == nil {
+			lb.logRequest(state, "ERROR", "All backends are down - Request: %s %s", r.Method, r.URL.Path)
+			lb.writeError(w, state, http.StatusServiceUnavailable, "Service unavailable - all backends are down")
+			return
+		}
+		if ctx.Err() != nil {
+			lb.totalTimeoutExceeded(w, r, state)
+			return
+		}
+		
+		state.attempts++
+		state.backend = selectedBackend
+		state.canRetry = retryable && state.attempts <= lb.cfg.MaxRetries
+		budgetDenied := state.canRetry && lb.retries != nil && !lb.retries.permits()
+		state.canRetry = state.canRetry && !budgetDenied
+		state.attemptErr = nil
+		state.timeout = ""
+		
+		lb.logRequest(state, "INFO", "Forwarding request to %s - Path: %s %s", selectedBackend.URL, r.Method, r.URL.Path)
+		if lb.cfg.DebugHeader || state.debug {
+			w.Header().Set("X-LB-Debug", state.debugHeader(selectedBackend))
+		}
+		if state.debug {
+			state.setDebugHeaders(w.Header(), selectedBackend)
+		}
+		
+		state.attemptStart = time.Now()
+		lb.proxyAttempt(w, r, selectedBackend)
+		attemptDuration := time.Since(state.attemptStart)
+		state.attemptTime += attemptDuration
+		lb.recordLatency(selectedBackend, attemptDuration)
+		
+		if state.attemptErr != nil && budgetDenied {
+			lb.metrics.retryBudgetExhausted.inc(selectedBackend.URL)
+		}
+		if state.attemptErr == nil || !state.canRetry {
+			break
+		}
+		if ctx.Err() != nil {
+			lb.totalTimeoutExceeded(w, r, state)
+			return
+		}
+		lb.logRequest(state, "WARN", "Attempt to %s failed: %v - retrying", selectedBackend.URL, state.attemptErr)
+		state.attemptLog = append(state.attemptLog, fmt.Sprintf("%d %s failed after %v: %v", state.attempts, selectedBackend.URL, attemptDuration, state.attemptErr))
+		if !slices.Contains(state.tried, selectedBackend) {
+			state.tried = append(state.tried, selectedBackend)
+		}
+		if lb.retries != nil {
+			lb.retries.retries.Add(1)
+		}
+	}
+	
+	duration := time.Since(state.start)
+	lb.recordPoolRequest(selectedBackend.Config.Pool, rec.status, duration)
+	lb.metrics.responseSize.observe(float64(rec.bytes), selectedBackend.URL)
+	lb.logRequest(state, "INFO", "Request completed: %s %s %d %d bytes in %v (queue: %v, attempts: %d, attempt time: %v)",
+		r.Method, r.URL.Path, rec.status, rec.bytes, duration, state.queueTime, state.attempts, state.attemptTime)
+	if lb.cfg.SlowRequestThreshold > 0 && duration > lb.cfg.SlowRequestThreshold {
+		lb.logRequest(state, "WARN", "Slow request: %s %s to %s returned %d in %v, over the %v threshold (queue: %v, attempts: %d)",
+			r.Method, r.URL.Path, selectedBackend.URL, rec.status, duration, lb.cfg.SlowRequestThreshold, state.queueTime, state.attempts)
+	}
+}
+
+// retryBudgetWindow is how long retry budget counts last before starting
+// over.
+const retryBudgetWindow = 10 * time.Second
+
+// retryBudgetMinRetries are always allowed per window, so retries still
+// work when there is too little traffic for a percentage to mean much.
+const retryBudgetMinRetries = 10
+
+// retryBudget caps retries at a percentage of requests, so a failing fleet
+// isn't sent a retry on top of every request. Once a window goes over
+// budget, retries stay off until the next one, even if the ratio recovers.
+type retryBudget struct {
+	percent   float64
+	events    *eventBus
+	requests  atomic.Int64
+	retries   atomic.Int64
+	exhausted atomic.Bool
+}
+
+// permits reports whether a failed attempt may be retried now. Concurrent
+// callers can overshoot the budget by a few retries.
+func (b *retryBudget) permits() bool {
+	if b.exhausted.Load() {
+		return false
+	}
+	retries := b.retries.Load()
+	if retries < retryBudgetMinRetries || float64(retries) < float64(b.requests.Load())*b.percent/100 {
+		return true
+	}
+	if b.exhausted.CompareAndSwap(false, true) {
+		log.Printf("[WARN] Retry budget exhausted (%d retries for %d requests), not retrying until the window ends\n",
+			retries, b.requests.Load())
+		b.events.publish("retry_budget_exhausted", map[string]any{"retries": retries, "requests": b.requests.Load()})
+	}
+	return false
+}
+
+func (b *retryBudget) run() {
+	for range time.Tick(retryBudgetWindow) {
+		b.reset()
+	}
+}
+
+// reset starts a new window, turning retries back on if the last one ran
+// out of budget.
+func (b *retryBudget) reset() {
+	b.requests.Store(0)
+	b.retries.Store(0)
+	if b.exhausted.Swap(false) {
+		log.Println("[INFO] Retry budget restored")
+		b.events.publish("retry_budget_restored", map[string]any{})
+	}
+}
+
+// countingBody counts the request body bytes the proxy reads, passing them
+// through unchanged. The transport may still be reading when the response
+// comes back, hence the atomic.
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (body *countingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.n.Add(int64(n))
+	return n, err
+}
+
+// statusRecorder remembers the final status code written to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 && status >= 200 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// bandwidthLimit returns the per-response limit for r on backend: its route's
+// if set, otherwise the backend's.
+func (lb *LoadBalancer) bandwidthLimit(r *http.Request, backend *Backend) (int64, int64) {
+	if state := getRequestState(r); state != nil && state.route != nil && state.route.BandwidthLimit > 0 {
+		return state.route.BandwidthLimit, state.route.BandwidthBurst
+	}
+	return backend.Config.BandwidthLimit, backend.Config.BandwidthBurst
+}
+
+func (lb *LoadBalancer) throttle(w http.ResponseWriter, r *http.Request, backend *Backend, limit, burst int64) *throttledWriter {
+	tw := &throttledWriter{
+		ResponseWriter: w,
+		ctx:            r.Context(),
+		buckets:        []*tokenBucket{newTokenBucket(limit, burst)},
+		onWrite: func(n int) {
+			lb.metrics.throttledBytes.add(float64(n), backend.URL)
+		},
+	}
+	if lb.bandwidth != nil {
+		tw.buckets = append(tw.buckets, lb.bandwidth)
+	}
+	tw.chunk = 16 << 10
+	for _, bucket := range tw.buckets {
+		tw.chunk = min(tw.chunk, int(bucket.burst))
+	}
+	tw.chunk = max(tw.chunk, 1)
+	return tw
+}
+
+// tokenBucket allows rate bytes per second on average, in bursts of up to
+// burst bytes.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+	
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int64) *tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes n tokens, going into debt if there aren't enough, and
+// returns how long the caller must wait before sending. Debt makes
+// concurrent callers queue up fairly behind one another.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// take takes one token if there is one, without going into debt as reserve
+// does. It returns the tokens left and, when none was available, how long
+// until one is.
+func (b *tokenBucket) take() (bool, float64, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, b.tokens, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, b.tokens, 0
+}
+
+// full reports whether the bucket has refilled completely by now.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// throttledWriter paces a response through token buckets, writing at most
+// chunk bytes at a time once every bucket allows it.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	buckets []*tokenBucket
+	chunk   int
+	onWrite func(n int)
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), tw.chunk)
+		var wait time.Duration
+		for _, bucket := range tw.buckets {
+			wait = max(wait, bucket.reserve(n))
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-tw.ctx.Done():
+				timer.Stop()
+				return written, tw.ctx.Err()
+			}
+		}
+		
+		m, err := tw.ResponseWriter.Write(p[:n])
+		written += m
+		tw.onWrite(m)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// choosePool splits traffic between the default (stable) pool and the canary
+// pool according to CANARY_WEIGHT, falling back to the default pool when no
+// canary backend is alive. Listeners with a pool of their own always use it.
+func (lb *LoadBalancer) choosePool(r *http.Request) string {
+	if pool, ok := lb.routedPool(r); ok {
+		return pool
+	}
+	
+	weight := lb.getCanaryWeight()
+	if weight <= 0 || rand.Float64()*100 >= weight {
+		return lb.cfg.DefaultPool
+	}
+	if lb.poolAvailable(lb.cfg.CanaryPool) {
+		return lb.cfg.CanaryPool
+	}
+	return lb.cfg.DefaultPool
+}
+
+// routedPool returns the pool r's listener, route or feature flag sends it
+// to, if any.
+func (lb *LoadBalancer) routedPool(r *http.Request) (string, bool) {
+	if listener := requestListener(r); listener != nil && listener.DefaultPool != "" {
+		return listener.DefaultPool, true
+	}
+	if route := lb.matchRoute(r); route != nil && route.FeatureFlag != "" {
+		return lb.featureFlagPool(r, route), true
+	} else if route != nil && route.Pool != "" {
+		return route.Pool, true
+	}
+	return "", false
+}
+
+func (lb *LoadBalancer) poolAvailable(pool string) bool {
+	for _, backend := range lb.getBackends() {
+		if backend.inPool(pool) && backend.available() {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRoute returns the first route whose pattern matches r's path and,
+// for routes with a body_match, whose body matched in inspectBody.
+func (lb *LoadBalancer) matchRoute(r *http.Request) *RouteConfig {
+	for i := range lb.cfg.Routes {
+		route := &lb.cfg.Routes[i]
+		if route.BodyMatch != nil {
+			if matched, _ := r.Context().Value(bodyMatchKey).([]bool); matched == nil || !matched[i] {
+				continue
+			}
+		}
+		if matchPathPattern(route.PathPattern, r.URL.Path) {
+			return route
+		}
+	}
+	return nil
+}
+
+// inspectBody evaluates the body_match routes for r's path, buffering the
+// body once up to the largest of their limits, and records which matched
+// for matchRoute.
+func (lb *LoadBalancer) inspectBody(r *http.Request) *http.Request {
+	var limit int64
+	for i := range lb.cfg.Routes {
+		route := &lb.cfg.Routes[i]
+		if route.BodyMatch != nil && matchPathPattern(route.PathPattern, r.URL.Path) {
+			limit = max(limit, route.BodyMatch.maxBytes())
+		}
+	}
+	if limit == 0 {
+		return r
+	}
+	
+	matched := make([]bool, len(lb.cfg.Routes))
+	if body, ok := peekBody(r, limit); ok {
+		for i := range lb.cfg.Routes {
+			route := &lb.cfg.Routes[i]
+			matched[i] = route.BodyMatch != nil && matchPathPattern(route.PathPattern, r.URL.Path) &&
+				int64(len(body)) <= route.BodyMatch.maxBytes() && route.BodyMatch.matches(body)
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), bodyMatchKey, matched))
+}
+
+// peekBody reads up to limit bytes of r's body and puts them back in front
+// of the rest for the proxy. It reports false when the body is longer than
+// limit, without reading anything if the declared length already says so.
+func peekBody(r *http.Request, limit int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > limit {
+		return nil, false
+	}
+	
+	body := r.Body
+	data, _ := io.ReadAll(io.LimitReader(body, limit+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), body), body}
+	return data, int64(len(data)) <= limit
+}
+
+// featureFlagPool evaluates the route's flag for the requesting user. Without
+// a provider, a user ID or a live backend in the flag's pool, requests stay
+// on the default pool.
+func (lb *LoadBalancer) featureFlagPool(r *http.Request, route *RouteConfig) string {
+	if lb.cfg.FeatureFlagProvider == nil {
+		return lb.cfg.DefaultPool
+	}
+	userID := lb.requestUserID(r)
+	if userID == "" || !lb.cfg.FeatureFlagProvider(route.FeatureFlag, userID) {
+		return lb.cfg.DefaultPool
+	}
+	if !lb.poolAvailable(route.FeatureFlagPool) {
+		log.Printf("[WARN] Feature flag %s is on for %s but pool %s has no available backends\n",
+			route.FeatureFlag, userID, route.FeatureFlagPool)
+		return lb.cfg.DefaultPool
+	}
+	return route.FeatureFlagPool
+}
+
+// requestUserID identifies the user for feature flags from the configured
+// claim of a bearer JWT, falling back to X-User-ID. Without JWT_SECRET the
+// token's signature is not verified: the ID only picks a pool, and backends
+// still authenticate. With it, tokens not signed with it are ignored.
+func (lb *LoadBalancer) requestUserID(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && (lb.cfg.JWTSecret == "" || jwtSignedWith(token, lb.cfg.JWTSecret)) {
+		if userID := jwtClaim(token, lb.cfg.FeatureFlagUserClaim); userID != "" {
+			return userID
+		}
+	}
+	return r.Header.Get("X-User-ID")
+}
+
+// jwtSignedWith reports whether token is an HS256 JWT signed with secret.
+func jwtSignedWith(token, secret string) bool {
+	dot := strings.LastIndex(token, ".")
+	if dot < 0 {
+		return false
+	}
+	header, _, _ := strings.Cut(token, ".")
+	headerJSON, err := base64.RawURLEncoding.DecodeString(header)
+	if err != nil {
+		return false
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if json.Unmarshal(headerJSON, &h) != nil || h.Alg != "HS256" {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[dot+1:])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(token[:dot]))
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+func jwtClaim(token, claim string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	switch value := claims[claim].(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+// proxyAttempt sends a single attempt to backend, bounded by the backend's
+// timeout for the request method or else BACKEND_TIMEOUT. The total request
+// deadline, if any, is already on r's context.
+func (lb *LoadBalancer) proxyAttempt(w http.ResponseWriter, r *http.Request, backend *Backend) {
+	// The backend's headers replace any a client limit set.
+	if backend.rateLimit != nil && !backend.rateLimit.allow(w, backend.URL) {
+		state := getRequestState(r)
+		lb.logRequest(state, "WARN", "Backend %s over its rate limit, rejecting request", backend.URL)
+		lb.writeError(w, state, http.StatusTooManyRequests, "Too many requests")
+		return
+	}
+	if backend.Config.MaxQueueLength > 0 {
+		if !lb.waitForBackendSlot(w, r, backend) {
+			return
+		}
+		defer backend.releaseSlot()
+	} else {
+		backend.active.Add(1)
+		defer backend.active.Add(-1)
+	}
+	if limit, burst := lb.bandwidthLimit(r, backend); limit > 0 {
+		w = lb.throttle(w, r, backend, limit, burst)
+	}
+	if timeout := lb.attemptTimeout(backend, r.Method); timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	ctx, abort := context.WithCancelCause(r.Context())
+	defer abort(nil)
+	r = r.WithContext(ctx)
+	defer backend.trackAttempt(r, abort)()
+	backend.requests.Add(1)
+	if lb.transcoder != nil {
+		if rule, _ := lb.transcoder.match(r); rule != nil {
+			lb.ServeGRPCTranscode(w, r, backend)
+			return
+		}
+	}
+	backend.Proxy.ServeHTTP(w, r)
+}
+
+// waitForBackendSlot queues r for a slot on backend, writing a 503 and
+// returning false if the queue is full or the wait exceeds the backend's
+// QueueTimeout. The wait counts as queue time rather than as the attempt's,
+// so it doesn't read as backend latency.
+func (lb *LoadBalancer) waitForBackendSlot(w http.ResponseWriter, r *http.Request, backend *Backend) bool {
+	state := getRequestState(r)
+	ctx, cancel := context.WithTimeout(r.Context(), backend.Config.QueueTimeout)
+	defer cancel()
+	
+	start := time.Now()
+	err := backend.acquireSlot(ctx)
+	if state != nil {
+		state.queueTime += time.Since(start)
+		state.attemptStart = time.Now()
+	}
+	if err == nil {
+		return true
+	}
+	reason := "timeout"
+	if errors.Is(err, errBackendQueueFull) {
+		reason = "queue_full"
+	}
+	lb.metrics.backendQueueRejections.inc(backend.URL, reason)
+	lb.logRequest(state, "WARN", "Backend %s at capacity, rejecting request (%s)", backend.URL, reason)
+	w.Header().Set("Retry-After", "1")
+	lb.writeError(w, state, http.StatusServiceUnavailable, "Service busy - backend at capacity")
+	return false
+}
+
+func (lb *LoadBalancer) attemptTimeout(backend *Backend, method string) time.Duration {
+	for m, timeout := range backend.Config.MethodTimeouts {
+		if strings.EqualFold(m, method) {
+			return timeout
+		}
+	}
+	return lb.cfg.BackendTimeout
+}
+
+func (lb *LoadBalancer) totalTimeoutExceeded(w http.ResponseWriter, r *http.Request, state *requestState) {
+	lb.logRequest(state, "ERROR", "Total request timeout (%v) exceeded - Request: %s %s (queue: %v, attempts: %d, attempt time: %v)",
+		lb.cfg.TotalRequestTimeout, r.Method, r.URL.Path, state.queueTime, state.attempts, state.attemptTime)
+	lb.writeError(w, state, http.StatusGatewayTimeout, "Gateway timeout")
+}
+
+// proxyErrorHandler records the failure so forward can retry it on another
+// backend, or writes the error response once no retries are left.
+func (lb *LoadBalancer) proxyErrorHandler(backend *Backend) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		state := getRequestState(r)
+		class := timeoutClass(r.Context(), err)
+		if class != "" {
+			lb.metrics.backendTimeouts.inc(backend.URL, class)
+		}
+		if lb.cfg.DialFailureCacheTTL > 0 && isDialError(err) {
+			backend.markDialFailure(lb.cfg.DialFailureCacheTTL)
+			lb.logRequest(state, "WARN", "Dial to %s failed, skipping it for %v", backend.URL, lb.cfg.DialFailureCacheTTL)
+		}
+		if cause := context.Cause(r.Context()); errors.Is(cause, errAttemptAborted) {
+			err = cause
+		}
+		if isHeaderLimitError(err) {
+			err = fmt.Errorf("%w: %v", errResponseHeadersTooLarge, err)
+		}
+		if state != nil {
+			state.attemptErr = err
+			state.timeout = class
+			if state.canRetry && !errors.Is(err, errResponseTooLarge) && !errors.Is(err, errResponseHeadersTooLarge) && !errors.Is(err, errHTTP10BodyTooLarge) {
+				return
+			}
+			state.canRetry = false
+		}
+		lb.writeAttemptError(w, state, backend, err, class)
+	}
+}
+
+// writeAttemptError answers with the error of a failed attempt to backend:
+// 504 if it timed out, with class naming the timeout, 413 if the request
+// body was too large to buffer for an HTTP/1.0 backend, and 502 otherwise.
+func (lb *LoadBalancer) writeAttemptError(w http.ResponseWriter, state *requestState, backend *Backend, err error, class string) {
+	if class != "" {
+		lb.logRequest(state, "ERROR", "Request to %s timed out (%s timeout): %v", backend.URL, class, err)
+		lb.writeError(w, state, http.StatusGatewayTimeout, "Gateway timeout")
+		return
+	}
+	lb.logRequest(state, "ERROR", "Proxy error for %s: %v", backend.URL, err)
+	if errors.Is(err, errHTTP10BodyTooLarge) {
+		lb.writeError(w, state, http.StatusRequestEntityTooLarge, "Request body too large")
+		return
+	}
+	lb.writeError(w, state, http.StatusBadGateway, "Bad gateway")
+}
+
+var errResponseTooLarge = errors.New("response body exceeds MAX_RESPONSE_BODY_BYTES")
+
+// defaultDuplicateHeaderPolicies resolve repeated request headers unless
+// duplicate_header_policies says otherwise. List-valued headers are merged,
+// which RFC 9110 section 5.3 makes equivalent; headers naming one value are
+// rejected, since backends disagree on which copy counts.
+var defaultDuplicateHeaderPolicies = map[string]string{
+	"X-Forwarded-For":     "merge",
+	"Forwarded":           "merge",
+	"Via":                 "merge",
+	"Accept":              "merge",
+	"Accept-Encoding":     "merge",
+	"Accept-Language":     "merge",
+	"Cache-Control":       "merge",
+	"Content-Type":        "reject",
+	"Authorization":       "reject",
+	"Proxy-Authorization": "reject",
+	"X-Forwarded-Host":    "reject",
+	"X-Forwarded-Proto":   "reject",
+	"X-Request-Id":        "reject",
+}
+
+// forcedDuplicateHeaderPolicies can't be overridden: a request carrying two
+// of these can be framed or routed two ways. net/http itself refuses
+// duplicate Host headers and differing Content-Lengths, and folds identical
+// Content-Lengths into one, so these only catch what it lets through.
+var forcedDuplicateHeaderPolicies = map[string]string{
+	"Content-Length": "reject",
+	"Host":           "reject",
+}
+
+// duplicateHeaderPolicies merges the configured policies over the defaults,
+// keyed by canonical header name.
+func duplicateHeaderPolicies(configured map[string]string) map[string]string {
+	policies := maps.Clone(defaultDuplicateHeaderPolicies)
+	for name, policy := range configured {
+		policies[http.CanonicalHeaderKey(name)] = policy
+	}
+	maps.Copy(policies, forcedDuplicateHeaderPolicies)
+	return policies
+}
+
+// normalizeDuplicateHeaders applies the duplicate header policies to h in
+// place. It returns the name of the first header that must be rejected,
+// leaving h partly normalized, or "" if there is none.
+func (lb *LoadBalancer) normalizeDuplicateHeaders(h http.Header) string {
+	for name, values := range h {
+		if len(values) < 2 {
+			continue
+		}
+		policy, ok := lb.duplicates[name]
+		if !ok {
+			continue
+		}
+		lb.metrics.duplicateHeaders.inc(name, policy)
+		switch policy {
+		case "merge":
+			h[name] = []string{strings.Join(values, ", ")}
+		case "first":
+			h[name] = values[:1]
+		case "last":
+			h[name] = values[len(values)-1:]
+		case "reject":
+			return name
+		}
+	}
+	return ""
+}
+
+// hopByHopHeaders are the connection-specific headers of RFC 7230 section
+// 6.1, plus the non-standard Proxy-Connection.
+var hopByHopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// stripHopByHopHeaders removes the hop-by-hop headers from h, including any
+// listed in its Connection header. httputil.ReverseProxy does the same to
+// backend responses before ModifyResponse runs; repeating it here keeps the
+// guarantee from resting on the proxy's internals. Neither can help when the
+// Connection header also says "close": net/http's response reader drops
+// the header outright, so the names listed alongside it are lost.
+func stripHopByHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+var errResponseHeadersTooLarge = errors.New("response headers exceed MAX_RESPONSE_HEADER_BYTES")
+
+// headerBytes approximates the size of h on the wire, one "Name: value\r\n"
+// line per value.
+func headerBytes(h http.Header) int64 {
+	var n int64
+	for name, values := range h {
+		for _, value := range values {
+			n += int64(len(name) + len(value) + 4)
+		}
+	}
+	return n
+}
+
+var errBodyIdleTimeout = errors.New("backend sent no response body bytes within body_idle_timeout")
+
+// timeoutClass names the timeout behind a failed attempt: "attempt" for
+// BACKEND_TIMEOUT and the total request deadline, "dial", "tls_handshake",
+// "response_header" or "body_idle". It is empty when err isn't a timeout.
+// ctx is the attempt's context.
+func timeoutClass(ctx context.Context, err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errBodyIdleTimeout):
+		return "body_idle"
+	// net/http doesn't export these two errors, and wraps
+	// context.DeadlineExceeded in the second.
+	case strings.Contains(err.Error(), "TLS handshake timeout"):
+		return "tls_handshake"
+	case strings.Contains(err.Error(), "timeout awaiting response headers"):
+		return "response_header"
+	// A deadline hit while dialing also surfaces as a dial timeout, so
+	// check the context first.
+	case errors.Is(ctx.Err(), context.DeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return "attempt"
+	case isDialError(err) && errors.As(err, &netErr) && netErr.Timeout():
+		return "dial"
+	}
+	return ""
+}
+
+// idleTimeoutBody fails a response body when a read waits longer than
+// timeout for the backend, since net/http has no read deadline for
+// response bodies. Only time spent inside Read counts, so a slow client
+// doesn't trip it. On timeout the underlying body is closed, which unblocks
+// the pending read.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, onTimeout func()) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, timeout: timeout}
+	b.timer = time.AfterFunc(timeout, func() {
+		if b.timedOut.CompareAndSwap(false, true) {
+			onTimeout()
+			body.Close()
+		}
+	})
+	b.timer.Stop()
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	if b.timedOut.Load() {
+		return 0, errBodyIdleTimeout
+	}
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if b.timedOut.Load() {
+		return n, errBodyIdleTimeout
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
+
+// isDialError reports whether err happened while connecting to the backend,
+// i.e. before any of the request was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isHeaderLimitError reports whether the transport gave up on a response
+// for going over its MaxResponseHeaderBytes. net/http has no sentinel for
+// this, so the message is matched; the same backend would send the same
+// headers again, so the attempt mustn't be retried.
+func isHeaderLimitError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "server response headers exceeded")
+}
+
+// modifyResponse post-processes backend responses before they are copied to
+// the client. Returning an error hands the request to the error handler.
+func (lb *LoadBalancer) modifyResponse(backend *Backend) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		// 101 responses need Connection and Upgrade for the protocol switch.
+		if lb.cfg.StripHopByHopHeaders && resp.StatusCode != http.StatusSwitchingProtocols {
+			stripHopByHopHeaders(resp.Header)
+		}
+		// The transport's limit counts differently and a custom
+		// BackendRoundTripperFactory may not have one, so check here too.
+		if limit := backend.Config.MaxResponseHeaderBytes; limit > 0 {
+			if size := headerBytes(resp.Header) + headerBytes(resp.Trailer); size > limit {
+				lb.logRequest(getRequestState(resp.Request), "WARN", "Rejecting response from %s for %s with %d bytes of headers (limit %d)",
+					backend.URL, resp.Request.URL.Path, size, limit)
+				return errResponseHeadersTooLarge
+			}
+		}
+		if lb.rateLimits != nil || backend.rateLimit != nil {
+			// Ours are already on the response writer, and the proxy
+			// would add the backend's alongside rather than replace them.
+			for _, name := range rateLimitHeaders {
+				resp.Header.Del(name)
+			}
+		}
+		if state := getRequestState(resp.Request); state != nil && state.debug {
+			// Time to response headers; the body is still to come.
+			resp.Header.Set("X-LB-Debug-Timing", state.debugTiming())
+		}
+		if lb.cfg.RewriteLocationHeaders && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+			lb.rewriteLocationHeader(resp, backend)
+		}
+		if lb.cfg.StickySessions && resp.StatusCode != http.StatusSwitchingProtocols {
+			lb.setStickyCookie(resp, backend)
+		}
+		if lb.cfg.ViaHeaderEnabled {
+			via := append(resp.Header.Values("Via"), lb.cfg.ViaHeaderVersion+" "+lb.cfg.ViaHeaderValue)
+			resp.Header.Set("Via", strings.Join(via, ", "))
+		}
+		if lb.cfg.RetryAfterMaxBackoff > 0 && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+			lb.honorRetryAfter(resp, backend)
+		}
+		if lb.replacesErrorBody(getRequestState(resp.Request), resp.StatusCode) {
+			lb.replaceErrorBody(resp, backend)
+		}
+		
+		if timeout := backend.Config.BodyIdleTimeout; timeout > 0 && resp.StatusCode != http.StatusSwitchingProtocols {
+			resp.Body = newIdleTimeoutBody(resp.Body, timeout, func() {
+				lb.metrics.backendTimeouts.inc(backend.URL, "body_idle")
+				lb.logRequest(getRequestState(resp.Request), "ERROR", "Request to %s timed out (body_idle timeout): no response body bytes for %v, aborting %s",
+					backend.URL, timeout, resp.Request.URL.Path)
+			})
+		}
+		if lb.cfg.MaxResponseBodyBytes > 0 && !lb.responseLimitExempt(resp) {
+			if resp.ContentLength > lb.cfg.MaxResponseBodyBytes {
+				lb.oversizedResponses.Add(1)
+				lb.logRequest(getRequestState(resp.Request), "WARN", "Rejecting %d byte response from %s for %s (limit %d)",
+					resp.ContentLength, backend.URL, resp.Request.URL.Path, lb.cfg.MaxResponseBodyBytes)
+				return errResponseTooLarge
+			}
+			resp.Body = &limitedBody{
+				ReadCloser: resp.Body,
+				remaining:  lb.cfg.MaxResponseBodyBytes,
+				onExceeded: func() {
+					lb.oversizedResponses.Add(1)
+					lb.logRequest(getRequestState(resp.Request), "WARN", "Cutting response from %s for %s at %d bytes",
+						backend.URL, resp.Request.URL.Path, lb.cfg.MaxResponseBodyBytes)
+				},
+			}
+		}
+		return nil
+	}
+}
+
+// honorRetryAfter passes the backend over for as long as the Retry-After of
+// its 429 or 503 response asks, up to RetryAfterMaxBackoff. The header
+// itself goes on to the client unchanged.
+func (lb *LoadBalancer) honorRetryAfter(resp *http.Response, backend *Backend) {
+	d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok || d <= 0 {
+		return
+	}
+	d = min(d, lb.cfg.RetryAfterMaxBackoff)
+	if backend.backOff(d) {
+		lb.events.publish("backend_backoff", map[string]any{
+			"backend": backend.URL,
+			"status":  resp.StatusCode,
+			"until":   time.Now().Add(d),
+		})
+	}
+	lb.metrics.retryAfterBackoffs.inc(backend.URL)
+	lb.logRequest(getRequestState(resp.Request), "WARN", "%s answered %d with Retry-After %q, backing off from it for %v",
+		backend.URL, resp.StatusCode, resp.Header.Get("Retry-After"), d)
+}
+
+// parseRetryAfter reads a Retry-After value, either delay seconds or an
+// HTTP date, as a duration from now.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(min(seconds, math.MaxInt64/int64(time.Second))) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date.Sub(now), true
+	}
+	return 0, false
+}
+
+// replacesErrorBody reports whether a backend response with status should get
+// the JSON error envelope, per the request's route or the global settings.
+func (lb *LoadBalancer) replacesErrorBody(state *requestState, status int) bool {
+	enabled, statuses := lb.cfg.ReplaceErrorBodies, lb.cfg.ReplaceErrorStatuses
+	if state != nil && state.route != nil {
+		if state.route.ReplaceErrorBodies != nil {
+			enabled = *state.route.ReplaceErrorBodies
+		}
+		if len(state.route.ReplaceErrorStatuses) > 0 {
+			statuses = state.route.ReplaceErrorStatuses
+		}
+	}
+	if !enabled {
+		return false
+	}
+	for _, statusRange := range statuses {
+		if low, high, err := parseStatusRange(statusRange); err == nil && status >= low && status <= high {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStatusRange parses "503" or "500-599".
+func parseStatusRange(value string) (int, int, error) {
+	lowText, highText, isRange := strings.Cut(value, "-")
+	if !isRange {
+		highText = lowText
+	}
+	low, err := strconv.Atoi(strings.TrimSpace(lowText))
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad status range %q", value)
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(highText))
+	if err != nil || low < 100 || high > 999 || low > high {
+		return 0, 0, fmt.Errorf("bad status range %q", value)
+	}
+	return low, high, nil
+}
+
+// replaceErrorBody swaps the backend's body for the JSON error envelope.
+// ModifyResponse runs before anything reaches the client, so the status is
+// kept and only the headers describing the old body need fixing.
+func (lb *LoadBalancer) replaceErrorBody(resp *http.Response, backend *Backend) {
+	state := getRequestState(resp.Request)
+	envelope := ErrorResponse{Error: http.StatusText(resp.StatusCode), Status: resp.StatusCode}
+	if state != nil {
+		envelope.RequestID = state.id
+		envelope.TraceID = state.traceID
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.TransferEncoding = nil
+	for _, name := range []string{"Content-Encoding", "Content-Range", "ETag", "Last-Modified", "Transfer-Encoding"} {
+		resp.Header.Del(name)
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Set("X-Content-Type-Options", "nosniff")
+	
+	lb.metrics.replacedErrorBodies.inc(backend.URL)
+	lb.logRequest(state, "WARN", "Replaced %d response body from %s with the error envelope", resp.StatusCode, backend.URL)
+}
+
+// rewriteLocationHeader maps a redirect Location pointing at the backend's
+// own (internal) origin back to the origin the client used, keeping path and
+// query. Relative Locations and other hosts are left alone.
+func (lb *LoadBalancer) rewriteLocationHeader(resp *http.Response, backend *Backend) {
+	location := resp.Header.Get("Location")
+	state := getRequestState(resp.Request)
+	if location == "" || state == nil {
+		return
+	}
+	
+	target, err := url.Parse(location)
+	if err != nil || target.Host == "" {
+		return
+	}
+	if !lb.isInternalHost(target.Host, backend) {
+		return
+	}
+	
+	rewritten := rewriteLocation(location, state.clientScheme+"://"+state.clientHost)
+	if rewritten == location {
+		return
+	}
+	resp.Header.Set("Location", rewritten)
+	lb.logRequest(state, "INFO", "Rewrote Location %s -> %s", location, rewritten)
+}
+
+// rewriteLocation replaces the scheme and host of an absolute location with
+// those of publicBaseURL, keeping path, query and fragment. Relative
+// locations, and anything that fails to parse, come back unchanged.
+func rewriteLocation(location, publicBaseURL string) string {
+	target, err := url.Parse(location)
+	if err != nil || target.Host == "" {
+		return location
+	}
+	public, err := url.Parse(publicBaseURL)
+	if err != nil || public.Host == "" {
+		return location
+	}
+	target.Scheme = public.Scheme
+	target.Host = public.Host
+	return target.String()
+}
+
+func (lb *LoadBalancer) isInternalHost(host string, backend *Backend) bool {
+	if backendURL, err := url.Parse(backend.URL); err == nil && strings.EqualFold(backendURL.Host, host) {
+		return true
+	}
+	for _, internal := range lb.cfg.LocationInternalHosts {
+		if strings.EqualFold(internal, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (lb *LoadBalancer) responseLimitExempt(resp *http.Response) bool {
+	contentType := resp.Header.Get("Content-Type")
+	for _, exempt := range lb.cfg.ResponseLimitExemptTypes {
+		if strings.HasPrefix(contentType, exempt) {
+			return true
+		}
+	}
+	for _, pattern := range lb.cfg.ResponseLimitExemptPaths {
+		if matchPathPattern(pattern, resp.Request.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitedBody fails the read once more than the limit has been read. The
+// reverse proxy then aborts the client connection, so a cut response is
+// never mistaken for a complete one.
+type limitedBody struct {
+	io.ReadCloser
+	remaining  int64
+	onExceeded func()
+	exceeded   bool
+}
+
+func (body *limitedBody) Read(p []byte) (int, error) {
+	if body.exceeded {
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > body.remaining+1 {
+		p = p[:body.remaining+1]
+	}
+	n, err := body.ReadCloser.Read(p)
+	if int64(n) > body.remaining {
+		body.exceeded = true
+		body.onExceeded()
+		return int(body.remaining), errResponseTooLarge
+	}
+	body.remaining -= int64(n)
+	return n, err
+}
+
+func (lb *LoadBalancer) healthCheck() {
+	if !lb.sweeping.CompareAndSwap(false, true) {
+		log.Println("[WARN] Previous health check sweep still running, skipping this one")
+		return
+	}
+	defer lb.sweeping.Store(false)
+	
+	log.Println("[INFO] Running health checks...")
+	
+	backends := lb.getBackends()
+	aliveCount := 0
+	for _, backend := range backends {
+		if lb.checkBackend(backend) {
+			aliveCount++
+		}
+	}
+	
+	log.Printf("[INFO] Health check complete: %d/%d backends alive\n", aliveCount, len(backends))
+}
+
+// checkBackend probes one backend and updates its state. A probe that is
+// still running from an earlier tick or sweep is never duplicated; the
+// overlapping check is skipped and the current state returned.
+func (lb *LoadBalancer) checkBackend(backend *Backend) bool {
+	if !backend.checking.CompareAndSwap(false, true) {
+		log.Printf("[WARN] Health check for %s still in progress, skipping overlapping check\n", backend.URL)
+		return backend.IsAlive()
+	}
+	defer backend.checking.Store(false)
+	
+	start := time.Now()
+	err := lb.cfg.probeBackend(backend)
+	lb.metrics.healthCheckDuration.observe(time.Since(start).Seconds(), backend.URL)
+	backend.setHealthError(err)
+	if err != nil {
+		lb.metrics.healthChecks.inc(backend.URL, "fail")
+		if hint := schemeMismatchHint(backend.URL, err); hint != "" {
+			log.Printf("[WARN] Health check failed for %s: %v (%s)\n", backend.URL, err, hint)
+		} else {
+			log.Printf("[WARN] Health check failed for %s: %v\n", backend.URL, err)
+		}
+		if backend.IsAlive() && backend.Config.HealthCheckPriority == "high" {
+			lb.notify("backend_down", map[string]any{
+				"backend":  backend.URL,
+				"priority": "high",
+				"error":    err.Error(),
+			})
+		}
+		wasAlive := backend.IsAlive()
+		if wasAlive {
+			lb.metrics.stateChanges.inc(backend.URL, "up_to_down")
+			backend.upToDown.Add(1)
+			lb.events.publish("backend_down", map[string]any{"backend": backend.URL, "error": err.Error()})
+		}
+		// Marking a backend down only stops new requests; those already
+		// in flight finish on their own connections. Only a force drain
+		// cancels them.
+		backend.SetAlive(false)
+		if wasAlive {
+			lb.closeIdleConnections(backend)
+		}
+		return false
+	}
+	
+	lb.metrics.healthChecks.inc(backend.URL, "pass")
+	if !backend.IsAlive() {
+		if err := lb.warmUp(backend); err != nil {
+			log.Printf("[WARN] Warmup of %s failed, keeping it out of rotation: %v\n", backend.URL, err)
+			return false
+		}
+		lb.metrics.stateChanges.inc(backend.URL, "down_to_up")
+		backend.downToUp.Add(1)
+		log.Printf("[INFO] Backend %s is now UP (recovered)\n", backend.URL)
+		lb.events.publish("backend_up", map[string]any{"backend": backend.URL})
+	}
+	backend.SetAlive(true)
+	return true
+}
+
+// warmUp sends the backend's warmup requests one after another, stopping at
+// the first that fails or doesn't return 2xx.
+func (lb *LoadBalancer) warmUp(backend *Backend) error {
+	count := backend.Config.WarmupRequestCount
+	if count == 0 {
+		return nil
+	}
+	target := strings.TrimSuffix(backend.URL, "/") + "/" + strings.TrimPrefix(backend.Config.WarmupRequestPath, "/")
+	client := &http.Client{Transport: backend.Proxy.Transport, Timeout: lb.cfg.healthCheckTimeout(backend.Config)}
+	
+	log.Printf("[INFO] Warming up %s with %d requests to %s\n", backend.URL, count, target)
+	start := time.Now()
+	for i := 1; i <= count; i++ {
+		resp, err := client.Get(target)
+		if err != nil {
+			return fmt.Errorf("request %d: %w", i, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("request %d returned status %d", i, resp.StatusCode)
+		}
+	}
+	log.Printf("[INFO] Warmed up %s in %v\n", backend.URL, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// probeBackend runs the configured health check. A probe that succeeds but
+// takes longer than HEALTH_CHECK_MAX_LATENCY still counts as a failure.
+func (c *Config) probeBackend(backend *Backend) error {
+	start := time.Now()
+	timeout := c.healthCheckTimeout(backend.Config)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	
+	var err error
+	switch checkType := c.healthCheckType(backend.Config); checkType {
+	case "http":
+		err = probeHTTP(ctx, backend, c.healthCheckPath(backend.Config))
+	case "external":
+		err = probeExternal(ctx, backend, c.healthCheckCommand(backend.Config))
+	case "grpc":
+		err = probeGRPC(ctx, backend, c.healthCheckGRPCService(backend.Config))
+	default:
+		err = fmt.Errorf("unknown health check type %q", checkType)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("health check timed out after %v", timeout)
+	}
+	if err != nil {
+		return err
+	}
+	
+	if took := time.Since(start); c.HealthCheckMaxLatency > 0 && took > c.HealthCheckMaxLatency {
+		return fmt.Errorf("probe took %v, exceeding HEALTH_CHECK_MAX_LATENCY %v",
+			took.Round(time.Millisecond), c.HealthCheckMaxLatency)
+	}
+	return nil
+}
+
+// probeHTTP GETs path on the backend, or its URL itself when path is empty,
+// and expects a 200.
+func probeHTTP(ctx context.Context, backend *Backend, path string) error {
+	target := backend.URL
+	if path != "" {
+		target = strings.TrimSuffix(backend.URL, "/") + "/" + strings.TrimPrefix(path, "/")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: backend.Proxy.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode == http.StatusBadRequest && req.URL.Scheme == "http" {
+		// TLS servers answer plain HTTP with a 400 that says so.
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if bytes.Contains(body, []byte("HTTP request to an HTTPS server")) || bytes.Contains(body, []byte("plain HTTP request was sent to HTTPS port")) {
+			return fmt.Errorf("returned status %d: %w", resp.StatusCode, errBackendSpeaksTLS)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+var errBackendSpeaksTLS = errors.New("plain HTTP sent to an HTTPS port")
+
+// schemeMismatchHint explains a probe failure that looks like the backend URL
+// has the wrong scheme: a TLS handshake answered in plain HTTP, or a plain
+// request answered by a TLS server. It returns "" for any other error.
+func schemeMismatchHint(backendURL string, err error) string {
+	u, parseErr := url.Parse(backendURL)
+	if parseErr != nil {
+		return ""
+	}
+	var recordErr tls.RecordHeaderError
+	switch u.Scheme {
+	case "https":
+		if errors.Is(err, http.ErrSchemeMismatch) || errors.As(err, &recordErr) {
+			return "TLS handshake failed - is the backend actually HTTP? Try http://" + u.Host
+		}
+	case "http":
+		// A TLS alert record starts 0x15 0x03.
+		if errors.Is(err, errBackendSpeaksTLS) || strings.Contains(err.Error(), `malformed HTTP response "\x15\x03`) {
+			return "backend answered with TLS - is it actually HTTPS? Try https://" + u.Host
+		}
+	}
+	return ""
+}
+
+// grpcServingStatus names grpc.health.v1.HealthCheckResponse.ServingStatus
+// values.
+var grpcServingStatus = map[uint64]string{0: "UNKNOWN", 1: "SERVING", 2: "NOT_SERVING", 3: "SERVICE_UNKNOWN"}
+
+// probeGRPC calls grpc.health.v1.Health/Check for service over HTTP/2 and
+// expects SERVING. The request and response are single small protobuf
+// messages, so they are framed and parsed by hand rather than pulling in a
+// gRPC client. Backends not already using the http2 transport get a
+// short-lived one for the probe.
+func probeGRPC(ctx context.Context, backend *Backend, service string) error {
+	transport := backend.Proxy.Transport
+	if backend.Config.Transport != "http2" {
+		h2 := HTTP2TransportFactory(backend.Config).(*http.Transport)
+		defer h2.CloseIdleConnections()
+		transport = h2
+	}
+	
+	// HealthCheckRequest has the service name as field 1.
+	msg := binary.AppendUvarint([]byte{0x0a}, uint64(len(service)))
+	msg = append(msg, service...)
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	frame = append(frame, msg...)
+	
+	target := strings.TrimSuffix(backend.URL, "/") + "/grpc.health.v1.Health/Check"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	client := &http.Client{Transport: transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if err != nil {
+		return err
+	}
+	// Errors may come as trailers or, with no message, as headers only.
+	code := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if code == "" {
+		code, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if code != "0" && message != "" {
+		return fmt.Errorf("gRPC health check failed with grpc-status %q: %s", code, message)
+	}
+	if code != "0" {
+		return fmt.Errorf("gRPC health check failed with grpc-status %q", code)
+	}
+	
+	status, err := parseGRPCHealthResponse(body)
+	if err != nil {
+		return err
+	}
+	if status != 1 {
+		name, ok := grpcServingStatus[status]
+		if !ok {
+			name = strconv.FormatUint(status, 10)
+		}
+		return fmt.Errorf("gRPC health status %s", name)
+	}
+	return nil
+}
+
+// parseGRPCHealthResponse reads the status (field 1) out of a framed
+// HealthCheckResponse, skipping any fields it doesn't know.
+func parseGRPCHealthResponse(body []byte) (uint64, error) {
+	if len(body) < 5 {
+		return 0, fmt.Errorf("gRPC health response is %d bytes, too short for a message", len(body))
+	}
+	if body[0] != 0 {
+		return 0, errors.New("gRPC health response is compressed")
+	}
+	size := binary.BigEndian.Uint32(body[1:5])
+	msg := body[5:]
+	if uint64(len(msg)) < uint64(size) {
+		return 0, fmt.Errorf("gRPC health response truncated: %d of %d bytes", len(msg), size)
+	}
+	msg = msg[:size]
+	
+	var status uint64 // proto3 omits the zero value, UNKNOWN
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("malformed gRPC health response")
+		}
+		msg = msg[n:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("malformed gRPC health response")
+			}
+			msg = msg[n:]
+			if tag>>3 == 1 {
+				status = v
+			}
+		case 2:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < length {
+				return 0, errors.New("malformed gRPC health response")
+			}
+			msg = msg[n+int(length):]
+		default:
+			return 0, fmt.Errorf("unexpected wire type %d in gRPC health response", tag&7)
+		}
+	}
+	return status, nil
+}
+
+// probeExternal runs the configured command with the backend URL as its last
+// argument. Exit code 0 means healthy; anything else, including a timeout,
+// means unhealthy.
+func probeExternal(ctx context.Context, backend *Backend, command string) error {
+	args := strings.Fields(command)
+	args = append(args, backend.URL)
+	
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if out := strings.TrimSpace(string(output)); out != "" {
+		if len(out) > 512 {
+			out = out[:512] + "..."
+		}
+		log.Printf("[INFO] Health check command output for %s: %s\n", backend.URL, out)
+	}
+	return err
+}
+
+func (c *Config) hasInternalListener() bool {
+	for _, listener := range c.Listeners {
+		if listener.Internal {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) healthCheckType(bc BackendConfig) string {
+	if bc.HealthCheckType != "" {
+		return bc.HealthCheckType
+	}
+	return c.HealthCheckType
+}
+
+func (c *Config) healthCheckCommand(bc BackendConfig) string {
+	if bc.HealthCheckCommand != "" {
+		return bc.HealthCheckCommand
+	}
+	return c.HealthCheckCommand
+}
+
+// healthCheckPath is the path of the backend's shallow HTTP probe: its
+// health_check_path if set, otherwise HEALTH_CHECK_PATH.
+func (c *Config) healthCheckPath(bc BackendConfig) string {
+	if bc.HealthCheckPath != "" {
+		return bc.HealthCheckPath
+	}
+	return c.HealthCheckPath
+}
+
+func (c *Config) healthCheckGRPCService(bc BackendConfig) string {
+	if bc.HealthCheckGRPCService != "" {
+		return bc.HealthCheckGRPCService
+	}
+	return c.HealthCheckGRPCService
+}
+
+func (c *Config) deepHealthCheckPath(bc BackendConfig) string {
+	if bc.DeepHealthCheckPath != "" {
+		return bc.DeepHealthCheckPath
+	}
+	return c.DeepHealthCheckPath
+}
+
+func (c *Config) deepHealthCheckInterval(bc BackendConfig) time.Duration {
+	if bc.DeepHealthCheckInterval > 0 {
+		return bc.DeepHealthCheckInterval
+	}
+	return c.DeepHealthCheckInterval
+}
+
+// healthCheckTimeout bounds a single probe: the backend's health_timeout if
+// set, otherwise HEALTH_CHECK_COMMAND_TIMEOUT for external checks and
+// HEALTH_CHECK_TIMEOUT for HTTP ones.
+func (c *Config) healthCheckTimeout(bc BackendConfig) time.Duration {
+	if bc.HealthTimeout > 0 {
+		return bc.HealthTimeout
+	}
+	if c.healthCheckType(bc) == "external" {
+		return c.HealthCheckCommandTimeout
+	}
+	return c.HealthCheckTimeout
+}
+
+// healthCheckInterval returns the backend's own interval, falling back to
+// the global HEALTH_CHECK_INTERVAL scaled by its priority: high-priority
+// backends are checked twice as often, low-priority ones half as often.
+func (lb *LoadBalancer) healthCheckInterval(backend *Backend) time.Duration {
+	if backend.Config.HealthCheckInterval > 0 {
+		return backend.Config.HealthCheckInterval
+	}
+	
+	switch backend.Config.HealthCheckPriority {
+	case "high":
+		return lb.cfg.HealthCheckInterval / 2
+	case "low":
+		return lb.cfg.HealthCheckInterval * 2
+	default:
+		return lb.cfg.HealthCheckInterval
+	}
+}
+
+func (lb *LoadBalancer) startHealthChecks() {
+	log.Printf("[INFO] Starting health checks (default interval: %v)\n", lb.cfg.HealthCheckInterval)
+	
+	lb.mux.Lock()
+	lb.healthChecksStarted = true
+	backends := lb.backends
+	lb.mux.Unlock()
+	
+	for _, backend := range backends {
+		lb.startBackendHealthCheck(backend)
+	}
+	for _, fallback := range lb.fallbacks {
+		lb.startFallbackProbe(fallback)
+	}
+}
+
+// fallbackBackend returns pool's fallback backend if it has one that is up.
+func (lb *LoadBalancer) fallbackBackend(pool string) *Backend {
+	if fallback := lb.fallbacks[pool]; fallback != nil && fallback.IsAlive() {
+		return fallback
+	}
+	return nil
+}
+
+// startFallbackProbe checks a fallback backend every health check interval.
+// Fallbacks are often static sites or buckets without a health endpoint, so
+// the probe is a GET of the backend's URL and only a failed request or a
+// 5xx counts as down. Results stay out of the health metrics and events,
+// which describe the backends in rotation.
+func (lb *LoadBalancer) startFallbackProbe(backend *Backend) {
+	interval := lb.healthCheckInterval(backend)
+	client := &http.Client{Transport: backend.Proxy.Transport, Timeout: lb.cfg.healthCheckTimeout(backend.Config)}
+	timer := time.NewTimer(lb.jitteredInterval(interval))
+	go func() {
+		for range timer.C {
+			err := probeFallback(client, backend.URL)
+			backend.setHealthError(err)
+			if err != nil && backend.IsAlive() {
+				log.Printf("[WARN] Fallback %s for pool %s is down: %v\n", backend.URL, backend.Config.Pool, err)
+			} else if err == nil && !backend.IsAlive() {
+				log.Printf("[INFO] Fallback %s for pool %s is up again\n", backend.URL, backend.Config.Pool)
+			}
+			backend.SetAlive(err == nil)
+			timer.Reset(lb.jitteredInterval(interval))
+		}
+	}()
+}
+
+func probeFallback(client *http.Client, target string) error {
+	resp, err := client.Get(target)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (lb *LoadBalancer) startBackendHealthCheck(backend *Backend) {
+	interval := lb.healthCheckInterval(backend)
+	if interval != lb.cfg.HealthCheckInterval {
+		log.Printf("[INFO] Health check interval for %s: %v\n", backend.URL, interval)
+	}
+	
+	timer := time.NewTimer(lb.jitteredInterval(interval))
+	go func() {
+		for range timer.C {
+			if backend.removed.Load() || lb.checkBackendDNS(backend) {
+				return
+			}
+			start := time.Now()
+			lb.checkBackend(backend)
+			if took := time.Since(start); took > interval {
+				log.Printf("[WARN] Health check for %s took %v, longer than its %v interval\n",
+					backend.URL, took.Round(time.Millisecond), interval)
+			}
+			timer.Reset(lb.jitteredInterval(interval))
+		}
+	}()
+	
+	if lb.cfg.deepHealthCheckPath(backend.Config) != "" {
+		lb.startDeepHealthCheck(backend)
+	}
+}
+
+// checkBackendDNS resolves the backend's hostname once per health check
+// cycle when DeregisterOnDNSFailureCount is set, and removes the backend once
+// that many lookups in a row found no such host: a deleted Kubernetes
+// service loses its DNS name before its pod IPs stop answering. Other lookup
+// errors, like timeouts, say nothing about the name and are not counted.
+// Returns whether the backend was removed.
+func (lb *LoadBalancer) checkBackendDNS(backend *Backend) bool {
+	limit := int64(backend.Config.DeregisterOnDNSFailureCount)
+	if limit <= 0 {
+		return false
+	}
+	u, err := url.Parse(backend.URL)
+	if err != nil || net.ParseIP(u.Hostname()) != nil {
+		return false
+	}
+	
+	ctx, cancel := context.WithTimeout(context.Background(), lb.cfg.healthCheckTimeout(backend.Config))
+	defer cancel()
+	_, err = lb.opts.Resolver.LookupHost(ctx, u.Hostname())
+	var dnsErr *net.DNSError
+	if err == nil {
+		backend.dnsFailures.Store(0)
+		return false
+	}
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		log.Printf("[WARN] DNS lookup for %s failed: %v\n", backend.URL, err)
+		return false
+	}
+	
+	failures := backend.dnsFailures.Add(1)
+	log.Printf("[WARN] Hostname of %s does not resolve (%d/%d): %v\n", backend.URL, failures, limit, err)
+	if failures < limit {
+		return false
+	}
+	if _, err := lb.RemoveBackend(backend.URL); err != nil {
+		return false
+	}
+	lb.audit("health", "deregister", fmt.Sprintf("%s: hostname did not resolve in %d health checks", backend.URL, failures))
+	log.Printf("[WARN] Deregistered %s after %d failed DNS lookups\n", backend.URL, failures)
+	return true
+}
+
+// startDeepHealthCheck probes the backend's deep health path on its own,
+// slower schedule. The result only decides whether the backend is preferred;
+// the shallow check alone takes backends out of rotation.
+func (lb *LoadBalancer) startDeepHealthCheck(backend *Backend) {
+	interval := lb.cfg.deepHealthCheckInterval(backend.Config)
+	log.Printf("[INFO] Deep health check for %s every %v\n", backend.URL, interval)
+	
+	timer := time.NewTimer(0)
+	go func() {
+		for range timer.C {
+			if backend.removed.Load() {
+				return
+			}
+			lb.checkDeepHealth(backend)
+			timer.Reset(lb.jitteredInterval(interval))
+		}
+	}()
+}
+
+func (lb *LoadBalancer) checkDeepHealth(backend *Backend) {
+	ctx, cancel := context.WithTimeout(context.Background(), lb.cfg.healthCheckTimeout(backend.Config))
+	defer cancel()
+	
+	err := probeHTTP(ctx, backend, lb.cfg.deepHealthCheckPath(backend.Config))
+	wasFailing := backend.deepFailing.Swap(err != nil)
+	switch {
+	case err != nil && !wasFailing:
+		log.Printf("[WARN] Deep health check failed for %s, deprioritizing it: %v\n", backend.URL, err)
+	case err == nil && wasFailing:
+		log.Printf("[INFO] Deep health check for %s passes again\n", backend.URL)
+	}
+}
+
+// jitteredInterval randomizes a wait within HEALTH_CHECK_JITTER of interval
+// so backends sharing an interval aren't all probed at the same moment.
+func (lb *LoadBalancer) jitteredInterval(interval time.Duration) time.Duration {
+	if lb.cfg.HealthCheckJitter <= 0 {
+		return interval
+	}
+	offset := (rand.Float64()*2 - 1) * lb.cfg.HealthCheckJitter * float64(interval)
+	return interval + time.Duration(offset)
+}
+
+func (lb *LoadBalancer) getStats() {
+	backends := lb.getBackends()
+	aliveCount := 0
+	for _, backend := range backends {
+		if backend.IsAlive() {
+			aliveCount++
+		}
+	}
+	
+	log.Printf("[STATS] Total backends: %d, Alive: %d, Down: %d\n", 
+		len(backends), aliveCount, len(backends)-aliveCount)
+	
+	for _, backend := range backends {
+		if backend.isEjected() {
+			backend.mux.RLock()
+			log.Printf("[STATS] Backend %s ejected until %s: %s\n",
+				backend.URL, backend.ejectedUntil.Format(time.RFC3339), backend.ejectionReason)
+			backend.mux.RUnlock()
+		}
+	}
+	
+	now := time.Now()
+	interval := now.Sub(cmp.Or(lb.statsTickAt, lb.startTime)).Round(time.Second)
+	lb.statsTickAt = now
+	shares, total := lb.requestDistribution()
+	parts := make([]string, len(shares))
+	for i, share := range shares {
+		parts[i] = fmt.Sprintf("%s %.1f%% (%d)", share.Backend, share.Percent, share.Requests)
+		lb.metrics.intervalRequests.set(float64(share.Requests), share.Backend)
+		lb.metrics.requestShare.set(share.Percent, share.Backend)
+	}
+	if total == 0 {
+		log.Printf("[STATS] Request distribution over the last %v: no requests\n", interval)
+	} else {
+		log.Printf("[STATS] Request distribution over the last %v (%d requests): %s\n",
+			interval, total, strings.Join(parts, ", "))
+	}
+	
+	if lb.idempotency != nil {
+		log.Printf("[STATS] Idempotency keys - Forwarded: %d, Replayed: %d, Conflicts: %d\n",
+			lb.idempotency.forwarded.Load(), lb.idempotency.replayed.Load(), lb.idempotency.conflicts.Load())
+	}
+	if lb.coalescer != nil {
+		log.Printf("[STATS] Coalescing - Leaders: %d, Coalesced: %d, Bypassed: %d, Oversized: %d\n",
+			lb.coalescer.leaders.Load(), lb.coalescer.coalesced.Load(),
+			lb.coalescer.bypassed.Load(), lb.coalescer.oversized.Load())
+	}
+}
+
+// BackendShare is one backend's part of the requests proxied in an interval.
+type BackendShare struct {
+	Backend  string  `json:"backend"`
+	Requests int64   `json:"requests"`
+	Percent  float64 `json:"percent"`
+}
+
+// requestDistribution returns how the requests proxied since the previous
+// call were spread over the backends, and their total. Retries count once
+// per attempt. Only the stats ticker may call it, as each call starts a new
+// interval.
+func (lb *LoadBalancer) requestDistribution() ([]BackendShare, int64) {
+	backends := lb.getBackends()
+	shares := make([]BackendShare, len(backends))
+	var total int64
+	for i, backend := range backends {
+		requests := backend.requests.Load()
+		shares[i] = BackendShare{Backend: backend.URL, Requests: requests - backend.statsMark}
+		backend.statsMark = requests
+		total += shares[i].Requests
+	}
+	if total > 0 {
+		for i := range shares {
+			shares[i].Percent = float64(shares[i].Requests) * 100 / float64(total)
+		}
+	}
+	return shares, total
+}
+
+// recordLatency counts attempts slower than LATENCY_SLO per backend over a
+// fixed window and ejects the backend for the cooldown once the slow share
+// exceeds LATENCY_EJECTION_THRESHOLD percent.
+func (lb *LoadBalancer) recordLatency(backend *Backend, duration time.Duration) {
+	if lb.cfg.Strategy == "auto_latency" {
+		backend.mux.Lock()
+		backend.latencySum += duration
+		backend.latencyCount++
+		backend.mux.Unlock()
+	}
+	if lb.cfg.LatencySLO <= 0 {
+		return
+	}
+	
+	backend.mux.Lock()
+	defer backend.mux.Unlock()
+	
+	now := time.Now()
+	if now.Sub(backend.latencyWindowStart) > lb.cfg.LatencyEjectionWindow {
+		backend.latencyWindowStart = now
+		backend.latencyRequests = 0
+		backend.latencySlow = 0
+	}
+	backend.latencyRequests++
+	if duration > lb.cfg.LatencySLO {
+		backend.latencySlow++
+	}
+	
+	if backend.latencyRequests < lb.cfg.LatencyEjectionMinRequests || now.Before(backend.ejectedUntil) {
+		return
+	}
+	slowPercent := float64(backend.latencySlow) / float64(backend.latencyRequests) * 100
+	if slowPercent <= lb.cfg.LatencyEjectionThreshold {
+		return
+	}
+	
+	backend.ejectedUntil = now.Add(lb.cfg.LatencyEjectionCooldown)
+	backend.ejectionReason = fmt.Sprintf("latency: %.0f%% of %d requests exceeded SLO %v",
+		slowPercent, backend.latencyRequests, lb.cfg.LatencySLO)
+	backend.latencyWindowStart = now
+	backend.latencyRequests = 0
+	backend.latencySlow = 0
+	log.Printf("[WARN] Ejecting backend %s for %v - %s\n", backend.URL, lb.cfg.LatencyEjectionCooldown, backend.ejectionReason)
+	lb.events.publish("backend_ejected", map[string]any{
+		"backend": backend.URL,
+		"reason":  backend.ejectionReason,
+		"until":   backend.ejectedUntil,
+	})
+	time.AfterFunc(lb.cfg.LatencyEjectionCooldown, func() {
+		log.Printf("[INFO] Backend %s reinstated after latency ejection cooldown\n", backend.URL)
+		lb.events.publish("backend_reinstated", map[string]any{"backend": backend.URL})
+	})
+}
+
+type Stats struct {
+	LB            LBStats        `json:"lb"`
+	TotalBackends int            `json:"total_backends"`
+	Alive         int            `json:"alive"`
+	Down          int            `json:"down"`
+	Backends      []BackendStats `json:"backends"`
+	Runtime       RuntimeStats   `json:"runtime"`
+
+	Connections  *ConnStats         `json:"connections,omitempty"`
+	Registration *RegistrationStats `json:"registration,omitempty"`
+
+	Fallbacks []FallbackStats `json:"fallbacks,omitempty"`
+}
+
+// FallbackStats reports a pool's fallback backend, which isn't counted among
+// the backends above.
+type FallbackStats struct {
+	Pool             string     `json:"pool"`
+	URL              string     `json:"url"`
+	Alive            bool       `json:"alive"`
+	Requests         int64      `json:"requests"` // attempts sent to it
+	LastProbeError   string     `json:"last_probe_error,omitempty"`
+	LastProbeErrorAt *time.Time `json:"last_probe_error_at,omitempty"`
+}
+
+// LBStats describes the load balancer process itself.
+type LBStats struct {
+	StartedAt      time.Time `json:"started_at"`
+	UptimeSeconds  float64   `json:"uptime_seconds"`
+	TotalRequests  int64     `json:"total_requests"`
+	InFlight       int64     `json:"in_flight"`
+	Goroutines     int       `json:"goroutines"`
+	ConfigChecksum string    `json:"config_checksum"`
+
+	OversizedResponses int64 `json:"oversized_responses"`
+
+	Totals     Totals     `json:"totals"`
+	Restored   *Totals    `json:"restored,omitempty"`
+	RestoredAt *time.Time `json:"restored_at,omitempty"` // when the restored counters were saved
+}
+
+// RuntimeStats is the Go runtime and process state, for telling time spent
+// in the balancer from time spent in backends. The file descriptor count
+// and CPU times come from /proc and are left out where there is none.
+type RuntimeStats struct {
+	SampledAt        time.Time `json:"sampled_at"`
+	Goroutines       int       `json:"goroutines"`
+	HeapInUseBytes   uint64    `json:"heap_in_use_bytes"`
+	HeapObjects      uint64    `json:"heap_objects"`
+	SysBytes         uint64    `json:"sys_bytes"`
+	NumGC            uint32    `json:"num_gc"`
+	GCPauseTotalMs   float64   `json:"gc_pause_total_ms"`
+	LastGCPauseMs    float64   `json:"last_gc_pause_ms"`
+	OpenFDs          *int      `json:"open_fds,omitempty"`
+	CPUUserSeconds   *float64  `json:"cpu_user_seconds,omitempty"`
+	CPUSystemSeconds *float64  `json:"cpu_system_seconds,omitempty"`
+}
+
+// runtimeStatsTTL bounds how often /admin/stats reads the runtime state;
+// ReadMemStats stops the world, so polling it hard would add latency.
+const runtimeStatsTTL = time.Second
+
+// runtimeStats returns the cached runtime state, refreshing it once it is
+// older than runtimeStatsTTL.
+func (lb *LoadBalancer) runtimeStats() RuntimeStats {
+	lb.runtimeMu.Lock()
+	defer lb.runtimeMu.Unlock()
+	if time.Since(lb.runtime.SampledAt) < runtimeStatsTTL {
+		return lb.runtime
+	}
+	
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := RuntimeStats{
+		SampledAt:      time.Now(),
+		Goroutines:     runtime.NumGoroutine(),
+		HeapInUseBytes: mem.HeapInuse,
+		HeapObjects:    mem.HeapObjects,
+		SysBytes:       mem.Sys,
+		NumGC:          mem.NumGC,
+		GCPauseTotalMs: float64(mem.PauseTotalNs) / 1e6,
+	}
+	if mem.NumGC > 0 {
+		stats.LastGCPauseMs = float64(mem.PauseNs[(mem.NumGC+255)%256]) / 1e6
+	}
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		fds := len(entries)
+		stats.OpenFDs = &fds
+	}
+	if user, system, err := procCPUTime(); err == nil {
+		stats.CPUUserSeconds, stats.CPUSystemSeconds = &user, &system
+	}
+	lb.runtime = stats
+	return stats
+}
+
+// procCPUTime reads the process's user and system CPU time from
+// /proc/self/stat, where they are the 14th and 15th fields, in USER_HZ
+// (100 per second) ticks.
+func procCPUTime() (float64, float64, error) {
+	data, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	// The command name, field 2, is in parentheses and may contain spaces.
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return 0, 0, errors.New("malformed /proc/self/stat")
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 13 {
+		return 0, 0, errors.New("malformed /proc/self/stat")
+	}
+	utime, err := strconv.ParseFloat(fields[11], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	stime, err := strconv.ParseFloat(fields[12], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return utime / 100, stime / 100, nil
+}
+
+// Totals are cumulative counters which, with LB_STATE_FILE, carry over
+// restarts. They include any Restored counters; the rest are live.
+type Totals struct {
+	Requests      int64   `json:"requests"`
+	UpToDown      int64   `json:"up_to_down,omitempty"`
+	DownToUp      int64   `json:"down_to_up,omitempty"`
+	UptimeSeconds float64 `json:"uptime_seconds"` // for a backend, time spent alive
+}
+
+func (t Totals) plus(other *Totals) Totals {
+	if other == nil {
+		return t
+	}
+	return Totals{
+		Requests:      t.Requests + other.Requests,
+		UpToDown:      t.UpToDown + other.UpToDown,
+		DownToUp:      t.DownToUp + other.DownToUp,
+		UptimeSeconds: t.UptimeSeconds + other.UptimeSeconds,
+	}
+}
+
+type BackendStats struct {
+	URL            string     `json:"url"`
+	BackendID      string     `json:"backend_id,omitempty"`
+	Pool           string     `json:"pool"`
+	Zone           string     `json:"zone,omitempty"`
+	Alive          bool       `json:"alive"`
+	DeepHealthy    *bool      `json:"deep_healthy,omitempty"`
+	Draining       bool       `json:"draining"`
+	Weight         int        `json:"weight"`
+	Ejected        bool       `json:"ejected"`
+	EjectionReason string     `json:"ejection_reason,omitempty"`
+	EjectedUntil   *time.Time `json:"ejected_until,omitempty"`
+
+	// BackingOff is set while the backend is passed over at the request
+	// of its own Retry-After; unlike ejection it still takes requests no
+	// other backend can.
+	BackingOff      bool       `json:"backing_off"`
+	BackingOffUntil *time.Time `json:"backing_off_until,omitempty"`
+
+	AvgLatencyMs  float64 `json:"avg_latency_ms,omitempty"`
+	LatencyWeight float64 `json:"latency_weight,omitempty"`
+
+	// EffectiveWeight is the weight after every modifier, and
+	// SelectionProbability the resulting share of its pool's requests.
+	EffectiveWeight      float64 `json:"effective_weight"`
+	SelectionProbability float64 `json:"selection_probability"`
+
+	LastHealthError   string     `json:"last_health_error,omitempty"`
+	LastHealthErrorAt *time.Time `json:"last_health_error_at,omitempty"`
+
+	NextScheduledChange *ScheduledChange `json:"next_scheduled_change,omitempty"`
+
+	DialFailureSkips int64 `json:"dial_failure_skips"`
+	ActiveRequests   int64 `json:"active_requests"`
+	QueuedRequests   int   `json:"queued_requests"`
+
+	RequestSizeP95  float64 `json:"request_size_p95"`
+	ResponseSizeP95 float64 `json:"response_size_p95"`
+
+	Totals   Totals  `json:"totals"`
+	Restored *Totals `json:"restored,omitempty"`
+}
+
+func (lb *LoadBalancer) collectStats() Stats {
+	backends := lb.getBackends()
+	stats := Stats{
+		LB: LBStats{
+			StartedAt:      lb.startTime,
+			UptimeSeconds:  time.Since(lb.startTime).Seconds(),
+			TotalRequests:  lb.totalRequests.Load(),
+			InFlight:       lb.inFlight.Load(),
+			Goroutines:     runtime.NumGoroutine(),
+			ConfigChecksum: lb.configChecksum,
+
+			OversizedResponses: lb.oversizedResponses.Load(),
+		},
+		TotalBackends: len(backends),
+		Backends:      []BackendStats{},
+		Runtime:       lb.runtimeStats(),
+	}
+	if lb.restored != nil {
+		stats.LB.Restored = &lb.restored.LB
+		stats.LB.RestoredAt = &lb.restored.SavedAt
+	}
+	stats.LB.Totals = lb.liveTotals().plus(stats.LB.Restored)
+	
+	shares := lb.selectionProbabilities()
+	for _, backend := range backends {
+		bs := BackendStats{
+			URL:       backend.URL,
+			BackendID: backend.Config.BackendID,
+			Pool:      backend.Config.Pool,
+			Zone:      backend.Config.Zone,
+			Alive:     backend.IsAlive(),
+			Draining:  backend.draining.Load(),
+			Weight:    backend.weight(),
+
+			NextScheduledChange: lb.nextScheduledChange(backend, time.Now()),
+
+			DialFailureSkips: backend.dialSkips.Load(),
+			ActiveRequests:   backend.active.Load(),
+			QueuedRequests:   backend.queued(),
+
+			RequestSizeP95:  lb.metrics.requestSize.quantile(0.95, backend.URL),
+			ResponseSizeP95: lb.metrics.responseSize.quantile(0.95, backend.URL),
+		}
+		if lb.restored != nil {
+			bs.Restored = lb.restored.Backends[backend.URL]
+		}
+		bs.Totals = backend.liveTotals().plus(bs.Restored)
+		if bs.Alive {
+			stats.Alive++
+		}
+		if lb.cfg.deepHealthCheckPath(backend.Config) != "" {
+			deepHealthy := !backend.deepFailing.Load()
+			bs.DeepHealthy = &deepHealthy
+		}
+		
+		backend.mux.RLock()
+		if backend.lastHealthError != "" {
+			at := backend.lastHealthErrorAt
+			bs.LastHealthError = backend.lastHealthError
+			bs.LastHealthErrorAt = &at
+		}
+		if time.Now().Before(backend.ejectedUntil) {
+			until := backend.ejectedUntil
+			bs.Ejected = true
+			bs.EjectionReason = backend.ejectionReason
+			bs.EjectedUntil = &until
+		}
+		if time.Now().Before(backend.backoffUntil) {
+			until := backend.backoffUntil
+			bs.BackingOff = true
+			bs.BackingOffUntil = &until
+		}
+		bs.AvgLatencyMs = float64(backend.avgLatency) / float64(time.Millisecond)
+		bs.LatencyWeight = backend.latencyWeight
+		backend.mux.RUnlock()
+		if bs.Alive {
+			bs.EffectiveWeight = backend.effectiveWeight()
+		}
+		bs.SelectionProbability = shares[backend]
+		
+		stats.Backends = append(stats.Backends, bs)
+	}
+	stats.Down = stats.TotalBackends - stats.Alive
+	
+	if lb.conns != nil {
+		connStats := lb.conns.stats(10)
+		stats.Connections = &connStats
+	}
+	if lb.registrar != nil {
+		registration := lb.registrar.stats()
+		stats.Registration = &registration
+	}
+	for pool, fallback := range lb.fallbacks {
+		fs := FallbackStats{Pool: pool, URL: fallback.URL, Alive: fallback.IsAlive(), Requests: fallback.requests.Load()}
+		fallback.mux.RLock()
+		if fallback.lastHealthError != "" {
+			at := fallback.lastHealthErrorAt
+			fs.LastProbeError = fallback.lastHealthError
+			fs.LastProbeErrorAt = &at
+		}
+		fallback.mux.RUnlock()
+		stats.Fallbacks = append(stats.Fallbacks, fs)
+	}
+	sort.Slice(stats.Fallbacks, func(i, j int) bool { return stats.Fallbacks[i].Pool < stats.Fallbacks[j].Pool })
+	
+	return stats
+}
+
+// configChecksum identifies the running configuration so operators can tell
+// whether two instances are running the same config.
+func configChecksum(cfg *Config) string {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (lb *LoadBalancer) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, lb.collectStats())
+}
+
+func (lb *LoadBalancer) liveTotals() Totals {
+	return Totals{
+		Requests:      lb.totalRequests.Load(),
+		UptimeSeconds: time.Since(lb.startTime).Seconds(),
+	}
+}
+
+func (b *Backend) liveTotals() Totals {
+	return Totals{
+		Requests:      b.requests.Load(),
+		UpToDown:      b.upToDown.Load(),
+		DownToUp:      b.downToUp.Load(),
+		UptimeSeconds: b.uptime().Seconds(),
+	}
+}
+
+// persistedState is the content of LB_STATE_FILE.
+type persistedState struct {
+	SavedAt  time.Time          `json:"saved_at"`
+	LB       Totals             `json:"lb"`
+	Backends map[string]*Totals `json:"backends"`
+}
+
+// restoreState loads the counters saved by a previous run. A missing or
+// unreadable file only means starting from zero.
+func (lb *LoadBalancer) restoreState() {
+	data, err := os.ReadFile(lb.cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("[INFO] No state file at %s yet; counters start from zero\n", lb.cfg.StateFile)
+		return
+	}
+	var state persistedState
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil {
+		log.Printf("[WARN] Ignoring state file %s: %v\n", lb.cfg.StateFile, err)
+		return
+	}
+	if state.Backends == nil {
+		state.Backends = make(map[string]*Totals)
+	}
+	lb.restored = &state
+	log.Printf("[INFO] Restored counters saved at %s from %s\n", state.SavedAt.Format(time.RFC3339), lb.cfg.StateFile)
+}
+
+// startStatePersistence saves the counters every StateSaveInterval. Saving
+// happens off the request path, and a failed save is only logged.
+func (lb *LoadBalancer) startStatePersistence() {
+	go func() {
+		ticker := time.NewTicker(lb.cfg.StateSaveInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := lb.saveState(); err != nil {
+				log.Printf("[WARN] Failed to save state to %s: %v\n", lb.cfg.StateFile, err)
+			}
+		}
+	}()
+}
+
+// saveState writes the combined restored and live counters to a temporary
+// file next to StateFile and renames it into place, so a crash mid-write
+// never leaves a truncated state file behind. Backends no longer configured
+// are dropped.
+func (lb *LoadBalancer) saveState() error {
+	state := persistedState{
+		SavedAt:  time.Now(),
+		Backends: make(map[string]*Totals),
+	}
+	var restoredLB *Totals
+	if lb.restored != nil {
+		restoredLB = &lb.restored.LB
+	}
+	state.LB = lb.liveTotals().plus(restoredLB)
+	for _, backend := range lb.getBackends() {
+		var restored *Totals
+		if lb.restored != nil {
+			restored = lb.restored.Backends[backend.URL]
+		}
+		totals := backend.liveTotals().plus(restored)
+		state.Backends[backend.URL] = &totals
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	
+	tmp, err := os.CreateTemp(filepath.Dir(lb.cfg.StateFile), filepath.Base(lb.cfg.StateFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), lb.cfg.StateFile)
+}
+
+// sizeBuckets are the upper bounds, in bytes, of the request and response
+// size histograms.
+var sizeBuckets = []float64{512, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics holds the series exported in Prometheus text format on METRICS_PATH.
+type metrics struct {
+	requestSize      *histogramVec
+	responseSize     *histogramVec
+	dialFailureSkips *counterVec
+
+	healthChecks        *counterVec
+	healthCheckDuration *histogramVec
+	stateChanges        *counterVec
+
+	replacedErrorBodies *counterVec
+
+	throttledBytes *counterVec
+	bandwidthLimit *counterVec
+
+	intervalRequests *counterVec
+	requestShare     *counterVec
+
+	concurrencyQueued     *counterVec
+	concurrencyRejections *counterVec
+
+	backendQueueRejections *counterVec
+	backendTimeouts        *counterVec
+
+	fallbackResponses    *counterVec
+	retryBudgetExhausted *counterVec
+
+	duplicateHeaders *counterVec
+	dnsChanges       *counterVec
+
+	retryAfterBackoffs *counterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requestSize: newHistogramVec("lb_request_size_bytes",
+			"Size of request bodies read from clients, by backend.", sizeBuckets, "backend"),
+		responseSize: newHistogramVec("lb_response_size_bytes",
+			"Size of response bodies sent to clients, by backend.", sizeBuckets, "backend"),
+		dialFailureSkips: newCounterVec("lb_dial_failure_skips_total",
+			"Selections that skipped a backend because dialing it failed moments ago.", "backend"),
+
+		healthChecks: newCounterVec("lb_health_check_total",
+			"Health check probes by backend and result (pass or fail).", "backend", "result"),
+		healthCheckDuration: newHistogramVec("lb_health_check_duration_seconds",
+			"Time taken by health check probes, by backend.", durationBuckets, "backend"),
+		stateChanges: newCounterVec("lb_backend_state_changes_total",
+			"Backend health transitions (up_to_down or down_to_up), to spot flapping.", "backend", "change"),
+
+		replacedErrorBodies: newCounterVec("lb_replaced_error_bodies_total",
+			"Backend error responses whose body was replaced with the JSON error envelope.", "backend"),
+
+		throttledBytes: newCounterVec("lb_throttled_response_bytes_total",
+			"Response bytes sent through bandwidth throttling, by backend; its rate is the delivered throughput.", "backend"),
+		bandwidthLimit: newGaugeVec("lb_bandwidth_limit_bytes_per_second",
+			"Configured bandwidth caps: the aggregate one and each backend's per-response one.", "scope"),
+
+		intervalRequests: newGaugeVec("lb_backend_interval_requests",
+			"Requests proxied to each backend during the last stats interval.", "backend"),
+		requestShare: newGaugeVec("lb_backend_request_share_percent",
+			"Each backend's share of the requests in the last stats interval.", "backend"),
+
+		concurrencyQueued: newGaugeVec("lb_concurrency_queued_requests",
+			"Requests waiting for a CONCURRENCY_LIMIT slot, by priority class.", "class"),
+		concurrencyRejections: newCounterVec("lb_concurrency_rejections_total",
+			"Requests refused with 503 by the concurrency limiter, by priority class and reason (queue_full or timeout).", "class", "reason"),
+
+		backendQueueRejections: newCounterVec("lb_backend_queue_rejections_total",
+			"Requests refused with 503 by a backend's max_queue_length queue, by backend and reason (queue_full or timeout).", "backend", "reason"),
+		backendTimeouts: newCounterVec("lb_backend_timeouts_total",
+			"Backend attempts that timed out, by backend and class (attempt, dial, tls_handshake, response_header or body_idle).", "backend", "class"),
+
+		fallbackResponses: newCounterVec("lb_fallback_responses_total",
+			"Requests sent to a pool's fallback backend because none of its backends was available, by pool.", "pool"),
+		retryBudgetExhausted: newCounterVec("lb_retry_budget_exhausted_total",
+			"Failed attempts returned without a retry because RETRY_BUDGET_PERCENT was used up, by backend.", "backend"),
+
+		duplicateHeaders: newCounterVec("lb_duplicate_request_headers_total",
+			"Requests that repeated a header with a duplicate header policy, by header and the policy applied.", "header", "policy"),
+		dnsChanges: newCounterVec("lb_backend_dns_changes_total",
+			"Times DNS_REFRESH_INTERVAL found a backend's hostname resolving to different addresses, by backend.", "backend"),
+
+		retryAfterBackoffs: newCounterVec("lb_backend_retry_after_backoffs_total",
+			"429 and 503 responses whose Retry-After made the LB back off from the backend, by backend.", "backend"),
+	}
+}
+
+func (m *metrics) write(w io.Writer) {
+	m.requestSize.write(w)
+	m.responseSize.write(w)
+	m.dialFailureSkips.write(w)
+	m.healthChecks.write(w)
+	m.healthCheckDuration.write(w)
+	m.stateChanges.write(w)
+	m.replacedErrorBodies.write(w)
+	m.throttledBytes.write(w)
+	m.bandwidthLimit.write(w)
+	m.intervalRequests.write(w)
+	m.requestShare.write(w)
+	m.concurrencyQueued.write(w)
+	m.concurrencyRejections.write(w)
+	m.backendQueueRejections.write(w)
+	m.backendTimeouts.write(w)
+	m.fallbackResponses.write(w)
+	m.retryBudgetExhausted.write(w)
+	m.duplicateHeaders.write(w)
+	m.dnsChanges.write(w)
+	m.retryAfterBackoffs.write(w)
+}
+
+// counterVec is a minimal Prometheus counter partitioned by label values.
+// With kind "gauge", from newGaugeVec, its series are set rather than added
+// to.
+type counterVec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*counter
+}
+
+type counter struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name, help string, labelNames ...string) *counterVec {
+	return &counterVec{name: name, help: help, kind: "counter", labelNames: labelNames, series: make(map[string]*counter)}
+}
+
+func newGaugeVec(name, help string, labelNames ...string) *counterVec {
+	gauge := newCounterVec(name, help, labelNames...)
+	gauge.kind = "gauge"
+	return gauge
+}
+
+func (cv *counterVec) set(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	cv.series[key] = &counter{labelValues: labelValues, value: value}
+}
+
+func (cv *counterVec) inc(labelValues ...string) {
+	cv.add(1, labelValues...)
+}
+
+func (cv *counterVec) add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	c, ok := cv.series[key]
+	if !ok {
+		c = &counter{labelValues: labelValues}
+		cv.series[key] = c
+	}
+	c.value += delta
+}
+
+func (cv *counterVec) write(w io.Writer) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", cv.name, cv.help, cv.name, cv.kind)
+	keys := make([]string, 0, len(cv.series))
+	for key := range cv.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	
+	for _, key := range keys {
+		c := cv.series[key]
+		labels := strings.TrimSuffix(formatLabels(cv.labelNames, c.labelValues), ",")
+		fmt.Fprintf(w, "%s{%s} %s\n", cv.name, labels, strconv.FormatFloat(c.value, 'f', -1, 64))
+	}
+}
+
+// histogramVec is a minimal Prometheus histogram partitioned by label values.
+type histogramVec struct {
+	name       string
+	help       string
+	buckets    []float64
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative; the last entry is +Inf
+	count       uint64
+	sum         float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		buckets:    buckets,
+		labelNames: labelNames,
+		series:     make(map[string]*histogram),
+	}
+}
+
+func (hv *histogramVec) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	h, ok := hv.series[key]
+	if !ok {
+		h = &histogram{labelValues: labelValues, counts: make([]uint64, len(hv.buckets)+1)}
+		hv.series[key] = h
+	}
+	h.counts[sort.SearchFloat64s(hv.buckets, value)]++
+	h.count++
+	h.sum += value
+}
+
+// quantile estimates the q-quantile the same way Prometheus'
+// histogram_quantile does: linear interpolation inside the matching bucket.
+// Observations beyond the largest bucket report that bucket's upper bound.
+func (hv *histogramVec) quantile(q float64, labelValues ...string) float64 {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	h, ok := hv.series[strings.Join(labelValues, "\xff")]
+	if !ok || h.count == 0 {
+		return 0
+	}
+	
+	rank := q * float64(h.count)
+	var cumulative uint64
+	for i, upper := range hv.buckets {
+		if float64(cumulative+h.counts[i]) >= rank {
+			lower := 0.0
+			if i > 0 {
+				lower = hv.buckets[i-1]
+			}
+			return lower + (upper-lower)*(rank-float64(cumulative))/float64(h.counts[i])
+		}
+		cumulative += h.counts[i]
+	}
+	return hv.buckets[len(hv.buckets)-1]
+}
+
+func (hv *histogramVec) write(w io.Writer) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", hv.name, hv.help, hv.name)
+	keys := make([]string, 0, len(hv.series))
+	for key := range hv.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	
+	for _, key := range keys {
+		h := hv.series[key]
+		labels := formatLabels(hv.labelNames, h.labelValues)
+		var cumulative uint64
+		for i, upper := range hv.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", hv.name, labels, strconv.FormatFloat(upper, 'f', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", hv.name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", hv.name, strings.TrimSuffix(labels, ","), strconv.FormatFloat(h.sum, 'f', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", hv.name, strings.TrimSuffix(labels, ","), h.count)
+	}
+}
+
+// formatLabels renders label pairs with a trailing comma so callers can
+// append le="..." directly.
+func formatLabels(names, values []string) string {
+	var b strings.Builder
+	for i, name := range names {
+		fmt.Fprintf(&b, "%s=%s,", name, strconv.Quote(values[i]))
+	}
+	return b.String()
+}
+
+func (lb *LoadBalancer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	lb.metrics.write(w)
+}
+
+// forwardAuth asks an external auth service whether requests may proceed.
+type forwardAuth struct {
+	client   *http.Client
+	failOpen bool
+	headers  []string
+	cacheTTL time.Duration
+	
+	mu    sync.Mutex
+	cache map[string]*authDecision
+}
+
+// authDecision is an auth service's answer: a 2xx status, 401 or 403.
+type authDecision struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newForwardAuth(cfg *Config) *forwardAuth {
+	return &forwardAuth{
+		client: &http.Client{
+			Timeout: cfg.ForwardAuthTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		failOpen: cfg.ForwardAuthFailOpen,
+		headers:  cfg.ForwardAuthResponseHeaders,
+		cacheTTL: cfg.ForwardAuthCacheTTL,
+		cache:    make(map[string]*authDecision),
+	}
+}
+
+// authorize runs the forward auth check of the route matching r, if any. On
+// a 2xx answer the configured auth response headers replace any the client
+// sent and it reports true; 401 and 403 are relayed to the client as they
+// are. Other answers and failures follow FORWARD_AUTH_FAIL_OPEN.
+func (lb *LoadBalancer) authorize(w http.ResponseWriter, r *http.Request) bool {
+	route := lb.matchRoute(r)
+	if route == nil || route.ForwardAuthURL == "" {
+		return true
+	}
+	fa := lb.forwardAuth
+	
+	decision, err := fa.decide(r, route.ForwardAuthURL)
+	if err != nil {
+		if fa.failOpen {
+			log.Printf("[WARN] Forward auth via %s failed, letting %s %s through: %v\n", route.ForwardAuthURL, r.Method, r.URL.Path, err)
+			decision = &authDecision{header: http.Header{}}
+		} else {
+			log.Printf("[ERROR] Forward auth via %s failed for %s %s: %v\n", route.ForwardAuthURL, r.Method, r.URL.Path, err)
+			lb.writeError(w, nil, http.StatusServiceUnavailable, "Authentication service unavailable")
+			return false
+		}
+	}
+	
+	if decision.status == http.StatusUnauthorized || decision.status == http.StatusForbidden {
+		for name, values := range decision.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(decision.status)
+		w.Write(decision.body)
+		log.Printf("[INFO] Forward auth denied %s %s with %d\n", r.Method, r.URL.Path, decision.status)
+		return false
+	}
+	for _, name := range fa.headers {
+		r.Header.Del(name)
+		for _, value := range decision.header.Values(name) {
+			r.Header.Add(name, value)
+		}
+	}
+	return true
+}
+
+// decide sends the auth subrequest for r: its method and headers, without
+// the body, with the original request described in X-Forwarded-* headers.
+func (fa *forwardAuth) decide(r *http.Request, authURL string) (*authDecision, error) {
+	key := ""
+	if token := r.Header.Get("Authorization"); token != "" && fa.cacheTTL > 0 {
+		key = authURL + " " + token
+		fa.mu.Lock()
+		decision := fa.cache[key]
+		fa.mu.Unlock()
+		if decision != nil && time.Now().Before(decision.expires) {
+			return decision, nil
+		}
+	}
+	
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, authURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	for _, name := range []string{"Connection", "Content-Length", "Expect", "Te", "Trailer", "Transfer-Encoding", "Upgrade"} {
+		req.Header.Del(name)
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+		req.Header.Set("X-Forwarded-For", clientIP)
+	}
+	
+	resp, err := fa.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !ok && resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		return nil, fmt.Errorf("auth service returned status %d", resp.StatusCode)
+	}
+	
+	decision := &authDecision{status: resp.StatusCode, header: resp.Header, body: body, expires: time.Now().Add(fa.cacheTTL)}
+	if key != "" {
+		fa.mu.Lock()
+		if len(fa.cache) >= 10000 {
+			now := time.Now()
+			for k, cached := range fa.cache {
+				if now.After(cached.expires) {
+					delete(fa.cache, k)
+				}
+			}
+		}
+		fa.cache[key] = decision
+		fa.mu.Unlock()
+	}
+	return decision, nil
+}
+
+// serveMock answers r from the first matching mock rule. It reports false
+// when no rule matches so the request falls through to the backends.
+func (lb *LoadBalancer) serveMock(w http.ResponseWriter, r *http.Request) bool {
+	for _, rule := range lb.cfg.MockRules {
+		if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+			continue
+		}
+		if !matchPathPattern(rule.PathPattern, r.URL.Path) {
+			continue
+		}
+		
+		for name, value := range rule.ResponseHeaders {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(rule.ResponseStatus)
+		if r.Method != http.MethodHead {
+			io.WriteString(w, rule.ResponseBody)
+		}
+		log.Printf("[INFO] Served mock response %d for %s %s\n", rule.ResponseStatus, r.Method, r.URL.Path)
+		return true
+	}
+	return false
+}
+
+// serveUtility answers r from the first utility path matching it, checking
+// the configured ones before the defaults. It reports whether the response
+// has been written.
+func (lb *LoadBalancer) serveUtility(w http.ResponseWriter, r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, acmeChallengePrefix) {
+		return false
+	}
+	for _, rules := range [][]UtilityPath{lb.cfg.UtilityPaths, defaultUtilityPaths} {
+		for _, rule := range rules {
+			if !matchPathPattern(rule.PathPattern, r.URL.Path) {
+				continue
+			}
+			if rule.Proxy {
+				return false
+			}
+			
+			for name, value := range rule.ResponseHeaders {
+				w.Header().Set(name, value)
+			}
+			w.WriteHeader(rule.ResponseStatus)
+			if r.Method != http.MethodHead {
+				io.WriteString(w, rule.ResponseBody)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// injectChaos applies the first chaos rule matching r, if its dice roll
+// fires: it sleeps for LatencyMs and then, if ErrorCode is set, answers with
+// that status. It reports whether the response has been written.
+func (lb *LoadBalancer) injectChaos(w http.ResponseWriter, r *http.Request) bool {
+	for _, rule := range lb.cfg.ChaosRules {
+		if !matchPathPattern(rule.PathPattern, r.URL.Path) {
+			continue
+		}
+		if rule.Probability <= 0 || rand.Float64() >= rule.Probability {
+			return false
+		}
+		
+		if rule.LatencyMs > 0 {
+			log.Printf("[INFO] Chaos: delaying %s %s by %dms\n", r.Method, r.URL.Path, rule.LatencyMs)
+			select {
+			case <-time.After(time.Duration(rule.LatencyMs) * time.Millisecond):
+			case <-r.Context().Done():
+				return true
+			}
+		}
+		if rule.ErrorCode > 0 {
+			log.Printf("[INFO] Chaos: failing %s %s with %d\n", r.Method, r.URL.Path, rule.ErrorCode)
+			http.Error(w, "Chaos injected error", rule.ErrorCode)
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// matchPathPattern matches a request path against a pattern: a trailing "*"
+// is a prefix match, otherwise path.Match glob syntax applies.
+func matchPathPattern(pattern, requestPath string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok && !strings.ContainsAny(prefix, "*?[") {
+		return strings.HasPrefix(requestPath, prefix)
+	}
+	matched, err := path.Match(pattern, requestPath)
+	return err == nil && matched
+}
+
+// checkPathPattern reports a pattern that matchPathPattern could never match
+// because path.Match rejects it.
+func checkPathPattern(pattern string) error {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok && !strings.ContainsAny(prefix, "*?[") {
+		return nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid path_pattern %q: %v", pattern, err)
+	}
+	return nil
+}
+
+// connTracker counts open connections per client IP. Connections beyond
+// the limit are accepted but answered with 429 and closed on their first
+// request, which is friendlier to clients than a bare reset.
+type connTracker struct {
+	limit  int
+	exempt []*net.IPNet
+	
+	mu       sync.Mutex
+	counts   map[string]int
+	rejected int64
+}
+
+type ConnStats struct {
+	Limit      int               `json:"limit"`
+	Open       int               `json:"open"`
+	Rejected   int64             `json:"rejected"`
+	TopClients []ClientConnCount `json:"top_clients"`
+}
+
+type ClientConnCount struct {
+	Client      string `json:"client"`
+	Connections int    `json:"connections"`
+}
+
+func newConnTracker(limit int, exempt []*net.IPNet) *connTracker {
+	return &connTracker{limit: limit, exempt: exempt, counts: make(map[string]int)}
+}
+
+// connContext is used as http.Server.ConnContext; it runs once per accepted
+// connection, before any request is read.
+func (ct *connTracker) connContext(ctx context.Context, c net.Conn) context.Context {
+	ip := clientIP(c.RemoteAddr().String())
+	
+	ct.mu.Lock()
+	ct.counts[ip]++
+	over := ct.counts[ip] > ct.limit && !ipInCIDRs(ip, ct.exempt)
+	if over {
+		ct.rejected++
+	}
+	ct.mu.Unlock()
+	
+	if over {
+		log.Printf("[WARN] Client %s exceeded %d concurrent connections\n", ip, ct.limit)
+		return context.WithValue(ctx, connOverLimitKey, true)
+	}
+	return ctx
+}
+
+// connState is used as http.Server.ConnState to release closed connections.
+func (ct *connTracker) connState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	ip := clientIP(c.RemoteAddr().String())
+	
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.counts[ip] <= 1 {
+		delete(ct.counts, ip)
+	} else {
+		ct.counts[ip]--
+	}
+}
+
+func (ct *connTracker) stats(top int) ConnStats {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	
+	stats := ConnStats{Limit: ct.limit, Rejected: ct.rejected, TopClients: []ClientConnCount{}}
+	for ip, n := range ct.counts {
+		stats.Open += n
+		stats.TopClients = append(stats.TopClients, ClientConnCount{Client: ip, Connections: n})
+	}
+	sort.Slice(stats.TopClients, func(i, j int) bool {
+		return stats.TopClients[i].Connections > stats.TopClients[j].Connections
+	})
+	if len(stats.TopClients) > top {
+		stats.TopClients = stats.TopClients[:top]
+	}
+	return stats
+}
+
+// rateLimitSweepInterval is how often rateLimiter forgets clients whose
+// buckets have refilled, which would behave the same if recreated.
+const rateLimitSweepInterval = time.Minute
+
+// rateLimitHeaders are the headers rateLimiter.allow sets.
+var rateLimitHeaders = []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"}
+
+// rateLimiter gives each client IP a token bucket of requests. A backend's
+// rate_limit_rps uses one keyed by its URL.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate, burst int64) *rateLimiter {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &rateLimiter{rate: float64(rate), burst: float64(burst), buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// allow takes a request from client's bucket and sets the X-RateLimit-*
+// headers from what is left: Limit is the burst, Remaining the whole
+// requests left and Reset the seconds until the bucket is full again. When
+// the bucket is empty it also sets Retry-After and returns false; the
+// caller sends the 429.
+func (rl *rateLimiter) allow(w http.ResponseWriter, client string) bool {
+	now := time.Now()
+	rl.mu.Lock()
+	if now.Sub(rl.lastSweep) >= rateLimitSweepInterval {
+		for ip, bucket := range rl.buckets {
+			if bucket.full(now) {
+				delete(rl.buckets, ip)
+			}
+		}
+		rl.lastSweep = now
+	}
+	bucket := rl.buckets[client]
+	if bucket == nil {
+		bucket = newTokenBucket(int64(rl.rate), int64(rl.burst))
+		rl.buckets[client] = bucket
+	}
+	rl.mu.Unlock()
+	
+	ok, left, wait := bucket.take()
+	reset := math.Ceil((rl.burst - left) / rl.rate)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(rl.burst)))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(max(left, 0))))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(reset)))
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	return ok
+}
+
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func ipInCIDRs(ip string, nets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// newServer builds the HTTP server for the load balancer, wiring in the
+// per-client connection tracking hooks when enabled.
+func (lb *LoadBalancer) newServer(listener *ListenerConfig) *http.Server {
+	srv := &http.Server{
+		Addr:    listener.Address,
+		Handler: lb,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			ctx = context.WithValue(ctx, listenerKey, listener)
+			if lb.conns != nil {
+				ctx = lb.conns.connContext(ctx, c)
+			}
+			return ctx
+		},
+	}
+	if lb.conns != nil {
+		srv.ConnState = lb.conns.connState
+	}
+	if lb.cfg.ClientConnectionClose {
+		// Every response then carries "Connection: close".
+		srv.SetKeepAlivesEnabled(false)
+	}
+	return srv
+}
+
+// listenAndServe binds every listener before serving on any, so startup
+// fails outright if one address can't be bound, then serves until one
+// listener fails or ctx is done. A failed listener closes all the others;
+// on ctx the instance is deregistered and the servers shut down gracefully,
+// giving in-flight requests up to shutdownTimeout to finish. With
+// HTTP3_ENABLED each listener also binds the UDP port of its TCP one.
+func (lb *LoadBalancer) listenAndServe(ctx context.Context) error {
+	tlsConfig, err := lb.cfg.serverTLSConfig()
+	if err != nil {
+		return err
+	}
+	
+	var listeners []net.Listener
+	var packetConns []net.PacketConn
+	closeBound := func() {
+		for _, bound := range listeners {
+			bound.Close()
+		}
+		for _, bound := range packetConns {
+			bound.Close()
+		}
+	}
+	for _, listener := range lb.cfg.Listeners {
+		ln, err := net.Listen("tcp", listener.Address)
+		if err != nil {
+			closeBound()
+			return fmt.Errorf("listening on %s: %w", listener.Address, err)
+		}
+		if lb.cfg.HTTP3Enabled {
+			// The bound address, so port 0 gets the same port for both.
+			pc, err := net.ListenPacket("udp", ln.Addr().String())
+			if err != nil {
+				ln.Close()
+				closeBound()
+				return fmt.Errorf("listening on %s for HTTP/3: %w", listener.Address, err)
+			}
+			packetConns = append(packetConns, pc)
+		}
+		if lb.cfg.ProxyProtocol || listener.ProxyProtocol {
+			ln = newProxyProtocolListener(ln, lb.proxyTrusted)
+		}
+		listeners = append(listeners, ln)
+	}
+	
+	servers := make([]*http.Server, len(listeners))
+	quicServers := make([]*http3.Server, len(packetConns))
+	errs := make(chan error, len(listeners)+len(packetConns))
+	for i, ln := range listeners {
+		listener := &lb.cfg.Listeners[i]
+		servers[i] = lb.newServer(listener)
+		servers[i].TLSConfig = tlsConfig
+		log.Printf("[INFO] Load balancer listening on %s (default pool: %s, internal: %t, tls: %t)\n",
+			ln.Addr(), cmp.Or(listener.DefaultPool, lb.cfg.DefaultPool), listener.Internal, tlsConfig != nil)
+		if lb.cfg.HTTP3Enabled {
+			pc := packetConns[i]
+			quicServers[i] = lb.newHTTP3Server(listener, tlsConfig)
+			servers[i].Handler = advertiseHTTP3(servers[i].Handler, pc.LocalAddr())
+			log.Printf("[INFO] Serving HTTP/3 on %s/udp (experimental)\n", pc.LocalAddr())
+			go func() {
+				errs <- quicServers[i].Serve(pc)
+			}()
+		}
+		go func() {
+			if tlsConfig != nil {
+				errs <- servers[i].ServeTLS(ln, "", "")
+				return
+			}
+			errs <- servers[i].Serve(ln)
+		}()
+	}
+	defer func() {
+		for _, pc := range packetConns {
+			pc.Close()
+		}
+	}()
+	
+	if lb.registrar != nil {
+		go lb.registrar.run(ctx)
+	}
+	
+	select {
+	case err := <-errs:
+		for _, srv := range servers {
+			srv.Close()
+		}
+		for _, srv := range quicServers {
+			srv.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+	
+	log.Println("[INFO] Shutting down...")
+	lb.events.close()
+	if lb.registrar != nil {
+		lb.registrar.deregister()
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				log.Printf("[WARN] Closing %s with requests still in flight: %v\n", srv.Addr, err)
+				srv.Close()
+			}
+		}()
+	}
+	for _, srv := range quicServers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Shutdown closes whatever is still open once shutdownCtx ends.
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				log.Printf("[WARN] Closed HTTP/3 connections with requests still in flight: %v\n", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if lb.requestTrace != nil {
+		lb.requestTrace.close()
+	}
+	return nil
+}
+
+const shutdownTimeout = 30 * time.Second
+
+// serverTLSConfig loads TLS_CERT and TLS_KEY, or TLS_CERT_FILE and
+// TLS_KEY_FILE, returning nil when the listeners serve plain HTTP.
+func (c *Config) serverTLSConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case c.TLSCert != "":
+		if cert, err = tls.X509KeyPair([]byte(c.TLSCert), []byte(c.TLSKey)); err != nil {
+			return nil, fmt.Errorf("parsing TLS_CERT and TLS_KEY: %w", err)
+		}
+	case c.TLSCertFile != "":
+		if cert, err = tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile); err != nil {
+			return nil, fmt.Errorf("loading TLS_CERT_FILE and TLS_KEY_FILE: %w", err)
+		}
+	default:
+		return nil, nil
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// newHTTP3Server serves listener's traffic over QUIC with the same handler.
+// MAX_CONNS_PER_CLIENT and the PROXY protocol only apply to its TCP side.
+func (lb *LoadBalancer) newHTTP3Server(listener *ListenerConfig, tlsConfig *tls.Config) *http3.Server {
+	return &http3.Server{
+		Handler:   lb,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+		ConnContext: func(ctx context.Context, _ *quic.Conn) context.Context {
+			return context.WithValue(ctx, listenerKey, listener)
+		},
+	}
+}
+
+// advertiseHTTP3 points HTTP/1.1 and HTTP/2 clients at the HTTP/3 server on
+// addr's port with an Alt-Svc header.
+func advertiseHTTP3(next http.Handler, addr net.Addr) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=86400`, addr.(*net.UDPAddr).Port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Alt-Svc", altSvc)
+		next.ServeHTTP(w, r)
+	})
+}
+
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyProtocolListener reads the PROXY protocol (v1 or v2) header of each
+// accepted connection and reports the client address it carries as the
+// connection's RemoteAddr. Headers are read off the accept path, so a slow
+// peer can't stall other connections. Peers outside trusted and connections
+// without a valid header are closed.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newProxyProtocolListener(inner net.Listener, trusted []*net.IPNet) *proxyProtocolListener {
+	l := &proxyProtocolListener{
+		Listener: inner,
+		trusted:  trusted,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyProtocolListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.errs <- err
+			return
+		}
+		go l.handshake(c)
+	}
+}
+
+func (l *proxyProtocolListener) handshake(c net.Conn) {
+	peer := c.RemoteAddr().String()
+	if !ipInCIDRs(clientIP(peer), l.trusted) {
+		log.Printf("[WARN] Rejecting connection from untrusted PROXY protocol peer %s\n", peer)
+		c.Close()
+		return
+	}
+	
+	c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	reader := bufio.NewReader(c)
+	remote, err := readProxyHeader(reader)
+	if err != nil {
+		log.Printf("[WARN] Rejecting connection from %s: %v\n", peer, err)
+		c.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	if remote == nil {
+		remote = c.RemoteAddr()
+	}
+	
+	select {
+	case l.conns <- &proxyProtocolConn{Conn: c, reader: reader, remote: remote}:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyProtocolListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader consumes a PROXY protocol header and returns the source
+// address it names, or nil when the header carries none (v1 UNKNOWN, v2
+// LOCAL or a non-TCP family).
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	prefix, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %w", err)
+	}
+	if bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyHeaderV2(reader)
+	}
+	if bytes.HasPrefix(prefix, []byte("PROXY ")) {
+		return readProxyHeaderV1(reader)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyHeaderV1 parses "PROXY TCP4|TCP6 <src> <dst> <sport> <dport>\r\n".
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+	
+	fields := strings.Fields(text)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", text)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", text)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	command, family := header[12]&0x0f, header[13]
+	payload := make([]byte, int(header[14])<<8|int(header[15]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 addresses: %w", err)
+	}
+	
+	if command == 0x0 {
+		// LOCAL: the proxy's own connection, e.g. a health check.
+		return nil, nil
+	}
+	if command != 0x1 {
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", command)
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(payload[8])<<8 | int(payload[9])}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(payload[32])<<8 | int(payload[33])}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// coalescer collapses identical in-flight GET/HEAD requests into a single
+// upstream request and fans the buffered response out to every waiter.
+type coalescer struct {
+	maxWaiters   int
+	maxBodyBytes int64
+	keyHeaders   []string
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+
+	leaders   atomic.Int64
+	coalesced atomic.Int64
+	bypassed  atomic.Int64
+	oversized atomic.Int64
+}
+
+type coalescedCall struct {
+	done     chan struct{}
+	waiters  int
+	status   int
+	header   http.Header
+	body     []byte
+	oversize bool
+}
+
+func newCoalescer(maxWaiters int, maxBodyBytes int64, keyHeaders []string) *coalescer {
+	return &coalescer{
+		maxWaiters:   maxWaiters,
+		maxBodyBytes: maxBodyBytes,
+		keyHeaders:   keyHeaders,
+		calls:        make(map[string]*coalescedCall),
+	}
+}
+
+func (c *coalescer) eligible(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.ContentLength == 0 && r.Header.Get("Upgrade") == ""
+}
+
+func (c *coalescer) key(r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(r.Method)
+	sb.WriteByte(' ')
+	sb.WriteString(r.Host)
+	sb.WriteString(r.URL.RequestURI())
+	for _, name := range c.keyHeaders {
+		sb.WriteByte('\n')
+		sb.WriteString(name)
+		sb.WriteByte(':')
+		sb.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return sb.String()
+}
+
+func (c *coalescer) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	key := c.key(r)
+	
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		if call.waiters >= c.maxWaiters {
+			c.mu.Unlock()
+			c.bypassed.Add(1)
+			next(w, r)
+			return
+		}
+		call.waiters++
+		c.mu.Unlock()
+		c.wait(w, r, call, next)
+		return
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+	
+	c.leaders.Add(1)
+	rec := &coalesceRecorder{ResponseWriter: w, max: c.maxBodyBytes}
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		
+		call.status = rec.status
+		if call.status == 0 {
+			call.status = http.StatusOK
+		}
+		call.header = rec.header
+		if call.header == nil {
+			call.header = w.Header().Clone()
+		}
+		call.body = rec.body.Bytes()
+		call.oversize = rec.oversize
+		close(call.done)
+	}()
+	
+	next(rec, r)
+}
+
+func (c *coalescer) wait(w http.ResponseWriter, r *http.Request, call *coalescedCall, next http.HandlerFunc) {
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		return
+	}
+	
+	// Responses too large to buffer are not shared; each waiter fetches its own.
+	if call.oversize {
+		c.oversized.Add(1)
+		next(w, r)
+		return
+	}
+	
+	c.coalesced.Add(1)
+	for name, values := range call.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.WriteHeader(call.status)
+	if r.Method != http.MethodHead {
+		w.Write(call.body)
+	}
+}
+
+// coalesceRecorder writes through to the leader's client while keeping a
+// bounded copy of the response for the waiters.
+type coalesceRecorder struct {
+	http.ResponseWriter
+	max      int64
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	oversize bool
+}
+
+func (rec *coalesceRecorder) WriteHeader(status int) {
+	if rec.status == 0 && status >= 200 {
+		rec.status = status
+		rec.header = rec.ResponseWriter.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *coalesceRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.oversize {
+		if int64(rec.body.Len()+len(p)) > rec.max {
+			rec.oversize = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+func (rec *coalesceRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *coalesceRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// idempotencyCache makes requests with the same Idempotency-Key reach the
+// backend once. Repeats that arrive while the first is in flight wait for
+// it; later ones within the TTL get its stored response replayed. Only
+// final answers are stored: 2xx and 4xx other than 408, 425 and 429. After
+// anything else the key is forgotten so the client can retry. Keys are
+// scoped to the method, path and Authorization header, so one client can't
+// replay another's response.
+type idempotencyCache struct {
+	ttl              time.Duration
+	maxResponseBytes int64
+	maxBytes         int64
+	
+	mu     sync.Mutex
+	calls  map[string]*idempotentCall
+	order  []*idempotentCall // completed calls, oldest first
+	stored int64             // size of the completed calls in calls
+	
+	forwarded atomic.Int64
+	replayed  atomic.Int64
+	conflicts atomic.Int64
+}
+
+type idempotentCall struct {
+	key        string
+	done       chan struct{}
+	expires    time.Time // zero while in flight
+	size       int64
+	status     int
+	header     http.Header
+	body       []byte
+	replayable bool // false when the body was too large to keep
+}
+
+func newIdempotencyCache(ttl time.Duration, maxResponseBytes, maxBytes int64) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:              ttl,
+		maxResponseBytes: maxResponseBytes,
+		maxBytes:         maxBytes,
+		calls:            make(map[string]*idempotentCall),
+	}
+}
+
+func (c *idempotencyCache) key(r *http.Request) string {
+	auth := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return r.Method + " " + r.Host + r.URL.Path + "\n" + r.Header.Get("Idempotency-Key") + "\n" + hex.EncodeToString(auth[:])
+}
+
+func (c *idempotencyCache) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	key := c.key(r)
+	
+	c.mu.Lock()
+	c.evict()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		c.repeat(w, r, call, next)
+		return
+	}
+	call := &idempotentCall{key: key, done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+	
+	c.forwarded.Add(1)
+	rec := &coalesceRecorder{ResponseWriter: w, max: c.maxResponseBytes}
+	defer c.finish(call, rec)
+	next(rec, r)
+}
+
+// finish stores the outcome of call, or forgets the key if the response
+// isn't a final answer.
+func (c *idempotencyCache) finish(call *idempotentCall, rec *coalesceRecorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(call.done)
+	
+	status := rec.status
+	final := (status >= 200 && status < 300) || (status >= 400 && status < 500 &&
+		status != http.StatusRequestTimeout && status != http.StatusTooEarly && status != http.StatusTooManyRequests)
+	if !final {
+		delete(c.calls, call.key)
+		return
+	}
+	
+	call.status = status
+	call.header = rec.header
+	call.replayable = !rec.oversize
+	if call.replayable {
+		call.body = rec.body.Bytes()
+	}
+	call.size = int64(len(call.key)+len(call.body)) + headerBytes(call.header)
+	call.expires = time.Now().Add(c.ttl)
+	c.stored += call.size
+	c.order = append(c.order, call)
+	c.evict()
+}
+
+// repeat answers a request whose key is already known, once the first
+// request with it has finished.
+func (c *idempotencyCache) repeat(w http.ResponseWriter, r *http.Request, call *idempotentCall, next http.HandlerFunc) {
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		return
+	}
+	
+	c.mu.Lock()
+	current := c.calls[call.key] == call
+	c.mu.Unlock()
+	if !current {
+		// The first attempt didn't produce a final answer; try again.
+		c.serve(w, r, next)
+		return
+	}
+	if !call.replayable {
+		c.conflicts.Add(1)
+		http.Error(w, "A request with this Idempotency-Key was already processed; its response is too large to replay", http.StatusConflict)
+		return
+	}
+	
+	c.replayed.Add(1)
+	for name, values := range call.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(call.status)
+	if r.Method != http.MethodHead {
+		w.Write(call.body)
+	}
+}
+
+// evict drops expired calls and, while over maxBytes, the oldest completed
+// ones. Calls in flight aren't in c.order, so a slow one holds up neither.
+// Caller must hold c.mu.
+func (c *idempotencyCache) evict() {
+	now := time.Now()
+	for len(c.order) > 0 {
+		oldest := c.order[0]
+		if c.calls[oldest.key] == oldest {
+			if now.Before(oldest.expires) && c.stored <= c.maxBytes {
+				break
+			}
+			delete(c.calls, oldest.key)
+			c.stored -= oldest.size
+		}
+		c.order[0] = nil
+		c.order = c.order[1:]
+	}
+}
+
+// grpcTranscoder serves HTTP/JSON requests as unary gRPC calls, using the
+// services in a FileDescriptorSet. Every unary method answers POST
+// /package.Service/Method with the request message as the JSON body, and
+// methods with a google.api.http option also get their annotated bindings.
+// Messages are converted by hand, following the proto3 JSON mapping for
+// scalars, enums, nested and repeated messages and maps; well-known types
+// such as Timestamp are treated as the ordinary messages they are on the
+// wire, and streaming methods are not transcoded.
+type grpcTranscoder struct {
+	messages  map[string]*protoMessage // by full name, without the leading dot
+	enums     map[string]*protoEnum
+	rules     []*transcodeRule
+	streaming []string // methods left to native gRPC clients
+	
+	mu         sync.Mutex
+	transports map[string]*http.Transport // for backends not on the http2 transport
+}
+
+type protoMessage struct {
+	name     string
+	fields   []*protoField
+	byNumber map[int]*protoField
+	byName   map[string]*protoField // proto and JSON names
+	mapEntry bool
+}
+
+type protoField struct {
+	name     string
+	jsonName string
+	number   int
+	typ      int // FieldDescriptorProto.Type
+	typeName string
+	repeated bool
+}
+
+type protoEnum struct {
+	byName   map[string]int32
+	byNumber map[int32]string
+}
+
+// transcodeRule binds an HTTP method and path template to a gRPC method.
+// body is "" for no body, "*" for the whole request message or the name of
+// the field the body fills; responseBody likewise picks the response field
+// returned, if any.
+type transcodeRule struct {
+	httpMethod   string
+	path         *regexp.Regexp
+	pathFields   []string
+	body         string
+	responseBody string
+	grpcMethod   string // /package.Service/Method
+	input        string
+	output       string
+}
+
+// Protobuf field types, from descriptor.proto.
+const (
+	protoDouble   = 1
+	protoFloat    = 2
+	protoInt64    = 3
+	protoUint64   = 4
+	protoInt32    = 5
+	protoFixed64  = 6
+	protoFixed32  = 7
+	protoBool     = 8
+	protoString   = 9
+	protoMessageT = 11
+	protoBytes    = 12
+	protoUint32   = 13
+	protoEnumT    = 14
+	protoSfixed32 = 15
+	protoSfixed64 = 16
+	protoSint32   = 17
+	protoSint64   = 18
+)
+
+// httpRuleExtension is the field number of the google.api.http method option.
+const httpRuleExtension = 72295728
+
+// maxTranscodeMessageBytes matches gRPC's default maximum message size.
+const maxTranscodeMessageBytes = 4 << 20
+
+var errMalformedProto = errors.New("malformed protobuf message")
+
+// protoFields walks an encoded protobuf message, calling fn with each
+// field's number and wire type, and its value for varint and fixed fields
+// or its bytes for length-delimited ones.
+func protoFields(msg []byte, fn func(num, wireType int, value uint64, data []byte) error) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errMalformedProto
+		}
+		msg = msg[n:]
+	
+		var value uint64
+		var data []byte
+		switch tag & 7 {
+		case 0:
+			value, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return errMalformedProto
+			}
+			msg = msg[n:]
+		case 1:
+			if len(msg) < 8 {
+				return errMalformedProto
+			}
+			value, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case 2:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < length {
+				return errMalformedProto
+			}
+			data, msg = msg[n:n+int(length)], msg[n+int(length):]
+		case 5:
+			if len(msg) < 4 {
+				return errMalformedProto
+			}
+			value, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", tag&7)
+		}
+		if err := fn(int(tag>>3), int(tag&7), value, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadGRPCTranscoder reads a FileDescriptorSet, as written by protoc
+// --include_imports --descriptor_set_out, and builds the transcoding rules
+// for its unary methods.
+func loadGRPCTranscoder(path string) (*grpcTranscoder, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &grpcTranscoder{
+		messages:   make(map[string]*protoMessage),
+		enums:      make(map[string]*protoEnum),
+		transports: make(map[string]*http.Transport),
+	}
+	var annotated, defaults []*transcodeRule
+	err = protoFields(data, func(num, _ int, _ uint64, file []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var pkg string
+		var messages, enums, services [][]byte
+		if err := protoFields(file, func(num, _ int, _ uint64, data []byte) error {
+			switch num {
+			case 2:
+				pkg = string(data)
+			case 4:
+				messages = append(messages, data)
+			case 5:
+				enums = append(enums, data)
+			case 6:
+				services = append(services, data)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	
+		prefix := ""
+		if pkg != "" {
+			prefix = pkg + "."
+		}
+		for _, message := range messages {
+			if err := t.addMessage(prefix, message); err != nil {
+				return err
+			}
+		}
+		for _, enum := range enums {
+			if err := t.addEnum(prefix, enum); err != nil {
+				return err
+			}
+		}
+		for _, service := range services {
+			serviceAnnotated, serviceDefaults, err := t.addService(prefix, service)
+			if err != nil {
+				return err
+			}
+			annotated = append(annotated, serviceAnnotated...)
+			defaults = append(defaults, serviceDefaults...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	
+	// Annotated bindings are more specific than the catch-all defaults.
+	t.rules = append(annotated, defaults...)
+	if len(t.rules) == 0 {
+		return nil, fmt.Errorf("%s has no unary gRPC methods", path)
+	}
+	if err := t.checkTypes(); err != nil {
+		return nil, fmt.Errorf("%s: %w (was it built with --include_imports?)", path, err)
+	}
+	return t, nil
+}
+
+// addMessage registers a DescriptorProto and its nested types.
+func (t *grpcTranscoder) addMessage(prefix string, data []byte) error {
+	msg := &protoMessage{byNumber: make(map[int]*protoField), byName: make(map[string]*protoField)}
+	var nested, enums [][]byte
+	err := protoFields(data, func(num, _ int, value uint64, data []byte) error {
+		switch num {
+		case 1:
+			msg.name = prefix + string(data)
+		case 2:
+			field, err := parseProtoField(data)
+			if err != nil {
+				return err
+			}
+			msg.fields = append(msg.fields, field)
+			msg.byNumber[field.number] = field
+			msg.byName[field.name] = field
+			msg.byName[field.jsonName] = field
+		case 3:
+			nested = append(nested, data)
+		case 4:
+			enums = append(enums, data)
+		case 7:
+			// MessageOptions.map_entry
+			return protoFields(data, func(num, _ int, value uint64, _ []byte) error {
+				if num == 7 {
+					msg.mapEntry = value != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	
+	t.messages[msg.name] = msg
+	for _, data := range nested {
+		if err := t.addMessage(msg.name+".", data); err != nil {
+			return err
+		}
+	}
+	for _, data := range enums {
+		if err := t.addEnum(msg.name+".", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseProtoField(data []byte) (*protoField, error) {
+	field := &protoField{}
+	err := protoFields(data, func(num, _ int, value uint64, data []byte) error {
+		switch num {
+		case 1:
+			field.name = string(data)
+		case 3:
+			field.number = int(value)
+		case 4:
+			field.repeated = value == 3 // LABEL_REPEATED
+		case 5:
+			field.typ = int(value)
+		case 6:
+			field.typeName = strings.TrimPrefix(string(data), ".")
+		case 10:
+			field.jsonName = string(data)
+		}
+		return nil
+	})
+	if field.typ == 10 {
+		return nil, fmt.Errorf("field %s is a group, which is not supported", field.name)
+	}
+	if field.jsonName == "" {
+		field.jsonName = protoJSONName(field.name)
+	}
+	return field, err
+}
+
+// protoJSONName is protoc's default json_name: snake_case to lowerCamelCase.
+func protoJSONName(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, c := range name {
+		switch {
+		case c == '_':
+			upper = true
+		case upper && c >= 'a' && c <= 'z':
+			b.WriteRune(c - 'a' + 'A')
+			upper = false
+		default:
+			b.WriteRune(c)
+			upper = false
+		}
+	}
+	return b.String()
+}
+
+func (t *grpcTranscoder) addEnum(prefix string, data []byte) error {
+	enum := &protoEnum{byName: make(map[string]int32), byNumber: make(map[int32]string)}
+	var name string
+	err := protoFields(data, func(num, _ int, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			name = prefix + string(data)
+		case 2:
+			var valueName string
+			var number int32
+			if err := protoFields(data, func(num, _ int, value uint64, data []byte) error {
+				switch num {
+				case 1:
+					valueName = string(data)
+				case 2:
+					number = int32(value)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			enum.byName[valueName] = number
+			if _, ok := enum.byNumber[number]; !ok { // the first alias names the value
+				enum.byNumber[number] = valueName
+			}
+		}
+		return nil
+	})
+	t.enums[name] = enum
+	return err
+}
+
+// addService builds the rules for a ServiceDescriptorProto's unary methods:
+// those from google.api.http options, and the default POST for each.
+// Streaming methods are only noted.
+func (t *grpcTranscoder) addService(prefix string, data []byte) ([]*transcodeRule, []*transcodeRule, error) {
+	var service string
+	var methods [][]byte
+	if err := protoFields(data, func(num, _ int, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			service = prefix + string(data)
+		case 2:
+			methods = append(methods, data)
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	
+	var annotated, defaults []*transcodeRule
+	for _, data := range methods {
+		var name, input, output string
+		var options []byte
+		streaming := false
+		if err := protoFields(data, func(num, _ int, value uint64, data []byte) error {
+			switch num {
+			case 1:
+				name = string(data)
+			case 2:
+				input = strings.TrimPrefix(string(data), ".")
+			case 3:
+				output = strings.TrimPrefix(string(data), ".")
+			case 4:
+				options = data
+			case 5, 6:
+				streaming = streaming || value != 0
+			}
+			return nil
+		}); err != nil {
+			return nil, nil, err
+		}
+		if streaming {
+			t.streaming = append(t.streaming, service+"/"+name)
+			continue
+		}
+	
+		base := transcodeRule{grpcMethod: "/" + service + "/" + name, input: input, output: output}
+		defaultRule := base
+		defaultRule.httpMethod, defaultRule.body = http.MethodPost, "*"
+		defaultRule.path = regexp.MustCompile("^" + regexp.QuoteMeta(base.grpcMethod) + "$")
+		defaults = append(defaults, &defaultRule)
+	
+		err := protoFields(options, func(num, _ int, _ uint64, data []byte) error {
+			if num != httpRuleExtension {
+				return nil
+			}
+			rules, err := parseHTTPRule(base, data)
+			annotated = append(annotated, rules...)
+			return err
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("method %s/%s: %w", service, name, err)
+		}
+	}
+	return annotated, defaults, nil
+}
+
+// parseHTTPRule reads a google.api.HttpRule and its additional bindings.
+func parseHTTPRule(base transcodeRule, data []byte) ([]*transcodeRule, error) {
+	rule := base
+	var template string
+	var additional [][]byte
+	err := protoFields(data, func(num, _ int, _ uint64, data []byte) error {
+		switch num {
+		case 2, 3, 4, 5, 6:
+			rule.httpMethod = []string{2: "GET", 3: "PUT", 4: "POST", 5: "DELETE", 6: "PATCH"}[num]
+			template = string(data)
+		case 7:
+			rule.body = string(data)
+		case 8:
+			// CustomHttpPattern
+			return protoFields(data, func(num, _ int, _ uint64, data []byte) error {
+				switch num {
+				case 1:
+					rule.httpMethod = string(data)
+				case 2:
+					template = string(data)
+				}
+				return nil
+			})
+		case 11:
+			additional = append(additional, data)
+		case 12:
+			rule.responseBody = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rule.httpMethod == "" || template == "" {
+		return nil, errors.New("google.api.http option has no pattern")
+	}
+	if rule.path, rule.pathFields, err = compilePathTemplate(template); err != nil {
+		return nil, err
+	}
+	
+	rules := []*transcodeRule{&rule}
+	for _, data := range additional {
+		more, err := parseHTTPRule(base, data)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, more...)
+	}
+	return rules, nil
+}
+
+// compilePathTemplate turns an HttpRule path template such as
+// "/v1/{name=shelves/*}/books/{id}:publish" into a regexp with one group per
+// variable, returning the variables' field paths in group order.
+func compilePathTemplate(template string) (*regexp.Regexp, []string, error) {
+	var pattern strings.Builder
+	var fields []string
+	pattern.WriteString("^")
+	for rest := template; rest != ""; {
+		if rest[0] == '{' {
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return nil, nil, fmt.Errorf("unclosed variable in path template %q", template)
+			}
+			field, segments, ok := strings.Cut(rest[1:end], "=")
+			if !ok {
+				segments = "*"
+			}
+			fields = append(fields, field)
+			pattern.WriteString("(" + templateSegments(segments) + ")")
+			rest = rest[end+1:]
+			continue
+		}
+		end := strings.IndexByte(rest, '{')
+		if end < 0 {
+			end = len(rest)
+		}
+		pattern.WriteString(templateSegments(rest[:end]))
+		rest = rest[end:]
+	}
+	pattern.WriteString("$")
+	re, err := regexp.Compile(pattern.String())
+	return re, fields, err
+}
+
+// templateSegments translates the "*" and "**" wildcards in a run of path
+// template segments, quoting everything else.
+func templateSegments(segments string) string {
+	parts := strings.Split(segments, "/")
+	for i, part := range parts {
+		switch part {
+		case "*":
+			parts[i] = "[^/]+"
+		case "**":
+			parts[i] = ".+"
+		default:
+			parts[i] = regexp.QuoteMeta(part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// checkTypes makes sure every message and enum the rules use is known.
+func (t *grpcTranscoder) checkTypes() error {
+	for _, rule := range t.rules {
+		for _, name := range []string{rule.input, rule.output} {
+			if t.messages[name] == nil {
+				return fmt.Errorf("message %s used by %s is not in the descriptor set", name, rule.grpcMethod)
+			}
+		}
+		if rule.body != "" && rule.body != "*" && t.messages[rule.input].byName[rule.body] == nil {
+			return fmt.Errorf("%s binds the body to unknown field %q", rule.grpcMethod, rule.body)
+		}
+		if rule.responseBody != "" && t.messages[rule.output].byName[rule.responseBody] == nil {
+			return fmt.Errorf("%s returns unknown response field %q", rule.grpcMethod, rule.responseBody)
+		}
+	}
+	for _, msg := range t.messages {
+		for _, field := range msg.fields {
+			if field.typ == protoMessageT && t.messages[field.typeName] == nil {
+				return fmt.Errorf("message %s used by %s is not in the descriptor set", field.typeName, msg.name)
+			}
+			if field.typ == protoEnumT && t.enums[field.typeName] == nil {
+				return fmt.Errorf("enum %s used by %s is not in the descriptor set", field.typeName, msg.name)
+			}
+		}
+	}
+	return nil
+}
+
+// match finds the rule for r and the values of its path variables. Requests
+// that are already gRPC are left to the proxy.
+func (t *grpcTranscoder) match(r *http.Request) (*transcodeRule, []string) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		return nil, nil
+	}
+	for _, rule := range t.rules {
+		if rule.httpMethod != r.Method {
+			continue
+		}
+		if values := rule.path.FindStringSubmatch(r.URL.Path); values != nil {
+			return rule, values[1:]
+		}
+	}
+	return nil, nil
+}
+
+// transport returns an HTTP/2 round tripper for backend, reusing the
+// backend's own when it already speaks HTTP/2.
+func (t *grpcTranscoder) transport(backend *Backend) http.RoundTripper {
+	if backend.Config.Transport == "http2" {
+		return backend.Proxy.Transport
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	transport := t.transports[backend.URL]
+	if transport == nil {
+		transport = HTTP2TransportFactory(backend.Config).(*http.Transport)
+		t.transports[backend.URL] = transport
+	}
+	return transport
+}
+
+// requestMessage assembles the JSON form of rule's input message from r's
+// body, path variables and, for fields the body doesn't cover, query
+// parameters.
+func (t *grpcTranscoder) requestMessage(r *http.Request, rule *transcodeRule, pathValues []string) (map[string]any, error) {
+	obj := map[string]any{}
+	if rule.body != "" && r.Body != nil {
+		dec := json.NewDecoder(io.LimitReader(r.Body, maxTranscodeMessageBytes))
+		dec.UseNumber()
+		var body any
+		if err := dec.Decode(&body); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("invalid JSON body: %w", err)
+		}
+		if rule.body == "*" {
+			if body != nil {
+				var ok bool
+				if obj, ok = body.(map[string]any); !ok {
+					return nil, errors.New("request body must be a JSON object")
+				}
+			}
+		} else if body != nil {
+			obj[rule.body] = body
+		}
+	}
+	if rule.body != "*" {
+		for name, values := range r.URL.Query() {
+			if len(values) == 1 {
+				setJSONPath(obj, name, values[0])
+			} else {
+				list := make([]any, len(values))
+				for i, value := range values {
+					list[i] = value
+				}
+				setJSONPath(obj, name, list)
+			}
+		}
+	}
+	for i, field := range rule.pathFields {
+		setJSONPath(obj, field, pathValues[i])
+	}
+	return obj, nil
+}
+
+// setJSONPath sets a dotted field path such as "book.id" in obj, creating
+// the intermediate objects.
+func setJSONPath(obj map[string]any, path string, value any) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := obj[part].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			obj[part] = next
+		}
+		obj = next
+	}
+	obj[parts[len(parts)-1]] = value
+}
+
+// encodeMessage converts the JSON form of msg to protobuf. Fields may be
+// given by proto or JSON name; the proto name wins if both are present, so
+// that path variables override the body.
+func (t *grpcTranscoder) encodeMessage(msg *protoMessage, obj map[string]any) ([]byte, error) {
+	for key := range obj {
+		if msg.byName[key] == nil {
+			return nil, fmt.Errorf("unknown field %q in %s", key, msg.name)
+		}
+	}
+	
+	var buf []byte
+	for _, field := range msg.fields {
+		value, ok := obj[field.name]
+		if !ok {
+			value = obj[field.jsonName]
+		}
+		if value == nil {
+			continue
+		}
+	
+		var err error
+		switch entry := t.messages[field.typeName]; {
+		case field.typ == protoMessageT && entry.mapEntry:
+			object, ok := value.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("field %s of %s must be a JSON object", field.name, msg.name)
+			}
+			for _, key := range slices.Sorted(maps.Keys(object)) {
+				data, err := t.encodeMessage(entry, map[string]any{"key": key, "value": object[key]})
+				if err != nil {
+					return nil, err
+				}
+				buf = protowire(buf, field.number, 2)
+				buf = binary.AppendUvarint(buf, uint64(len(data)))
+				buf = append(buf, data...)
+			}
+		case field.repeated:
+			list, ok := value.([]any)
+			if !ok {
+				list = []any{value}
+			}
+			for _, item := range list {
+				if buf, err = t.encodeValue(buf, field, item); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			if buf, err = t.encodeValue(buf, field, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf, nil
+}
+
+// protowire appends a field tag.
+func protowire(buf []byte, number, wireType int) []byte {
+	return binary.AppendUvarint(buf, uint64(number)<<3|uint64(wireType))
+}
+
+// encodeValue appends one value of field. Numbers may be JSON numbers or
+// strings, as proto3 JSON allows.
+func (t *grpcTranscoder) encodeValue(buf []byte, field *protoField, value any) ([]byte, error) {
+	invalid := func(err error) error {
+		if err == nil {
+			err = fmt.Errorf("unexpected %T", value)
+		}
+		return fmt.Errorf("field %s: %w", field.name, err)
+	}
+	
+	switch field.typ {
+	case protoMessageT:
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return nil, invalid(nil)
+		}
+		data, err := t.encodeMessage(t.messages[field.typeName], obj)
+		if err != nil {
+			return nil, err
+		}
+		buf = protowire(buf, field.number, 2)
+		buf = binary.AppendUvarint(buf, uint64(len(data)))
+		return append(buf, data...), nil
+	case protoString, protoBytes:
+		s, ok := value.(string)
+		if !ok {
+			return nil, invalid(nil)
+		}
+		data := []byte(s)
+		if field.typ == protoBytes {
+			var err error
+			if data, err = base64.StdEncoding.DecodeString(s); err != nil {
+				if data, err = base64.URLEncoding.DecodeString(s); err != nil {
+					return nil, invalid(err)
+				}
+			}
+		}
+		buf = protowire(buf, field.number, 2)
+		buf = binary.AppendUvarint(buf, uint64(len(data)))
+		return append(buf, data...), nil
+	case protoBool:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, invalid(nil)
+		}
+		var v uint64
+		if b {
+			v = 1
+		}
+		return binary.AppendUvarint(protowire(buf, field.number, 0), v), nil
+	case protoEnumT:
+		enum := t.enums[field.typeName]
+		if name, ok := value.(string); ok {
+			if number, ok := enum.byName[name]; ok {
+				return binary.AppendUvarint(protowire(buf, field.number, 0), uint64(int64(number))), nil
+			}
+		}
+		n, err := jsonInt(value, 32)
+		if err != nil {
+			return nil, invalid(fmt.Errorf("unknown %s value %v", field.typeName, value))
+		}
+		return binary.AppendUvarint(protowire(buf, field.number, 0), uint64(n)), nil
+	case protoDouble, protoFloat:
+		f, err := jsonFloat(value)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		if field.typ == protoFloat {
+			return binary.LittleEndian.AppendUint32(protowire(buf, field.number, 5), math.Float32bits(float32(f))), nil
+		}
+		return binary.LittleEndian.AppendUint64(protowire(buf, field.number, 1), math.Float64bits(f)), nil
+	case protoInt32, protoInt64, protoSint32, protoSint64, protoSfixed32, protoSfixed64:
+		bits := 64
+		if field.typ == protoInt32 || field.typ == protoSint32 || field.typ == protoSfixed32 {
+			bits = 32
+		}
+		n, err := jsonInt(value, bits)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		switch field.typ {
+		case protoSint32, protoSint64:
+			return binary.AppendUvarint(protowire(buf, field.number, 0), uint64(n<<1^n>>63)), nil
+		case protoSfixed32:
+			return binary.LittleEndian.AppendUint32(protowire(buf, field.number, 5), uint32(n)), nil
+		case protoSfixed64:
+			return binary.LittleEndian.AppendUint64(protowire(buf, field.number, 1), uint64(n)), nil
+		}
+		return binary.AppendUvarint(protowire(buf, field.number, 0), uint64(n)), nil
+	case protoUint32, protoUint64, protoFixed32, protoFixed64:
+		bits := 64
+		if field.typ == protoUint32 || field.typ == protoFixed32 {
+			bits = 32
+		}
+		n, err := jsonUint(value, bits)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		switch field.typ {
+		case protoFixed32:
+			return binary.LittleEndian.AppendUint32(protowire(buf, field.number, 5), uint32(n)), nil
+		case protoFixed64:
+			return binary.LittleEndian.AppendUint64(protowire(buf, field.number, 1), n), nil
+		}
+		return binary.AppendUvarint(protowire(buf, field.number, 0), n), nil
+	}
+	return nil, invalid(fmt.Errorf("unsupported type %d", field.typ))
+}
+
+func jsonInt(value any, bits int) (int64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return strconv.ParseInt(string(v), 10, bits)
+	case string:
+		return strconv.ParseInt(v, 10, bits)
+	}
+	return 0, fmt.Errorf("expected an integer, got %T", value)
+}
+
+func jsonUint(value any, bits int) (uint64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return strconv.ParseUint(string(v), 10, bits)
+	case string:
+		return strconv.ParseUint(v, 10, bits)
+	}
+	return 0, fmt.Errorf("expected an unsigned integer, got %T", value)
+}
+
+// jsonFloat also accepts the "NaN", "Infinity" and "-Infinity" strings of
+// proto3 JSON.
+func jsonFloat(value any) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case string:
+		switch v {
+		case "Infinity":
+			return math.Inf(1), nil
+		case "-Infinity":
+			return math.Inf(-1), nil
+		}
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("expected a number, got %T", value)
+}
+
+// decodeMessage converts protobuf to the JSON form of msg. Like
+// grpc-gateway, fields the message left at their defaults are included,
+// with their zero values.
+func (t *grpcTranscoder) decodeMessage(msg *protoMessage, data []byte) (map[string]any, error) {
+	obj := map[string]any{}
+	err := protoFields(data, func(num, wireType int, value uint64, data []byte) error {
+		field := msg.byNumber[num]
+		if field == nil {
+			return nil // unknown fields are dropped
+		}
+	
+		if entry := t.messages[field.typeName]; field.typ == protoMessageT && entry.mapEntry {
+			kv, err := t.decodeMessage(entry, data)
+			if err != nil {
+				return err
+			}
+			object, _ := obj[field.jsonName].(map[string]any)
+			if object == nil {
+				object = map[string]any{}
+				obj[field.jsonName] = object
+			}
+			object[fmt.Sprint(kv["key"])] = kv["value"]
+			return nil
+		}
+	
+		// Repeated scalars are usually packed into one length-delimited field.
+		want := protoWireType(field.typ)
+		if field.repeated && wireType == 2 && want != 2 {
+			list, _ := obj[field.jsonName].([]any)
+			for len(data) > 0 {
+				var n int
+				switch want {
+				case 0:
+					value, n = binary.Uvarint(data)
+				case 1:
+					if len(data) >= 8 {
+						value, n = binary.LittleEndian.Uint64(data), 8
+					}
+				case 5:
+					if len(data) >= 4 {
+						value, n = uint64(binary.LittleEndian.Uint32(data)), 4
+					}
+				}
+				if n <= 0 {
+					return errMalformedProto
+				}
+				data = data[n:]
+				item, err := t.decodeValue(field, value, nil)
+				if err != nil {
+					return err
+				}
+				list = append(list, item)
+			}
+			obj[field.jsonName] = list
+			return nil
+		}
+		if wireType != want {
+			return fmt.Errorf("field %s of %s has wire type %d, expected %d", field.name, msg.name, wireType, want)
+		}
+	
+		item, err := t.decodeValue(field, value, data)
+		if err != nil {
+			return err
+		}
+		if field.repeated {
+			list, _ := obj[field.jsonName].([]any)
+			obj[field.jsonName] = append(list, item)
+		} else {
+			obj[field.jsonName] = item
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	
+	for _, field := range msg.fields {
+		if _, ok := obj[field.jsonName]; !ok {
+			obj[field.jsonName] = t.zeroValue(field)
+		}
+	}
+	return obj, nil
+}
+
+func protoWireType(typ int) int {
+	switch typ {
+	case protoDouble, protoFixed64, protoSfixed64:
+		return 1
+	case protoString, protoBytes, protoMessageT:
+		return 2
+	case protoFloat, protoFixed32, protoSfixed32:
+		return 5
+	}
+	return 0
+}
+
+// decodeValue converts one value of field. 64-bit integers become strings,
+// as proto3 JSON has them, so JavaScript clients don't lose precision.
+func (t *grpcTranscoder) decodeValue(field *protoField, value uint64, data []byte) (any, error) {
+	switch field.typ {
+	case protoMessageT:
+		return t.decodeMessage(t.messages[field.typeName], data)
+	case protoString:
+		return string(data), nil
+	case protoBytes:
+		return base64.StdEncoding.EncodeToString(data), nil
+	case protoBool:
+		return value != 0, nil
+	case protoEnumT:
+		if name, ok := t.enums[field.typeName].byNumber[int32(value)]; ok {
+			return name, nil
+		}
+		return int32(value), nil
+	case protoDouble:
+		return jsonFloatValue(math.Float64frombits(value)), nil
+	case protoFloat:
+		return jsonFloatValue(float64(math.Float32frombits(uint32(value)))), nil
+	case protoInt32, protoSfixed32:
+		return int32(value), nil
+	case protoUint32, protoFixed32:
+		return uint32(value), nil
+	case protoSint32:
+		return int32(value>>1) ^ -int32(value&1), nil
+	case protoInt64, protoSfixed64:
+		return strconv.FormatInt(int64(value), 10), nil
+	case protoUint64, protoFixed64:
+		return strconv.FormatUint(value, 10), nil
+	case protoSint64:
+		return strconv.FormatInt(int64(value>>1)^-int64(value&1), 10), nil
+	}
+	return nil, fmt.Errorf("field %s has unsupported type %d", field.name, field.typ)
+}
+
+// jsonFloatValue spells out the values encoding/json can't represent.
+func jsonFloatValue(f float64) any {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return f
+}
+
+func (t *grpcTranscoder) zeroValue(field *protoField) any {
+	switch {
+	case field.typ == protoMessageT && t.messages[field.typeName].mapEntry:
+		return map[string]any{}
+	case field.repeated:
+		return []any{}
+	}
+	switch field.typ {
+	case protoMessageT:
+		return nil
+	case protoString, protoBytes:
+		return ""
+	case protoBool:
+		return false
+	case protoEnumT:
+		if name, ok := t.enums[field.typeName].byNumber[0]; ok {
+			return name
+		}
+	case protoInt64, protoUint64, protoFixed64, protoSfixed64, protoSint64:
+		return "0"
+	}
+	return 0
+}
+
+// grpcHTTPStatus maps gRPC status codes to HTTP, as grpc-gateway does.
+var grpcHTTPStatus = map[int]int{
+	0: http.StatusOK, 1: 499, 2: http.StatusInternalServerError, 3: http.StatusBadRequest,
+	4: http.StatusGatewayTimeout, 5: http.StatusNotFound, 6: http.StatusConflict, 7: http.StatusForbidden,
+	8: http.StatusTooManyRequests, 9: http.StatusBadRequest, 10: http.StatusConflict, 11: http.StatusBadRequest,
+	12: http.StatusNotImplemented, 13: http.StatusInternalServerError, 14: http.StatusServiceUnavailable,
+	15: http.StatusInternalServerError, 16: http.StatusUnauthorized,
+}
+
+// transcodedHeaders are the request headers passed on to the backend as gRPC
+// metadata, besides any Grpc-Metadata-* ones.
+var transcodedHeaders = []string{"Authorization", "X-Request-ID", "Traceparent", "Tracestate"}
+
+// writeTranscodeError answers with the JSON error body grpc-gateway uses.
+func writeTranscodeError(w http.ResponseWriter, code int, message string) {
+	status, ok := grpcHTTPStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, map[string]any{"code": code, "message": message})
+}
+
+// ServeGRPCTranscode answers a JSON request with a unary gRPC call to
+// backend. Failures to reach the backend go to the proxy's error handler, so
+// they are retried and reported like any other attempt.
+func (lb *LoadBalancer) ServeGRPCTranscode(w http.ResponseWriter, r *http.Request, backend *Backend) {
+	t := lb.transcoder
+	rule, pathValues := t.match(r)
+	if rule == nil {
+		writeTranscodeError(w, 12, "no gRPC method for "+r.Method+" "+r.URL.Path)
+		return
+	}
+	state := getRequestState(r)
+	
+	obj, err := t.requestMessage(r, rule, pathValues)
+	if err != nil {
+		writeTranscodeError(w, 3, err.Error())
+		return
+	}
+	msg, err := t.encodeMessage(t.messages[rule.input], obj)
+	if err != nil {
+		writeTranscodeError(w, 3, err.Error())
+		return
+	}
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	frame = append(frame, msg...)
+	
+	target := strings.TrimSuffix(backend.URL, "/") + rule.grpcMethod
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, target, bytes.NewReader(frame))
+	if err != nil {
+		lb.proxyErrorHandler(backend)(w, r, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	for _, name := range transcodedHeaders {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	for name, values := range r.Header {
+		if metadata, ok := strings.CutPrefix(name, "Grpc-Metadata-"); ok {
+			req.Header[http.CanonicalHeaderKey(metadata)] = values
+		}
+	}
+	
+	lb.logRequest(state, "INFO", "Transcoding %s %s to gRPC %s", r.Method, r.URL.Path, rule.grpcMethod)
+	resp, err := t.transport(backend).RoundTrip(req)
+	if err != nil {
+		lb.proxyErrorHandler(backend)(w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != http.StatusOK {
+		lb.proxyErrorHandler(backend)(w, r, fmt.Errorf("gRPC backend returned HTTP status %d", resp.StatusCode))
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTranscodeMessageBytes+6))
+	if err != nil {
+		lb.proxyErrorHandler(backend)(w, r, err)
+		return
+	}
+	// Errors may come as trailers or, with no message, as headers only.
+	code, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if code == "" {
+		code, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if code != "0" {
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			n = 2 // UNKNOWN
+		}
+		if unescaped, err := url.PathUnescape(message); err == nil {
+			message = unescaped
+		}
+		writeTranscodeError(w, n, message)
+		return
+	}
+	
+	if len(body) < 5 || body[0] != 0 || uint64(len(body)-5) < uint64(binary.BigEndian.Uint32(body[1:5])) {
+		writeTranscodeError(w, 13, "malformed or compressed gRPC response from backend")
+		return
+	}
+	out, err := t.decodeMessage(t.messages[rule.output], body[5:5+binary.BigEndian.Uint32(body[1:5])])
+	if err != nil {
+		writeTranscodeError(w, 13, "decoding gRPC response: "+err.Error())
+		return
+	}
+	if rule.responseBody != "" {
+		writeJSON(w, http.StatusOK, out[t.messages[rule.output].byName[rule.responseBody].jsonName])
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// poolWindow keeps a bounded ring of recent request samples for a pool.
+type poolWindow struct {
+	mu      sync.Mutex
+	samples []requestSample
+	next    int
+}
+
+type requestSample struct {
+	at       time.Time
+	duration time.Duration
+	failed   bool
+}
+
+const poolWindowSize = 10000
+
+func (lb *LoadBalancer) recordPoolRequest(pool string, status int, duration time.Duration) {
+	lb.poolStatsMu.Lock()
+	pw, ok := lb.poolStats[pool]
+	if !ok {
+		pw = &poolWindow{}
+		lb.poolStats[pool] = pw
+	}
+	lb.poolStatsMu.Unlock()
+	
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	sample := requestSample{at: time.Now(), duration: duration, failed: status == 0 || status >= 500}
+	if len(pw.samples) < poolWindowSize {
+		pw.samples = append(pw.samples, sample)
+		return
+	}
+	pw.samples[pw.next] = sample
+	pw.next = (pw.next + 1) % poolWindowSize
+}
+
+func (lb *LoadBalancer) poolSamples(pool string, since time.Time) []requestSample {
+	lb.poolStatsMu.Lock()
+	pw, ok := lb.poolStats[pool]
+	lb.poolStatsMu.Unlock()
+	if !ok {
+		return nil
+	}
+	
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	var out []requestSample
+	for _, sample := range pw.samples {
+		if !sample.at.Before(since) {
+			out = append(out, sample)
+		}
+	}
+	return out
+}
+
+type PoolStats struct {
+	Pool      string  `json:"pool"`
+	Requests  int     `json:"requests"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate_percent"`
+	P50Ms     float64 `json:"p50_ms"`
+	P90Ms     float64 `json:"p90_ms"`
+	P99Ms     float64 `json:"p99_ms"`
+}
+
+type CanaryReport struct {
+	Window            string    `json:"window"`
+	Stable            PoolStats `json:"stable"`
+	Canary            PoolStats `json:"canary"`
+	ErrorRateDelta    float64   `json:"error_rate_delta_percent"`
+	MaxErrorRateDelta float64   `json:"max_error_rate_delta_percent"`
+	Verdict           string    `json:"verdict"`
+}
+
+func summarizePool(pool string, samples []requestSample) PoolStats {
+	stats := PoolStats{Pool: pool, Requests: len(samples)}
+	if len(samples) == 0 {
+		return stats
+	}
+	
+	durations := make([]time.Duration, len(samples))
+	for i, sample := range samples {
+		durations[i] = sample.duration
+		if sample.failed {
+			stats.Errors++
+		}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	
+	stats.ErrorRate = float64(stats.Errors) / float64(stats.Requests) * 100
+	stats.P50Ms = percentileMs(durations, 50)
+	stats.P90Ms = percentileMs(durations, 90)
+	stats.P99Ms = percentileMs(durations, 99)
+	return stats
+}
+
+// percentileMs returns the p-th percentile of sorted durations in milliseconds.
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * p / 100)
+	return float64(sorted[idx]) / float64(time.Millisecond)
+}
+
+// compareCanary decides whether the canary pool is doing worse than the
+// stable pool. It is a pure function of the two pools' stats.
+func compareCanary(stable, canary PoolStats, maxErrorRateDelta float64) CanaryReport {
+	report := CanaryReport{
+		Stable:            stable,
+		Canary:            canary,
+		ErrorRateDelta:    canary.ErrorRate - stable.ErrorRate,
+		MaxErrorRateDelta: maxErrorRateDelta,
+	}
+	
+	switch {
+	case stable.Requests == 0 || canary.Requests == 0:
+		report.Verdict = "insufficient_data"
+	case report.ErrorRateDelta > maxErrorRateDelta:
+		report.Verdict = "fail"
+	default:
+		report.Verdict = "pass"
+	}
+	return report
+}
+
+func (lb *LoadBalancer) canaryReport(window time.Duration) CanaryReport {
+	since := time.Now().Add(-window)
+	stable := summarizePool(lb.cfg.DefaultPool, lb.poolSamples(lb.cfg.DefaultPool, since))
+	canary := summarizePool(lb.cfg.CanaryPool, lb.poolSamples(lb.cfg.CanaryPool, since))
+	
+	report := compareCanary(stable, canary, lb.cfg.CanaryMaxErrorRateDelta)
+	report.Window = window.String()
+	return report
+}
+
+func (lb *LoadBalancer) getCanaryWeight() float64 {
+	lb.canaryMu.Lock()
+	defer lb.canaryMu.Unlock()
+	return lb.canaryWeight
+}
+
+// startCanaryRollback periodically compares the canary pool against the
+// stable pool and, once the canary has been failing for
+// CANARY_ROLLBACK_SUSTAIN, drops its weight to 0 until an admin re-enables it.
+func (lb *LoadBalancer) startCanaryRollback() {
+	mode := "enforcing"
+	if lb.cfg.CanaryRollbackDryRun {
+		mode = "dry-run"
+	}
+	log.Printf("[INFO] Canary auto-rollback enabled (%s, margin: %.2f%%, window: %v, sustain: %v)\n",
+		mode, lb.cfg.CanaryRollbackErrorRateDelta, lb.cfg.CanaryRollbackWindow, lb.cfg.CanaryRollbackSustain)
+	
+	ticker := time.NewTicker(lb.cfg.CanaryRollbackInterval)
+	go func() {
+		for range ticker.C {
+			lb.evaluateCanary()
+		}
+	}()
+}
+
+// autoLatencyMaxWeight is the auto_latency weight of the fastest backend.
+// Slower ones get proportionally less, but never under 1, so a backend that
+// speeds up again still sees enough traffic to show it.
+const autoLatencyMaxWeight = 100
+
+// startDNSRefresh re-resolves backend hostnames every DNSRefreshInterval,
+// so backends behind a DNS name that moves to new addresses stop being
+// served over connections to the old ones.
+func (lb *LoadBalancer) startDNSRefresh() {
+	log.Printf("[INFO] Re-resolving backend hostnames every %v\n", lb.cfg.DNSRefreshInterval)
+	
+	ticker := time.NewTicker(lb.cfg.DNSRefreshInterval)
+	go func() {
+		lb.refreshBackendDNS()
+		for range ticker.C {
+			lb.refreshBackendDNS()
+		}
+	}()
+}
+
+// refreshBackendDNS resolves the hostname of each backend addressed by one.
+// Connections to addresses missing from the result are marked stale and
+// closed once their current request is done, or right away when idle on an
+// isolated transport; new connections dial whatever the name resolves to
+// then. A failed lookup keeps the previous addresses.
+func (lb *LoadBalancer) refreshBackendDNS() {
+	backends := slices.Concat(lb.getBackends(), slices.Collect(maps.Values(lb.fallbacks)))
+	for _, backend := range backends {
+		u, err := url.Parse(backend.URL)
+		if err != nil || net.ParseIP(u.Hostname()) != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), lb.cfg.healthCheckTimeout(backend.Config))
+		addrs, err := lb.opts.Resolver.LookupHost(ctx, u.Hostname())
+		cancel()
+		if err != nil || len(addrs) == 0 {
+			log.Printf("[WARN] Re-resolving %s failed, keeping its previous addresses: %v\n", backend.URL, err)
+			continue
+		}
+		
+		current := make(map[string]bool, len(addrs))
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil {
+				current[ip.String()] = true
+			}
+		}
+		previous := backend.pool.addrs.Swap(&current)
+		if previous == nil || maps.Equal(*previous, current) {
+			continue
+		}
+		log.Printf("[INFO] %s now resolves to %s, recycling connections to its old addresses\n",
+			backend.URL, strings.Join(slices.Sorted(maps.Keys(current)), ", "))
+		lb.metrics.dnsChanges.inc(backend.URL)
+		lb.closeIdleConnections(backend)
+	}
+}
+
+// startAutoLatency recomputes the auto_latency weights every
+// AUTO_LATENCY_INTERVAL.
+func (lb *LoadBalancer) startAutoLatency() {
+	log.Printf("[INFO] auto_latency weights recomputed every %v\n", lb.cfg.AutoLatencyInterval)
+	
+	ticker := time.NewTicker(lb.cfg.AutoLatencyInterval)
+	go func() {
+		for range ticker.C {
+			lb.updateLatencyWeights()
+		}
+	}()
+}
+
+// updateLatencyWeights folds each backend's latency since the last update
+// into its rolling average, then weights backends inversely to their
+// averages, cross-zone penalty included. Backends with no samples yet get
+// the full weight so they are measured quickly.
+func (lb *LoadBalancer) updateLatencyWeights() {
+	backends := lb.getBackends()
+	averages := make([]time.Duration, len(backends))
+	var fastest time.Duration
+	for i, backend := range backends {
+		backend.mux.Lock()
+		if backend.latencyCount > 0 {
+			sample := backend.latencySum / time.Duration(backend.latencyCount)
+			if backend.avgLatency == 0 {
+				backend.avgLatency = sample
+			} else {
+				backend.avgLatency = (backend.avgLatency + sample) / 2
+			}
+			backend.latencySum, backend.latencyCount = 0, 0
+		}
+		measured := backend.avgLatency > 0
+		backend.mux.Unlock()
+		if measured {
+			averages[i] = lb.zoneLatency(backend)
+		}
+		if averages[i] > 0 && (fastest == 0 || averages[i] < fastest) {
+			fastest = averages[i]
+		}
+	}
+	if fastest == 0 {
+		return
+	}
+	
+	for i, backend := range backends {
+		weight := float64(autoLatencyMaxWeight)
+		if averages[i] > 0 {
+			weight = max(weight*float64(fastest)/float64(averages[i]), 1)
+		}
+		backend.mux.Lock()
+		backend.latencyWeight = weight
+		backend.mux.Unlock()
+	}
+}
+
+// ScheduledChange is the next time a schedule changes a backend, and the
+// weight and state it will have from then on.
+type ScheduledChange struct {
+	At      time.Time `json:"at"`
+	Weight  int       `json:"weight"`
+	Enabled bool      `json:"enabled"`
+}
+
+// startSchedules applies the schedules now and then re-checks them every
+// 15 seconds.
+func (lb *LoadBalancer) startSchedules() {
+	log.Printf("[INFO] %d backend schedules configured\n", len(lb.cfg.Schedules))
+	lb.applySchedules(time.Now())
+	
+	ticker := time.NewTicker(15 * time.Second)
+	go func() {
+		for range ticker.C {
+			lb.applySchedules(time.Now())
+		}
+	}()
+}
+
+// activeSchedule returns the schedule for backendURL covering t, if any.
+func (lb *LoadBalancer) activeSchedule(backendURL string, t time.Time) *ScheduleRule {
+	for i := range lb.cfg.Schedules {
+		if rule := &lb.cfg.Schedules[i]; rule.Backend == backendURL && rule.active(t) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// applySchedules moves each backend to the settings of the schedule active
+// at now. Only changes of schedule touch the backend, so an operator's
+// drain or undrain in between sticks until the next scheduled change.
+func (lb *LoadBalancer) applySchedules(now time.Time) {
+	reweighted := false
+	defer func() {
+		if reweighted {
+			lb.weightsChanged()
+		}
+	}()
+	for _, backend := range lb.getBackends() {
+		rule := lb.activeSchedule(backend.URL, now)
+		if rule == backend.schedule {
+			continue
+		}
+		previous := backend.schedule
+		backend.schedule = rule
+		
+		weight, enabled := 0, true
+		if rule != nil && rule.Weight != nil {
+			weight = *rule.Weight
+		}
+		if rule != nil && rule.Enabled != nil {
+			enabled = *rule.Enabled
+		}
+		if backend.scheduledWeight.Swap(int64(weight)) != int64(weight) {
+			reweighted = true
+		}
+		if (rule != nil && rule.Enabled != nil) || (previous != nil && previous.Enabled != nil) {
+			backend.draining.Store(!enabled)
+		}
+		
+		window := "default settings"
+		if rule != nil {
+			window = fmt.Sprintf("window %s-%s %s", rule.Start, rule.End, rule.loc)
+		}
+		lb.audit("scheduler", "schedule", fmt.Sprintf("%s weight=%d enabled=%t (%s)", backend.URL, backend.weight(), enabled, window))
+	}
+}
+
+// weightsChanged starts smooth weighted round-robin over from a clean slate
+// after a weight changes; credit built up under the old weights would
+// otherwise skew the next rounds. The hash ring is rebuilt too, as each
+// backend gets points in proportion to its weight.
+func (lb *LoadBalancer) weightsChanged() {
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	for _, backend := range lb.backends {
+		backend.currentWeight = 0
+	}
+	lb.buildHashRing()
+}
+
+// nextScheduledChange looks up to a week ahead for the next minute at which
+// a different schedule, or none, applies to backend.
+func (lb *LoadBalancer) nextScheduledChange(backend *Backend, now time.Time) *ScheduledChange {
+	if len(lb.cfg.Schedules) == 0 {
+		return nil
+	}
+	current := lb.activeSchedule(backend.URL, now)
+	start := now.Truncate(time.Minute).Add(time.Minute)
+	for t := start; t.Before(start.Add(7 * 24 * time.Hour)); t = t.Add(time.Minute) {
+		rule := lb.activeSchedule(backend.URL, t)
+		if rule == current {
+			continue
+		}
+		change := &ScheduledChange{At: t, Weight: backend.Config.Weight, Enabled: true}
+		if change.Weight < 1 {
+			change.Weight = 1
+		}
+		if rule != nil && rule.Weight != nil {
+			change.Weight = *rule.Weight
+		}
+		if rule != nil && rule.Enabled != nil {
+			change.Enabled = *rule.Enabled
+		}
+		return change
+	}
+	return nil
+}
+
+func (lb *LoadBalancer) evaluateCanary() {
+	since := time.Now().Add(-lb.cfg.CanaryRollbackWindow)
+	stable := summarizePool(lb.cfg.DefaultPool, lb.poolSamples(lb.cfg.DefaultPool, since))
+	canary := summarizePool(lb.cfg.CanaryPool, lb.poolSamples(lb.cfg.CanaryPool, since))
+	report := compareCanary(stable, canary, lb.cfg.CanaryRollbackErrorRateDelta)
+	
+	lb.canaryMu.Lock()
+	defer lb.canaryMu.Unlock()
+	
+	if lb.canaryLocked || lb.canaryWeight <= 0 {
+		return
+	}
+	if stable.Requests < lb.cfg.CanaryRollbackMinRequests || canary.Requests < lb.cfg.CanaryRollbackMinRequests {
+		return
+	}
+	if report.Verdict != "fail" {
+		lb.canaryFailingSince = time.Time{}
+		return
+	}
+	
+	now := time.Now()
+	if lb.canaryFailingSince.IsZero() {
+		lb.canaryFailingSince = now
+		log.Printf("[WARN] Canary error rate %.2f%% exceeds stable %.2f%% by more than %.2f%%\n",
+			canary.ErrorRate, stable.ErrorRate, lb.cfg.CanaryRollbackErrorRateDelta)
+	}
+	if now.Sub(lb.canaryFailingSince) < lb.cfg.CanaryRollbackSustain {
+		return
+	}
+	
+	detail := fmt.Sprintf("canary error rate %.2f%% vs stable %.2f%% for %v (weight %.2f -> 0)",
+		canary.ErrorRate, stable.ErrorRate, now.Sub(lb.canaryFailingSince).Round(time.Second), lb.canaryWeight)
+	if lb.cfg.CanaryRollbackDryRun {
+		lb.audit("auto-rollback", "canary_rollback_dry_run", detail)
+		lb.canaryFailingSince = time.Time{}
+		return
+	}
+	
+	lb.canaryPreviousWeight = lb.canaryWeight
+	lb.canaryWeight = 0
+	lb.canaryLocked = true
+	lb.canaryFailingSince = time.Time{}
+	lb.audit("auto-rollback", "canary_rollback", detail)
+	lb.notify("canary_rollback", map[string]any{
+		"pool":   lb.cfg.CanaryPool,
+		"detail": detail,
+		"report": report,
+	})
+}
+
+type canaryWeightRequest struct {
+	Weight *float64 `json:"weight"`
+}
+
+// handleCanaryWeight sets the canary weight. It refuses while an automatic
+// rollback lock is held; use /admin/canary/reenable to clear it.
+func (lb *LoadBalancer) handleCanaryWeight(w http.ResponseWriter, r *http.Request) {
+	var req canaryWeightRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Weight == nil || *req.Weight < 0 || *req.Weight > 100 {
+		http.Error(w, "Body must be {\"weight\": 0-100}", http.StatusBadRequest)
+		return
+	}
+	
+	lb.canaryMu.Lock()
+	defer lb.canaryMu.Unlock()
+	if lb.canaryLocked {
+		http.Error(w, "Canary was rolled back automatically; re-enable it first", http.StatusConflict)
+		return
+	}
+	lb.audit("admin", "canary_weight", fmt.Sprintf("weight %.2f -> %.2f", lb.canaryWeight, *req.Weight))
+	lb.canaryWeight = *req.Weight
+	writeJSON(w, http.StatusOK, map[string]any{"weight": lb.canaryWeight})
+}
+
+// handleCanaryReenable clears an automatic rollback, restoring the weight
+// from before the rollback unless a new one is given.
+func (lb *LoadBalancer) handleCanaryReenable(w http.ResponseWriter, r *http.Request) {
+	var req canaryWeightRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Weight != nil && (*req.Weight < 0 || *req.Weight > 100)) {
+			http.Error(w, "Body must be empty or {\"weight\": 0-100}", http.StatusBadRequest)
+			return
+		}
+	}
+	
+	lb.canaryMu.Lock()
+	defer lb.canaryMu.Unlock()
+	if !lb.canaryLocked {
+		http.Error(w, "Canary is not rolled back", http.StatusConflict)
+		return
+	}
+	weight := lb.canaryPreviousWeight
+	if req.Weight != nil {
+		weight = *req.Weight
+	}
+	lb.canaryLocked = false
+	lb.canaryWeight = weight
+	lb.audit("admin", "canary_reenable", fmt.Sprintf("weight 0 -> %.2f", weight))
+	writeJSON(w, http.StatusOK, map[string]any{"weight": weight})
+}
+
+type HealthCheckResult struct {
+	URL   string `json:"url"`
+	Alive bool   `json:"alive"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleHealthReset clears ejection and dial-failure state, for every
+// backend or just ?backend=<url>, and probes them straight away.
+func (lb *LoadBalancer) handleHealthReset(w http.ResponseWriter, r *http.Request) {
+	lb.serveHealthSweep(w, r, true)
+}
+
+// handleHealthRun probes every backend (or ?backend=<url>) out of cycle
+// without touching its state.
+func (lb *LoadBalancer) handleHealthRun(w http.ResponseWriter, r *http.Request) {
+	lb.serveHealthSweep(w, r, false)
+}
+
+// serveHealthSweep probes through checkBackend, which skips a backend whose
+// scheduled probe is still running, so it is safe alongside a sweep.
+func (lb *LoadBalancer) serveHealthSweep(w http.ResponseWriter, r *http.Request, reset bool) {
+	backends := lb.getBackends()
+	target := r.URL.Query().Get("backend")
+	if target != "" {
+		var matched []*Backend
+		for _, backend := range backends {
+			if backend.URL == target {
+				matched = append(matched, backend)
+			}
+		}
+		if len(matched) == 0 {
+			http.Error(w, "Unknown backend", http.StatusNotFound)
+			return
+		}
+		backends = matched
+	}
+	
+	action, detail := "health_run", target
+	if reset {
+		action = "health_reset"
+	}
+	if detail == "" {
+		detail = "all backends"
+	}
+	lb.audit("admin", action, detail)
+	
+	results := make([]HealthCheckResult, 0, len(backends))
+	for _, backend := range backends {
+		if reset {
+			backend.resetHealthState()
+		}
+		result := HealthCheckResult{URL: backend.URL, Alive: lb.checkBackend(backend)}
+		backend.mux.RLock()
+		result.Error = backend.lastHealthError
+		backend.mux.RUnlock()
+		results = append(results, result)
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+type drainRequest struct {
+	Backend  string `json:"backend"`
+	Draining *bool  `json:"draining"`
+	Force    bool   `json:"force"` // also abort requests in flight
+}
+
+// handleDrain stops (or resumes) sending new requests to a backend. Requests
+// already in flight to it are left to finish, unless force is set: then
+// their attempts are cancelled, for a backend known to be bad, and retried
+// elsewhere where the request allows it.
+func (lb *LoadBalancer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	var req drainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Backend == "" || req.Draining == nil || (req.Force && !*req.Draining) {
+		http.Error(w, "Body must be {\"backend\": \"<url>\", \"draining\": true|false, \"force\": true|false}; force needs draining", http.StatusBadRequest)
+		return
+	}
+	
+	for _, backend := range lb.getBackends() {
+		if backend.URL == req.Backend {
+			backend.draining.Store(*req.Draining)
+			if !req.Force {
+				lb.audit("admin", "drain", fmt.Sprintf("%s draining=%t", backend.URL, *req.Draining))
+				writeJSON(w, http.StatusOK, map[string]any{"backend": backend.URL, "draining": *req.Draining})
+				return
+			}
+			aborted := backend.abortAttempts()
+			lb.closeIdleConnections(backend)
+			log.Printf("[WARN] Force-drained %s, aborting %d requests in flight\n", backend.URL, aborted)
+			lb.audit("admin", "drain", fmt.Sprintf("%s draining=true force=true aborted=%d", backend.URL, aborted))
+			writeJSON(w, http.StatusOK, map[string]any{"backend": backend.URL, "draining": true, "aborted": aborted})
+			return
+		}
+	}
+	http.Error(w, "Unknown backend", http.StatusNotFound)
+}
+
+type weightRequest struct {
+	Backend string `json:"backend"`
+	Weight  *int   `json:"weight"`
+}
+
+// handleWeight overrides a backend's weight, including any scheduled one,
+// until the LB restarts. A weight of 0 removes the override.
+func (lb *LoadBalancer) handleWeight(w http.ResponseWriter, r *http.Request) {
+	var req weightRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Backend == "" || req.Weight == nil || *req.Weight < 0 {
+		http.Error(w, "Body must be {\"backend\": \"<url>\", \"weight\": <non-negative int>}", http.StatusBadRequest)
+		return
+	}
+	
+	for _, backend := range lb.getBackends() {
+		if backend.URL == req.Backend {
+			backend.adminWeight.Store(int64(*req.Weight))
+			lb.weightsChanged()
+			lb.audit("admin", "weight", fmt.Sprintf("%s weight=%d", backend.URL, backend.weight()))
+			writeJSON(w, http.StatusOK, map[string]any{"backend": backend.URL, "weight": backend.weight()})
+			return
+		}
+	}
+	http.Error(w, "Unknown backend", http.StatusNotFound)
+}
+
+// handleAddBackend registers a backend at runtime; the body is a backend
+// entry as in CONFIG_FILE, e.g. {"url": "http://host:9001", "weight": 2}.
+func (lb *LoadBalancer) handleAddBackend(w http.ResponseWriter, r *http.Request) {
+	var backendCfg BackendConfig
+	if err := json.NewDecoder(r.Body).Decode(&backendCfg); err != nil || backendCfg.URL == "" {
+		http.Error(w, "Body must be a backend config with at least {\"url\": \"<url>\"}", http.StatusBadRequest)
+		return
+	}
+	var invalid *BackendValidationError
+	if _, err := parseBackendURL(backendCfg.URL); errors.As(err, &invalid) {
+		writeJSON(w, http.StatusBadRequest, invalid)
+		return
+	}
+	report := &ConfigReport{Errors: []string{}, Warnings: []string{}}
+	lb.cfg.validateBackend(report, backendCfg)
+	if len(report.Errors) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, report)
+		return
+	}
+	
+	backend, err := lb.AddBackend(backendCfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	lb.audit("admin", "add_backend", backend.URL)
+	writeJSON(w, http.StatusCreated, map[string]any{"backend": backend.URL, "weight": backend.weight()})
+}
+
+// handleRemoveBackend removes the backend whose URL is given, path-escaped,
+// e.g. DELETE /admin/backends/http:%2F%2Fhost:9001.
+func (lb *LoadBalancer) handleRemoveBackend(w http.ResponseWriter, r *http.Request) {
+	backend, err := lb.RemoveBackend(r.PathValue("url"))
+	if err != nil {
+		http.Error(w, "Unknown backend", http.StatusNotFound)
+		return
+	}
+	lb.audit("admin", "remove_backend", backend.URL)
+	writeJSON(w, http.StatusOK, map[string]any{"backend": backend.URL, "removed": true})
+}
+
+// handleConnections reports the connection pool of the backend whose URL is
+// given, path-escaped, e.g. GET /admin/backends/http:%2F%2Fhost:9001/connections.
+func (lb *LoadBalancer) handleConnections(w http.ResponseWriter, r *http.Request) {
+	backendURL := r.PathValue("url")
+	for _, backend := range lb.getBackends() {
+		if backend.URL == backendURL {
+			stats := backend.pool.stats()
+			stats.Backend = backend.URL
+			writeJSON(w, http.StatusOK, stats)
+			return
+		}
+	}
+	http.Error(w, "Unknown backend", http.StatusNotFound)
+}
+
+// handleValidateConfig checks a candidate CONFIG_FILE document, overlaid on
+// the current environment the way loadConfig would, without applying
+// anything. With ?probe=true, backends that aren't running yet get a health
+// check; failures are warnings since a new backend may not be up yet.
+// Responds 200 for a valid config and 422 otherwise.
+func (lb *LoadBalancer) handleValidateConfig(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Failed to read config", http.StatusBadRequest)
+		return
+	}
+	
+	cfg := envConfig()
+	var report *ConfigReport
+	if err := json.Unmarshal(data, cfg); err != nil {
+		report = &ConfigReport{Errors: []string{fmt.Sprintf("Failed to parse config: %v", err)}, Warnings: []string{}}
+	} else {
+		report = cfg.validate()
+	}
+	if report.Valid && r.URL.Query().Get("probe") == "true" {
+		lb.probeNewBackends(cfg, report)
+	}
+	
+	status := http.StatusOK
+	if !report.Valid {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, report)
+}
+
+// probeNewBackends health checks, concurrently and with the candidate's
+// health check settings, the backends in cfg that aren't running.
+func (lb *LoadBalancer) probeNewBackends(cfg *Config, report *ConfigReport) {
+	running := make(map[string]bool)
+	for _, backend := range lb.getBackends() {
+		running[backend.URL] = true
+	}
+	
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, backendCfg := range cfg.Backends {
+		if running[backendCfg.URL] {
+			continue
+		}
+		backend := &Backend{
+			URL:    backendCfg.URL,
+			Config: backendCfg,
+			Proxy:  &httputil.ReverseProxy{Transport: lb.opts.BackendRoundTripperFactory(backendCfg)},
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := cfg.probeBackend(backend)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Probed = append(report.Probed, backend.URL)
+			if err != nil {
+				report.warnf("New backend %s failed its health check: %v", backend.URL, err)
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Strings(report.Probed)
+}
+
+func (lb *LoadBalancer) handleHashOverrides(w http.ResponseWriter, r *http.Request) {
+	lb.mux.Lock()
+	overrides := maps.Clone(lb.pinned)
+	lb.mux.Unlock()
+	writeJSON(w, http.StatusOK, overrides)
+}
+
+// handleSetHashOverride pins a hash key to a backend: PUT
+// /admin/hash-overrides/{key} with {"backend": "<url>"}.
+func (lb *LoadBalancer) handleSetHashOverride(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Backend string `json:"backend"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Backend == "" {
+		http.Error(w, "Body must be {\"backend\": \"<url>\"}", http.StatusBadRequest)
+		return
+	}
+	key := r.PathValue("key")
+	
+	lb.mux.Lock()
+	known := slices.ContainsFunc(lb.backends, func(b *Backend) bool { return b.URL == req.Backend })
+	if known {
+		lb.pinned[key] = req.Backend
+	}
+	lb.mux.Unlock()
+	if !known {
+		http.Error(w, "Unknown backend", http.StatusNotFound)
+		return
+	}
+	
+	lb.audit("admin", "hash_override", fmt.Sprintf("%s -> %s", key, req.Backend))
+	writeJSON(w, http.StatusOK, map[string]string{"key": key, "backend": req.Backend})
+}
+
+func (lb *LoadBalancer) handleDeleteHashOverride(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	lb.mux.Lock()
+	_, ok := lb.pinned[key]
+	delete(lb.pinned, key)
+	lb.mux.Unlock()
+	if !ok {
+		http.Error(w, "Unknown hash override", http.StatusNotFound)
+		return
+	}
+	
+	lb.audit("admin", "hash_override", fmt.Sprintf("%s removed", key))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html><head><title>Down for maintenance</title></head>
+<body><h1>Down for maintenance</h1><p>We'll be back shortly.</p></body></html>
+`
+
+// setMaintenance switches maintenance mode. The page is (re)read from
+// MAINTENANCE_PAGE each time it is switched on, so edits take effect then.
+func (lb *LoadBalancer) setMaintenance(on bool) error {
+	page := []byte(defaultMaintenancePage)
+	if on && lb.cfg.MaintenancePage != "" {
+		var err error
+		if page, err = os.ReadFile(lb.cfg.MaintenancePage); err != nil {
+			return err
+		}
+	}
+	
+	lb.maintenanceMu.Lock()
+	defer lb.maintenanceMu.Unlock()
+	lb.maintenance = on
+	lb.maintenancePage = page
+	return nil
+}
+
+// serveMaintenance answers with the maintenance page while maintenance mode
+// is on, without touching the backends.
+func (lb *LoadBalancer) serveMaintenance(w http.ResponseWriter) bool {
+	lb.maintenanceMu.RLock()
+	on, page := lb.maintenance, lb.maintenancePage
+	lb.maintenanceMu.RUnlock()
+	if !on {
+		return false
+	}
+	
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(lb.cfg.MaintenanceRetryAfter.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(page)
+	return true
+}
+
+type maintenanceRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+func (lb *LoadBalancer) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req maintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		http.Error(w, "Body must be {\"enabled\": true|false}", http.StatusBadRequest)
+		return
+	}
+	if err := lb.setMaintenance(*req.Enabled); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read maintenance page: %v", err), http.StatusInternalServerError)
+		return
+	}
+	
+	state := "off"
+	if *req.Enabled {
+		state = "on"
+	}
+	lb.audit("admin", "maintenance", state)
+	writeJSON(w, http.StatusOK, map[string]any{"enabled": *req.Enabled})
+}
+
+// CaptureFilter selects the requests a capture records. Zero values get
+// the defaults below.
+type CaptureFilter struct {
+	PathPrefix   string  `json:"path_prefix"`
+	SampleRate   float64 `json:"sample_rate"`    // fraction of matching requests, default 1
+	MaxCount     int64   `json:"max_count"`      // stop after this many, default 100
+	MaxBodyBytes int64   `json:"max_body_bytes"` // body bytes kept per request, default 64 KiB
+}
+
+// CapturedRequest is one line of a capture file. Body is base64 in JSON.
+type CapturedRequest struct {
+	Time          time.Time   `json:"time"`
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	Host          string      `json:"host"`
+	Proto         string      `json:"proto"`
+	RemoteAddr    string      `json:"remote_addr"`
+	Headers       http.Header `json:"headers"`
+	Body          []byte      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+type CaptureStatus struct {
+	File       string        `json:"file"`
+	Filter     CaptureFilter `json:"filter"`
+	Active     bool          `json:"active"`
+	StartedAt  time.Time     `json:"started_at"`
+	StopReason string        `json:"stop_reason,omitempty"`
+	Captured   int64         `json:"captured"`
+	Dropped    int64         `json:"dropped"` // writer fell behind
+}
+
+// captureQueueSize bounds the records waiting to be written; requests never
+// wait on the file, so a capture drops records rather than add latency.
+const captureQueueSize = 1024
+
+// capture records sampled requests to an NDJSON file from a background
+// writer until its count limit is reached or it is stopped.
+type capture struct {
+	filter  CaptureFilter
+	file    string
+	started time.Time
+	redact  []string
+	
+	mu      sync.RWMutex // guards sends on records against stop closing it
+	records chan *CapturedRequest
+	reason  string
+	active  atomic.Bool
+	taken   atomic.Int64 // records claimed, possibly past MaxCount
+	written atomic.Int64
+	dropped atomic.Int64
+	done    chan struct{} // closed once the file is flushed and closed
+}
+
+func (lb *LoadBalancer) startCapture(filter CaptureFilter) (*capture, error) {
+	dir := lb.cfg.CaptureDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	name := filepath.Join(dir, "capture-"+time.Now().Format("20060102-150405.000")+".ndjson")
+	// Captures hold request data, so keep them private.
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	
+	c := &capture{
+		filter:  filter,
+		file:    name,
+		started: time.Now(),
+		records: make(chan *CapturedRequest, captureQueueSize),
+		done:    make(chan struct{}),
+	}
+	for _, header := range lb.cfg.CaptureRedactHeaders {
+		c.redact = append(c.redact, http.CanonicalHeaderKey(header))
+	}
+	c.active.Store(true)
+	go c.write(f)
+	return c, nil
+}
+
+// record queues r if it passes the filter. Up to MaxBodyBytes of the body
+// are read ahead and put back in front of the rest for the proxy.
+func (c *capture) record(r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, c.filter.PathPrefix) {
+		return
+	}
+	if c.filter.SampleRate < 1 && rand.Float64() >= c.filter.SampleRate {
+		return
+	}
+	n := c.taken.Add(1)
+	if n > c.filter.MaxCount {
+		return
+	}
+	
+	rec := &CapturedRequest{
+		Time:       time.Now(),
+		Method:     r.Method,
+		URL:        r.URL.RequestURI(),
+		Host:       r.Host,
+		Proto:      r.Proto,
+		RemoteAddr: r.RemoteAddr,
+		Headers:    r.Header.Clone(),
+	}
+	for _, header := range c.redact {
+		if _, ok := rec.Headers[header]; ok {
+			rec.Headers[header] = []string{"[REDACTED]"}
+		}
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		body := r.Body
+		data, _ := io.ReadAll(io.LimitReader(body, c.filter.MaxBodyBytes+1))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), body), body}
+		rec.BodyTruncated = int64(len(data)) > c.filter.MaxBodyBytes
+		rec.Body = data[:min(int64(len(data)), c.filter.MaxBodyBytes)]
+	}
+	
+	c.mu.RLock()
+	if c.active.Load() {
+		select {
+		case c.records <- rec:
+		default:
+			c.dropped.Add(1)
+		}
+	}
+	c.mu.RUnlock()
+	if n == c.filter.MaxCount {
+		c.stop("max_count")
+	}
+}
+
+// stop ends the capture; the writer then drains what is queued. Only the
+// first call counts.
+func (c *capture) stop(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.active.Load() {
+		return
+	}
+	c.active.Store(false)
+	c.reason = reason
+	close(c.records)
+}
+
+func (c *capture) write(f *os.File) {
+	defer close(c.done)
+	log.Printf("[INFO] Capturing requests to %s (path prefix %q, sample rate %v, max %d)\n",
+		c.file, c.filter.PathPrefix, c.filter.SampleRate, c.filter.MaxCount)
+	
+	buf := bufio.NewWriter(f)
+	enc := json.NewEncoder(buf)
+	for rec := range c.records {
+		if err := enc.Encode(rec); err != nil {
+			log.Printf("[ERROR] Failed to write captured request to %s: %v\n", c.file, err)
+			continue
+		}
+		c.written.Add(1)
+		// Flush whenever the queue is empty so the file can be read while
+		// the capture is still running.
+		if len(c.records) == 0 {
+			buf.Flush()
+		}
+	}
+	
+	err := buf.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to finish capture file %s: %v\n", c.file, err)
+	}
+	c.mu.RLock()
+	reason := c.reason
+	c.mu.RUnlock()
+	log.Printf("[INFO] Capture to %s stopped (%s): %d requests written, %d dropped\n",
+		c.file, reason, c.written.Load(), c.dropped.Load())
+}
+
+func (c *capture) status() CaptureStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return CaptureStatus{
+		File:       c.file,
+		Filter:     c.filter,
+		Active:     c.active.Load(),
+		StartedAt:  c.started,
+		StopReason: c.reason,
+		Captured:   c.written.Load(),
+		Dropped:    c.dropped.Load(),
+	}
+}
+
+// handleStartCapture starts recording requests matching the JSON filter in
+// the body, e.g. {"path_prefix": "/api/", "sample_rate": 0.1, "max_count":
+// 500}. Only one capture runs at a time.
+func (lb *LoadBalancer) handleStartCapture(w http.ResponseWriter, r *http.Request) {
+	var filter CaptureFilter
+	if err := json.NewDecoder(r.Body).Decode(&filter); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("Invalid capture filter: %v", err), http.StatusBadRequest)
+		return
+	}
+	if filter.SampleRate == 0 {
+		filter.SampleRate = 1
+	}
+	if filter.MaxCount == 0 {
+		filter.MaxCount = 100
+	}
+	if filter.MaxBodyBytes == 0 {
+		filter.MaxBodyBytes = 64 << 10
+	}
+	if filter.SampleRate < 0 || filter.SampleRate > 1 || filter.MaxCount < 0 || filter.MaxBodyBytes < 0 {
+		http.Error(w, "sample_rate must be between 0 and 1, max_count and max_body_bytes must not be negative", http.StatusBadRequest)
+		return
+	}
+	
+	lb.captureMu.Lock()
+	defer lb.captureMu.Unlock()
+	if c := lb.capture.Load(); c != nil && c.active.Load() {
+		http.Error(w, fmt.Sprintf("A capture to %s is already running", c.file), http.StatusConflict)
+		return
+	}
+	c, err := lb.startCapture(filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create capture file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	lb.capture.Store(c)
+	lb.audit("admin", "capture_start", fmt.Sprintf("%s path_prefix=%q sample_rate=%v max_count=%d",
+		c.file, filter.PathPrefix, filter.SampleRate, filter.MaxCount))
+	writeJSON(w, http.StatusCreated, c.status())
+}
+
+// handleStopCapture stops the running capture and waits for its file to be
+// complete.
+func (lb *LoadBalancer) handleStopCapture(w http.ResponseWriter, r *http.Request) {
+	lb.captureMu.Lock()
+	defer lb.captureMu.Unlock()
+	c := lb.capture.Load()
+	if c == nil || !c.active.Load() {
+		http.Error(w, "No capture is running", http.StatusNotFound)
+		return
+	}
+	c.stop("stopped")
+	<-c.done
+	lb.audit("admin", "capture_stop", fmt.Sprintf("%s after %d requests", c.file, c.written.Load()))
+	writeJSON(w, http.StatusOK, c.status())
+}
+
+func (lb *LoadBalancer) handleCaptureStatus(w http.ResponseWriter, r *http.Request) {
+	c := lb.capture.Load()
+	if c == nil {
+		http.Error(w, "No capture has run", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, c.status())
+}
+
+// requestTraceRecord is one line of REQUEST_TRACE_FILE. CacheHit marks
+// responses replayed from the idempotency cache or shared by the coalescer,
+// which never reach a backend themselves.
+type requestTraceRecord struct {
+	TS         time.Time `json:"ts"`
+	RequestID  string    `json:"request_id"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	ClientIP   string    `json:"client_ip"`
+	BackendURL string    `json:"backend_url"`
+	Status     int       `json:"status"`
+	DurationMs float64   `json:"duration_ms"`
+	RetryCount int       `json:"retry_count"`
+	CacheHit   bool      `json:"cache_hit"`
+	
+	state *requestState // set by forward
+}
+
+// requestTraceFlushInterval bounds how long trace records sit in the buffer.
+const requestTraceFlushInterval = 100 * time.Millisecond
+
+// requestTraceLog appends request trace records to a file through a buffer
+// that a background goroutine flushes, so requests never wait on the disk
+// beyond copying their line. Once the file passes maxSize it is renamed to
+// <path>.1, replacing any earlier one, and a new file is started.
+type requestTraceLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64 // 0 never rotates
+	file    *os.File
+	buf     *bufio.Writer
+	size    int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newRequestTraceLog(path string, maxSize int64) (*requestTraceLog, error) {
+	t := &requestTraceLog{path: path, maxSize: maxSize, stop: make(chan struct{}), done: make(chan struct{})}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	go t.flushLoop()
+	return t, nil
+}
+
+// Caller must hold t.mu, or own t exclusively.
+func (t *requestTraceLog) open() error {
+	file, err := os.OpenFile(t.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	t.file, t.buf, t.size = file, bufio.NewWriter(file), info.Size()
+	return nil
 }
 
-func (b *Backend) SetAlive(alive bool) {
-	b.mux.Lock()
-	defer b.mux.Unlock()
-	b.Alive = alive
+func (t *requestTraceLog) flushLoop() {
+	defer close(t.done)
+	ticker := time.NewTicker(requestTraceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.mu.Lock()
+			if err := t.buf.Flush(); err != nil {
+				log.Printf("[WARN] Failed to write request trace: %v\n", err)
+			}
+			t.mu.Unlock()
+		case <-t.stop:
+			return
+		}
+	}
 }
 
-func (b *Backend) IsAlive() bool {
-	b.mux.RLock()
-	defer b.mux.RUnlock()
-	return b.Alive
+// finish completes record from the response and the request's state, if it
+// was forwarded, and queues it for writing.
+func (t *requestTraceLog) finish(record *requestTraceRecord, rec *statusRecorder) {
+	record.Status = rec.status
+	record.DurationMs = float64(time.Since(record.TS)) / float64(time.Millisecond)
+	if state := record.state; state != nil {
+		if state.backend != nil {
+			record.BackendURL = state.backend.URL
+		}
+		record.RetryCount = max(state.attempts-1, 0)
+	} else {
+		record.CacheHit = true
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return
+	}
+	if t.maxSize > 0 && t.size > 0 && t.size+int64(len(line)) > t.maxSize {
+		if err := t.rotate(); err != nil {
+			log.Printf("[ERROR] Failed to rotate request trace %s, stopping it: %v\n", t.path, err)
+			return
+		}
+	}
+	n, _ := t.buf.Write(line)
+	t.size += int64(n)
 }
 
-type LoadBalancer struct {
-	backends []*Backend
-	current  int
-	mux      sync.Mutex
+// rotate moves the full file aside and starts a new one. Caller must hold
+// t.mu.
+func (t *requestTraceLog) rotate() error {
+	t.buf.Flush()
+	t.file.Close()
+	t.file = nil
+	if err := os.Rename(t.path, t.path+".1"); err != nil {
+		return err
+	}
+	return t.open()
 }
 
-func NewLoadBalancer(backendURLs []string) *LoadBalancer {
-	lb := &LoadBalancer{
-		backends: []*Backend{},
-		current:  0,
+// close flushes what is buffered and closes the file; records finished
+// later are dropped.
+func (t *requestTraceLog) close() {
+	close(t.stop)
+	<-t.done
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return
+	}
+	if err := t.buf.Flush(); err != nil {
+		log.Printf("[WARN] Failed to write request trace: %v\n", err)
+	}
+	t.file.Close()
+	t.file = nil
+}
+
+const (
+	priorityHigh = iota
+	priorityNormal
+)
+
+var priorityClassNames = [...]string{priorityHigh: "high", priorityNormal: "normal"}
+
+var errQueueFull = errors.New("priority queue is full")
+
+// priorityLimiter is a counting semaphore whose waiters are served high
+// priority first, then in arrival order. Each class has its own bounded
+// queue.
+type priorityLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	inUse    int
+	queues   [2][]chan struct{}
+	maxQueue [2]int
+	metrics  *metrics
+}
+
+func newPriorityLimiter(limit, highQueue, normalQueue int, m *metrics) *priorityLimiter {
+	return &priorityLimiter{limit: limit, maxQueue: [2]int{highQueue, normalQueue}, metrics: m}
+}
+
+// acquire takes a slot, waiting in class's queue until one frees up or ctx
+// is done.
+func (l *priorityLimiter) acquire(ctx context.Context, class int) error {
+	l.mu.Lock()
+	if l.inUse < l.limit && len(l.queues[priorityHigh]) == 0 && len(l.queues[priorityNormal]) == 0 {
+		l.inUse++
+		l.mu.Unlock()
+		return nil
+	}
+	if len(l.queues[class]) >= l.maxQueue[class] {
+		l.mu.Unlock()
+		return errQueueFull
 	}
+	ready := make(chan struct{})
+	l.queues[class] = append(l.queues[class], ready)
+	l.updateQueueGauge(class)
+	l.mu.Unlock()
 	
-	for _, backendURL := range backendURLs {
-		parsedURL, err := url.Parse(backendURL)
-		
-		if err != nil {
-			log.Printf("[ERROR] Failed to parse URL %s: %v\n", backendURL, err)
-			continue
-		}
-		
-		proxy := httputil.NewSingleHostReverseProxy(parsedURL)
-		
-		backend := &Backend{
-			URL:   backendURL,
-			Proxy: proxy,
-			Alive: true,
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+	
+	l.mu.Lock()
+	if i := slices.Index(l.queues[class], ready); i >= 0 {
+		l.queues[class] = slices.Delete(l.queues[class], i, i+1)
+		l.updateQueueGauge(class)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+	l.mu.Unlock()
+	// Handed a slot just as the wait ended; pass it on.
+	l.release()
+	return ctx.Err()
+}
+
+// release hands the slot to the first waiter, high priority first, or
+// frees it.
+func (l *priorityLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for class := range l.queues {
+		if len(l.queues[class]) > 0 {
+			ready := l.queues[class][0]
+			l.queues[class] = l.queues[class][1:]
+			l.updateQueueGauge(class)
+			close(ready)
+			return
 		}
-		lb.backends = append(lb.backends, backend)
-		log.Printf("[INFO] Added backend: %s\n", backendURL)
 	}
+	l.inUse--
+}
+
+// Caller must hold l.mu.
+func (l *priorityLimiter) updateQueueGauge(class int) {
+	l.metrics.concurrencyQueued.set(float64(len(l.queues[class])), priorityClassNames[class])
+}
+
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Detail string    `json:"detail"`
+}
+
+const auditLogSize = 500
+
+// audit records an administrative or automatic change, keeping the most
+// recent entries in memory for GET /admin/audit.
+func (lb *LoadBalancer) audit(actor, action, detail string) {
+	log.Printf("[AUDIT] %s %s: %s\n", actor, action, detail)
+	lb.events.publish("audit", map[string]any{"actor": actor, "action": action, "detail": detail})
 	
-	return lb
+	lb.auditMu.Lock()
+	defer lb.auditMu.Unlock()
+	lb.auditLog = append(lb.auditLog, AuditEntry{Time: time.Now(), Actor: actor, Action: action, Detail: detail})
+	if len(lb.auditLog) > auditLogSize {
+		lb.auditLog = lb.auditLog[len(lb.auditLog)-auditLogSize:]
+	}
 }
 
-func (lb *LoadBalancer) getNextBackend() *Backend {
-	lb.mux.Lock()
-	defer lb.mux.Unlock()
+func (lb *LoadBalancer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	lb.auditMu.Lock()
+	entries := append([]AuditEntry(nil), lb.auditLog...)
+	lb.auditMu.Unlock()
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// Event is one entry of the GET /admin/events stream. Backends report
+// backend_down and backend_up on health transitions, backend_ejected and
+// backend_reinstated around latency ejections and backend_backoff when a
+// Retry-After takes them out of rotation; retry_budget_exhausted and
+// retry_budget_restored trip and reset retries as a whole, and audit
+// records admin actions. The config is only read at startup, so nothing
+// reports reloads.
+type Event struct {
+	ID   uint64         `json:"id"`
+	Time time.Time      `json:"time"`
+	Type string         `json:"type"`
+	Data map[string]any `json:"data"`
+}
+
+const (
+	eventHistorySize = 1000 // events kept for replay
+	eventBufferSize  = 256  // events a subscriber may fall behind by before losing some
+	eventKeepalive   = 15 * time.Second
+)
+
+// eventBus fans events out to the /admin/events streams. Publishing never
+// blocks: a subscriber whose buffer is full misses the event, and its
+// stream reports the gap from the jump in IDs.
+type eventBus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	history     []Event
+	subscribers map[chan Event]struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{nextID: 1, subscribers: make(map[chan Event]struct{}), done: make(chan struct{})}
+}
+
+func (bus *eventBus) publish(eventType string, data map[string]any) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	event := Event{ID: bus.nextID, Time: time.Now(), Type: eventType, Data: data}
+	bus.nextID++
+	bus.history = append(bus.history, event)
+	if len(bus.history) > eventHistorySize {
+		bus.history = bus.history[len(bus.history)-eventHistorySize:]
+	}
+	for ch := range bus.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// subscribe registers a stream and returns the stored events after lastID
+// (at most replay of them when replay >= 0) and the latest event's ID, so
+// nothing falls between the replay and the live events.
+func (bus *eventBus) subscribe(lastID uint64, replay int) (chan Event, []Event, uint64) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	start := sort.Search(len(bus.history), func(i int) bool { return bus.history[i].ID > lastID })
+	missed := bus.history[start:]
+	if replay >= 0 && len(missed) > replay {
+		missed = missed[len(missed)-replay:]
+	}
+	ch := make(chan Event, eventBufferSize)
+	bus.subscribers[ch] = struct{}{}
+	return ch, slices.Clone(missed), bus.nextID - 1
+}
+
+func (bus *eventBus) unsubscribe(ch chan Event) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	delete(bus.subscribers, ch)
+}
+
+// close ends every stream, for shutdown; open streams would otherwise hold
+// the server's graceful shutdown until it times out.
+func (bus *eventBus) close() {
+	bus.closeOnce.Do(func() { close(bus.done) })
+}
+
+// handleEvents streams events as server-sent events. A reconnecting client's
+// Last-Event-ID header (or the last_event_id parameter) resumes after that
+// event; otherwise ?replay=N starts with the last N events. Events the
+// client missed, because they fell out of the history or its connection
+// was too slow, are reported with a "gap" event.
+func (lb *LoadBalancer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	var lastID uint64
+	replay := 0
+	if v := cmp.Or(r.Header.Get("Last-Event-ID"), r.URL.Query().Get("last_event_id")); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		lastID, replay = id, -1
+	} else if v := r.URL.Query().Get("replay"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid replay", http.StatusBadRequest)
+			return
+		}
+		replay = min(n, eventHistorySize)
+	}
 	
-	for i := 0; i < len(lb.backends); i++ {
-		idx := (lb.current + i) % len(lb.backends)
-		
-		if lb.backends[idx].IsAlive() {
-			lb.current = (idx + 1) % len(lb.backends)
-			return lb.backends[idx]
+	ch, missed, latest := lb.events.subscribe(lastID, replay)
+	defer lb.events.unsubscribe(ch)
+	if replay >= 0 {
+		// Events before those replayed aren't a gap.
+		lastID = latest - uint64(len(missed))
+	}
+	
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	
+	send := func(event Event) error {
+		if event.ID > lastID+1 {
+			gap, _ := json.Marshal(map[string]uint64{"missed": event.ID - lastID - 1, "from": lastID + 1, "to": event.ID - 1})
+			if _, err := fmt.Fprintf(w, "event: gap\ndata: %s\n\n", gap); err != nil {
+				return err
+			}
+		}
+		lastID = event.ID
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		return err
+	}
+	for _, event := range missed {
+		if err := send(event); err != nil {
+			return
 		}
 	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
 	
-	return nil
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-ch:
+			if err := send(event); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-lb.events.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
 }
 
-func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()  
+// TraceEvent is one log line of a proxied request, kept briefly in memory
+// for GET /admin/requests/{request_id}.
+type TraceEvent struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Attempt   int       `json:"attempt"`
+	Backend   string    `json:"backend,omitempty"`
+	Level     string    `json:"level"`
+	Message   string    `json:"message"`
+}
+
+// recordTrace appends to the debug trace, which holds at most
+// DEBUG_TRACE_CAPACITY events and drops those older than DEBUG_TRACE_WINDOW.
+func (lb *LoadBalancer) recordTrace(event TraceEvent) {
+	if lb.cfg.DebugTraceCapacity <= 0 {
+		return
+	}
 	
-	selectedBackend := lb.getNextBackend()
+	lb.traceMu.Lock()
+	defer lb.traceMu.Unlock()
+	lb.traceEvents = append(lb.traceEvents, event)
+	if len(lb.traceEvents) > lb.cfg.DebugTraceCapacity {
+		lb.traceEvents = lb.traceEvents[len(lb.traceEvents)-lb.cfg.DebugTraceCapacity:]
+	}
+	cutoff := event.Time.Add(-lb.cfg.DebugTraceWindow)
+	expired := sort.Search(len(lb.traceEvents), func(i int) bool {
+		return lb.traceEvents[i].Time.After(cutoff)
+	})
+	lb.traceEvents = lb.traceEvents[expired:]
+}
+
+func (lb *LoadBalancer) handleRequestTrace(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("request_id")
+	cutoff := time.Now().Add(-lb.cfg.DebugTraceWindow)
 	
-	if selectedBackend == nil {
-		log.Printf("[ERROR] All backends are down - Request: %s %s\n", r.Method, r.URL.Path)
-		http.Error(w, "Service unavailable - all backends are down", http.StatusServiceUnavailable)
-		return
+	events := []TraceEvent{}
+	lb.traceMu.Lock()
+	for _, event := range lb.traceEvents {
+		if event.RequestID == id && event.Time.After(cutoff) {
+			events = append(events, event)
+		}
 	}
+	lb.traceMu.Unlock()
 	
-	log.Printf("[INFO] Forwarding request to %s - Path: %s %s\n", 
-		selectedBackend.URL, r.Method, r.URL.Path)
+	if len(events) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no trace for request " + id})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"request_id": id, "events": events})
+}
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// notify posts an alert to ALERT_WEBHOOK_URL in the background.
+func (lb *LoadBalancer) notify(event string, payload map[string]any) {
+	if lb.cfg.AlertWebhookURL == "" {
+		return
+	}
 	
-	selectedBackend.Proxy.ServeHTTP(w, r)
+	body, err := json.Marshal(map[string]any{"event": event, "time": time.Now(), "data": payload})
+	if err != nil {
+		log.Printf("[ERROR] Failed to encode %s alert: %v\n", event, err)
+		return
+	}
+	go func() {
+		resp, err := webhookClient.Post(lb.cfg.AlertWebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("[WARN] Failed to send %s alert: %v\n", event, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("[WARN] Alert webhook returned status %d for %s\n", resp.StatusCode, event)
+		}
+	}()
+}
+
+// Instance is how this load balancer describes itself to a registry.
+type Instance struct {
+	ID      string   `json:"id"`
+	Service string   `json:"service"`
+	Address string   `json:"address"`
+	Port    int      `json:"port"`
+	Version string   `json:"version"`
+	Tags    []string `json:"tags"`
+}
+
+// registry is a place this instance announces itself. Heartbeats keep the
+// registration alive; a failed one is followed by registering again.
+type registry interface {
+	register(inst Instance) error
+	heartbeat(inst Instance) error
+	deregister(inst Instance) error
+}
+
+// RegistrationStats is the self-registration status in /admin/stats.
+type RegistrationStats struct {
+	Registry      string     `json:"registry"`
+	Instance      Instance   `json:"instance"`
+	Registered    bool       `json:"registered"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// registrar keeps this instance registered while it runs. Registry errors
+// are logged and retried on the next heartbeat; they never stop serving.
+type registrar struct {
+	kind     string
+	registry registry
+	instance Instance
+	interval time.Duration
 	
-	duration := time.Since(start)
-	log.Printf("[INFO] Request completed in %v - Backend: %s\n", duration, selectedBackend.URL)
+	mu     sync.Mutex
+	status RegistrationStats
 }
 
-func (lb *LoadBalancer) healthCheck() {
-	log.Println("[INFO] Running health checks...")
+func newRegistrar(cfg *Config) *registrar {
+	address := cfg.RegisterAddress
+	if address == "" {
+		address, _ = os.Hostname()
+	}
+	port := cfg.RegisterPort
+	if port == 0 && len(cfg.Listeners) > 0 {
+		if _, p, err := net.SplitHostPort(cfg.Listeners[0].Address); err == nil {
+			port, _ = strconv.Atoi(p)
+		}
+	}
+	inst := Instance{
+		ID:      fmt.Sprintf("%s-%s-%d", cfg.RegisterServiceName, address, port),
+		Service: cfg.RegisterServiceName,
+		Address: address,
+		Port:    port,
+		Version: version,
+		Tags:    cfg.RegisterTags,
+	}
 	
-	aliveCount := 0
-	for _, backend := range lb.backends {
-		resp, err := http.Get(backend.URL)
+	r := &registrar{kind: cfg.SelfRegister, instance: inst, interval: cfg.RegisterHeartbeatInterval}
+	switch cfg.SelfRegister {
+	case "consul":
+		r.registry = &consulRegistry{addr: strings.TrimSuffix(cfg.ConsulAddr, "/"), token: cfg.ConsulToken, ttl: 3 * cfg.RegisterHeartbeatInterval}
+	case "webhook":
+		r.registry = &webhookRegistry{url: cfg.RegisterWebhookURL}
+	}
+	r.status = RegistrationStats{Registry: r.kind, Instance: inst}
+	return r
+}
+
+func (r *registrar) run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.mu.Lock()
+		registered := r.status.Registered
+		r.mu.Unlock()
 		
-		if err != nil {
-			log.Printf("[WARN] Health check failed for %s: %v\n", backend.URL, err)
-			backend.SetAlive(false)
-		} else if resp.StatusCode != http.StatusOK {
-			log.Printf("[WARN] Backend %s returned status %d\n", backend.URL, resp.StatusCode)
-			backend.SetAlive(false)
-		} else {
-			if !backend.IsAlive() {
-				log.Printf("[INFO] Backend %s is now UP (recovered)\n", backend.URL)
+		if !registered {
+			err := r.registry.register(r.instance)
+			r.record(err, err == nil)
+			if err != nil {
+				log.Printf("[WARN] Failed to register with %s: %v\n", r.kind, err)
+			} else {
+				log.Printf("[INFO] Registered %s with %s\n", r.instance.ID, r.kind)
 			}
-			backend.SetAlive(true)
-			aliveCount++
+		} else if err := r.registry.heartbeat(r.instance); err != nil {
+			r.record(err, false)
+			log.Printf("[WARN] Registration heartbeat to %s failed, will register again: %v\n", r.kind, err)
+		} else {
+			r.record(nil, true)
 		}
 		
-		if resp != nil {
-			resp.Body.Close()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 	}
-	
-	log.Printf("[INFO] Health check complete: %d/%d backends alive\n", aliveCount, len(lb.backends))
 }
 
-func (lb *LoadBalancer) startHealthChecks(interval time.Duration) {
-	log.Printf("[INFO] Starting health checks (interval: %v)\n", interval)
-	
-	ticker := time.NewTicker(interval)
-	go func() {
-		for range ticker.C {
-			lb.healthCheck()
-		}
-	}()
+func (r *registrar) record(err error, registered bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.Registered = registered
+	r.status.LastError = ""
+	if err != nil {
+		r.status.LastError = err.Error()
+		return
+	}
+	now := time.Now()
+	r.status.LastHeartbeat = &now
 }
 
-func (lb *LoadBalancer) getStats() {
-	aliveCount := 0
-	for _, backend := range lb.backends {
-		if backend.IsAlive() {
-			aliveCount++
+func (r *registrar) deregister() {
+	if err := r.registry.deregister(r.instance); err != nil {
+		log.Printf("[WARN] Failed to deregister from %s: %v\n", r.kind, err)
+		return
+	}
+	r.mu.Lock()
+	r.status.Registered = false
+	r.mu.Unlock()
+	log.Printf("[INFO] Deregistered %s from %s\n", r.instance.ID, r.kind)
+}
+
+func (r *registrar) stats() RegistrationStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+var registryClient = &http.Client{Timeout: 5 * time.Second}
+
+// consulRegistry registers with the local Consul agent, using a TTL check
+// the heartbeats pass. Consul removes the service by itself if heartbeats
+// stop for a minute, e.g. after a crash.
+type consulRegistry struct {
+	addr  string
+	token string
+	ttl   time.Duration
+}
+
+func (c *consulRegistry) checkID(inst Instance) string {
+	return inst.ID + "-ttl"
+}
+
+func (c *consulRegistry) register(inst Instance) error {
+	return c.put("/v1/agent/service/register", map[string]any{
+		"ID":      inst.ID,
+		"Name":    inst.Service,
+		"Address": inst.Address,
+		"Port":    inst.Port,
+		"Tags":    inst.Tags,
+		"Meta":    map[string]string{"version": inst.Version},
+		"Check": map[string]any{
+			"CheckID":                        c.checkID(inst),
+			"TTL":                            c.ttl.String(),
+			"DeregisterCriticalServiceAfter": "1m",
+		},
+	})
+}
+
+func (c *consulRegistry) heartbeat(inst Instance) error {
+	return c.put("/v1/agent/check/pass/"+url.PathEscape(c.checkID(inst)), nil)
+}
+
+func (c *consulRegistry) deregister(inst Instance) error {
+	return c.put("/v1/agent/service/deregister/"+url.PathEscape(inst.ID), nil)
+}
+
+func (c *consulRegistry) put(apiPath string, body any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
 		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(http.MethodPut, c.addr+apiPath, reader)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("consul returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// webhookRegistry POSTs {"event": "register"|"heartbeat"|"deregister",
+// "instance": {...}} to a URL, for registries without built-in support.
+type webhookRegistry struct {
+	url string
+}
+
+func (h *webhookRegistry) register(inst Instance) error {
+	return h.post("register", inst)
+}
+
+func (h *webhookRegistry) heartbeat(inst Instance) error {
+	return h.post("heartbeat", inst)
+}
+
+func (h *webhookRegistry) deregister(inst Instance) error {
+	return h.post("deregister", inst)
+}
+
+func (h *webhookRegistry) post(event string, inst Instance) error {
+	body, err := json.Marshal(map[string]any{"event": event, "time": time.Now(), "instance": inst})
+	if err != nil {
+		return err
+	}
+	resp, err := registryClient.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (lb *LoadBalancer) adminRoutes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/stats", lb.handleStats)
+	mux.HandleFunc("GET /admin/canary/report", lb.handleCanaryReport)
+	mux.HandleFunc("POST /admin/canary/weight", lb.handleCanaryWeight)
+	mux.HandleFunc("POST /admin/canary/reenable", lb.handleCanaryReenable)
+	mux.HandleFunc("GET /admin/audit", lb.handleAudit)
+	mux.HandleFunc("GET /admin/events", lb.handleEvents)
+	mux.HandleFunc("GET /admin/requests/{request_id}", lb.handleRequestTrace)
+	mux.HandleFunc("POST /admin/health/reset", lb.handleHealthReset)
+	mux.HandleFunc("POST /admin/health/run", lb.handleHealthRun)
+	mux.HandleFunc("POST /admin/maintenance", lb.handleMaintenance)
+	mux.HandleFunc("GET /admin/capture", lb.handleCaptureStatus)
+	mux.HandleFunc("POST /admin/capture", lb.handleStartCapture)
+	mux.HandleFunc("DELETE /admin/capture", lb.handleStopCapture)
+	mux.HandleFunc("POST /admin/backends/drain", lb.handleDrain)
+	mux.HandleFunc("POST /admin/backends/weight", lb.handleWeight)
+	mux.HandleFunc("POST /admin/backends", lb.handleAddBackend)
+	mux.HandleFunc("POST /admin/rewrite/test", lb.handleRewriteTest)
+	mux.HandleFunc("DELETE /admin/backends/{url}", lb.handleRemoveBackend)
+	mux.HandleFunc("GET /admin/backends/{url}/connections", lb.handleConnections)
+	mux.HandleFunc("POST /admin/config/validate", lb.handleValidateConfig)
+	mux.HandleFunc("GET /admin/hash-overrides", lb.handleHashOverrides)
+	mux.HandleFunc("PUT /admin/hash-overrides/{key}", lb.handleSetHashOverride)
+	mux.HandleFunc("DELETE /admin/hash-overrides/{key}", lb.handleDeleteHashOverride)
+	return mux
+}
+
+// adminEnabled reports whether the admin API is served on r's listener: on
+// every listener once ADMIN_TOKEN is set, otherwise only on internal ones.
+func (lb *LoadBalancer) adminEnabled(r *http.Request) bool {
+	if lb.cfg.AdminToken != "" {
+		return true
+	}
+	listener := requestListener(r)
+	return listener != nil && listener.Internal
+}
+
+// serveAdmin authenticates admin requests with the ADMIN_TOKEN bearer token,
+// except on internal listeners.
+func (lb *LoadBalancer) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if listener := requestListener(r); listener != nil && listener.Internal {
+		lb.admin.ServeHTTP(w, r)
+		return
 	}
 	
-	log.Printf("[STATS] Total backends: %d, Alive: %d, Down: %d\n", 
-		len(lb.backends), aliveCount, len(lb.backends)-aliveCount)
+	expected := []byte("Bearer " + lb.cfg.AdminToken)
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+		log.Printf("[WARN] Unauthorized admin request: %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	lb.admin.ServeHTTP(w, r)
+}
+
+func (lb *LoadBalancer) handleCanaryReport(w http.ResponseWriter, r *http.Request) {
+	window := lb.cfg.CanaryReportWindow
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid window", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	writeJSON(w, http.StatusOK, lb.canaryReport(window))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("[ERROR] Failed to encode JSON response: %v\n", err)
+	}
 }
 
 func main(){
+	printConfigDocs := flag.Bool("print-config-docs", false, "print configuration documentation and exit")
+	configDocsFormat := flag.String("config-docs-format", "markdown", "format for --print-config-docs: markdown or json-schema")
+	flag.Parse()
+	if *printConfigDocs {
+		docs := GenerateConfigDocs(*configDocsFormat)
+		if docs == "" {
+			log.Fatalf("[FATAL] Unknown config docs format %q\n", *configDocsFormat)
+		}
+		fmt.Print(docs)
+		return
+	}
 
 	en := godotenv.Load()
 	if en != nil {
 		log.Println("[WARN] No .env file found, using system environment variables")
 	}
 	
-	Port:=os.Getenv("PORT")
-	backendsEnv:=os.Getenv("Backend_URLs")
-
-	if backendsEnv == "" {
-		log.Fatal("Backend_URLs environment variable not set")
-	}
-	if Port == "" {
-		log.Fatal("PORT environment variable not set")
-	}
+	cfg := loadConfig()
 
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)  
 	
 	log.Println("[INFO] Starting load balancer...")
 	
-	backendURLs := strings.Split(backendsEnv, ",")
-	
-	lb := NewLoadBalancer(backendURLs)
+	lb := NewLoadBalancer(cfg)
 	
 	if len(lb.backends) == 0 {
 		log.Fatal("[FATAL] No valid backend servers configured!")
@@ -184,7 +10960,35 @@ func main(){
 
 	lb.healthCheck()
 	
-	lb.startHealthChecks(10 * time.Second)
+	lb.startHealthChecks()
+	
+	if cfg.CanaryAutoRollback {
+		lb.startCanaryRollback()
+	}
+	
+	if len(cfg.Schedules) > 0 {
+		lb.startSchedules()
+	}
+	
+	if cfg.Strategy == "auto_latency" {
+		lb.startAutoLatency()
+	}
+	
+	if cfg.DNSRefreshInterval > 0 {
+		lb.startDNSRefresh()
+	}
+	
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	
+	if cfg.VaultEnabled {
+		startVaultRenewal(ctx, cfg.VaultClient)
+	}
+	
+	if cfg.StateFile != "" {
+		lb.restoreState()
+		lb.startStatePersistence()
+	}
 	
 	go func() {
 		ticker := time.NewTicker(30 * time.Second)
@@ -193,10 +10997,13 @@ func main(){
 		}
 	}()
 	
-	log.Printf("[INFO] Load balancer listening on :%s\n", Port)
 	log.Printf("[INFO] Configured %d backend servers\n", len(lb.backends))
 	
-	err := http.ListenAndServe(":"+Port, lb)
+	if cfg.SelfRegister != "" {
+		lb.registrar = newRegistrar(cfg)
+	}
+	
+	err := lb.listenAndServe(ctx)
 	if err != nil {
 		log.Fatalf("[FATAL] Server failed to start: %v\n", err)
 	}
@@ -0,0 +1,9149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testConfig returns the configuration the environment defaults give,
+// balancing over backendURLs.
+func testConfig(backendURLs ...string) *Config {
+	cfg := envConfig()
+	cfg.Listeners = nil
+	cfg.Backends = nil
+	for _, backendURL := range backendURLs {
+		cfg.Backends = append(cfg.Backends, BackendConfig{URL: backendURL})
+	}
+	return cfg
+}
+
+// deadBackendURL returns the URL of a server that has already shut down,
+// so dialing it is refused.
+func deadBackendURL(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL
+}
+
+// serve sends r through lb and returns the recorded response.
+func serve(lb *LoadBalancer, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestRetryWithNoBackendLeftReturnsAttemptError(t *testing.T) {
+	cfg := testConfig(deadBackendURL(t))
+	cfg.MaxRetries = 2
+	cfg.LatencySLO = time.Nanosecond
+	cfg.LatencyEjectionMinRequests = 1
+	cfg.LatencyEjectionThreshold = 0
+	lb := NewLoadBalancer(cfg)
+
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	if !lb.backends[0].isEjected() {
+		t.Fatal("backend was not ejected by the failed attempt")
+	}
+}
+
+func TestAllBackendsDownBeforeAnyAttempt(t *testing.T) {
+	lb := NewLoadBalancer(testConfig(deadBackendURL(t)))
+	lb.backends[0].SetAlive(false)
+
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestExpandForwardedPath(t *testing.T) {
+	tests := []struct {
+		name, template, incoming, wantPath, wantQuery string
+	}{
+		{"complete override", "/api/v2/webhook", "/webhook?id=1", "/api/v2/webhook", "id=1"},
+		{"path passthrough", "/api/v2${path}", "/users/7", "/api/v2/users/7", ""},
+		{"query appended", "/hook?source=lb&${query}", "/x?id=1&b=2", "/hook", "source=lb&id=1&b=2"},
+		{"empty query", "/hook?source=lb&${query}", "/x", "/hook", "source=lb"},
+		{"double slashes", "/api/${path}", "/users", "/api/users", ""},
+		{"relative template", "api${path}", "/users", "/api/users", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.incoming)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotPath, gotQuery := expandForwardedPath(tt.template, u)
+			if gotPath != tt.wantPath || gotQuery != tt.wantQuery {
+				t.Errorf("expandForwardedPath(%q, %q) = %q, %q; want %q, %q",
+					tt.template, tt.incoming, gotPath, gotQuery, tt.wantPath, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestForwardedPathKeepsBackendBasePath(t *testing.T) {
+	var got string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RequestURI()
+	}))
+	defer backend.Close()
+
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: backend.URL + "/api/", ForwardedPath: "/v2${path}"}}
+	lb := NewLoadBalancer(cfg)
+
+	serve(lb, httptest.NewRequest(http.MethodGet, "/webhook?id=1", nil))
+	if want := "/api/v2/webhook?id=1"; got != want {
+		t.Errorf("backend got %q, want %q", got, want)
+	}
+}
+
+func TestStatsIncludesLBSection(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	cfg := testConfig(backend.URL)
+	cfg.StatsEnabled = true
+	lb := NewLoadBalancer(cfg)
+
+	for range 2 {
+		serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var stats Stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.LB.TotalRequests != 3 {
+		t.Errorf("total_requests = %d, want 3", stats.LB.TotalRequests)
+	}
+	if stats.LB.InFlight != 1 {
+		t.Errorf("in_flight = %d, want 1 (the stats request itself)", stats.LB.InFlight)
+	}
+	if stats.LB.Goroutines <= 0 || stats.LB.UptimeSeconds <= 0 || stats.LB.StartedAt.IsZero() {
+		t.Errorf("process fields not populated: %+v", stats.LB)
+	}
+	if stats.LB.ConfigChecksum != configChecksum(cfg) || stats.LB.ConfigChecksum == "" {
+		t.Errorf("config_checksum = %q, want %q", stats.LB.ConfigChecksum, configChecksum(cfg))
+	}
+}
+
+func TestStatsPathProxiedWhenDisabled(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+	lb := NewLoadBalancer(testConfig(backend.URL))
+
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/stats", nil)); rec.Code != http.StatusTeapot {
+		t.Errorf("status = %d, want the backend's %d", rec.Code, http.StatusTeapot)
+	}
+}
+
+// adminRequest builds an admin API request carrying lb's admin token.
+func adminRequest(lb *LoadBalancer, method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+lb.cfg.AdminToken)
+	return r
+}
+
+func TestWeightChangeResetsWeightedRoundRobin(t *testing.T) {
+	cfg := testConfig()
+	cfg.Strategy = "weighted_round_robin"
+	cfg.AdminToken = "secret"
+	cfg.Backends = []BackendConfig{
+		{URL: "http://127.0.0.1:9001", Weight: 10},
+		{URL: "http://127.0.0.1:9002", Weight: 1},
+	}
+	lb := NewLoadBalancer(cfg)
+	a, b := lb.backends[0], lb.backends[1]
+
+	// Build up credit under the old weights.
+	for range 5 {
+		lb.getNextBackend(httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	for _, change := range []string{
+		`{"backend": "http://127.0.0.1:9001", "weight": 1}`,
+		`{"backend": "http://127.0.0.1:9002", "weight": 3}`,
+	} {
+		if rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/backends/weight", change)); rec.Code != http.StatusOK {
+			t.Fatalf("weight change %s: status %d: %s", change, rec.Code, rec.Body)
+		}
+	}
+
+	// With the state reset, the very first round already follows 1:3.
+	counts := map[*Backend]int{}
+	for range 4 {
+		counts[lb.getNextBackend(httptest.NewRequest(http.MethodGet, "/", nil))]++
+	}
+	if counts[a] != 1 || counts[b] != 3 {
+		t.Errorf("first round after the change picked a %d and b %d times, want 1 and 3", counts[a], counts[b])
+	}
+}
+
+func TestWeightOverrideRemoved(t *testing.T) {
+	cfg := testConfig()
+	cfg.AdminToken = "secret"
+	cfg.Backends = []BackendConfig{{URL: "http://127.0.0.1:9001", Weight: 2}}
+	lb := NewLoadBalancer(cfg)
+
+	serve(lb, adminRequest(lb, http.MethodPost, "/admin/backends/weight", `{"backend": "http://127.0.0.1:9001", "weight": 7}`))
+	if got := lb.backends[0].weight(); got != 7 {
+		t.Fatalf("weight = %d, want the override 7", got)
+	}
+	serve(lb, adminRequest(lb, http.MethodPost, "/admin/backends/weight", `{"backend": "http://127.0.0.1:9001", "weight": 0}`))
+	if got := lb.backends[0].weight(); got != 2 {
+		t.Errorf("weight = %d, want the configured 2 after removing the override", got)
+	}
+	rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/backends/weight", `{"backend": "http://127.0.0.1:9999", "weight": 1}`))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown backend: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+// namedBackend starts a backend that answers with its name.
+func namedBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStickySessionSurvivesBackendURLChange(t *testing.T) {
+	old, other, moved := namedBackend(t, "old"), namedBackend(t, "other"), namedBackend(t, "moved")
+	cfg := testConfig()
+	cfg.StickySessions = true
+	cfg.AdminToken = "secret"
+	cfg.Backends = []BackendConfig{{URL: old.URL, BackendID: "api-1"}, {URL: other.URL}}
+	lb := NewLoadBalancer(cfg)
+
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Body.String() != "old" {
+		t.Fatalf("first request went to %q, want old", rec.Body)
+	}
+	cookie := rec.Result().Cookies()
+	if len(cookie) != 1 || cookie[0].Value != "api-1" {
+		t.Fatalf("sticky cookie = %v, want the backend id api-1", cookie)
+	}
+
+	// The backend moves to a new port and is re-registered under its id.
+	if rec := serve(lb, adminRequest(lb, http.MethodDelete, "/admin/backends/"+url.PathEscape(old.URL), "")); rec.Code != http.StatusOK {
+		t.Fatalf("removing the old URL: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/backends", `{"url": "`+moved.URL+`", "backend_id": "api-1"}`)); rec.Code != http.StatusCreated {
+		t.Fatalf("adding the new URL: status %d: %s", rec.Code, rec.Body)
+	}
+
+	for range 3 {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(cookie[0])
+		rec := serve(lb, r)
+		if rec.Body.String() != "moved" {
+			t.Fatalf("sticky request went to %q, want moved", rec.Body)
+		}
+		if len(rec.Result().Cookies()) != 0 {
+			t.Errorf("cookie reissued although it already names the backend")
+		}
+	}
+}
+
+func TestStickySessionUnknownIDFallsBackToStrategy(t *testing.T) {
+	a := namedBackend(t, "a")
+	cfg := testConfig(a.URL)
+	cfg.StickySessions = true
+	lb := NewLoadBalancer(cfg)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: cfg.StickyCookieName, Value: "gone"})
+	rec := serve(lb, r)
+	if rec.Body.String() != "a" {
+		t.Fatalf("request went to %q, want a", rec.Body)
+	}
+	cookie := rec.Result().Cookies()
+	if len(cookie) != 1 || cookie[0].Value != url.QueryEscape(a.URL) {
+		t.Errorf("sticky cookie = %v, want one naming %s, the default id", cookie, a.URL)
+	}
+}
+
+type sseEvent struct {
+	id, event, data string
+}
+
+// readSSE reads the next server-sent event from r, skipping comments.
+func readSSE(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && ev.event != "":
+			return ev
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// openEvents connects to lb's event stream, served by srv, with header set.
+func openEvents(t *testing.T, lb *LoadBalancer, srv *httptest.Server, query string, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/admin/events"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+lb.cfg.AdminToken)
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func newEventsLB(t *testing.T) (*LoadBalancer, *httptest.Server) {
+	t.Helper()
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.AdminToken = "secret"
+	lb := NewLoadBalancer(cfg)
+	srv := httptest.NewServer(lb)
+	t.Cleanup(srv.Close)
+	t.Cleanup(lb.events.close)
+	return lb, srv
+}
+
+func TestEventsRequireAdminToken(t *testing.T) {
+	_, srv := newEventsLB(t)
+	resp, err := http.Get(srv.URL + "/admin/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestEventsReplayAndLive(t *testing.T) {
+	lb, srv := newEventsLB(t)
+	backend := lb.backends[0]
+	for _, alive := range []bool{false, true, false} {
+		backend.SetAlive(alive)
+		lb.events.publish(map[bool]string{false: "backend_down", true: "backend_up"}[alive], map[string]any{"backend": backend.URL})
+	}
+
+	resp := openEvents(t, lb, srv, "?replay=2", nil)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	events := bufio.NewReader(resp.Body)
+	for _, want := range []sseEvent{{id: "2", event: "backend_up"}, {id: "3", event: "backend_down"}} {
+		if got := readSSE(t, events); got.id != want.id || got.event != want.event {
+			t.Fatalf("replayed %s %s, want %s %s", got.id, got.event, want.id, want.event)
+		}
+	}
+
+	lb.audit("admin", "drain", backend.URL)
+	got := readSSE(t, events)
+	var event Event
+	if err := json.Unmarshal([]byte(got.data), &event); err != nil {
+		t.Fatal(err)
+	}
+	if got.event != "audit" || event.ID != 4 || event.Data["action"] != "drain" {
+		t.Errorf("live event = %+v, want audit 4 for the drain", got)
+	}
+}
+
+func TestEventsResumeReportsGap(t *testing.T) {
+	lb, srv := newEventsLB(t)
+	for range eventHistorySize + 10 {
+		lb.events.publish("backend_up", map[string]any{})
+	}
+
+	resp := openEvents(t, lb, srv, "", http.Header{"Last-Event-Id": {"1"}})
+	events := bufio.NewReader(resp.Body)
+	gap := readSSE(t, events)
+	if gap.event != "gap" || gap.data != `{"from":2,"missed":9,"to":10}` {
+		t.Fatalf("first event = %+v, want a gap for events 2 to 10", gap)
+	}
+	if next := readSSE(t, events); next.id != "11" {
+		t.Errorf("resumed at %s, want 11", next.id)
+	}
+}
+
+func TestEventsStreamEndsOnShutdown(t *testing.T) {
+	lb, srv := newEventsLB(t)
+	resp := openEvents(t, lb, srv, "", nil)
+	lb.events.close()
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Errorf("stream didn't end cleanly on shutdown: %v", err)
+	}
+}
+
+func TestRetryAfterPublishesBackoffEvent(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer backend.Close()
+	cfg := testConfig(backend.URL)
+	cfg.RetryAfterMaxBackoff = time.Minute
+	lb := NewLoadBalancer(cfg)
+
+	for range 2 {
+		serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	ch, events, _ := lb.events.subscribe(0, -1)
+	lb.events.unsubscribe(ch)
+	if len(events) != 1 || events[0].Type != "backend_backoff" || events[0].Data["status"] != http.StatusTooManyRequests {
+		t.Errorf("events = %+v, want one backend_backoff for the 429", events)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// to dir, returning their paths and a pool trusting the certificate.
+func writeTestCert(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+// freeAddress returns a loopback address whose port was free a moment ago.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// startListeners runs lb.listenAndServe until the test ends, once its
+// first listener accepts connections.
+func startListeners(t *testing.T, lb *LoadBalancer) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- lb.listenAndServe(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("listenAndServe: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("listenAndServe didn't return after shutdown")
+		}
+	})
+	for range 100 {
+		if conn, err := net.Dial("tcp", lb.cfg.Listeners[0].Address); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("listener never came up")
+}
+
+func newTLSConfigLB(t *testing.T, http3Enabled bool) (*LoadBalancer, *x509.CertPool) {
+	t.Helper()
+	backend := namedBackend(t, "backend")
+	certFile, keyFile, pool := writeTestCert(t, t.TempDir())
+	cfg := testConfig(backend.URL)
+	cfg.Listeners = []ListenerConfig{{Address: freeAddress(t)}}
+	cfg.TLSCertFile, cfg.TLSKeyFile = certFile, keyFile
+	cfg.HTTP3Enabled = http3Enabled
+	if report := cfg.validate(); !report.Valid {
+		t.Fatalf("invalid config: %v", report.Errors)
+	}
+	return NewLoadBalancer(cfg), pool
+}
+
+func TestHTTP3Listener(t *testing.T) {
+	lb, pool := newTLSConfigLB(t, true)
+	startListeners(t, lb)
+	address := lb.cfg.Listeners[0].Address
+	_, port, _ := net.SplitHostPort(address)
+
+	tcpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true}}
+	resp, err := tcpClient.Get("https://" + address + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("TLS listener answered over %s, want HTTP/2", resp.Proto)
+	}
+	if got, want := resp.Header.Get("Alt-Svc"), `h3=":`+port+`"; ma=86400`; got != want {
+		t.Errorf("Alt-Svc = %q, want %q", got, want)
+	}
+
+	h3 := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	defer h3.Close()
+	resp, err = (&http.Client{Transport: h3, Timeout: 5 * time.Second}).Get("https://" + address + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Proto != "HTTP/3.0" || string(body) != "backend" {
+		t.Errorf("HTTP/3 request got %s %q, want HTTP/3.0 from the backend", resp.Proto, body)
+	}
+	if resp.Header.Get("Alt-Svc") != "" {
+		t.Errorf("HTTP/3 response advertised Alt-Svc %q", resp.Header.Get("Alt-Svc"))
+	}
+}
+
+func TestHTTP3DisabledBindsNoUDP(t *testing.T) {
+	lb, pool := newTLSConfigLB(t, false)
+	startListeners(t, lb)
+	address := lb.cfg.Listeners[0].Address
+
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatalf("UDP port in use with HTTP/3 off: %v", err)
+	}
+	pc.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + address + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Alt-Svc") != "" {
+		t.Errorf("Alt-Svc = %q with HTTP/3 off", resp.Header.Get("Alt-Svc"))
+	}
+}
+
+func TestHTTP3NeedsTLS(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.HTTP3Enabled = true
+	report := cfg.validate()
+	if report.Valid || !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, "HTTP3_ENABLED") }) {
+		t.Errorf("errors = %v, want one about HTTP3_ENABLED needing TLS", report.Errors)
+	}
+}
+
+// headerEchoBackend answers with the request headers it got as JSON, and
+// counts the requests that reached it.
+func headerEchoBackend(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+// rawRequest writes raw to a fresh connection to address and reads the
+// response, since net/http's client won't send duplicate headers.
+func rawRequest(t *testing.T, address, raw string) (*http.Response, http.Header) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var echoed http.Header
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&echoed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp, echoed
+}
+
+func TestDuplicateHeaderPolicies(t *testing.T) {
+	const request = "GET / HTTP/1.1\r\nHost: lb.test\r\n%s: one\r\n%s: two\r\nConnection: close\r\n\r\n"
+	tests := []struct {
+		header, policy string
+		want           []string // values the backend sees; nil if rejected
+	}{
+		{"X-Custom", "merge", []string{"one, two"}},
+		{"X-Custom", "first", []string{"one"}},
+		{"X-Custom", "last", []string{"two"}},
+		{"X-Custom", "reject", nil},
+		{"X-Custom", "", []string{"one", "two"}},
+		{"Authorization", "", nil},
+		{"Authorization", "merge", []string{"one, two"}},
+		{"Authorization", "first", []string{"one"}},
+		{"Authorization", "last", []string{"two"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header+"/"+tt.policy, func(t *testing.T) {
+			backend, hits := headerEchoBackend(t)
+			cfg := testConfig(backend.URL)
+			cfg.NormalizeDuplicateHeaders = true
+			if tt.policy != "" {
+				cfg.DuplicateHeaderPolicies = map[string]string{strings.ToLower(tt.header): tt.policy}
+			}
+			srv := httptest.NewServer(NewLoadBalancer(cfg))
+			defer srv.Close()
+
+			resp, echoed := rawRequest(t, srv.Listener.Addr().String(), fmt.Sprintf(request, tt.header, tt.header))
+			if tt.want == nil {
+				if resp.StatusCode != http.StatusBadRequest || hits.Load() != 0 {
+					t.Fatalf("got %d with %d backend requests, want 400 before proxying", resp.StatusCode, hits.Load())
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			if got := echoed.Values(tt.header); !slices.Equal(got, tt.want) {
+				t.Errorf("backend saw %s %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDuplicateHeadersLeftAloneWhenDisabled(t *testing.T) {
+	backend, _ := headerEchoBackend(t)
+	srv := httptest.NewServer(NewLoadBalancer(testConfig(backend.URL)))
+	defer srv.Close()
+
+	resp, echoed := rawRequest(t, srv.Listener.Addr().String(),
+		"GET / HTTP/1.1\r\nHost: lb.test\r\nAuthorization: one\r\nAuthorization: two\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := echoed.Values("Authorization"); !slices.Equal(got, []string{"one", "two"}) {
+		t.Errorf("backend saw Authorization %q, want both values", got)
+	}
+}
+
+// Host and Content-Length are rejected whatever the configuration says.
+func TestDuplicateFramingHeadersAlwaysRejected(t *testing.T) {
+	requests := map[string]string{
+		"Host":           "GET / HTTP/1.1\r\nHost: a.test\r\nHost: b.test\r\nConnection: close\r\n\r\n",
+		"Content-Length": "POST / HTTP/1.1\r\nHost: lb.test\r\nContent-Length: 2\r\nContent-Length: 3\r\nConnection: close\r\n\r\nabc",
+	}
+	for header, raw := range requests {
+		t.Run(header, func(t *testing.T) {
+			backend, hits := headerEchoBackend(t)
+			cfg := testConfig(backend.URL)
+			cfg.NormalizeDuplicateHeaders = true
+			cfg.DuplicateHeaderPolicies = map[string]string{header: "first"}
+			report := cfg.validate()
+			if !slices.ContainsFunc(report.Warnings, func(w string) bool { return strings.Contains(w, "always rejected") }) {
+				t.Errorf("warnings = %v, want one about %s being always rejected", report.Warnings, header)
+			}
+			lb := NewLoadBalancer(cfg)
+			srv := httptest.NewServer(lb)
+			defer srv.Close()
+
+			resp, _ := rawRequest(t, srv.Listener.Addr().String(), raw)
+			if resp.StatusCode != http.StatusBadRequest || hits.Load() != 0 {
+				t.Errorf("got %d with %d backend requests, want 400 before proxying", resp.StatusCode, hits.Load())
+			}
+
+			// net/http refuses these before the policy runs, so check
+			// the policy itself still rejects what it'd be handed.
+			h := http.Header{header: {"1", "2"}}
+			if got := lb.normalizeDuplicateHeaders(h); got != header {
+				t.Errorf("normalizeDuplicateHeaders = %q, want %q", got, header)
+			}
+		})
+	}
+}
+
+// recordingVaultClient serves fixed secrets and hands out the lease TTLs in
+// ttls one renewal at a time, reporting each renewal on renewals. Once ttls
+// runs out it returns 0, which stops startVaultRenewal.
+type recordingVaultClient struct {
+	StaticVaultClient
+	ttls     []time.Duration
+	renewals chan time.Time
+}
+
+func (c *recordingVaultClient) RenewToken() (time.Duration, error) {
+	c.renewals <- time.Now()
+	if len(c.ttls) == 0 {
+		return 0, nil
+	}
+	ttl := c.ttls[0]
+	c.ttls = c.ttls[1:]
+	return ttl, nil
+}
+
+func TestVaultSecretsConfigureLoadBalancer(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.AdminToken = "from-env"
+	cfg.Port = "8080"
+	cfg.VaultEnabled = true
+	cfg.VaultPath = "secret/data/lb"
+	cfg.VaultClient = StaticVaultClient{"secret/data/lb": {
+		"admin_token":       "from-vault",
+		"alert_webhook_url": "https://alerts.test/hook",
+		"consul_token":      "consul-secret",
+		"port":              "9999",
+	}}
+	if err := loadVaultSecrets(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AdminToken != "from-vault" || cfg.AlertWebhookURL != "https://alerts.test/hook" || cfg.ConsulToken != "consul-secret" {
+		t.Errorf("secrets not applied: admin %q, webhook %q, consul %q", cfg.AdminToken, cfg.AlertWebhookURL, cfg.ConsulToken)
+	}
+	if cfg.Port != "8080" {
+		t.Errorf("port = %q, want non-secret keys ignored", cfg.Port)
+	}
+
+	lb := NewLoadBalancer(cfg)
+	if rec := serve(lb, adminRequest(lb, http.MethodGet, "/admin/stats", "")); rec.Code != http.StatusOK {
+		t.Errorf("admin API with the Vault token: status %d, want 200", rec.Code)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+	r.Header.Set("Authorization", "Bearer from-env")
+	if rec := serve(lb, r); rec.Code != http.StatusUnauthorized {
+		t.Errorf("admin API with the replaced token: status %d, want 401", rec.Code)
+	}
+}
+
+func TestVaultSecretsErrors(t *testing.T) {
+	cfg := testConfig()
+	cfg.VaultClient = StaticVaultClient{}
+	if err := loadVaultSecrets(cfg); err == nil || !strings.Contains(err.Error(), "VAULT_PATH") {
+		t.Errorf("no path: err = %v, want one naming VAULT_PATH", err)
+	}
+	cfg.VaultPath = "secret/data/missing"
+	if err := loadVaultSecrets(cfg); err == nil || !strings.Contains(err.Error(), "secret/data/missing") {
+		t.Errorf("missing secret: err = %v, want one naming the path", err)
+	}
+
+	cfg = testConfig()
+	cfg.VaultPath = "secret/data/lb"
+	if err := loadVaultSecrets(cfg); err == nil || !strings.Contains(err.Error(), "VAULT_ADDR") {
+		t.Errorf("no client or address: err = %v, want one naming VAULT_ADDR", err)
+	}
+}
+
+func TestVaultRenewalFollowsLease(t *testing.T) {
+	client := &recordingVaultClient{
+		ttls:     []time.Duration{40 * time.Millisecond, 80 * time.Millisecond},
+		renewals: make(chan time.Time, 10),
+	}
+	startVaultRenewal(context.Background(), client)
+
+	var renewals []time.Time
+	for range 3 {
+		select {
+		case at := <-client.renewals:
+			renewals = append(renewals, at)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("saw %d renewals, want 3", len(renewals))
+		}
+	}
+	// Each renewal comes at half of the previous lease.
+	if gap := renewals[1].Sub(renewals[0]); gap < 20*time.Millisecond {
+		t.Errorf("second renewal after %v, want at least 20ms", gap)
+	}
+	if gap := renewals[2].Sub(renewals[1]); gap < 40*time.Millisecond {
+		t.Errorf("third renewal after %v, want at least 40ms", gap)
+	}
+	// The last lease didn't expire, so renewal stops.
+	select {
+	case <-client.renewals:
+		t.Error("token renewed after a lease that doesn't expire")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestVaultRenewalStopsOnShutdown(t *testing.T) {
+	client := &recordingVaultClient{
+		ttls:     slices.Repeat([]time.Duration{20 * time.Millisecond}, 100),
+		renewals: make(chan time.Time, 100),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	startVaultRenewal(ctx, client)
+	for range 2 {
+		<-client.renewals
+	}
+	cancel()
+
+	// A renewal already under way may still land.
+	time.Sleep(20 * time.Millisecond)
+	for len(client.renewals) > 0 {
+		<-client.renewals
+	}
+	select {
+	case <-client.renewals:
+		t.Error("token renewed after shutdown")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func signedJWT(claims, secret string) string {
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestVaultLoadsTLSAndJWTSecrets(t *testing.T) {
+	certFile, keyFile, _ := writeTestCert(t, t.TempDir())
+	certPEM, _ := os.ReadFile(certFile)
+	keyPEM, _ := os.ReadFile(keyFile)
+	secret, _ := json.Marshal(map[string]any{"data": map[string]any{
+		"data": map[string]string{
+			"tls_cert":   string(certPEM),
+			"tls_key":    string(keyPEM),
+			"jwt_secret": "signing-key",
+		},
+		"metadata": map[string]any{"version": 1},
+	}})
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/lb" || r.Header.Get("X-Vault-Token") != "static" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		w.Write(secret)
+	}))
+	t.Cleanup(vault.Close)
+
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.VaultAddr, cfg.VaultPath, cfg.VaultToken = vault.URL, "secret/data/lb", "static"
+	if err := loadVaultSecrets(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TLSCert != string(certPEM) || cfg.TLSKey != string(keyPEM) || cfg.JWTSecret != "signing-key" {
+		t.Fatalf("secrets not applied: cert %d bytes, key %d bytes, JWT secret %q", len(cfg.TLSCert), len(cfg.TLSKey), cfg.JWTSecret)
+	}
+	if report := cfg.validate(); !report.Valid {
+		t.Fatalf("config with Vault TLS secrets is invalid: %v", report.Errors)
+	}
+	tlsConfig, err := cfg.serverTLSConfig()
+	if err != nil || tlsConfig == nil || len(tlsConfig.Certificates) != 1 {
+		t.Fatalf("serverTLSConfig = %v, %v, want the certificate from Vault", tlsConfig, err)
+	}
+
+	// Feature flags now only trust tokens signed with the Vault key.
+	lb := newFeatureFlagLB(t)
+	lb.cfg.JWTSecret = cfg.JWTSecret
+	for _, tc := range []struct {
+		name, token, want string
+	}{
+		{"signed", signedJWT(`{"sub":"2"}`, "signing-key"), "beta"},
+		{"wrong key", signedJWT(`{"sub":"2"}`, "other-key"), "stable"},
+		{"unsigned", unsignedJWT(`{"sub":"2"}`), "stable"},
+	} {
+		req := httptest.NewRequest("GET", "/app/home", nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		if got := serve(lb, req).Body.String(); got != tc.want {
+			t.Errorf("%s token reached %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// fakeVault is a Vault server with one KV v2 secret, AppRole login, and a
+// token renewal endpoint that fails once tokens are revoked.
+func fakeVault(t *testing.T) (*httptest.Server, *atomic.Int64, *atomic.Bool) {
+	t.Helper()
+	var logins atomic.Int64
+	var revoked atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Vault-Token")
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["role_id"] != "role" || body["secret_id"] != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"errors":["invalid role or secret ID"]}`)
+				return
+			}
+			n := logins.Add(1)
+			revoked.Store(false)
+			fmt.Fprintf(w, `{"auth":{"client_token":"token-%d","lease_duration":60}}`, n)
+		case "/v1/auth/token/renew-self":
+			if revoked.Load() || token == "" {
+				w.WriteHeader(http.StatusForbidden)
+				io.WriteString(w, `{"errors":["permission denied"]}`)
+				return
+			}
+			io.WriteString(w, `{"auth":{"client_token":"`+token+`","lease_duration":120}}`)
+		case "/v1/secret/data/lb":
+			if token == "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			io.WriteString(w, `{"data":{"data":{"admin_token":"from-vault"},"metadata":{"version":3}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &logins, &revoked
+}
+
+func TestVaultHTTPClientAppRole(t *testing.T) {
+	vault, logins, revoked := fakeVault(t)
+	cfg := testConfig()
+	cfg.VaultAddr = vault.URL + "/"
+	cfg.VaultPath = "secret/data/lb"
+	cfg.VaultRoleID, cfg.VaultSecretID = "role", "secret"
+	if err := loadVaultSecrets(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AdminToken != "from-vault" {
+		t.Errorf("admin token = %q, want the KV v2 value", cfg.AdminToken)
+	}
+	if logins.Load() != 1 {
+		t.Errorf("logins = %d, want 1", logins.Load())
+	}
+
+	ttl, err := cfg.VaultClient.RenewToken()
+	if err != nil || ttl != 120*time.Second {
+		t.Errorf("renewal = %v, %v, want the renewed 2m lease", ttl, err)
+	}
+	revoked.Store(true)
+	ttl, err = cfg.VaultClient.RenewToken()
+	if err != nil || ttl != 60*time.Second || logins.Load() != 2 {
+		t.Errorf("renewal of a revoked token = %v, %v after %d logins, want a fresh login", ttl, err, logins.Load())
+	}
+}
+
+func TestVaultHTTPClientStaticToken(t *testing.T) {
+	vault, _, revoked := fakeVault(t)
+	cfg := testConfig()
+	cfg.VaultAddr = vault.URL
+	cfg.VaultToken = "static"
+	client, err := newVaultHTTPClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked.Store(true)
+	if _, err := client.RenewToken(); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("renewal of a revoked static token: err = %v, want Vault's error", err)
+	}
+
+	cfg.VaultToken = ""
+	if _, err := newVaultHTTPClient(cfg); err == nil {
+		t.Error("client with neither a token nor a role ID was created")
+	}
+	cfg.VaultRoleID = "wrong"
+	if _, err := newVaultHTTPClient(cfg); err == nil || !strings.Contains(err.Error(), "invalid role") {
+		t.Errorf("bad AppRole login: err = %v, want Vault's error", err)
+	}
+}
+
+// flakyBackend drops every connection without answering, counting the
+// requests it got.
+func flakyBackend(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+// counterValue returns the value of the cv series with labelValues.
+func counterValue(cv *counterVec, labelValues ...string) float64 {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	if c, ok := cv.series[strings.Join(labelValues, "\xff")]; ok {
+		return c.value
+	}
+	return 0
+}
+
+// eventTypes lists the types of the events lb has published so far.
+func eventTypes(lb *LoadBalancer) []string {
+	ch, events, _ := lb.events.subscribe(0, -1)
+	lb.events.unsubscribe(ch)
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+// A cascade failure: every attempt fails, so retries stop once the window
+// has used its minimum retries and is over the percentage.
+func TestRetryBudgetSuppressesRetries(t *testing.T) {
+	a, aHits := flakyBackend(t)
+	b, bHits := flakyBackend(t)
+	cfg := testConfig(a.URL, b.URL)
+	cfg.MaxRetries = 1
+	cfg.RetryBudgetPercent = 20
+	lb := NewLoadBalancer(cfg)
+	attempts := func() int64 { return aHits.Load() + bHits.Load() }
+	exhausted := func() float64 {
+		return counterValue(lb.metrics.retryBudgetExhausted, a.URL) + counterValue(lb.metrics.retryBudgetExhausted, b.URL)
+	}
+
+	for i := range retryBudgetMinRetries {
+		if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusBadGateway {
+			t.Fatalf("request %d: status %d, want 502", i, rec.Code)
+		}
+	}
+	if got := attempts(); got != 2*retryBudgetMinRetries {
+		t.Fatalf("%d attempts for %d requests, want each retried while under the minimum", got, retryBudgetMinRetries)
+	}
+	if exhausted() != 0 || slices.Contains(eventTypes(lb), "retry_budget_exhausted") {
+		t.Fatal("budget exhausted within the minimum retries")
+	}
+
+	for i := range 2 {
+		before := attempts()
+		if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusBadGateway {
+			t.Fatalf("status %d, want the failed attempt's 502", rec.Code)
+		}
+		if got := attempts() - before; got != 1 {
+			t.Errorf("over budget: %d attempts, want 1", got)
+		}
+		if got := exhausted(); got != float64(i+1) {
+			t.Errorf("lb_retry_budget_exhausted_total = %v, want %d", got, i+1)
+		}
+	}
+	exhaustedEvents := slices.DeleteFunc(eventTypes(lb), func(t string) bool { return t != "retry_budget_exhausted" })
+	if len(exhaustedEvents) != 1 {
+		t.Errorf("%d retry_budget_exhausted events, want one per window", len(exhaustedEvents))
+	}
+
+	lb.retries.reset()
+	before := attempts()
+	serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := attempts() - before; got != 2 {
+		t.Errorf("after the window reset: %d attempts, want the retry back", got)
+	}
+	if !slices.Contains(eventTypes(lb), "retry_budget_restored") {
+		t.Error("no retry_budget_restored event after the reset")
+	}
+}
+
+func TestRetryBudgetPercentOfWindow(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.RetryBudgetPercent = 20
+	budget := NewLoadBalancer(cfg).retries
+
+	budget.requests.Store(100)
+	budget.retries.Store(19)
+	if !budget.permits() {
+		t.Fatal("19 retries for 100 requests refused at a 20% budget")
+	}
+	budget.retries.Store(20)
+	if budget.permits() {
+		t.Fatal("20 retries for 100 requests permitted at a 20% budget")
+	}
+	// Once out of budget, the window stays out even as requests grow.
+	budget.requests.Store(1000)
+	if budget.permits() {
+		t.Error("retries back on before the window ended")
+	}
+	budget.reset()
+	if budget.requests.Load() != 0 || budget.retries.Load() != 0 || !budget.permits() {
+		t.Error("reset didn't start a fresh window")
+	}
+}
+
+func TestRetryBudgetDisabled(t *testing.T) {
+	a, aHits := flakyBackend(t)
+	b, bHits := flakyBackend(t)
+	cfg := testConfig(a.URL, b.URL)
+	cfg.MaxRetries = 1
+	cfg.RetryBudgetPercent = 0
+	lb := NewLoadBalancer(cfg)
+	if lb.retries != nil {
+		t.Fatal("retry budget set up with RETRY_BUDGET_PERCENT=0")
+	}
+	const requests = 3 * retryBudgetMinRetries
+	for range requests {
+		serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	if got := aHits.Load() + bHits.Load(); got != 2*requests {
+		t.Errorf("%d attempts for %d requests, want every request retried", got, requests)
+	}
+}
+
+// The hash ring sends a path to the same backend every time, so only
+// avoiding the backend that failed keeps its retry from failing too.
+func TestRetryAvoidsFailedBackend(t *testing.T) {
+	flaky, flakyHits := flakyBackend(t)
+	cfg := testConfig(flaky.URL, namedBackend(t, "a").URL, namedBackend(t, "b").URL)
+	cfg.Strategy = "consistent_hash_path"
+	cfg.MaxRetries = 1
+	cfg.RetryBudgetPercent = 0
+	lb := NewLoadBalancer(cfg)
+
+	for i := range 20 {
+		before := flakyHits.Load()
+		rec := serve(lb, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/p%d", i), nil))
+		if rec.Code != http.StatusOK || rec.Body.String() == "" {
+			t.Errorf("/p%d: status %d, want a healthy backend's answer", i, rec.Code)
+		}
+		if hits := flakyHits.Load() - before; hits > 1 {
+			t.Errorf("/p%d: failing backend tried %d times", i, hits)
+		}
+	}
+	if flakyHits.Load() == 0 {
+		t.Fatal("no path hashed to the failing backend")
+	}
+}
+
+// Once every backend has failed the request, retries go back to ones
+// already tried rather than giving up early.
+func TestRetryFallsBackToTriedBackends(t *testing.T) {
+	a, aHits := flakyBackend(t)
+	b, bHits := flakyBackend(t)
+	cfg := testConfig(a.URL, b.URL)
+	cfg.MaxRetries = 3
+	cfg.RetryBudgetPercent = 0
+	lb := NewLoadBalancer(cfg)
+
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", rec.Code)
+	}
+	if aHits.Load() != 2 || bHits.Load() != 2 {
+		t.Errorf("attempts per backend = %d and %d, want 2 each", aHits.Load(), bHits.Load())
+	}
+}
+
+func TestNextBackendSkipsTried(t *testing.T) {
+	lb := NewLoadBalancer(testConfig("http://127.0.0.1:9001", "http://127.0.0.1:9002", "http://127.0.0.1:9003"))
+	state := &requestState{tried: []*Backend{lb.backends[0]}}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), requestStateKey, state))
+
+	for range 6 {
+		if backend := lb.getNextBackend(r); backend == lb.backends[0] {
+			t.Fatal("picked a backend that already failed the request")
+		}
+	}
+	state.tried = lb.backends
+	if backend := lb.getNextBackend(r); backend == nil {
+		t.Error("no backend picked once all of them were tried")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"120", 120 * time.Second, true},
+		{" 5 ", 5 * time.Second, true},
+		{"0", 0, true},
+		{"-1", 0, false},
+		{"", 0, false},
+		{"soon", 0, false},
+		{"99999999999999999", time.Duration(math.MaxInt64 / int64(time.Second) * int64(time.Second)), true},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), -time.Minute, true},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRetryAfter(%q) = %v, %t, want %v, %t", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// retryAfterBackend answers with status and Retry-After value until the
+// test ends, counting its requests.
+func retryAfterBackend(t *testing.T, status int, value func() string) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Retry-After", value())
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+// backendStats returns the stats entry of the backend with url.
+func backendStats(t *testing.T, lb *LoadBalancer, url string) BackendStats {
+	t.Helper()
+	for _, bs := range lb.collectStats().Backends {
+		if bs.URL == url {
+			return bs
+		}
+	}
+	t.Fatalf("no stats for %s", url)
+	return BackendStats{}
+}
+
+func TestRetryAfterBacksOffBackend(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		value  func() string
+	}{
+		{"429 delay seconds", http.StatusTooManyRequests, func() string { return "20" }},
+		{"503 delay seconds", http.StatusServiceUnavailable, func() string { return "20" }},
+		{"429 HTTP date", http.StatusTooManyRequests, func() string { return time.Now().Add(20 * time.Second).Format(http.TimeFormat) }},
+		{"503 HTTP date", http.StatusServiceUnavailable, func() string { return time.Now().Add(20 * time.Second).Format(http.TimeFormat) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limited, limitedHits := retryAfterBackend(t, tt.status, tt.value)
+			cfg := testConfig(limited.URL, namedBackend(t, "good").URL)
+			cfg.RetryAfterMaxBackoff = time.Minute
+			lb := NewLoadBalancer(cfg)
+
+			rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.status || rec.Header().Get("Retry-After") == "" {
+				t.Fatalf("first request: status %d, Retry-After %q, want the backend's answer passed on", rec.Code, rec.Header().Get("Retry-After"))
+			}
+			bs := backendStats(t, lb, limited.URL)
+			if !bs.Alive || !bs.BackingOff || bs.BackingOffUntil == nil {
+				t.Fatalf("stats = %+v, want alive and backing off", bs)
+			}
+			// HTTP dates have whole-second precision.
+			if left := time.Until(*bs.BackingOffUntil); left < 18*time.Second || left > 20*time.Second {
+				t.Errorf("backing off for another %v, want about 20s", left)
+			}
+
+			for range 4 {
+				if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Body.String() != "good" {
+					t.Errorf("status %d %q during the backoff, want the other backend", rec.Code, rec.Body.String())
+				}
+			}
+			if limitedHits.Load() != 1 {
+				t.Errorf("backing-off backend got %d requests, want 1", limitedHits.Load())
+			}
+		})
+	}
+}
+
+// A backend claiming a day's Retry-After is only passed over for
+// RetryAfterMaxBackoff, and takes requests again once that runs out.
+func TestRetryAfterCappedAndExpires(t *testing.T) {
+	limited, limitedHits := retryAfterBackend(t, http.StatusServiceUnavailable, func() string { return "86400" })
+	cfg := testConfig(limited.URL, namedBackend(t, "good").URL)
+	cfg.RetryAfterMaxBackoff = 100 * time.Millisecond
+	lb := NewLoadBalancer(cfg)
+
+	serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	bs := backendStats(t, lb, limited.URL)
+	if !bs.BackingOff || time.Until(*bs.BackingOffUntil) > 100*time.Millisecond {
+		t.Fatalf("stats = %+v, want a backoff capped at 100ms", bs)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if bs := backendStats(t, lb, limited.URL); bs.BackingOff || bs.BackingOffUntil != nil {
+		t.Errorf("stats = %+v after the cap, want the backoff over", bs)
+	}
+	for range 2 {
+		serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	if limitedHits.Load() != 2 {
+		t.Errorf("backend got %d requests, want it back in rotation after the backoff", limitedHits.Load())
+	}
+}
+
+func TestRetryAfterBackendStillServesAlone(t *testing.T) {
+	limited, limitedHits := retryAfterBackend(t, http.StatusTooManyRequests, func() string { return "30" })
+	cfg := testConfig(limited.URL)
+	cfg.RetryAfterMaxBackoff = time.Minute
+	lb := NewLoadBalancer(cfg)
+
+	for range 3 {
+		if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusTooManyRequests {
+			t.Errorf("status = %d, want the backend's 429 rather than an outage", rec.Code)
+		}
+	}
+	if limitedHits.Load() != 3 {
+		t.Errorf("backend got %d requests, want all 3", limitedHits.Load())
+	}
+}
+
+func TestRetryAfterIgnored(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		maxBackoff time.Duration
+	}{
+		{"disabled", http.StatusTooManyRequests, 0},
+		{"500", http.StatusInternalServerError, time.Minute},
+		{"200", http.StatusOK, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, _ := retryAfterBackend(t, tt.status, func() string { return "30" })
+			cfg := testConfig(backend.URL, namedBackend(t, "good").URL)
+			cfg.RetryAfterMaxBackoff = tt.maxBackoff
+			lb := NewLoadBalancer(cfg)
+
+			serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+			if bs := backendStats(t, lb, backend.URL); bs.BackingOff {
+				t.Errorf("backing off after a %d with RETRY_AFTER_MAX_BACKOFF=%v", tt.status, tt.maxBackoff)
+			}
+		})
+	}
+}
+
+// fakeResolver answers every lookup with addrs, or err if set.
+type fakeResolver struct {
+	mu      sync.Mutex
+	addrs   []string
+	err     error
+	lookups int
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return r.addrs, r.err
+}
+
+func (r *fakeResolver) set(err error, addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs, r.err = addrs, err
+}
+
+// connCountingBackend is a backend on 127.0.0.1, addressed as localhost,
+// that counts the connections opened to it and closed.
+func connCountingBackend(t *testing.T) (string, *atomic.Int64, *atomic.Int64) {
+	t.Helper()
+	var opened, closed atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			opened.Add(1)
+		case http.StateClosed:
+			closed.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	return "http://localhost:" + port, &opened, &closed
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(cond func() bool) bool {
+	for range 100 {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestDNSChangeRecyclesConnections(t *testing.T) {
+	backendURL, opened, closed := connCountingBackend(t)
+	resolver := &fakeResolver{addrs: []string{"127.0.0.1"}}
+	cfg := testConfig(backendURL)
+	cfg.TransportMode = "isolated"
+	lb := NewLoadBalancerWithOptions(cfg, LoadBalancerOptions{Resolver: resolver})
+	get := func() {
+		t.Helper()
+		if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+	}
+
+	lb.refreshBackendDNS()
+	get()
+	get()
+	if opened.Load() != 1 {
+		t.Fatalf("%d connections for two requests, want the first reused", opened.Load())
+	}
+
+	// The name moves away from the address the pooled connection goes to.
+	resolver.set(nil, "127.0.0.2")
+	lb.refreshBackendDNS()
+	if got := counterValue(lb.metrics.dnsChanges, backendURL); got != 1 {
+		t.Errorf("lb_backend_dns_changes_total = %v, want 1", got)
+	}
+	if !waitFor(func() bool { return closed.Load() == 1 }) {
+		t.Fatal("idle connection to the old address wasn't closed")
+	}
+	// New connections still land on 127.0.0.1, which the name no longer
+	// resolves to, so each is retired after its request.
+	get()
+	get()
+	if opened.Load() != 3 || !waitFor(func() bool { return closed.Load() == 3 }) {
+		t.Errorf("%d connections opened and %d closed, want each stale one retired", opened.Load(), closed.Load())
+	}
+
+	resolver.set(nil, "127.0.0.1")
+	lb.refreshBackendDNS()
+	get()
+	get()
+	if opened.Load() != 4 {
+		t.Errorf("%d connections opened, want the new address's connection reused", opened.Load())
+	}
+	if got := counterValue(lb.metrics.dnsChanges, backendURL); got != 2 {
+		t.Errorf("lb_backend_dns_changes_total = %v, want 2", got)
+	}
+}
+
+func TestDNSChangeRetiresBusyConnectionAfterRequest(t *testing.T) {
+	var opened, closed atomic.Int64
+	started, gate := make(chan struct{}, 1), make(chan struct{})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-gate
+		}
+		io.WriteString(w, "done")
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			opened.Add(1)
+		case http.StateClosed:
+			closed.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	backendURL := "http://localhost:" + port
+
+	resolver := &fakeResolver{addrs: []string{"127.0.0.1"}}
+	lb := NewLoadBalancerWithOptions(testConfig(backendURL), LoadBalancerOptions{Resolver: resolver})
+	lb.refreshBackendDNS()
+
+	// The name moves while a request is using the only connection. On the
+	// shared transport nothing closes it early.
+	result := make(chan *httptest.ResponseRecorder)
+	go func() { result <- serve(lb, httptest.NewRequest(http.MethodGet, "/slow", nil)) }()
+	<-started
+	resolver.set(nil, "127.0.0.2")
+	lb.refreshBackendDNS()
+	close(gate)
+	if rec := <-result; rec.Code != http.StatusOK || rec.Body.String() != "done" {
+		t.Fatalf("request in flight during the DNS change got %d %q, want it to finish", rec.Code, rec.Body)
+	}
+	if !waitFor(func() bool { return closed.Load() == 1 }) {
+		t.Fatal("connection to the old address wasn't retired after its request")
+	}
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusOK || opened.Load() != 2 {
+		t.Errorf("next request got %d over %d connections, want a fresh connection", rec.Code, opened.Load())
+	}
+}
+
+func TestDNSLookupFailureKeepsAddresses(t *testing.T) {
+	backendURL, opened, _ := connCountingBackend(t)
+	resolver := &fakeResolver{addrs: []string{"127.0.0.1"}}
+	cfg := testConfig(backendURL)
+	cfg.TransportMode = "isolated"
+	lb := NewLoadBalancerWithOptions(cfg, LoadBalancerOptions{Resolver: resolver})
+
+	lb.refreshBackendDNS()
+	resolver.set(errors.New("no such host"))
+	lb.refreshBackendDNS()
+	resolver.set(nil)
+	lb.refreshBackendDNS()
+	for range 2 {
+		serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	if opened.Load() != 1 || counterValue(lb.metrics.dnsChanges, backendURL) != 0 {
+		t.Errorf("%d connections and %v DNS changes after failed lookups, want the old addresses kept",
+			opened.Load(), counterValue(lb.metrics.dnsChanges, backendURL))
+	}
+}
+
+func TestDNSRefreshSkipsIPBackends(t *testing.T) {
+	resolver := &fakeResolver{addrs: []string{"127.0.0.2"}}
+	lb := NewLoadBalancerWithOptions(testConfig(namedBackend(t, "ip").URL), LoadBalancerOptions{Resolver: resolver})
+	lb.refreshBackendDNS()
+	if resolver.lookups != 0 {
+		t.Errorf("%d lookups for a backend addressed by IP, want none", resolver.lookups)
+	}
+}
+
+// probeCountingBackend counts the health probes to /healthz it gets.
+func probeCountingBackend(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var probes atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			probes.Add(1)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &probes
+}
+
+// startTestHealthChecks starts lb's health checks and stops them when the
+// test ends.
+func startTestHealthChecks(t *testing.T, lb *LoadBalancer) {
+	t.Helper()
+	lb.startHealthChecks()
+	t.Cleanup(func() {
+		for _, backend := range lb.getBackends() {
+			backend.removed.Store(true)
+		}
+	})
+}
+
+func TestPerBackendHealthCheckInterval(t *testing.T) {
+	fast, fastProbes := probeCountingBackend(t)
+	slow, slowProbes := probeCountingBackend(t)
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{
+		{URL: fast.URL, HealthCheckInterval: 50 * time.Millisecond},
+		{URL: slow.URL},
+	}
+	cfg.HealthCheckInterval = 250 * time.Millisecond
+	cfg.HealthCheckPath = "/healthz"
+	cfg.HealthCheckJitter = 0
+	lb := NewLoadBalancer(cfg)
+
+	startTestHealthChecks(t, lb)
+	time.Sleep(time.Second)
+	if got := fastProbes.Load(); got < 15 || got > 20 {
+		t.Errorf("backend with a 50ms interval probed %d times in 1s, want about 20", got)
+	}
+	if got := slowProbes.Load(); got < 3 || got > 4 {
+		t.Errorf("backend on the 250ms default probed %d times in 1s, want about 4", got)
+	}
+}
+
+func TestHealthCheckIntervalFallsBackToGlobal(t *testing.T) {
+	cfg := testConfig()
+	cfg.HealthCheckInterval = 10 * time.Second
+	cfg.Backends = []BackendConfig{
+		{URL: "http://127.0.0.1:9001"},
+		{URL: "http://127.0.0.1:9002", HealthCheckInterval: 2 * time.Second},
+	}
+	lb := NewLoadBalancer(cfg)
+	if got := lb.healthCheckInterval(lb.backends[0]); got != 10*time.Second {
+		t.Errorf("interval without an override = %v, want HEALTH_CHECK_INTERVAL", got)
+	}
+	if got := lb.healthCheckInterval(lb.backends[1]); got != 2*time.Second {
+		t.Errorf("interval with an override = %v, want 2s", got)
+	}
+}
+
+// writeScript writes an executable shell script with body to dir.
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExternalHealthCheck(t *testing.T) {
+	dir := t.TempDir()
+	seen := filepath.Join(dir, "seen")
+	healthy := writeScript(t, dir, "healthy.sh", `echo "$@" > `+seen)
+	failing := writeScript(t, dir, "failing.sh", "echo dependency down; exit 3")
+	slow := writeScript(t, dir, "slow.sh", "exec sleep 5")
+
+	cfg := testConfig()
+	cfg.HealthCheckType = "external"
+	cfg.HealthCheckCommandTimeout = 100 * time.Millisecond
+	cfg.Backends = []BackendConfig{
+		{URL: "http://127.0.0.1:9001", HealthCheckCommand: healthy + " --verbose"},
+		{URL: "http://127.0.0.1:9002", HealthCheckCommand: failing},
+		{URL: "http://127.0.0.1:9003", HealthCheckCommand: slow},
+	}
+	lb := NewLoadBalancer(cfg)
+
+	if !lb.checkBackend(lb.backends[0]) || !lb.backends[0].IsAlive() {
+		t.Error("backend whose command exits 0 is not up")
+	}
+	if data, _ := os.ReadFile(seen); strings.TrimSpace(string(data)) != "--verbose http://127.0.0.1:9001" {
+		t.Errorf("command got arguments %q, want its own followed by the backend URL", data)
+	}
+
+	if lb.checkBackend(lb.backends[1]) || lb.backends[1].IsAlive() {
+		t.Error("backend whose command exits 3 is up")
+	}
+	var exitErr *exec.ExitError
+	if err := cfg.probeBackend(lb.backends[1]); !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("probe error = %v, want exit status 3", err)
+	}
+
+	start := time.Now()
+	err := cfg.probeBackend(lb.backends[2])
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("probe error = %v, want a timeout", err)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("probe of a hung command took %v, want it killed at the timeout", took)
+	}
+}
+
+func TestExternalHealthCheckNeedsCommand(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.HealthCheckType = "external"
+	report := cfg.validate()
+	if report.Valid || !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, "HEALTH_CHECK_COMMAND") }) {
+		t.Errorf("errors = %v, want one about the missing HEALTH_CHECK_COMMAND", report.Errors)
+	}
+}
+
+// picks counts the backends getNextBackend picks for n requests, by URL.
+func picks(lb *LoadBalancer, n int) map[string]int {
+	counts := make(map[string]int)
+	for range n {
+		if backend := lb.getNextBackend(httptest.NewRequest(http.MethodGet, "/", nil)); backend != nil {
+			counts[backend.URL]++
+		}
+	}
+	return counts
+}
+
+func TestSlowStartRampsNewBackend(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.Strategy = "weighted_round_robin"
+	lb := NewLoadBalancer(cfg)
+	picks(lb, 10)
+
+	added, err := lb.AddBackend(BackendConfig{URL: "http://127.0.0.1:9002", SlowStartDuration: 400 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := picks(lb, 100)[added.URL]; got > 10 {
+		t.Errorf("new backend got %d of 100 requests right after being added, want almost none", got)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if f := added.rampFactor(); f < 0.4 || f > 0.8 {
+		t.Errorf("ramp factor halfway through slow start = %v, want about 0.5", f)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if f := added.rampFactor(); f != 1 {
+		t.Errorf("ramp factor after slow start = %v, want 1", f)
+	}
+	if got := picks(lb, 100)[added.URL]; got != 50 {
+		t.Errorf("new backend got %d of 100 requests after slow start, want its full half", got)
+	}
+}
+
+func TestSlowStartDisabled(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.Strategy = "weighted_round_robin"
+	lb := NewLoadBalancer(cfg)
+
+	added, err := lb.AddBackend(BackendConfig{URL: "http://127.0.0.1:9002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := picks(lb, 100)[added.URL]; got != 50 {
+		t.Errorf("backend without slow start got %d of 100 requests, want its full half at once", got)
+	}
+}
+
+func TestDebugHeader(t *testing.T) {
+	a, b := namedBackend(t, "a"), namedBackend(t, "b")
+	cfg := testConfig(a.URL, b.URL)
+	lb := NewLoadBalancer(cfg)
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Header().Get("X-LB-Debug") != "" {
+		t.Errorf("X-LB-Debug = %q with LB_DEBUG_HEADER off", rec.Header().Get("X-LB-Debug"))
+	}
+
+	cfg.DebugHeader = true
+	lb = NewLoadBalancer(cfg)
+	for _, backend := range []string{a.URL, b.URL} {
+		rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+		want := "strategy=round_robin; candidates=2; backend=" + backend + "; attempt=1; retry=false"
+		if got := rec.Header().Get("X-LB-Debug"); got != want {
+			t.Errorf("X-LB-Debug = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestDebugHeaderReportsFailover(t *testing.T) {
+	flaky, _ := flakyBackend(t)
+	good := namedBackend(t, "good")
+	cfg := testConfig(flaky.URL, good.URL)
+	cfg.MaxRetries = 1
+	cfg.RetryBudgetPercent = 0
+	cfg.DebugHeader = true
+	lb := NewLoadBalancer(cfg)
+
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	want := "strategy=round_robin; candidates=1; backend=" + good.URL + "; attempt=2; retry=true"
+	if got := rec.Header().Get("X-LB-Debug"); got != want {
+		t.Errorf("X-LB-Debug = %q, want %q", got, want)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestBackendRoundTripperFactory(t *testing.T) {
+	echoToken := func() *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Header.Get("X-Backend-Token"))
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	a, b := echoToken(), echoToken()
+	tokens := map[string]string{a.URL: "token-a", b.URL: "token-b"}
+
+	var built []string
+	factory := func(cfg BackendConfig) http.RoundTripper {
+		built = append(built, cfg.URL)
+		token := tokens[cfg.URL]
+		return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			r.Header.Set("X-Backend-Token", token)
+			return http.DefaultTransport.RoundTrip(r)
+		})
+	}
+	lb := NewLoadBalancerWithOptions(testConfig(a.URL, b.URL), LoadBalancerOptions{BackendRoundTripperFactory: factory})
+	if !slices.Equal(built, []string{a.URL, b.URL}) {
+		t.Errorf("factory called for %v, want once per backend", built)
+	}
+	for _, want := range []string{"token-a", "token-b"} {
+		if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Body.String() != want {
+			t.Errorf("backend saw X-Backend-Token %q, want %q", rec.Body.String(), want)
+		}
+	}
+}
+
+func TestConfiguredTransportFactory(t *testing.T) {
+	if got := ConfiguredTransportFactory(BackendConfig{URL: "http://a"}); got != http.DefaultTransport {
+		t.Errorf("untuned backend got %T, want http.DefaultTransport", got)
+	}
+	h2, ok := ConfiguredTransportFactory(BackendConfig{URL: "http://a", Transport: "http2"}).(*http.Transport)
+	if !ok || h2.Protocols == nil || !h2.Protocols.UnencryptedHTTP2() {
+		t.Error("http2 transport to an http:// backend doesn't speak h2c")
+	}
+	if _, ok := ConfiguredTransportFactory(BackendConfig{URL: "http://a", Transport: "http1.0"}).(*http10Transport); !ok {
+		t.Error("http1.0 transport isn't the HTTP/1.0 one")
+	}
+	mtls := ConfiguredTransportFactory(BackendConfig{URL: "https://a", Transport: "mtls", TLSClientCert: "/missing.crt", TLSClientKey: "/missing.key"})
+	if _, err := mtls.RoundTrip(httptest.NewRequest(http.MethodGet, "https://a/", nil)); err == nil {
+		t.Error("mTLS transport with missing files sent the request")
+	}
+}
+
+// sleepyBackend answers with name after sleeping for delay, counting its
+// requests.
+func sleepyBackend(t *testing.T, name string, delay time.Duration) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(delay)
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestLatencyEjection(t *testing.T) {
+	slow, slowHits := sleepyBackend(t, "slow", 30*time.Millisecond)
+	cfg := testConfig(slow.URL, namedBackend(t, "fast").URL)
+	cfg.LatencySLO = 10 * time.Millisecond
+	cfg.LatencyEjectionMinRequests = 4
+	cfg.LatencyEjectionCooldown = 200 * time.Millisecond
+	lb := NewLoadBalancer(cfg)
+
+	for range 8 {
+		serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	bs := backendStats(t, lb, slow.URL)
+	if !bs.Ejected || !strings.HasPrefix(bs.EjectionReason, "latency: 100% of 4 requests exceeded SLO 10ms") || bs.EjectedUntil == nil {
+		t.Fatalf("stats = %+v, want the slow backend ejected for latency", bs)
+	}
+	for range 4 {
+		if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Body.String() != "fast" {
+			t.Errorf("got %q while the slow backend is ejected, want fast", rec.Body.String())
+		}
+	}
+	if slowHits.Load() != 4 {
+		t.Errorf("slow backend got %d requests, want none after its ejection", slowHits.Load())
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if bs := backendStats(t, lb, slow.URL); bs.Ejected {
+		t.Errorf("stats = %+v after the cooldown, want reinstated", bs)
+	}
+	for range 2 {
+		serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	if slowHits.Load() != 5 {
+		t.Errorf("slow backend got %d requests, want it back in rotation", slowHits.Load())
+	}
+	if types := eventTypes(lb); !slices.Contains(types, "backend_ejected") || !slices.Contains(types, "backend_reinstated") {
+		t.Errorf("events = %v, want backend_ejected and backend_reinstated", types)
+	}
+}
+
+func TestLatencyEjectionThreshold(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.LatencySLO = 10 * time.Millisecond
+	cfg.LatencyEjectionMinRequests = 4
+	lb := NewLoadBalancer(cfg)
+	backend := lb.backends[0]
+
+	// Half the requests over the SLO is at the threshold, not over it.
+	for _, d := range []time.Duration{time.Millisecond, 20 * time.Millisecond, time.Millisecond, 20 * time.Millisecond} {
+		lb.recordLatency(backend, d)
+	}
+	if backend.isEjected() {
+		t.Error("ejected with 50% of requests over the SLO and a 50% threshold")
+	}
+
+	cfg.LatencySLO = 0
+	for range 10 {
+		lb.recordLatency(backend, time.Second)
+	}
+	if backend.isEjected() {
+		t.Error("ejected with LATENCY_SLO unset")
+	}
+}
+
+func TestHealthCheckPriorityIntervals(t *testing.T) {
+	high, highProbes := probeCountingBackend(t)
+	normal, normalProbes := probeCountingBackend(t)
+	low, lowProbes := probeCountingBackend(t)
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{
+		{URL: high.URL, HealthCheckPriority: "high"},
+		{URL: normal.URL},
+		{URL: low.URL, HealthCheckPriority: "low"},
+	}
+	cfg.HealthCheckInterval = 100 * time.Millisecond
+	cfg.HealthCheckPath = "/healthz"
+	cfg.HealthCheckJitter = 0
+	lb := NewLoadBalancer(cfg)
+
+	startTestHealthChecks(t, lb)
+	time.Sleep(time.Second)
+	counts := []int64{highProbes.Load(), normalProbes.Load(), lowProbes.Load()}
+	for i, want := range []int64{20, 10, 5} {
+		if counts[i] < want*3/4 || counts[i] > want {
+			t.Errorf("probes in 1s at high, normal and low priority = %v, want about 20, 10 and 5", counts)
+			break
+		}
+	}
+}
+
+func TestHighPriorityFailureNotifies(t *testing.T) {
+	alerts := make(chan map[string]any, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert map[string]any
+		json.NewDecoder(r.Body).Decode(&alert)
+		alerts <- alert
+	}))
+	defer webhook.Close()
+	high, normal := deadBackendURL(t), deadBackendURL(t)
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: normal}, {URL: high, HealthCheckPriority: "high"}}
+	cfg.AlertWebhookURL = webhook.URL
+	lb := NewLoadBalancer(cfg)
+
+	lb.checkBackend(lb.backends[0])
+	lb.checkBackend(lb.backends[1])
+	select {
+	case alert := <-alerts:
+		data, _ := alert["data"].(map[string]any)
+		if alert["event"] != "backend_down" || data["backend"] != high || data["priority"] != "high" {
+			t.Errorf("alert = %v, want backend_down for the high-priority backend", alert)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no alert for the high-priority backend going down")
+	}
+
+	// Only the transition alerts: it's already down now.
+	lb.checkBackend(lb.backends[1])
+	select {
+	case alert := <-alerts:
+		t.Errorf("unexpected alert %v", alert)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// blockingProbeBackend holds each /healthz probe until release is closed,
+// tracking how many run at once.
+func blockingProbeBackend(t *testing.T) (*httptest.Server, chan struct{}, *atomic.Int64, *atomic.Int64) {
+	t.Helper()
+	release := make(chan struct{})
+	var running, maxRunning atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	return srv, release, &running, &maxRunning
+}
+
+func TestOverlappingHealthCheckSkipped(t *testing.T) {
+	srv, release, running, maxRunning := blockingProbeBackend(t)
+	cfg := testConfig(srv.URL)
+	cfg.HealthCheckPath = "/healthz"
+	cfg.HealthCheckTimeout = 5 * time.Second
+	lb := NewLoadBalancer(cfg)
+	backend := lb.backends[0]
+
+	done := make(chan bool)
+	go func() { done <- lb.checkBackend(backend) }()
+	if !waitFor(func() bool { return running.Load() == 1 }) {
+		t.Fatal("first probe never reached the backend")
+	}
+	start := time.Now()
+	if !lb.checkBackend(backend) {
+		t.Error("overlapping check didn't report the backend's current state")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("overlapping check waited %v for the running one", took)
+	}
+	close(release)
+	if !<-done {
+		t.Error("first check failed")
+	}
+	if maxRunning.Load() != 1 {
+		t.Errorf("%d probes ran at once, want 1", maxRunning.Load())
+	}
+}
+
+// A probe slower than the interval delays the next one rather than
+// piling up beside it.
+func TestSlowHealthCheckCycleDoesNotOverlap(t *testing.T) {
+	srv, release, running, maxRunning := blockingProbeBackend(t)
+	cfg := testConfig(srv.URL)
+	cfg.AdminToken = "secret"
+	cfg.HealthCheckPath = "/healthz"
+	cfg.HealthCheckInterval = 20 * time.Millisecond
+	cfg.HealthCheckJitter = 0
+	cfg.HealthCheckTimeout = 5 * time.Second
+	lb := NewLoadBalancer(cfg)
+
+	startTestHealthChecks(t, lb)
+	if !waitFor(func() bool { return running.Load() == 1 }) {
+		t.Fatal("scheduled probe never reached the backend")
+	}
+	// Several intervals pass while the probe hangs; an admin sweep runs
+	// on top of it.
+	time.Sleep(100 * time.Millisecond)
+	serve(lb, adminRequest(lb, http.MethodPost, "/admin/health/run", ""))
+	close(release)
+	if maxRunning.Load() != 1 {
+		t.Errorf("%d probes ran at once, want 1", maxRunning.Load())
+	}
+}
+
+func newMockLB(t *testing.T, enabled bool) (*LoadBalancer, *atomic.Int64) {
+	t.Helper()
+	backend, hits := headerEchoBackend(t)
+	cfg := testConfig(backend.URL)
+	cfg.Port = "8080"
+	cfg.MockEnabled = enabled
+	cfg.MockRules = []MockRule{
+		{PathPattern: "/api/users/*", Method: "GET", ResponseStatus: http.StatusTeapot,
+			ResponseHeaders: map[string]string{"Content-Type": "application/json", "X-Mock": "users"},
+			ResponseBody:    `{"id":1}`},
+		{PathPattern: "/api/*", ResponseBody: "catch-all"},
+	}
+	if report := cfg.validate(); !report.Valid {
+		t.Fatalf("invalid config: %v", report.Errors)
+	}
+	return NewLoadBalancer(cfg), hits
+}
+
+func TestMockRules(t *testing.T) {
+	lb, hits := newMockLB(t, true)
+
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/api/users/1", nil))
+	if rec.Code != http.StatusTeapot || rec.Body.String() != `{"id":1}` ||
+		rec.Header().Get("Content-Type") != "application/json" || rec.Header().Get("X-Mock") != "users" {
+		t.Errorf("got %d %q %v, want the users mock", rec.Code, rec.Body.String(), rec.Header())
+	}
+	// Rules match in order, and the first one is GET only.
+	rec = serve(lb, httptest.NewRequest(http.MethodPost, "/api/users/1", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "catch-all" {
+		t.Errorf("POST got %d %q, want the catch-all mock with its default 200", rec.Code, rec.Body.String())
+	}
+	rec = serve(lb, httptest.NewRequest(http.MethodHead, "/api/other", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("HEAD got %d %q, want the mock's status without a body", rec.Code, rec.Body.String())
+	}
+	if hits.Load() != 0 {
+		t.Errorf("backend got %d requests for mocked paths", hits.Load())
+	}
+
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/other", nil)); rec.Code != http.StatusOK || hits.Load() != 1 {
+		t.Errorf("unmatched request got %d with %d backend requests, want it forwarded", rec.Code, hits.Load())
+	}
+}
+
+func TestMockRulesDisabled(t *testing.T) {
+	lb, hits := newMockLB(t, false)
+	for _, target := range []string{"/api/users/1", "/api/other"} {
+		if rec := serve(lb, httptest.NewRequest(http.MethodGet, target, nil)); rec.Code != http.StatusOK || rec.Header().Get("X-Mock") != "" {
+			t.Errorf("%s got %d %v with mocks off, want the backend's answer", target, rec.Code, rec.Header())
+		}
+	}
+	if hits.Load() != 2 {
+		t.Errorf("backend got %d requests, want both forwarded", hits.Load())
+	}
+}
+
+func newChaosLB(t *testing.T, enabled bool, rules ...ChaosRule) (*LoadBalancer, *atomic.Int64) {
+	t.Helper()
+	backend, hits := headerEchoBackend(t)
+	cfg := testConfig(backend.URL)
+	cfg.ChaosEnabled = enabled
+	cfg.ChaosRules = rules
+	return NewLoadBalancer(cfg), hits
+}
+
+func TestChaosErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		rule       ChaosRule
+		wantStatus int
+	}{
+		{"disabled", false, ChaosRule{PathPattern: "/*", Probability: 1, ErrorCode: 503}, http.StatusOK},
+		{"never", true, ChaosRule{PathPattern: "/*", Probability: 0, ErrorCode: 503}, http.StatusOK},
+		{"always", true, ChaosRule{PathPattern: "/*", Probability: 1, ErrorCode: 503}, http.StatusServiceUnavailable},
+		{"error code", true, ChaosRule{PathPattern: "/*", Probability: 1, ErrorCode: 418}, http.StatusTeapot},
+		{"other path", true, ChaosRule{PathPattern: "/slow/*", Probability: 1, ErrorCode: 503}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, hits := newChaosLB(t, tt.enabled, tt.rule)
+			for range 20 {
+				if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+				}
+			}
+			forwarded := tt.wantStatus == http.StatusOK
+			if forwarded != (hits.Load() == 20) || !forwarded && hits.Load() != 0 {
+				t.Errorf("backend got %d of 20 requests, want forwarded %t", hits.Load(), forwarded)
+			}
+		})
+	}
+}
+
+func TestChaosLatency(t *testing.T) {
+	lb, hits := newChaosLB(t, true,
+		ChaosRule{PathPattern: "/slow/*", Probability: 1, LatencyMs: 50},
+		ChaosRule{PathPattern: "/*", Probability: 1, ErrorCode: 503})
+
+	start := time.Now()
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/slow/x", nil))
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Errorf("request took %v, want the injected 50ms", took)
+	}
+	// Only the first matching rule applies, and latency alone still
+	// forwards the request.
+	if rec.Code != http.StatusOK || hits.Load() != 1 {
+		t.Errorf("got %d with %d backend requests, want the delayed request forwarded", rec.Code, hits.Load())
+	}
+}
+
+func TestChaosProbability(t *testing.T) {
+	lb, _ := newChaosLB(t, true, ChaosRule{PathPattern: "/*", Probability: 0.5, ErrorCode: 503})
+	failed := 0
+	for range 400 {
+		if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code == http.StatusServiceUnavailable {
+			failed++
+		}
+	}
+	if failed < 140 || failed > 260 {
+		t.Errorf("%d of 400 requests failed at probability 0.5", failed)
+	}
+}
+
+func TestHealthCheckMaxLatency(t *testing.T) {
+	slow, _ := sleepyBackend(t, "slow", 60*time.Millisecond)
+	fast := namedBackend(t, "fast")
+	cfg := testConfig(slow.URL, fast.URL)
+	cfg.HealthCheckMaxLatency = 30 * time.Millisecond
+	lb := NewLoadBalancer(cfg)
+
+	if lb.checkBackend(lb.backends[0]) || lb.backends[0].IsAlive() {
+		t.Error("backend answering 200 after 60ms is up with a 30ms limit")
+	}
+	if bs := backendStats(t, lb, slow.URL); !strings.Contains(bs.LastHealthError, "exceeding HEALTH_CHECK_MAX_LATENCY 30ms") {
+		t.Errorf("last health error = %q, want it to name the latency limit", bs.LastHealthError)
+	}
+	if !lb.checkBackend(lb.backends[1]) {
+		t.Error("fast backend failed its health check")
+	}
+
+	cfg.HealthCheckMaxLatency = 0
+	if !lb.checkBackend(lb.backends[0]) {
+		t.Error("slow backend failed its health check with HEALTH_CHECK_MAX_LATENCY off")
+	}
+}
+
+// scrapeMetrics fetches lb's metrics endpoint and returns each sample's
+// value keyed by its name and labels as written.
+func scrapeMetrics(t *testing.T, lb *LoadBalancer) map[string]string {
+	t.Helper()
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, lb.cfg.MetricsPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("metrics status = %d", rec.Code)
+	}
+	samples := make(map[string]string)
+	for line := range strings.Lines(rec.Body.String()) {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.LastIndexByte(line, ' '); i > 0 {
+			samples[line[:i]] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return samples
+}
+
+// checkSizeHistogram compares the histogram name's series for backendURL
+// with the cumulative bucket counts in want, keyed by le.
+func checkSizeHistogram(t *testing.T, samples map[string]string, name, backendURL string, want map[string]string, sum string) {
+	t.Helper()
+	labels := `backend="` + backendURL + `"`
+	for le, count := range want {
+		if got := samples[name+"_bucket{"+labels+`,le="`+le+`"}`]; got != count {
+			t.Errorf("%s bucket le=%s = %q, want %s", name, le, got, count)
+		}
+	}
+	if got := samples[name+"_sum{"+labels+"}"]; got != sum {
+		t.Errorf("%s_sum = %q, want %s", name, got, sum)
+	}
+}
+
+func TestResponseSizeHistogram(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		io.WriteString(w, strings.Repeat("x", n))
+	}))
+	defer backend.Close()
+	cfg := testConfig(backend.URL)
+	cfg.MetricsEnabled = true
+	lb := NewLoadBalancer(cfg)
+
+	for _, n := range []int{100, 600, 2000, 2000, 70000} {
+		if rec := serve(lb, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/?n=%d", n), nil)); rec.Body.Len() != n {
+			t.Fatalf("client got %d bytes, want %d", rec.Body.Len(), n)
+		}
+	}
+	checkSizeHistogram(t, scrapeMetrics(t, lb), "lb_response_size_bytes", backend.URL, map[string]string{
+		"512": "1", "1024": "2", "4096": "4", "16384": "4", "65536": "4", "262144": "5", "1048576": "5", "+Inf": "5",
+	}, "74700")
+	if p95 := backendStats(t, lb, backend.URL).ResponseSizeP95; p95 <= 65536 || p95 > 262144 {
+		t.Errorf("response_size_p95 = %v, want it in the 64KiB-256KiB bucket", p95)
+	}
+}
+
+// expectContinueUpload sends a POST with "Expect: 100-continue" to address
+// over a raw connection, sending body only once a 100 arrives. It returns
+// whether one did and the final response.
+func expectContinueUpload(t *testing.T, address, body string) (bool, *http.Response, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: lb.test\r\nContent-Length: %d\r\nExpect: 100-continue\r\nConnection: close\r\n\r\n", len(body))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	continued := resp.StatusCode == http.StatusContinue
+	if continued {
+		io.WriteString(conn, body)
+		if resp, err = http.ReadResponse(br, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return continued, resp, string(data)
+}
+
+func TestExpectContinueRelayed(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reading the body sends the 100 Continue.
+		data, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "got %d bytes", len(data))
+	}))
+	defer backend.Close()
+	cfg := testConfig(backend.URL)
+	cfg.ExpectContinueTimeout = 5 * time.Second
+	lb := NewLoadBalancer(cfg)
+	srv := httptest.NewServer(lb)
+	defer srv.Close()
+
+	body := strings.Repeat("x", 64<<10)
+	continued, resp, got := expectContinueUpload(t, srv.Listener.Addr().String(), body)
+	if !continued || resp.StatusCode != http.StatusOK || got != "got 65536 bytes" {
+		t.Errorf("upload: continued %t, final %d %q, want the backend's 100 relayed and the body delivered", continued, resp.StatusCode, got)
+	}
+
+	// The backend's own transport waits for the 100 rather than sending the
+	// body right away.
+	transport, ok := lb.backends[0].Proxy.Transport.(*poolTransport).RoundTripper.(*http.Transport)
+	if !ok || transport.ExpectContinueTimeout != 5*time.Second {
+		t.Errorf("backend transport = %T, want an *http.Transport with EXPECT_CONTINUE_TIMEOUT", lb.backends[0].Proxy.Transport)
+	}
+}
+
+func TestExpectContinueRejectedWithoutBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+	}))
+	defer backend.Close()
+	cfg := testConfig(backend.URL)
+	cfg.ExpectContinueTimeout = 5 * time.Second
+	srv := httptest.NewServer(NewLoadBalancer(cfg))
+	defer srv.Close()
+
+	start := time.Now()
+	continued, resp, _ := expectContinueUpload(t, srv.Listener.Addr().String(), strings.Repeat("x", 1<<20))
+	if continued || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("continued %t, final %d, want the backend's 413 before any body is sent", continued, resp.StatusCode)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("rejection took %v, want it without waiting out EXPECT_CONTINUE_TIMEOUT", took)
+	}
+}
+
+func TestPerBackendHealthTimeout(t *testing.T) {
+	patient, _ := sleepyBackend(t, "patient", 100*time.Millisecond)
+	strict, _ := sleepyBackend(t, "strict", 100*time.Millisecond)
+	cfg := testConfig()
+	cfg.HealthCheckTimeout = 50 * time.Millisecond
+	cfg.Backends = []BackendConfig{
+		{URL: patient.URL, HealthTimeout: time.Second},
+		{URL: strict.URL},
+	}
+	lb := NewLoadBalancer(cfg)
+
+	if !lb.checkBackend(lb.backends[0]) {
+		t.Error("backend with a 1s health_timeout failed a 100ms probe")
+	}
+	if lb.checkBackend(lb.backends[1]) {
+		t.Error("backend on the 50ms HEALTH_CHECK_TIMEOUT passed a 100ms probe")
+	}
+	if bs := backendStats(t, lb, strict.URL); !strings.Contains(bs.LastHealthError, "timed out after 50ms") {
+		t.Errorf("last health error = %q, want the 50ms timeout", bs.LastHealthError)
+	}
+}
+
+func newZoneLB(zoneAware bool) *LoadBalancer {
+	cfg := testConfig()
+	cfg.ZoneAwareRouting = zoneAware
+	cfg.LocalZone = "us-east-1a"
+	cfg.Backends = []BackendConfig{
+		{URL: "http://127.0.0.1:9001", Zone: "us-east-1a"},
+		{URL: "http://127.0.0.1:9002", Zone: "us-east-1b"},
+		{URL: "http://127.0.0.1:9003", Zone: "us-east-1a"},
+		{URL: "http://127.0.0.1:9004", Zone: "us-east-1b"},
+	}
+	return NewLoadBalancer(cfg)
+}
+
+func TestZoneAwareRouting(t *testing.T) {
+	lb := newZoneLB(true)
+	counts := picks(lb, 100)
+	if local := counts["http://127.0.0.1:9001"] + counts["http://127.0.0.1:9003"]; local != 100 {
+		t.Errorf("%d of 100 requests stayed in the local zone, want all while it has live backends", local)
+	}
+
+	// One local backend left still takes everything.
+	lb.backends[0].SetAlive(false)
+	if got := picks(lb, 20)["http://127.0.0.1:9003"]; got != 20 {
+		t.Errorf("remaining local backend got %d of 20 requests, want all", got)
+	}
+
+	lb.backends[2].SetAlive(false)
+	counts = picks(lb, 20)
+	if counts["http://127.0.0.1:9002"] != 10 || counts["http://127.0.0.1:9004"] != 10 {
+		t.Errorf("picks with the local zone down = %v, want the other zone round-robined", counts)
+	}
+}
+
+func TestZoneAwareRoutingDisabled(t *testing.T) {
+	counts := picks(newZoneLB(false), 100)
+	if len(counts) != 4 || counts["http://127.0.0.1:9001"] != 25 || counts["http://127.0.0.1:9002"] != 25 {
+		t.Errorf("picks = %v, want all four backends to share evenly with zone awareness off", counts)
+	}
+}
+
+func TestZoneAwareRoutingNeedsZone(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.ZoneAwareRouting = true
+	if report := cfg.validate(); report.Valid {
+		t.Error("ZONE_AWARE_ROUTING without LB_ZONE passed validation")
+	}
+}
+
+func TestErrorResponsesCarryIDs(t *testing.T) {
+	const trace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	request := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Request-ID", "req-123")
+		r.Header.Set("Traceparent", "00-"+trace+"-00f067aa0ba902b7-01")
+		return r
+	}
+	down := NewLoadBalancer(testConfig(deadBackendURL(t)))
+	down.backends[0].SetAlive(false)
+	tests := []struct {
+		name string
+		lb   *LoadBalancer
+		want int
+	}{
+		{"bad gateway", NewLoadBalancer(testConfig(deadBackendURL(t))), http.StatusBadGateway},
+		{"unavailable", down, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, asJSON := range []bool{false, true} {
+				tt.lb.cfg.ErrorResponseJSON = asJSON
+				rec := serve(tt.lb, request())
+				if rec.Code != tt.want || rec.Header().Get("X-Request-ID") != "req-123" || rec.Header().Get("X-Trace-ID") != trace {
+					t.Errorf("json %t: got %d with headers %v, want %d with the request and trace IDs", asJSON, rec.Code, rec.Header(), tt.want)
+				}
+				if !asJSON {
+					continue
+				}
+				var body ErrorResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+					t.Fatalf("body %q: %v", rec.Body.String(), err)
+				}
+				if body.Status != tt.want || body.RequestID != "req-123" || body.TraceID != trace || body.Error == "" {
+					t.Errorf("body = %+v, want the status, error and both IDs", body)
+				}
+			}
+		})
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	tests := map[string]string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": "",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01": "",
+		"00-4bf92f35-00f067aa0ba902b7-01":                         "",
+		"":                                                        "",
+	}
+	for traceparent, want := range tests {
+		if got := traceID(traceparent); got != want {
+			t.Errorf("traceID(%q) = %q, want %q", traceparent, got, want)
+		}
+	}
+}
+
+func TestConfigDocsMarkdownListsEveryField(t *testing.T) {
+	docs := GenerateConfigDocs("markdown")
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if !strings.Contains(docs, "| `"+name+"` |") {
+			t.Errorf("markdown docs have no row for %s (%s)", field.Name, name)
+		}
+	}
+	if strings.Contains(docs, "VaultClient") {
+		t.Error("markdown docs list a field kept out of the JSON config")
+	}
+	if GenerateConfigDocs("yaml") != "" {
+		t.Error("unknown format produced output")
+	}
+}
+
+// checkSchema reports the ways s isn't a JSON Schema of the shape
+// configSchema produces, recursing into subschemas.
+func checkSchema(t *testing.T, where string, s map[string]any) {
+	t.Helper()
+	validType := func(v any) bool {
+		name, ok := v.(string)
+		return ok && slices.Contains([]string{"null", "boolean", "object", "array", "number", "string", "integer"}, name)
+	}
+	switch typ := s["type"].(type) {
+	case string:
+		if !validType(typ) {
+			t.Errorf("%s: invalid type %q", where, typ)
+		}
+	case []any:
+		if len(typ) == 0 || !slices.ContainsFunc(typ, validType) {
+			t.Errorf("%s: invalid type list %v", where, typ)
+		}
+	default:
+		t.Errorf("%s: type %v is neither a string nor a list", where, s["type"])
+	}
+	if d, ok := s["description"]; ok {
+		if _, isString := d.(string); !isString {
+			t.Errorf("%s: description %v is not a string", where, d)
+		}
+	}
+	if items, ok := s["items"]; ok {
+		sub, isObject := items.(map[string]any)
+		if !isObject {
+			t.Fatalf("%s: items is not a schema", where)
+		}
+		checkSchema(t, where+"[]", sub)
+	}
+	switch additional := s["additionalProperties"].(type) {
+	case nil, bool:
+	case map[string]any:
+		checkSchema(t, where+".*", additional)
+	default:
+		t.Errorf("%s: additionalProperties %v is neither a boolean nor a schema", where, additional)
+	}
+	if properties, ok := s["properties"]; ok {
+		props, isObject := properties.(map[string]any)
+		if !isObject {
+			t.Fatalf("%s: properties is not an object", where)
+		}
+		for name, prop := range props {
+			sub, isObject := prop.(map[string]any)
+			if !isObject {
+				t.Fatalf("%s.%s: not a schema", where, name)
+			}
+			checkSchema(t, where+"."+name, sub)
+		}
+	}
+}
+
+func TestConfigDocsJSONSchema(t *testing.T) {
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(GenerateConfigDocs("json-schema")), &schema); err != nil {
+		t.Fatalf("schema is not JSON: %v", err)
+	}
+	if schema["$schema"] != "https://json-schema.org/draft/2020-12/schema" {
+		t.Errorf("$schema = %v, want draft 2020-12", schema["$schema"])
+	}
+	checkSchema(t, "config", schema)
+
+	// Every key a Config marshals to is described, with a default of the
+	// property's own type.
+	data, err := json.Marshal(envConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys map[string]any
+	json.Unmarshal(data, &keys)
+	properties := schema["properties"].(map[string]any)
+	for key := range keys {
+		if _, ok := properties[key]; !ok {
+			t.Errorf("schema has no property %q", key)
+		}
+	}
+	if jitter := properties["health_check_jitter"].(map[string]any); jitter["type"] != "number" || jitter["default"] != 0.1 {
+		t.Errorf("health_check_jitter = %v, want a number defaulting to 0.1", jitter)
+	}
+	if enabled := properties["metrics_enabled"].(map[string]any); enabled["type"] != "boolean" || enabled["default"] != false {
+		t.Errorf("metrics_enabled = %v, want a boolean defaulting to false", enabled)
+	}
+}
+
+func TestJitteredIntervalStaysInWindow(t *testing.T) {
+	cfg := testConfig()
+	cfg.HealthCheckJitter = 0.2
+	lb := NewLoadBalancer(cfg)
+
+	interval := time.Second
+	seen := make(map[time.Duration]bool)
+	for range 1000 {
+		wait := lb.jitteredInterval(interval)
+		if wait < 800*time.Millisecond || wait > 1200*time.Millisecond {
+			t.Fatalf("jittered wait %v is outside 20%% of %v", wait, interval)
+		}
+		seen[wait.Truncate(50*time.Millisecond)] = true
+	}
+	// 1000 draws cover all eight 50ms buckets of the 400ms window.
+	if len(seen) != 8 {
+		t.Errorf("waits fell in %d of 8 buckets across the window", len(seen))
+	}
+
+	lb.cfg.HealthCheckJitter = 0
+	if wait := lb.jitteredInterval(interval); wait != interval {
+		t.Errorf("wait without jitter = %v, want %v", wait, interval)
+	}
+}
+
+func TestHealthCheckJitterSpreadsProbes(t *testing.T) {
+	var mu sync.Mutex
+	var firstProbes []time.Time
+	cfg := testConfig()
+	for range 5 {
+		var probed atomic.Bool
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" && !probed.Swap(true) {
+				mu.Lock()
+				firstProbes = append(firstProbes, time.Now())
+				mu.Unlock()
+			}
+		}))
+		t.Cleanup(srv.Close)
+		cfg.Backends = append(cfg.Backends, BackendConfig{URL: srv.URL})
+	}
+	cfg.HealthCheckInterval = 200 * time.Millisecond
+	cfg.HealthCheckPath = "/healthz"
+	cfg.HealthCheckJitter = 0.5
+	lb := NewLoadBalancer(cfg)
+
+	startTestHealthChecks(t, lb)
+	if !waitFor(func() bool { mu.Lock(); defer mu.Unlock(); return len(firstProbes) == 5 }) {
+		t.Fatal("not every backend was probed")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	earliest := slices.MinFunc(firstProbes, time.Time.Compare)
+	latest := slices.MaxFunc(firstProbes, time.Time.Compare)
+	if spread := latest.Sub(earliest); spread < 10*time.Millisecond {
+		t.Errorf("first probes of 5 backends landed within %v, want them spread over the 200ms window", spread)
+	}
+}
+
+func TestValidateRejectsOutOfRangeJitter(t *testing.T) {
+	for _, jitter := range []float64{-0.1, 1, 1.5} {
+		cfg := testConfig("http://127.0.0.1:9001")
+		cfg.Port = "8080"
+		cfg.HealthCheckJitter = jitter
+		report := cfg.validate()
+		if report.Valid || !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, "HEALTH_CHECK_JITTER") }) {
+			t.Errorf("jitter %v: errors = %v, want a HEALTH_CHECK_JITTER error", jitter, report.Errors)
+		}
+	}
+}
+
+// newFeatureFlagLB routes /app/* to the beta pool for users with even IDs.
+func newFeatureFlagLB(t *testing.T) *LoadBalancer {
+	stable, beta := namedBackend(t, "stable"), namedBackend(t, "beta")
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: stable.URL}, {URL: beta.URL, Pool: "beta"}}
+	cfg.Routes = []RouteConfig{{PathPattern: "/app/*", FeatureFlag: "new-ui", FeatureFlagPool: "beta"}}
+	cfg.FeatureFlagProvider = func(flag, userID string) bool {
+		n, err := strconv.Atoi(userID)
+		return flag == "new-ui" && err == nil && n%2 == 0
+	}
+	return NewLoadBalancer(cfg)
+}
+
+func unsignedJWT(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte(claims)) + ".sig"
+}
+
+func TestFeatureFlagRoutesByUserID(t *testing.T) {
+	lb := newFeatureFlagLB(t)
+	for id := 1; id <= 6; id++ {
+		req := httptest.NewRequest("GET", "/app/home", nil)
+		req.Header.Set("X-User-ID", strconv.Itoa(id))
+		want := "stable"
+		if id%2 == 0 {
+			want = "beta"
+		}
+		if got := serve(lb, req).Body.String(); got != want {
+			t.Errorf("user %d reached %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestFeatureFlagUserFromJWTClaim(t *testing.T) {
+	lb := newFeatureFlagLB(t)
+	cases := []struct {
+		name, claims, header, want string
+	}{
+		{"string claim", `{"sub":"42"}`, "", "beta"},
+		{"numeric claim", `{"sub":7}`, "", "stable"},
+		{"claim beats header", `{"sub":"3"}`, "4", "stable"},
+		{"no claim falls back to header", `{"name":"x"}`, "8", "beta"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "/app/home", nil)
+		req.Header.Set("Authorization", "Bearer "+unsignedJWT(tc.claims))
+		if tc.header != "" {
+			req.Header.Set("X-User-ID", tc.header)
+		}
+		if got := serve(lb, req).Body.String(); got != tc.want {
+			t.Errorf("%s: reached %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	lb.cfg.FeatureFlagUserClaim = "uid"
+	req := httptest.NewRequest("GET", "/app/home", nil)
+	req.Header.Set("Authorization", "Bearer "+unsignedJWT(`{"sub":"1","uid":"2"}`))
+	if got := serve(lb, req).Body.String(); got != "beta" {
+		t.Errorf("with FEATURE_FLAG_USER_CLAIM=uid reached %q, want beta", got)
+	}
+}
+
+func TestFeatureFlagFallsBackToDefaultPool(t *testing.T) {
+	lb := newFeatureFlagLB(t)
+	request := func(userID string) string {
+		req := httptest.NewRequest("GET", "/app/home", nil)
+		if userID != "" {
+			req.Header.Set("X-User-ID", userID)
+		}
+		return serve(lb, req).Body.String()
+	}
+
+	if got := request(""); got != "stable" {
+		t.Errorf("request without a user reached %q, want stable", got)
+	}
+	other := httptest.NewRequest("GET", "/other", nil)
+	other.Header.Set("X-User-ID", "2")
+	if got := serve(lb, other).Body.String(); got != "stable" {
+		t.Errorf("request outside the flagged route reached %q, want stable", got)
+	}
+
+	lb.backends[1].SetAlive(false)
+	if got := request("2"); got != "stable" {
+		t.Errorf("flagged user with the beta pool down reached %q, want stable", got)
+	}
+	lb.backends[1].SetAlive(true)
+
+	lb.cfg.FeatureFlagProvider = nil
+	if got := request("2"); got != "stable" {
+		t.Errorf("flagged user without a provider reached %q, want stable", got)
+	}
+}
+
+func TestValidateRequiresFeatureFlagPool(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.Routes = []RouteConfig{{PathPattern: "/app/*", FeatureFlag: "new-ui"}}
+	report := cfg.validate()
+	if report.Valid || !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, "feature_flag_pool") }) {
+		t.Errorf("errors = %v, want one about the missing feature_flag_pool", report.Errors)
+	}
+}
+
+func TestMaintenanceModeShortCircuitsRequests(t *testing.T) {
+	srv, hits := sleepyBackend(t, "backend", 0)
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	os.WriteFile(page, []byte("<h1>Back at noon</h1>"), 0o644)
+	cfg := testConfig(srv.URL)
+	cfg.AdminToken = "secret"
+	cfg.MetricsEnabled = true
+	cfg.MaintenancePage = page
+	cfg.MaintenanceRetryAfter = 10 * time.Minute
+	lb := NewLoadBalancer(cfg)
+
+	if rec := serve(lb, adminRequest(lb, "POST", "/admin/maintenance", `{"enabled": true}`)); rec.Code != http.StatusOK {
+		t.Fatalf("enabling maintenance returned %d: %s", rec.Code, rec.Body)
+	}
+	rec := serve(lb, httptest.NewRequest("GET", "/orders", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "<h1>Back at noon</h1>" {
+		t.Errorf("request in maintenance got %d %q, want 503 with the page", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "600" {
+		t.Errorf("Retry-After = %q, want 600", got)
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("Content-Type = %q, want HTML", got)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("backend saw %d requests during maintenance", hits.Load())
+	}
+
+	// Admin and metrics endpoints keep working.
+	if rec := serve(lb, adminRequest(lb, "GET", "/admin/stats", "")); rec.Code != http.StatusOK {
+		t.Errorf("admin endpoint in maintenance returned %d", rec.Code)
+	}
+	if rec := serve(lb, httptest.NewRequest("GET", cfg.MetricsPath, nil)); rec.Code != http.StatusOK {
+		t.Errorf("metrics endpoint in maintenance returned %d", rec.Code)
+	}
+
+	serve(lb, adminRequest(lb, "POST", "/admin/maintenance", `{"enabled": false}`))
+	if rec := serve(lb, httptest.NewRequest("GET", "/orders", nil)); rec.Code != http.StatusOK || hits.Load() != 1 {
+		t.Errorf("request after maintenance got %d with %d backend hits, want it proxied", rec.Code, hits.Load())
+	}
+}
+
+func TestMaintenanceModeDefaultsAndErrors(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.AdminToken = "secret"
+	cfg.MaintenanceMode = true
+	lb := NewLoadBalancer(cfg)
+
+	rec := serve(lb, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "Down for maintenance") {
+		t.Errorf("MAINTENANCE_MODE without a page got %d %q, want the built-in page", rec.Code, rec.Body)
+	}
+
+	if rec := serve(lb, adminRequest(lb, "POST", "/admin/maintenance", `{}`)); rec.Code != http.StatusBadRequest {
+		t.Errorf("body without enabled returned %d, want 400", rec.Code)
+	}
+	lb.cfg.MaintenancePage = filepath.Join(t.TempDir(), "missing.html")
+	if rec := serve(lb, adminRequest(lb, "POST", "/admin/maintenance", `{"enabled": true}`)); rec.Code != http.StatusInternalServerError {
+		t.Errorf("unreadable page returned %d, want 500", rec.Code)
+	}
+}
+
+func TestMethodTimeouts(t *testing.T) {
+	srv, _ := sleepyBackend(t, "slow", 100*time.Millisecond)
+	cfg := testConfig()
+	cfg.MaxRetries = 0
+	cfg.BackendTimeout = 50 * time.Millisecond
+	cfg.Backends = []BackendConfig{{URL: srv.URL, MethodTimeouts: map[string]time.Duration{
+		"get":  20 * time.Millisecond,
+		"POST": time.Second,
+	}}}
+	lb := NewLoadBalancer(cfg)
+
+	cases := []struct {
+		method           string
+		ok               bool
+		minTime, maxTime time.Duration
+	}{
+		{"GET", false, 20 * time.Millisecond, 45 * time.Millisecond},    // method timeout, matched case-insensitively
+		{"POST", true, 100 * time.Millisecond, time.Second},             // longer method timeout outlasts the backend
+		{"DELETE", false, 50 * time.Millisecond, 90 * time.Millisecond}, // no override: BACKEND_TIMEOUT
+	}
+	for _, tc := range cases {
+		start := time.Now()
+		rec := serve(lb, httptest.NewRequest(tc.method, "/", nil))
+		took := time.Since(start)
+		if ok := rec.Code == http.StatusOK; ok != tc.ok {
+			t.Errorf("%s got %d, want success %v", tc.method, rec.Code, tc.ok)
+		}
+		if took < tc.minTime || took > tc.maxTime {
+			t.Errorf("%s took %v, want %v to %v", tc.method, took, tc.minTime, tc.maxTime)
+		}
+	}
+}
+
+func TestValidateRejectsNonPositiveMethodTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.Port = "8080"
+	cfg.Backends = []BackendConfig{{URL: "http://127.0.0.1:9001", MethodTimeouts: map[string]time.Duration{"POST": 0}}}
+	report := cfg.validate()
+	if report.Valid || !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, "POST method timeout") }) {
+		t.Errorf("errors = %v, want one about the POST method timeout", report.Errors)
+	}
+}
+
+func TestDrainingRedistributesWeight(t *testing.T) {
+	cfg := testConfig()
+	cfg.Strategy = "weighted_round_robin"
+	cfg.AdminToken = "secret"
+	cfg.Backends = []BackendConfig{
+		{URL: "http://127.0.0.1:9001", Weight: 3},
+		{URL: "http://127.0.0.1:9002", Weight: 2},
+		{URL: "http://127.0.0.1:9003", Weight: 1},
+	}
+	lb := NewLoadBalancer(cfg)
+	a, b, c := lb.backends[0], lb.backends[1], lb.backends[2]
+
+	counts := picks(lb, 600)
+	if counts[a.URL] != 300 || counts[b.URL] != 200 || counts[c.URL] != 100 {
+		t.Fatalf("picks before draining = %v, want 300/200/100", counts)
+	}
+
+	drain := func(backend *Backend, draining bool) {
+		body := fmt.Sprintf(`{"backend": %q, "draining": %v}`, backend.URL, draining)
+		if rec := serve(lb, adminRequest(lb, "POST", "/admin/backends/drain", body)); rec.Code != http.StatusOK {
+			t.Fatalf("drain returned %d: %s", rec.Code, rec.Body)
+		}
+	}
+	drain(a, true)
+	counts = picks(lb, 600)
+	if counts[a.URL] != 0 || counts[b.URL] != 400 || counts[c.URL] != 200 {
+		t.Errorf("picks with the weight 3 backend draining = %v, want 0/400/200", counts)
+	}
+	shares := lb.selectionProbabilities()
+	if math.Abs(shares[b]-2.0/3) > 1e-9 || math.Abs(shares[c]-1.0/3) > 1e-9 || shares[a] != 0 {
+		t.Errorf("selection probabilities while draining = %v/%v/%v, want 0/0.67/0.33", shares[a], shares[b], shares[c])
+	}
+
+	// A down backend's weight is redistributed the same way.
+	c.SetAlive(false)
+	if counts = picks(lb, 60); counts[b.URL] != 60 {
+		t.Errorf("picks with only one eligible backend = %v, want all on %s", counts, b.URL)
+	}
+	c.SetAlive(true)
+
+	// Coming back, the drained backend starts without leftover credit.
+	drain(a, false)
+	counts = picks(lb, 600)
+	if counts[a.URL] != 300 || counts[b.URL] != 200 || counts[c.URL] != 100 {
+		t.Errorf("picks after undraining = %v, want 300/200/100", counts)
+	}
+}
+
+// logBuffer collects log output for one test; the proxy logs from
+// goroutines of its own, so writes are locked.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends the standard logger to a buffer until the test ends.
+func captureLog(t *testing.T) *logBuffer {
+	logs := &logBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	return logs
+}
+
+func TestSlowRequestLogged(t *testing.T) {
+	slow, _ := sleepyBackend(t, "slow", 60*time.Millisecond)
+	fast := namedBackend(t, "fast")
+	cfg := testConfig(slow.URL, fast.URL)
+	cfg.SlowRequestThreshold = 30 * time.Millisecond
+	lb := NewLoadBalancer(cfg)
+	logs := captureLog(t)
+
+	serve(lb, httptest.NewRequest("POST", "/reports/annual", nil))
+	serve(lb, httptest.NewRequest("GET", "/quick", nil))
+
+	var slowLines []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "Slow request") {
+			slowLines = append(slowLines, line)
+		}
+	}
+	if len(slowLines) != 1 {
+		t.Fatalf("slow request log lines = %q, want one", slowLines)
+	}
+	line := slowLines[0]
+	for _, want := range []string{"[WARN]", "POST /reports/annual", "to " + slow.URL, "returned 200", "over the 30ms threshold"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("slow request log %q is missing %q", line, want)
+		}
+	}
+}
+
+func TestSlowRequestLogDisabled(t *testing.T) {
+	slow, _ := sleepyBackend(t, "slow", 20*time.Millisecond)
+	cfg := testConfig(slow.URL)
+	cfg.SlowRequestThreshold = 0
+	lb := NewLoadBalancer(cfg)
+	logs := captureLog(t)
+
+	serve(lb, httptest.NewRequest("GET", "/", nil))
+	if strings.Contains(logs.String(), "Slow request") {
+		t.Errorf("slow request logged with SLOW_REQUEST_THRESHOLD=0:\n%s", logs)
+	}
+}
+
+// toggleHealthBackend answers its /healthz with 200 or 503 depending on
+// the returned flag.
+func toggleHealthBackend(t *testing.T) (*httptest.Server, *atomic.Bool) {
+	t.Helper()
+	var healthy atomic.Bool
+	healthy.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &healthy
+}
+
+func TestHealthCheckMetrics(t *testing.T) {
+	first, firstHealthy := toggleHealthBackend(t)
+	second, secondHealthy := toggleHealthBackend(t)
+	cfg := testConfig(first.URL, second.URL)
+	cfg.HealthCheckPath = "/healthz"
+	cfg.MetricsEnabled = true
+	lb := NewLoadBalancer(cfg)
+
+	lb.healthCheck()
+	firstHealthy.Store(false)
+	secondHealthy.Store(false)
+	lb.healthCheck()
+	firstHealthy.Store(true)
+	lb.healthCheck()
+
+	samples := scrapeMetrics(t, lb)
+	want := map[string]string{
+		`lb_health_check_total{backend="` + first.URL + `",result="pass"}`:                 "2",
+		`lb_health_check_total{backend="` + first.URL + `",result="fail"}`:                 "1",
+		`lb_health_check_total{backend="` + second.URL + `",result="pass"}`:                "1",
+		`lb_health_check_total{backend="` + second.URL + `",result="fail"}`:                "2",
+		`lb_health_check_duration_seconds_count{backend="` + first.URL + `"}`:              "3",
+		`lb_health_check_duration_seconds_count{backend="` + second.URL + `"}`:             "3",
+		`lb_backend_state_changes_total{backend="` + first.URL + `",change="up_to_down"}`:  "1",
+		`lb_backend_state_changes_total{backend="` + first.URL + `",change="down_to_up"}`:  "1",
+		`lb_backend_state_changes_total{backend="` + second.URL + `",change="up_to_down"}`: "1",
+	}
+	for series, value := range want {
+		if got := samples[series]; got != value {
+			t.Errorf("%s = %q, want %s", series, got, value)
+		}
+	}
+	if got, ok := samples[`lb_backend_state_changes_total{backend="`+second.URL+`",change="down_to_up"}`]; ok && got != "0" {
+		t.Errorf("second backend never recovered but down_to_up = %s", got)
+	}
+	if _, ok := samples[`lb_health_check_duration_seconds_bucket{backend="`+first.URL+`",le="+Inf"}`]; !ok {
+		t.Error("health check duration histogram has no +Inf bucket")
+	}
+}
+
+// pathOwners maps each of n paths to the backend the strategy picks for it.
+func pathOwners(lb *LoadBalancer, n int) map[string]string {
+	owners := make(map[string]string)
+	for i := range n {
+		path := fmt.Sprintf("/assets/%d.js", i)
+		if backend := lb.getNextBackend(httptest.NewRequest(http.MethodGet, path, nil)); backend != nil {
+			owners[path] = backend.URL
+		}
+	}
+	return owners
+}
+
+func TestConsistentHashPathAffinity(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001", "http://127.0.0.1:9002", "http://127.0.0.1:9003", "http://127.0.0.1:9004")
+	cfg.Strategy = "consistent_hash_path"
+	lb := NewLoadBalancer(cfg)
+
+	owners := pathOwners(lb, 1000)
+	if again := pathOwners(lb, 1000); !maps.Equal(owners, again) {
+		t.Fatal("the same paths mapped to different backends on a second pass")
+	}
+	perBackend := make(map[string]int)
+	for _, url := range owners {
+		perBackend[url]++
+	}
+	for url, n := range perBackend {
+		if n < 150 || n > 350 {
+			t.Errorf("%s owns %d of 1000 paths, want about 250", url, n)
+		}
+	}
+
+	// A new backend takes over about 1/5 of the paths, all from the others.
+	added, err := lb.AddBackend(BackendConfig{URL: "http://127.0.0.1:9005"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	for path, url := range pathOwners(lb, 1000) {
+		if url != owners[path] {
+			moved++
+			if url != added.URL {
+				t.Errorf("%s moved from %s to %s, not to the new backend", path, owners[path], url)
+			}
+		}
+	}
+	if moved < 100 || moved > 300 {
+		t.Errorf("adding a fifth backend moved %d of 1000 paths, want about 200", moved)
+	}
+}
+
+func TestConsistentHashPathSkipsDownBackend(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001", "http://127.0.0.1:9002", "http://127.0.0.1:9003")
+	cfg.Strategy = "consistent_hash_path"
+	lb := NewLoadBalancer(cfg)
+	owners := pathOwners(lb, 300)
+
+	down := lb.backends[1]
+	down.SetAlive(false)
+	for path, url := range pathOwners(lb, 300) {
+		switch {
+		case url == down.URL:
+			t.Errorf("%s still sent to the down backend", path)
+		case owners[path] != down.URL && url != owners[path]:
+			t.Errorf("%s moved from %s to %s though its backend is up", path, owners[path], url)
+		}
+	}
+
+	down.SetAlive(true)
+	if back := pathOwners(lb, 300); !maps.Equal(owners, back) {
+		t.Error("paths did not return to their backend once it came back up")
+	}
+}
+
+func TestMaxConnAgeRecyclesIdleConnections(t *testing.T) {
+	backendURL, opened, closed := connCountingBackend(t)
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: backendURL, BackendMaxConnAge: 100 * time.Millisecond}}
+	lb := NewLoadBalancer(cfg)
+
+	for range 3 {
+		if rec := serve(lb, httptest.NewRequest("GET", "/", nil)); rec.Code != http.StatusOK {
+			t.Fatalf("status %d", rec.Code)
+		}
+	}
+	if opened.Load() != 1 {
+		t.Fatalf("%d connections for 3 requests within backend_max_conn_age, want 1", opened.Load())
+	}
+
+	if !waitFor(func() bool { return closed.Load() == 1 }) {
+		t.Fatalf("idle connection not closed after backend_max_conn_age (closed %d)", closed.Load())
+	}
+	if rec := serve(lb, httptest.NewRequest("GET", "/", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("request after the connection expired got %d", rec.Code)
+	}
+	if opened.Load() != 2 {
+		t.Errorf("%d connections opened, want a new one after the first expired", opened.Load())
+	}
+}
+
+func TestMaxConnAgeWaitsForInFlightRequest(t *testing.T) {
+	var opened, closed atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		io.WriteString(w, "done")
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			opened.Add(1)
+		case http.StateClosed:
+			closed.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: srv.URL, BackendMaxConnAge: 50 * time.Millisecond}}
+	lb := NewLoadBalancer(cfg)
+
+	// The connection expires halfway through the request, which still
+	// completes; the connection is closed once it is returned.
+	rec := serve(lb, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "done" {
+		t.Fatalf("request spanning backend_max_conn_age got %d %q", rec.Code, rec.Body)
+	}
+	if !waitFor(func() bool { return closed.Load() == 1 }) {
+		t.Errorf("expired connection not closed after its request finished (closed %d)", closed.Load())
+	}
+}
+
+func TestConnectionsReusedWithoutMaxConnAge(t *testing.T) {
+	backendURL, opened, closed := connCountingBackend(t)
+	lb := NewLoadBalancer(testConfig(backendURL))
+
+	serve(lb, httptest.NewRequest("GET", "/", nil))
+	time.Sleep(150 * time.Millisecond)
+	serve(lb, httptest.NewRequest("GET", "/", nil))
+	if opened.Load() != 1 || closed.Load() != 0 {
+		t.Errorf("opened %d and closed %d connections without backend_max_conn_age, want one kept open", opened.Load(), closed.Load())
+	}
+}
+
+func TestValidateMaxConnAge(t *testing.T) {
+	cases := map[string]BackendConfig{
+		"negative backend_max_conn_age": {URL: "http://127.0.0.1:9001", BackendMaxConnAge: -time.Second},
+		"only applies to HTTP/1.1":      {URL: "http://127.0.0.1:9001", BackendMaxConnAge: time.Minute, Transport: "http2"},
+	}
+	for want, backendCfg := range cases {
+		cfg := testConfig()
+		cfg.Port = "8080"
+		cfg.Backends = []BackendConfig{backendCfg}
+		report := cfg.validate()
+		if report.Valid || !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, want) }) {
+			t.Errorf("errors = %v, want one containing %q", report.Errors, want)
+		}
+	}
+}
+
+func TestLastHealthErrorCapturedAndCleared(t *testing.T) {
+	srv, healthy := toggleHealthBackend(t)
+	dead := deadBackendURL(t)
+	cfg := testConfig(srv.URL, dead)
+	cfg.HealthCheckPath = "/healthz"
+	cfg.AdminToken = "secret"
+	lb := NewLoadBalancer(cfg)
+
+	healthy.Store(false)
+	before := time.Now()
+	lb.healthCheck()
+
+	stats := backendStats(t, lb, srv.URL)
+	if !strings.Contains(stats.LastHealthError, "503") {
+		t.Errorf("last error of a backend answering 503 = %q", stats.LastHealthError)
+	}
+	if stats.LastHealthErrorAt == nil || stats.LastHealthErrorAt.Before(before) {
+		t.Errorf("last error time = %v, want the failed check's", stats.LastHealthErrorAt)
+	}
+	if got := backendStats(t, lb, dead).LastHealthError; !strings.Contains(got, "connection refused") {
+		t.Errorf("last error of an unreachable backend = %q", got)
+	}
+
+	// The stats endpoint tells operators why the backend is down.
+	rec := serve(lb, adminRequest(lb, "GET", "/admin/stats", ""))
+	if !strings.Contains(rec.Body.String(), `"last_health_error"`) {
+		t.Errorf("/admin/stats has no last_health_error: %s", rec.Body)
+	}
+
+	healthy.Store(true)
+	rec = serve(lb, adminRequest(lb, "POST", "/admin/health/run?backend="+url.QueryEscape(srv.URL), ""))
+	var results []HealthCheckResult
+	json.Unmarshal(rec.Body.Bytes(), &results)
+	if len(results) != 1 || !results[0].Alive || results[0].Error != "" {
+		t.Errorf("health run after recovery = %+v, want alive without an error", results)
+	}
+	stats = backendStats(t, lb, srv.URL)
+	if stats.LastHealthError != "" || stats.LastHealthErrorAt != nil {
+		t.Errorf("last error after recovery = %q at %v, want it cleared", stats.LastHealthError, stats.LastHealthErrorAt)
+	}
+	if rec := serve(lb, adminRequest(lb, "GET", "/admin/stats", "")); strings.Count(rec.Body.String(), `"last_health_error"`) != 1 {
+		t.Errorf("/admin/stats should list only the unreachable backend's error: %s", rec.Body)
+	}
+}
+
+func TestBackendConnectionClose(t *testing.T) {
+	tests := []struct {
+		name        string
+		global      bool
+		perBackend  bool
+		connections int64
+	}{
+		{"keep-alive", false, false, 1},
+		{"BACKEND_CONNECTION_CLOSE", true, false, 3},
+		{"backend connection_close", false, true, 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			backendURL, opened, _ := connCountingBackend(t)
+			cfg := testConfig()
+			cfg.BackendConnectionClose = tc.global
+			cfg.Backends = []BackendConfig{{URL: backendURL, ConnectionClose: tc.perBackend}}
+			lb := NewLoadBalancer(cfg)
+			for range 3 {
+				if rec := serve(lb, httptest.NewRequest("GET", "/", nil)); rec.Code != http.StatusOK {
+					t.Fatalf("status %d", rec.Code)
+				}
+			}
+			if got := opened.Load(); got != tc.connections {
+				t.Errorf("3 requests opened %d backend connections, want %d", got, tc.connections)
+			}
+		})
+	}
+}
+
+func TestClientConnectionClose(t *testing.T) {
+	for _, closeConns := range []bool{false, true} {
+		cfg := testConfig(namedBackend(t, "a").URL)
+		cfg.Listeners = []ListenerConfig{{Address: freeAddress(t)}}
+		cfg.ClientConnectionClose = closeConns
+		lb := NewLoadBalancer(cfg)
+		startListeners(t, lb)
+
+		conn, err := net.Dial("tcp", cfg.Listeners[0].Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for i := range 2 {
+			io.WriteString(conn, "GET / HTTP/1.1\r\nHost: lb.test\r\n\r\n")
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				if closeConns && i == 1 {
+					break // closed after the first response, as configured
+				}
+				t.Fatalf("CLIENT_CONNECTION_CLOSE=%v: request %d on one connection: %v", closeConns, i+1, err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.Close != closeConns {
+				t.Errorf("CLIENT_CONNECTION_CLOSE=%v: response Connection header %q", closeConns, resp.Header.Get("Connection"))
+			}
+			if closeConns && i == 1 {
+				t.Error("CLIENT_CONNECTION_CLOSE=true: connection served a second request")
+			}
+		}
+	}
+}
+
+// viaBackend answers with the given Via headers, if any.
+func viaBackend(t *testing.T, via ...string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, v := range via {
+			w.Header().Add("Via", v)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestViaHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream []string
+		version  string
+		want     string
+	}{
+		{"absent", nil, "1.1", "1.1 go-lb/dev"},
+		{"appended", []string{"1.0 fred"}, "1.1", "1.0 fred, 1.1 go-lb/dev"},
+		{"appended to several", []string{"1.0 fred", "1.1 p.example.net"}, "1.1", "1.0 fred, 1.1 p.example.net, 1.1 go-lb/dev"},
+		{"configured version", nil, "2", "2 go-lb/dev"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig(viaBackend(t, tc.upstream...).URL)
+			cfg.ViaHeaderEnabled = true
+			cfg.ViaHeaderVersion = tc.version
+			lb := NewLoadBalancer(cfg)
+			rec := serve(lb, httptest.NewRequest("GET", "/", nil))
+			if got := rec.Header().Values("Via"); len(got) != 1 || got[0] != tc.want {
+				t.Errorf("Via = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestViaHeaderDisabled(t *testing.T) {
+	lb := NewLoadBalancer(testConfig(viaBackend(t, "1.0 fred").URL))
+	rec := serve(lb, httptest.NewRequest("GET", "/", nil))
+	if got := rec.Header().Values("Via"); len(got) != 1 || got[0] != "1.0 fred" {
+		t.Errorf("Via with VIA_HEADER_ENABLED off = %q, want the backend's untouched", got)
+	}
+
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.ViaHeaderEnabled = true
+	cfg.ViaHeaderValue = ""
+	if report := cfg.validate(); report.Valid {
+		t.Error("VIA_HEADER_ENABLED with an empty VIA_HEADER_VALUE passed validation")
+	}
+}
+
+// leveledHealthBackend answers /healthz and /readyz with 200 or 503
+// depending on the returned flags, counting probes of each.
+func leveledHealthBackend(t *testing.T) (srv *httptest.Server, shallow, deep *atomic.Bool, shallowProbes, deepProbes *atomic.Int64) {
+	t.Helper()
+	shallow, deep = &atomic.Bool{}, &atomic.Bool{}
+	shallowProbes, deepProbes = &atomic.Int64{}, &atomic.Int64{}
+	shallow.Store(true)
+	deep.Store(true)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthy := true
+		switch r.URL.Path {
+		case "/healthz":
+			shallowProbes.Add(1)
+			healthy = shallow.Load()
+		case "/readyz":
+			deepProbes.Add(1)
+			healthy = deep.Load()
+		}
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, shallow, deep, shallowProbes, deepProbes
+}
+
+func TestShallowAndDeepHealthCombinations(t *testing.T) {
+	tests := []struct {
+		shallow, deep bool
+		wantPicks     int
+	}{
+		{true, true, 50},  // in rotation and preferred
+		{true, false, 0},  // in rotation but deprioritized behind the other backend
+		{false, true, 0},  // out of rotation
+		{false, false, 0}, // out of rotation
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("shallow=%v,deep=%v", tc.shallow, tc.deep), func(t *testing.T) {
+			srv, shallow, deep, _, _ := leveledHealthBackend(t)
+			other, _, _, _, _ := leveledHealthBackend(t)
+			cfg := testConfig(srv.URL, other.URL)
+			cfg.HealthCheckPath = "/healthz"
+			cfg.DeepHealthCheckPath = "/readyz"
+			lb := NewLoadBalancer(cfg)
+			backend := lb.backends[0]
+
+			shallow.Store(tc.shallow)
+			deep.Store(tc.deep)
+			lb.healthCheck()
+			for _, b := range lb.backends {
+				lb.checkDeepHealth(b)
+			}
+
+			if got := picks(lb, 100)[srv.URL]; got != tc.wantPicks {
+				t.Errorf("backend got %d of 100 picks, want %d", got, tc.wantPicks)
+			}
+			stats := backendStats(t, lb, srv.URL)
+			if stats.Alive != tc.shallow || stats.DeepHealthy == nil || *stats.DeepHealthy != tc.deep {
+				t.Errorf("stats alive=%v deep_healthy=%v, want %v and %v", stats.Alive, stats.DeepHealthy, tc.shallow, tc.deep)
+			}
+			if tc.shallow && !tc.deep && !backend.available() {
+				t.Error("backend failing only the deep check was taken out of rotation")
+			}
+		})
+	}
+}
+
+func TestDeepHealthFailingEverywhereKeepsServing(t *testing.T) {
+	a, _, aDeep, _, _ := leveledHealthBackend(t)
+	b, _, bDeep, _, _ := leveledHealthBackend(t)
+	cfg := testConfig(a.URL, b.URL)
+	cfg.DeepHealthCheckPath = "/readyz"
+	lb := NewLoadBalancer(cfg)
+
+	aDeep.Store(false)
+	bDeep.Store(false)
+	for _, backend := range lb.backends {
+		lb.checkDeepHealth(backend)
+	}
+	if counts := picks(lb, 100); counts[a.URL] != 50 || counts[b.URL] != 50 {
+		t.Errorf("picks with every backend failing the deep check = %v, want both still used", counts)
+	}
+
+	// Without a deep path, stats leave deep_healthy out.
+	if stats := backendStats(t, NewLoadBalancer(testConfig(a.URL)), a.URL); stats.DeepHealthy != nil {
+		t.Errorf("deep_healthy = %v without DEEP_HEALTH_CHECK_PATH, want it omitted", *stats.DeepHealthy)
+	}
+}
+
+func TestDeepHealthCheckRunsOnItsOwnInterval(t *testing.T) {
+	srv, _, _, shallowProbes, deepProbes := leveledHealthBackend(t)
+	cfg := testConfig(srv.URL)
+	cfg.HealthCheckPath = "/healthz"
+	cfg.HealthCheckInterval = 50 * time.Millisecond
+	cfg.HealthCheckJitter = 0
+	cfg.DeepHealthCheckPath = "/readyz"
+	cfg.DeepHealthCheckInterval = 300 * time.Millisecond
+	lb := NewLoadBalancer(cfg)
+
+	startTestHealthChecks(t, lb)
+	time.Sleep(time.Second)
+	if got := shallowProbes.Load(); got < 15 || got > 20 {
+		t.Errorf("shallow probes every 50ms ran %d times in 1s, want about 20", got)
+	}
+	// The first deep probe runs straight away, then every 300ms.
+	if got := deepProbes.Load(); got < 3 || got > 4 {
+		t.Errorf("deep probes every 300ms ran %d times in 1s, want about 4", got)
+	}
+}
+
+// warmupBackend counts requests to /warm, answering them with the status
+// warmStatus holds once release is closed, and serves "warm" elsewhere.
+func warmupBackend(t *testing.T) (srv *httptest.Server, warmups *atomic.Int64, warmStatus *atomic.Int64, release chan struct{}) {
+	t.Helper()
+	warmups, warmStatus = &atomic.Int64{}, &atomic.Int64{}
+	warmStatus.Store(http.StatusOK)
+	release = make(chan struct{})
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/warm" {
+			warmups.Add(1)
+			<-release
+			w.WriteHeader(int(warmStatus.Load()))
+			return
+		}
+		io.WriteString(w, "warm")
+	}))
+	t.Cleanup(srv.Close)
+	return srv, warmups, warmStatus, release
+}
+
+func TestWarmupBeforeRealTraffic(t *testing.T) {
+	srv, warmups, _, release := warmupBackend(t)
+	other := namedBackend(t, "other")
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: srv.URL, WarmupRequestCount: 3, WarmupRequestPath: "warm"}, {URL: other.URL}}
+	lb := NewLoadBalancer(cfg)
+	backend := lb.backends[0]
+	backend.SetAlive(false)
+
+	done := make(chan bool)
+	go func() { done <- lb.checkBackend(backend) }()
+	if !waitFor(func() bool { return warmups.Load() == 1 }) {
+		t.Fatal("no warmup request sent when the backend recovered")
+	}
+	if counts := picks(lb, 10); counts[srv.URL] != 0 {
+		t.Errorf("backend got %d picks while warming up", counts[srv.URL])
+	}
+	if body := serve(lb, httptest.NewRequest("GET", "/", nil)).Body.String(); body != "other" {
+		t.Errorf("request during warmup answered %q, want the other backend", body)
+	}
+
+	close(release)
+	if !<-done {
+		t.Fatal("backend not up after a successful warmup")
+	}
+	if got := warmups.Load(); got != 3 {
+		t.Errorf("%d warmup requests, want 3", got)
+	}
+	if counts := picks(lb, 10); counts[srv.URL] != 5 {
+		t.Errorf("backend got %d of 10 picks after warmup, want 5", counts[srv.URL])
+	}
+
+	// Checks of a backend that is already up don't warm it again.
+	lb.checkBackend(backend)
+	if got := warmups.Load(); got != 3 {
+		t.Errorf("%d warmup requests after a check of a live backend, want still 3", got)
+	}
+}
+
+func TestFailedWarmupKeepsBackendDown(t *testing.T) {
+	srv, warmups, warmStatus, release := warmupBackend(t)
+	close(release)
+	warmStatus.Store(http.StatusInternalServerError)
+	cfg := testConfig()
+	cfg.MetricsEnabled = true
+	cfg.Backends = []BackendConfig{{URL: srv.URL, WarmupRequestCount: 3, WarmupRequestPath: "/warm"}}
+	lb := NewLoadBalancer(cfg)
+	backend := lb.backends[0]
+	backend.SetAlive(false)
+
+	if lb.checkBackend(backend) || backend.IsAlive() {
+		t.Fatal("backend came up though its warmup failed")
+	}
+	if got := warmups.Load(); got != 1 {
+		t.Errorf("%d warmup requests, want the first failure to stop it", got)
+	}
+	series := `lb_backend_state_changes_total{backend="` + srv.URL + `",change="down_to_up"}`
+	if got, ok := scrapeMetrics(t, lb)[series]; ok && got != "0" {
+		t.Errorf("%s = %s after a failed warmup", series, got)
+	}
+
+	warmStatus.Store(http.StatusOK)
+	if !lb.checkBackend(backend) {
+		t.Error("backend still down after a successful warmup")
+	}
+}
+
+func TestRemovingAllBackendsDuringRequests(t *testing.T) {
+	cfg := testConfig()
+	for i := range 5 {
+		srv, _ := sleepyBackend(t, fmt.Sprint(i), time.Millisecond)
+		cfg.Backends = append(cfg.Backends, BackendConfig{URL: srv.URL})
+	}
+	cfg.MaxRetries = 1
+	lb := NewLoadBalancer(cfg)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var statuses sync.Map
+	for range 8 {
+		wg.Go(func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rec := serve(lb, httptest.NewRequest("GET", "/", nil))
+				statuses.Store(rec.Code, true)
+				lb.getNextBackend(httptest.NewRequest("GET", "/", nil))
+			}
+		})
+	}
+	time.Sleep(20 * time.Millisecond)
+	for _, backend := range cfg.Backends {
+		if _, err := lb.RemoveBackend(backend.URL); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	statuses.Range(func(code, _ any) bool {
+		if code != http.StatusOK && code != http.StatusServiceUnavailable && code != http.StatusBadGateway {
+			t.Errorf("unexpected status %v while backends were removed", code)
+		}
+		return true
+	})
+	if backend := lb.getNextBackend(httptest.NewRequest("GET", "/", nil)); backend != nil {
+		t.Errorf("getNextBackend with no backends = %s, want nil", backend.URL)
+	}
+	if rec := serve(lb, httptest.NewRequest("GET", "/", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("request with no backends got %d, want 503", rec.Code)
+	}
+	if lb.current != 0 {
+		t.Errorf("cursor = %d with no backends, want 0", lb.current)
+	}
+}
+
+func TestRemoveBackendKeepsRotationCursor(t *testing.T) {
+	next := func(lb *LoadBalancer) string {
+		return lb.getNextBackend(httptest.NewRequest("GET", "/", nil)).URL
+	}
+	a, b, c := "http://127.0.0.1:9001", "http://127.0.0.1:9002", "http://127.0.0.1:9003"
+
+	// Removing a backend before the cursor doesn't skip the next one.
+	lb := NewLoadBalancer(testConfig(a, b, c))
+	next(lb)
+	lb.RemoveBackend(a)
+	if got := next(lb); got != b {
+		t.Errorf("after removing the backend just used, next = %s, want %s", got, b)
+	}
+
+	// Removing the backend under the cursor at the end wraps around.
+	lb = NewLoadBalancer(testConfig(a, b, c))
+	next(lb)
+	next(lb)
+	lb.RemoveBackend(c)
+	if lb.current != 0 {
+		t.Errorf("cursor = %d after removing the last backend, want 0", lb.current)
+	}
+	if got := next(lb); got != a {
+		t.Errorf("after removing the backend under the cursor, next = %s, want %s", got, a)
+	}
+}
+
+func connectionStats(t *testing.T, lb *LoadBalancer, backendURL string) ConnectionStats {
+	t.Helper()
+	rec := serve(lb, adminRequest(lb, "GET", "/admin/backends/"+url.PathEscape(backendURL)+"/connections", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("connections endpoint returned %d: %s", rec.Code, rec.Body)
+	}
+	var stats ConnectionStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestConnectionPoolStatsEndpoint(t *testing.T) {
+	srv, release, running, _ := blockingProbeBackend(t)
+	cfg := testConfig()
+	cfg.AdminToken = "secret"
+	cfg.Backends = []BackendConfig{{URL: srv.URL, MaxIdleConnsPerHost: 7}}
+	lb := NewLoadBalancer(cfg)
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Go(func() { serve(lb, httptest.NewRequest("GET", "/", nil)) })
+	}
+	if !waitFor(func() bool { return running.Load() == 3 }) {
+		t.Fatalf("%d of 3 requests reached the backend", running.Load())
+	}
+	stats := connectionStats(t, lb, srv.URL)
+	if stats.Backend != srv.URL || stats.ActiveConns != 3 || stats.WaitCount != 0 {
+		t.Errorf("stats during 3 requests = %+v, want 3 active and none waiting", stats)
+	}
+	if stats.IdleConnsPerHost == nil || *stats.IdleConnsPerHost != 7 {
+		t.Errorf("idle_conns_per_host = %v, want the configured 7", stats.IdleConnsPerHost)
+	}
+	if stats.MaxConnsPerHost == nil || *stats.MaxConnsPerHost != 0 {
+		t.Errorf("max_conns_per_host = %v, want 0 for no limit", stats.MaxConnsPerHost)
+	}
+
+	close(release)
+	wg.Wait()
+	stats = connectionStats(t, lb, srv.URL)
+	if stats.ActiveConns != 0 || stats.IdleConns != 3 {
+		t.Errorf("stats after the requests = %+v, want 3 idle and none active", stats)
+	}
+
+	rec := serve(lb, adminRequest(lb, "GET", "/admin/backends/"+url.PathEscape("http://127.0.0.1:1")+"/connections", ""))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("connections of an unknown backend returned %d, want 404", rec.Code)
+	}
+}
+
+func TestDeregisterOnRepeatedDNSFailures(t *testing.T) {
+	nxdomain := &net.DNSError{Err: "no such host", Name: "api.internal", IsNotFound: true}
+	resolver := &fakeResolver{err: nxdomain}
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{
+		{URL: "http://api.internal:8080", DeregisterOnDNSFailureCount: 3},
+		{URL: "http://127.0.0.1:9001", DeregisterOnDNSFailureCount: 3},
+	}
+	lb := NewLoadBalancerWithOptions(cfg, LoadBalancerOptions{Resolver: resolver})
+	named, literal := lb.backends[0], lb.backends[1]
+
+	for cycle := 1; cycle <= 2; cycle++ {
+		if lb.checkBackendDNS(named) {
+			t.Fatalf("backend removed after %d failed lookups, want 3", cycle)
+		}
+	}
+	// A successful lookup starts the count over.
+	resolver.set(nil, "10.0.0.1")
+	lb.checkBackendDNS(named)
+	resolver.set(nxdomain)
+	for cycle := 1; cycle <= 2; cycle++ {
+		lb.checkBackendDNS(named)
+	}
+	if len(lb.getBackends()) != 2 {
+		t.Fatal("backend removed though a lookup in between succeeded")
+	}
+	if !lb.checkBackendDNS(named) {
+		t.Fatal("backend not removed after 3 failed lookups in a row")
+	}
+	if slices.Contains(lb.getBackends(), named) || !named.removed.Load() {
+		t.Error("deregistered backend is still in lb.backends")
+	}
+
+	// IP literals have no name to lose.
+	lookups := resolver.lookups
+	if lb.checkBackendDNS(literal) || resolver.lookups != lookups {
+		t.Error("backend addressed by IP was looked up")
+	}
+}
+
+func TestDNSDeregistrationIgnoresOtherErrors(t *testing.T) {
+	resolver := &fakeResolver{err: &net.DNSError{Err: "i/o timeout", Name: "api.internal", IsTimeout: true}}
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{
+		{URL: "http://api.internal:8080", DeregisterOnDNSFailureCount: 1},
+		{URL: "http://other.internal:8080"},
+	}
+	lb := NewLoadBalancerWithOptions(cfg, LoadBalancerOptions{Resolver: resolver})
+
+	for range 3 {
+		if lb.checkBackendDNS(lb.backends[0]) {
+			t.Fatal("backend removed for lookups that timed out")
+		}
+	}
+	resolver.set(&net.DNSError{Err: "no such host", IsNotFound: true})
+	lookups := resolver.lookups
+	if lb.checkBackendDNS(lb.backends[1]) || resolver.lookups != lookups {
+		t.Error("backend without deregister_on_dns_failure_count was looked up")
+	}
+}
+
+// protoBackend reports the protocol, framing and body of each request.
+func protoBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %v %d %s", r.Proto, r.TransferEncoding, r.ContentLength, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHTTP10Downgrade(t *testing.T) {
+	srv := protoBackend(t)
+	tests := []struct {
+		transport string
+		want      string
+	}{
+		{"http1.0", "HTTP/1.0 [] 5 hello"},
+		{"", "HTTP/1.1 [chunked] -1 hello"},
+	}
+	for _, tc := range tests {
+		cfg := testConfig()
+		cfg.Backends = []BackendConfig{{URL: srv.URL, Transport: tc.transport}}
+		lb := NewLoadBalancer(cfg)
+
+		// A body of unknown length would be sent chunked over HTTP/1.1.
+		req := httptest.NewRequest("POST", "/upload", io.NopCloser(strings.NewReader("hello")))
+		req.ContentLength = -1
+		rec := serve(lb, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != tc.want {
+			t.Errorf("transport %q: backend saw %q (status %d), want %q", tc.transport, rec.Body, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestHTTP10DowngradeGet(t *testing.T) {
+	srv := protoBackend(t)
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: srv.URL, Transport: "http1.0"}}
+	lb := NewLoadBalancer(cfg)
+
+	// HTTP/1.0 connections aren't kept alive, so each request dials anew.
+	for range 2 {
+		rec := serve(lb, httptest.NewRequest("GET", "/page?x=1", nil))
+		if got := rec.Body.String(); got != "HTTP/1.0 [] 0 " {
+			t.Errorf("GET over HTTP/1.0: backend saw %q, want an HTTP/1.0 request without a body", got)
+		}
+	}
+}
+
+func TestHTTP10ClosesConnections(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Proto, r.Header.Get("Connection"))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: srv.URL, Transport: "http1.0"}}
+	lb := NewLoadBalancer(cfg)
+
+	for range 3 {
+		if got := serve(lb, httptest.NewRequest("GET", "/", nil)).Body.String(); got != "HTTP/1.0 close" {
+			t.Errorf("backend saw %q, want an HTTP/1.0 request with Connection: close", got)
+		}
+	}
+	if n := conns.Load(); n != 3 {
+		t.Errorf("3 requests used %d connections, want one each", n)
+	}
+}
+
+func TestHTTP10RejectsOversizedStreamedBody(t *testing.T) {
+	srv := protoBackend(t)
+	var hits atomic.Int32
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(counting.Close)
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: counting.URL, Transport: "http1.0"}}
+	lb := NewLoadBalancer(cfg)
+
+	req := httptest.NewRequest("POST", "/upload", io.NopCloser(io.LimitReader(zeroReader{}, maxHTTP10RequestBody+1)))
+	req.ContentLength = -1
+	if rec := serve(lb, req); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("streamed body over the cap got %d, want 413", rec.Code)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("backend got %d requests, want the oversized one rejected before sending", n)
+	}
+
+	// A body of known length isn't buffered, so the cap doesn't apply.
+	big := strings.Repeat("x", maxHTTP10RequestBody+1)
+	rec := serve(lb, httptest.NewRequest("POST", "/upload", strings.NewReader(big)))
+	if want := fmt.Sprintf("HTTP/1.0 [] %d %s", len(big), big); rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("body with a Content-Length got %d, want it forwarded unchanged", rec.Code)
+	}
+}
+
+// zeroReader reads endless zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestHTTP10TLSSettings(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeTestCert(t, dir)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %d", r.Proto, len(r.TLS.PeerCertificates))
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name       string
+		backend    BackendConfig
+		wantStatus int
+		wantBody   string
+	}{
+		{"untrusted CA", BackendConfig{URL: srv.URL, Transport: "http1.0"}, http.StatusBadGateway, ""},
+		{"CA bundle", BackendConfig{URL: srv.URL, Transport: "http1.0", TLSCACert: certFile}, http.StatusOK, "HTTP/1.0 0"},
+		{"client certificate", BackendConfig{URL: srv.URL, Transport: "http1.0", TLSCACert: certFile, TLSClientCert: certFile, TLSClientKey: keyFile},
+			http.StatusOK, "HTTP/1.0 1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			captureLog(t)
+			cfg := testConfig()
+			cfg.Backends = []BackendConfig{tc.backend}
+			lb := NewLoadBalancer(cfg)
+			rec := serve(lb, httptest.NewRequest("GET", "/", nil))
+			if rec.Code != tc.wantStatus || tc.wantBody != "" && rec.Body.String() != tc.wantBody {
+				t.Errorf("got %d %q, want %d %q", rec.Code, rec.Body, tc.wantStatus, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestIdlePoolTakesOverflow(t *testing.T) {
+	active, release, running, _ := blockingProbeBackend(t)
+	idle, idleHits := sleepyBackend(t, "idle", 0)
+	cfg := testConfig()
+	cfg.IdlePool = "reserve"
+	cfg.Backends = []BackendConfig{
+		{URL: active.URL, MaxConcurrentRequests: 2},
+		{URL: idle.URL, Pool: "reserve"},
+	}
+	lb := NewLoadBalancer(cfg)
+
+	if counts := picks(lb, 10); counts[idle.URL] != 0 {
+		t.Fatalf("idle pool got %d picks while the active pool had room", counts[idle.URL])
+	}
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Go(func() { serve(lb, httptest.NewRequest("GET", "/", nil)) })
+	}
+	if !waitFor(func() bool { return running.Load() == 2 }) {
+		t.Fatalf("%d of 2 requests reached the active backend", running.Load())
+	}
+	for range 3 {
+		if body := serve(lb, httptest.NewRequest("GET", "/", nil)).Body.String(); body != "idle" {
+			t.Errorf("request with the active pool saturated answered %q, want the idle pool", body)
+		}
+	}
+
+	close(release)
+	wg.Wait()
+	before := idleHits.Load()
+	if rec := serve(lb, httptest.NewRequest("GET", "/", nil)); rec.Code != http.StatusOK || idleHits.Load() != before {
+		t.Errorf("request once the active pool had room again went to the idle pool")
+	}
+}
+
+func TestIdlePoolWhenActivePoolDown(t *testing.T) {
+	cfg := testConfig()
+	cfg.IdlePool = "reserve"
+	cfg.Backends = []BackendConfig{
+		{URL: namedBackend(t, "active").URL},
+		{URL: namedBackend(t, "idle").URL, Pool: "reserve"},
+	}
+	lb := NewLoadBalancer(cfg)
+
+	lb.backends[0].SetAlive(false)
+	if body := serve(lb, httptest.NewRequest("GET", "/", nil)).Body.String(); body != "idle" {
+		t.Errorf("request with the active pool down answered %q, want the idle pool", body)
+	}
+
+	cfg = testConfig("http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.IdlePool = cfg.DefaultPool
+	if report := cfg.validate(); report.Valid {
+		t.Error("IDLE_POOL equal to DEFAULT_POOL passed validation")
+	}
+}
+
+func TestRequestDistributionPerInterval(t *testing.T) {
+	a, b, c := namedBackend(t, "a"), namedBackend(t, "b"), namedBackend(t, "c")
+	cfg := testConfig(a.URL, b.URL, c.URL)
+	cfg.MetricsEnabled = true
+	lb := NewLoadBalancer(cfg)
+
+	for range 10 {
+		serve(lb, httptest.NewRequest("GET", "/", nil))
+	}
+	shares, total := lb.requestDistribution()
+	sum := 0.0
+	for _, share := range shares {
+		sum += share.Percent
+	}
+	if total != 10 || math.Abs(sum-100) > 1e-9 {
+		t.Errorf("distribution of 10 requests = %+v (total %d), want percentages summing to 100", shares, total)
+	}
+	if shares[0].Requests != 4 || shares[1].Requests != 3 || shares[2].Requests != 3 {
+		t.Errorf("round robin over 3 backends = %+v, want 4/3/3", shares)
+	}
+
+	// The next interval counts only its own requests.
+	lb.backends[0].SetAlive(false)
+	for range 4 {
+		serve(lb, httptest.NewRequest("GET", "/", nil))
+	}
+	logs := captureLog(t)
+	lb.getStats()
+	if !strings.Contains(logs.String(), "(4 requests): "+a.URL+" 0.0% (0), "+b.URL+" 50.0% (2), "+c.URL+" 50.0% (2)") {
+		t.Errorf("stats tick logged:\n%s\nwant the last interval's 4 requests", logs)
+	}
+	samples := scrapeMetrics(t, lb)
+	if got := samples[`lb_backend_request_share_percent{backend="`+b.URL+`"}`]; got != "50" {
+		t.Errorf("request share gauge for %s = %q, want 50", b.URL, got)
+	}
+	if got := samples[`lb_backend_interval_requests{backend="`+a.URL+`"}`]; got != "0" {
+		t.Errorf("interval requests gauge for the down backend = %q, want 0", got)
+	}
+
+	lb.getStats()
+	if !strings.Contains(logs.String(), "no requests") {
+		t.Errorf("stats tick with no requests logged:\n%s", logs)
+	}
+}
+
+// directorTraces returns the director trace lines logged, before and after.
+func directorTraces(logs *logBuffer) (before, after []string) {
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if _, rest, ok := strings.Cut(line, "Director before: "); ok {
+			before = append(before, rest)
+		} else if _, rest, ok := strings.Cut(line, "Director after: "); ok {
+			after = append(after, rest)
+		}
+	}
+	return before, after
+}
+
+func TestTraceProxyDirector(t *testing.T) {
+	srv := namedBackend(t, "a")
+	cfg := testConfig()
+	cfg.TraceProxyDirector = true
+	cfg.Backends = []BackendConfig{{URL: srv.URL + "/api/", ForwardedPath: "/v2${path}"}}
+	lb := NewLoadBalancer(cfg)
+	logs := captureLog(t)
+
+	req := httptest.NewRequest("POST", "/orders?id=7", strings.NewReader("payload"))
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set("Cookie", "session=abc")
+	req.Header.Set("X-Custom", "kept")
+	if rec := serve(lb, req); rec.Code != http.StatusOK || rec.Body.String() != "a" {
+		t.Fatalf("traced request got %d %q", rec.Code, rec.Body)
+	}
+
+	before, after := directorTraces(logs)
+	if len(before) != 1 || len(after) != 1 {
+		t.Fatalf("director traces before %q after %q, want one of each", before, after)
+	}
+	if !strings.HasPrefix(before[0], "POST /orders?id=7 ") {
+		t.Errorf("trace before the director = %q, want the incoming URL", before[0])
+	}
+	if !strings.HasPrefix(after[0], "POST "+srv.URL+"/api/v2/orders?id=7 ") {
+		t.Errorf("trace after the director = %q, want the rewritten backend URL", after[0])
+	}
+	digest := fmt.Sprintf("body=sha256:%x (7 bytes)", sha256.Sum256([]byte("payload")))
+	for _, line := range append(before, after...) {
+		if !strings.Contains(line, digest) {
+			t.Errorf("trace %q has no body digest %q", line, digest)
+		}
+		if strings.Contains(line, "secret-token") || strings.Contains(line, "session=abc") {
+			t.Errorf("trace %q leaks a sensitive header", line)
+		}
+		if !strings.Contains(line, "Authorization: [REDACTED]") || !strings.Contains(line, "X-Custom: kept") {
+			t.Errorf("trace %q should redact Authorization and keep other headers", line)
+		}
+	}
+}
+
+func TestTraceProxyDirectorSensitiveHeadersAndDisabled(t *testing.T) {
+	srv := namedBackend(t, "a")
+	cfg := testConfig(srv.URL)
+	cfg.TraceProxyDirector = true
+	cfg.TraceSensitiveHeaders = true
+	lb := NewLoadBalancer(cfg)
+	logs := captureLog(t)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	serve(lb, req)
+	if before, _ := directorTraces(logs); len(before) != 1 || !strings.Contains(before[0], "Authorization: Bearer secret-token") {
+		t.Errorf("trace with TRACE_SENSITIVE_HEADERS = %q, want the Authorization value", before)
+	}
+
+	lb = NewLoadBalancer(testConfig(srv.URL))
+	logs = captureLog(t)
+	serve(lb, httptest.NewRequest("GET", "/", nil))
+	if before, after := directorTraces(logs); len(before)+len(after) != 0 {
+		t.Errorf("director traced without TRACE_PROXY_DIRECTOR: %q %q", before, after)
+	}
+}
+
+// grpcHealthServer is a stub grpc.health.v1.Health service over h2c. It
+// answers Check with the status statuses holds for the requested service,
+// and with grpc-status NOT_FOUND for services it doesn't know.
+func grpcHealthServer(t *testing.T, statuses map[string]uint64) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != "/grpc.health.v1.Health/Check" || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, "not a gRPC health check", http.StatusBadRequest)
+			return
+		}
+		frame, _ := io.ReadAll(r.Body)
+		var service string
+		if len(frame) > 5 && frame[5] == 0x0a {
+			size, n := binary.Uvarint(frame[6:])
+			service = string(frame[6+n : 6+n+int(size)])
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		status, ok := statuses[service]
+		if !ok {
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "unknown service "+service)
+			return
+		}
+		msg := []byte{}
+		if status != 0 {
+			msg = binary.AppendUvarint([]byte{0x08}, status)
+		}
+		w.Write(append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg))), msg...))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	srv := grpcHealthServer(t, map[string]uint64{"": 1, "orders": 1, "billing": 2, "search": 0})
+	tests := []struct {
+		service string
+		wantErr string
+	}{
+		{"", ""},
+		{"orders", ""},
+		{"billing", "NOT_SERVING"},
+		{"search", "UNKNOWN"},
+		{"inventory", `grpc-status "5": unknown service inventory`},
+	}
+	for _, tc := range tests {
+		cfg := testConfig()
+		cfg.HealthCheckType = "grpc"
+		cfg.HealthCheckGRPCService = tc.service
+		cfg.Backends = []BackendConfig{{URL: srv.URL}}
+		lb := NewLoadBalancer(cfg)
+		backend := lb.backends[0]
+
+		err := cfg.probeBackend(backend)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("service %q: probe failed: %v", tc.service, err)
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("service %q: probe error = %v, want one mentioning %s", tc.service, err, tc.wantErr)
+		}
+		if alive := lb.checkBackend(backend); alive != (tc.wantErr == "") {
+			t.Errorf("service %q: alive = %v after a health check", tc.service, alive)
+		}
+	}
+}
+
+func TestGRPCHealthCheckPerBackendService(t *testing.T) {
+	srv := grpcHealthServer(t, map[string]uint64{"orders": 1, "billing": 2})
+	cfg := testConfig()
+	cfg.HealthCheckType = "grpc"
+	cfg.HealthCheckGRPCService = "orders"
+	// The same stub serves both backends, under two spellings of its URL.
+	cfg.Backends = []BackendConfig{{URL: srv.URL}, {URL: srv.URL + "/", HealthCheckGRPCService: "billing"}}
+	lb := NewLoadBalancer(cfg)
+
+	lb.healthCheck()
+	if !lb.backends[0].IsAlive() || lb.backends[1].IsAlive() {
+		t.Errorf("alive = %v/%v, want the orders backend up and the billing one down",
+			lb.backends[0].IsAlive(), lb.backends[1].IsAlive())
+	}
+}
+
+func TestParseGRPCHealthResponse(t *testing.T) {
+	frame := func(msg ...byte) []byte {
+		return append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg))), msg...)
+	}
+	// An unknown length-delimited field 2 before the status is skipped.
+	if status, err := parseGRPCHealthResponse(frame(0x12, 0x02, 'h', 'i', 0x08, 0x01)); err != nil || status != 1 {
+		t.Errorf("status = %d, %v; want SERVING after skipping an unknown field", status, err)
+	}
+	for name, body := range map[string][]byte{
+		"too short":  {0, 0},
+		"compressed": append([]byte{1}, frame(0x08, 0x01)[1:]...),
+		"truncated":  frame(0x08, 0x01)[:6],
+		"wire type":  frame(0x0d, 0, 0, 0, 0),
+	} {
+		if _, err := parseGRPCHealthResponse(body); err == nil {
+			t.Errorf("%s response parsed without an error", name)
+		}
+	}
+}
+
+// bigHeaderBackend answers with n bytes of X-Filler header values.
+func bigHeaderBackend(t *testing.T, n int) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		for i := 0; i < n; i += 1000 {
+			w.Header().Add("X-Filler", strings.Repeat("x", 1000))
+		}
+		io.WriteString(w, "big")
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	tests := []struct {
+		name       string
+		global     int64
+		backendCfg func(url string) BackendConfig
+		wantStatus int
+	}{
+		{"transport limit", 4096, func(url string) BackendConfig { return BackendConfig{URL: url} }, http.StatusBadGateway},
+		{"http1.0 transport", 4096, func(url string) BackendConfig { return BackendConfig{URL: url, Transport: "http1.0"} }, http.StatusBadGateway},
+		{"backend override", 0, func(url string) BackendConfig { return BackendConfig{URL: url, MaxResponseHeaderBytes: 4096} }, http.StatusBadGateway},
+		{"no limit", 0, func(url string) BackendConfig { return BackendConfig{URL: url} }, http.StatusOK},
+		{"backend raises limit", 4096, func(url string) BackendConfig { return BackendConfig{URL: url, MaxResponseHeaderBytes: 64 << 10} }, http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			big, hits := bigHeaderBackend(t, 10<<10)
+			cfg := testConfig()
+			cfg.MaxRetries = 2
+			cfg.MaxResponseHeaderBytes = tc.global
+			cfg.Backends = []BackendConfig{tc.backendCfg(big.URL)}
+			lb := NewLoadBalancer(cfg)
+			logs := captureLog(t)
+
+			rec := serve(lb, httptest.NewRequest("GET", "/", nil))
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("response with 10KB of headers got %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if tc.wantStatus == http.StatusOK {
+				return
+			}
+			if len(rec.Header().Values("X-Filler")) != 0 {
+				t.Error("rejected response's headers reached the client")
+			}
+			if hits.Load() != 1 {
+				t.Errorf("backend hit %d times, want oversized headers not retried", hits.Load())
+			}
+			if !strings.Contains(logs.String(), big.URL) {
+				t.Errorf("log doesn't name the backend %s:\n%s", big.URL, logs)
+			}
+		})
+	}
+}
+
+func TestValidateMaxResponseHeaderBytes(t *testing.T) {
+	cfg := testConfig()
+	cfg.Port = "8080"
+	cfg.MaxResponseHeaderBytes = -1
+	cfg.Backends = []BackendConfig{{URL: "http://127.0.0.1:9001", MaxResponseHeaderBytes: -1}}
+	report := cfg.validate()
+	if len(report.Errors) != 2 {
+		t.Errorf("errors = %v, want the global and backend limits rejected", report.Errors)
+	}
+}
+
+func TestSharedTransportMode(t *testing.T) {
+	cfg := testConfig()
+	cfg.TransportMode = "shared"
+	cfg.Backends = []BackendConfig{
+		{URL: "http://127.0.0.1:9001", ResponseHeaderTimeout: time.Second},
+		{URL: "http://127.0.0.1:9002", ResponseHeaderTimeout: time.Second},
+		{URL: "http://127.0.0.1:9003", ResponseHeaderTimeout: 2 * time.Second},
+	}
+	lb := NewLoadBalancer(cfg)
+	a, b, c := lb.backends[0].pool.limits, lb.backends[1].pool.limits, lb.backends[2].pool.limits
+	if a == nil || a != b {
+		t.Error("backends with the same transport settings don't share a transport")
+	}
+	if c == a || c.ResponseHeaderTimeout != 2*time.Second {
+		t.Error("backend with its own response_header_timeout shares another backend's transport")
+	}
+}
+
+func TestIsolatedTransportMode(t *testing.T) {
+	slow, _ := sleepyBackend(t, "slow", 100*time.Millisecond)
+	cfg := testConfig()
+	cfg.TransportMode = "isolated"
+	cfg.MaxRetries = 0
+	cfg.Backends = []BackendConfig{
+		{URL: slow.URL, ResponseHeaderTimeout: 30 * time.Millisecond},
+		{URL: slow.URL + "/", IdleConnTimeout: time.Minute, MaxIdleConnsPerHost: 3},
+	}
+	lb := NewLoadBalancer(cfg)
+	first, second := lb.backends[0].pool.limits, lb.backends[1].pool.limits
+	if first == nil || second == nil || first == second {
+		t.Fatal("isolated backends don't each have a transport of their own")
+	}
+	if first == http.DefaultTransport || second == http.DefaultTransport {
+		t.Error("isolated backend uses http.DefaultTransport")
+	}
+	if second.IdleConnTimeout != time.Minute || second.MaxIdleConnsPerHost != 3 || second.ResponseHeaderTimeout != 0 {
+		t.Errorf("second transport = idle timeout %v, max idle %d, header timeout %v; want only its own settings",
+			second.IdleConnTimeout, second.MaxIdleConnsPerHost, second.ResponseHeaderTimeout)
+	}
+
+	// Only the backend with a response header timeout gives up on the slow
+	// answer.
+	if rec := serve(lb, httptest.NewRequest("GET", "/", nil)); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("backend with a 30ms response_header_timeout answered %d, want 504", rec.Code)
+	}
+	if rec := serve(lb, httptest.NewRequest("GET", "/", nil)); rec.Code != http.StatusOK {
+		t.Errorf("backend without a response_header_timeout answered %d", rec.Code)
+	}
+
+	cfg = testConfig("http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.TransportMode = "pooled"
+	if report := cfg.validate(); report.Valid {
+		t.Error("TRANSPORT_MODE=pooled passed validation")
+	}
+}
+
+func TestHopByHopHeadersStrippedFromResponses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Custom-Hop-By-Hop, Keep-Alive")
+		w.Header().Set("X-Custom-Hop-By-Hop", "secret")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Kept", "end-to-end")
+	}))
+	t.Cleanup(srv.Close)
+	cfg := testConfig(srv.URL)
+	cfg.StripHopByHopHeaders = true
+	lb := NewLoadBalancer(cfg)
+
+	rec := serve(lb, httptest.NewRequest("GET", "/", nil))
+	for _, name := range []string{"Connection", "X-Custom-Hop-By-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+		if got := rec.Header().Get(name); got != "" {
+			t.Errorf("hop-by-hop header %s = %q reached the client", name, got)
+		}
+	}
+	if got := rec.Header().Get("X-Kept"); got != "end-to-end" {
+		t.Errorf("X-Kept = %q, want end-to-end headers kept", got)
+	}
+}
+
+func TestStripHopByHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":     {"X-One, x-two", " X-Three "},
+		"X-One":          {"1"},
+		"X-Two":          {"2"},
+		"X-Three":        {"3"},
+		"Te":             {"trailers"},
+		"Upgrade":        {"websocket"},
+		"Content-Type":   {"text/plain"},
+		"Content-Length": {"12"},
+	}
+	stripHopByHopHeaders(h)
+	want := http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"12"}}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("headers after stripping = %v, want %v", h, want)
+	}
+}
+
+func TestModifyResponseHopByHopSetting(t *testing.T) {
+	tests := []struct {
+		name        string
+		strip       bool
+		status      int
+		wantUpgrade bool
+	}{
+		{"stripped", true, http.StatusOK, false},
+		{"protocol switch keeps Upgrade", true, http.StatusSwitchingProtocols, true},
+		{"disabled", false, http.StatusOK, true},
+	}
+	for _, tc := range tests {
+		cfg := testConfig("http://127.0.0.1:9001")
+		cfg.StripHopByHopHeaders = tc.strip
+		lb := NewLoadBalancer(cfg)
+		resp := &http.Response{
+			StatusCode: tc.status,
+			Header:     http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}},
+			Request:    httptest.NewRequest("GET", "/", nil),
+		}
+		if err := lb.modifyResponse(lb.backends[0])(resp); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := resp.Header.Get("Upgrade") != ""; got != tc.wantUpgrade {
+			t.Errorf("%s: Upgrade kept = %v, want %v", tc.name, got, tc.wantUpgrade)
+		}
+	}
+}
+
+// queuedLen reports how many requests wait in class's queue.
+func queuedLen(l *priorityLimiter, class int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queues[class])
+}
+
+func TestHighPriorityServedFirstUnderSaturation(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		order = append(order, r.Header.Get("X-Name"))
+		mu.Unlock()
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	cfg := testConfig(srv.URL)
+	cfg.ConcurrencyLimit = 1
+	lb := NewLoadBalancer(cfg)
+
+	var wg sync.WaitGroup
+	send := func(name, priority string) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Name", name)
+		if priority != "" {
+			req.Header.Set("X-Priority", priority)
+		}
+		wg.Go(func() {
+			if rec := serve(lb, req); rec.Code != http.StatusOK {
+				t.Errorf("%s got %d", name, rec.Code)
+			}
+		})
+	}
+	send("first", "")
+	if !waitFor(func() bool { mu.Lock(); defer mu.Unlock(); return len(order) == 1 }) {
+		t.Fatal("first request never reached the backend")
+	}
+	// Queue two normal requests, then a high-priority one behind them.
+	send("normal-1", "")
+	waitFor(func() bool { return queuedLen(lb.limiter, priorityNormal) == 1 })
+	send("normal-2", "low")
+	waitFor(func() bool { return queuedLen(lb.limiter, priorityNormal) == 2 })
+	send("urgent", "high")
+	if !waitFor(func() bool { return queuedLen(lb.limiter, priorityHigh) == 1 }) {
+		t.Fatal("high-priority request was not queued")
+	}
+
+	close(release)
+	wg.Wait()
+	want := []string{"first", "urgent", "normal-1", "normal-2"}
+	if !slices.Equal(order, want) {
+		t.Errorf("backend served %v, want %v", order, want)
+	}
+}
+
+func TestPriorityQueueBounds(t *testing.T) {
+	srv, release, running, _ := blockingProbeBackend(t)
+	cfg := testConfig(srv.URL)
+	cfg.ConcurrencyLimit = 1
+	cfg.NormalPriorityQueueSize = 1
+	cfg.HighPriorityQueueSize = 1
+	cfg.ConcurrencyQueueTimeout = time.Second
+	cfg.MetricsEnabled = true
+	lb := NewLoadBalancer(cfg)
+
+	var wg sync.WaitGroup
+	wg.Go(func() { serve(lb, httptest.NewRequest("GET", "/", nil)) })
+	waitFor(func() bool { return running.Load() == 1 })
+	wg.Go(func() { serve(lb, httptest.NewRequest("GET", "/", nil)) })
+	waitFor(func() bool { return queuedLen(lb.limiter, priorityNormal) == 1 })
+
+	// The normal queue is full, but the high-priority one has room.
+	rec := serve(lb, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("normal request over the queue size got %d (Retry-After %q), want 503", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	high := httptest.NewRequest("GET", "/", nil)
+	high.Header.Set("X-Priority", "high")
+	wg.Go(func() { serve(lb, high) })
+	if !waitFor(func() bool { return queuedLen(lb.limiter, priorityHigh) == 1 }) {
+		t.Error("high-priority request not queued while the normal queue was full")
+	}
+	samples := scrapeMetrics(t, lb)
+	if got := samples[`lb_concurrency_rejections_total{class="normal",reason="queue_full"}`]; got != "1" {
+		t.Errorf("normal queue_full rejections = %q, want 1", got)
+	}
+
+	close(release)
+	wg.Wait()
+}
+
+func TestPriorityQueueTimeout(t *testing.T) {
+	srv, _, running, _ := blockingProbeBackend(t)
+	cfg := testConfig(srv.URL)
+	cfg.ConcurrencyLimit = 1
+	cfg.ConcurrencyQueueTimeout = 30 * time.Millisecond
+	lb := NewLoadBalancer(cfg)
+
+	go serve(lb, httptest.NewRequest("GET", "/", nil))
+	waitFor(func() bool { return running.Load() == 1 })
+	start := time.Now()
+	if rec := serve(lb, httptest.NewRequest("GET", "/", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("request waiting past CONCURRENCY_QUEUE_TIMEOUT got %d, want 503", rec.Code)
+	}
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("request waited %v with a 30ms queue timeout", waited)
+	}
+	if n := queuedLen(lb.limiter, priorityNormal); n != 0 {
+		t.Errorf("%d requests left in the queue after timing out", n)
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	tests := []struct {
+		location, public, want string
+	}{
+		{"http://internal-backend:8080/new-path?a=1#top", "http://lb.example.com", "http://lb.example.com/new-path?a=1#top"},
+		{"/new-path", "http://lb.example.com", "/new-path"},
+		{"new-path", "https://lb.example.com", "new-path"},
+		{"http://internal-backend:8080/login", "https://lb.example.com", "https://lb.example.com/login"},
+		{"http://internal-backend:8080/x", "not a url", "http://internal-backend:8080/x"},
+	}
+	for _, tc := range tests {
+		if got := rewriteLocation(tc.location, tc.public); got != tc.want {
+			t.Errorf("rewriteLocation(%q, %q) = %q, want %q", tc.location, tc.public, got, tc.want)
+		}
+	}
+}
+
+// redirectBackend redirects to the Location given in the ?to parameter,
+// with "self" standing for its own URL.
+func redirectBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		location := strings.Replace(r.URL.Query().Get("to"), "self", srv.URL, 1)
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusFound)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRewriteLocationHeaders(t *testing.T) {
+	srv := redirectBackend(t)
+	cfg := testConfig(srv.URL)
+	cfg.RewriteLocationHeaders = true
+	cfg.LocationInternalHosts = []string{"internal-backend:8080"}
+	lb := NewLoadBalancer(cfg)
+
+	tests := []struct {
+		name, to string
+		https    bool
+		want     string
+	}{
+		{"backend's own URL", "self/new-path?a=1", false, "http://lb.example.com/new-path?a=1"},
+		{"listed internal host", "http://internal-backend:8080/new-path", false, "http://lb.example.com/new-path"},
+		{"relative", "/new-path", false, "/new-path"},
+		{"external domain", "https://accounts.example.org/login", false, "https://accounts.example.org/login"},
+		{"HTTPS client", "self/secure", true, "https://lb.example.com/secure"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "http://lb.example.com/old?to="+url.QueryEscape(tc.to), nil)
+		if tc.https {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rec := serve(lb, req)
+		if rec.Code != http.StatusFound {
+			t.Fatalf("%s: status %d", tc.name, rec.Code)
+		}
+		if got := rec.Header().Get("Location"); got != tc.want {
+			t.Errorf("%s: Location = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	lb.cfg.RewriteLocationHeaders = false
+	rec := serve(lb, httptest.NewRequest("GET", "http://lb.example.com/old?to=self/x", nil))
+	if got := rec.Header().Get("Location"); got != srv.URL+"/x" {
+		t.Errorf("Location with REWRITE_LOCATION_HEADERS off = %q, want the backend's", got)
+	}
+}
+
+func TestSchemeMismatchDiagnostics(t *testing.T) {
+	plain := namedBackend(t, "plain")
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(secure.Close)
+	tests := []struct {
+		name, url, want string
+	}{
+		{"https URL for an HTTP server", strings.Replace(plain.URL, "http://", "https://", 1), "is the backend actually HTTP? Try " + plain.URL},
+		{"http URL for an HTTPS server", strings.Replace(secure.URL, "https://", "http://", 1), "is it actually HTTPS? Try " + secure.URL},
+	}
+	for _, tc := range tests {
+		lb := NewLoadBalancer(testConfig(tc.url))
+		logs := captureLog(t)
+		lb.healthCheck()
+		if lb.backends[0].IsAlive() {
+			t.Errorf("%s: backend passed its health check", tc.name)
+		}
+		if !strings.Contains(logs.String(), tc.want) {
+			t.Errorf("%s: health check log has no %q:\n%s", tc.name, tc.want, logs)
+		}
+	}
+}
+
+func TestSchemeMismatchHintOnlyForSchemeErrors(t *testing.T) {
+	lb := NewLoadBalancer(testConfig(deadBackendURL(t)))
+	logs := captureLog(t)
+	lb.healthCheck()
+	if strings.Contains(logs.String(), "actually HTTP") {
+		t.Errorf("unreachable backend got a scheme mismatch hint:\n%s", logs)
+	}
+	if hint := schemeMismatchHint("https://backend:8443", errors.New("connection refused")); hint != "" {
+		t.Errorf("hint for an unrelated error = %q", hint)
+	}
+}
+
+// protoBytesField encodes one length-delimited protobuf field.
+func protoBytesField(num int, data []byte) []byte {
+	buf := binary.AppendUvarint(nil, uint64(num)<<3|2)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func protoVarintField(num int, value uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(num)<<3), value)
+}
+
+// helloDescriptorSet writes a FileDescriptorSet for
+//
+//	package hello;
+//	message HelloRequest { string name = 1; }
+//	message HelloReply { string message = 1; }
+//	service Greeter {
+//	  rpc SayHello(HelloRequest) returns (HelloReply) {
+//	    option (google.api.http) = { get: "/v1/hello/{name}" };
+//	  }
+//	}
+func helloDescriptorSet(t *testing.T) string {
+	t.Helper()
+	stringField := func(name string) []byte {
+		return slices.Concat(protoBytesField(1, []byte(name)), protoVarintField(3, 1), protoVarintField(4, 1), protoVarintField(5, protoString))
+	}
+	message := func(name, field string) []byte {
+		return protoBytesField(4, slices.Concat(protoBytesField(1, []byte(name)), protoBytesField(2, stringField(field))))
+	}
+	method := slices.Concat(
+		protoBytesField(1, []byte("SayHello")),
+		protoBytesField(2, []byte(".hello.HelloRequest")),
+		protoBytesField(3, []byte(".hello.HelloReply")),
+		protoBytesField(4, protoBytesField(httpRuleExtension, protoBytesField(2, []byte("/v1/hello/{name}")))),
+	)
+	file := slices.Concat(
+		protoBytesField(1, []byte("hello.proto")),
+		protoBytesField(2, []byte("hello")),
+		message("HelloRequest", "name"),
+		message("HelloReply", "message"),
+		protoBytesField(6, slices.Concat(protoBytesField(1, []byte("Greeter")), protoBytesField(2, method))),
+	)
+	path := filepath.Join(t.TempDir(), "hello.pb")
+	if err := os.WriteFile(path, protoBytesField(1, file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// greeterBackend answers SayHello over h2c, and anything else as plain HTTP.
+// A name of "missing" gets NOT_FOUND.
+func greeterBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hello.Greeter/SayHello" {
+			fmt.Fprintf(w, "plain %s %s", r.Method, r.URL.Path)
+			return
+		}
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, "not a gRPC call", http.StatusBadRequest)
+			return
+		}
+		frame, _ := io.ReadAll(r.Body)
+		var name string
+		if len(frame) > 5 && frame[5] == 0x0a {
+			size, n := binary.Uvarint(frame[6:])
+			name = string(frame[6+n : 6+n+int(size)])
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		if name == "missing" {
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "no such person")
+			return
+		}
+		msg := protoBytesField(1, []byte("Hello, "+name))
+		w.Write(append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg))), msg...))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGRPCTranscodingRoundTrip(t *testing.T) {
+	srv := greeterBackend(t)
+	cfg := testConfig(srv.URL)
+	cfg.GRPCTranscoding = true
+	cfg.ProtobufDescriptorPath = helloDescriptorSet(t)
+	lb := NewLoadBalancer(cfg)
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+		want   map[string]any
+	}{
+		{"annotated binding", httptest.NewRequest(http.MethodGet, "/v1/hello/ada", nil), http.StatusOK,
+			map[string]any{"message": "Hello, ada"}},
+		{"default binding", httptest.NewRequest(http.MethodPost, "/hello.Greeter/SayHello", strings.NewReader(`{"name":"grace"}`)), http.StatusOK,
+			map[string]any{"message": "Hello, grace"}},
+		{"gRPC status", httptest.NewRequest(http.MethodGet, "/v1/hello/missing", nil), http.StatusNotFound,
+			map[string]any{"code": float64(5), "message": "no such person"}},
+		{"unknown field", httptest.NewRequest(http.MethodPost, "/hello.Greeter/SayHello", strings.NewReader(`{"nickname":"x"}`)), http.StatusBadRequest,
+			nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(lb, tt.req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type = %q, want JSON", ct)
+			}
+			if tt.want == nil {
+				return
+			}
+			var got map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("response is not JSON: %v: %s", err, rec.Body)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("response = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCTranscodingLeavesOtherRequestsToProxy(t *testing.T) {
+	srv := greeterBackend(t)
+	cfg := testConfig(srv.URL)
+	cfg.GRPCTranscoding = true
+	cfg.ProtobufDescriptorPath = helloDescriptorSet(t)
+	lb := NewLoadBalancer(cfg)
+
+	// Paths and methods without a binding are proxied as they are.
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/v2/other", nil),
+		httptest.NewRequest(http.MethodPost, "/v1/hello/ada", nil),
+	} {
+		rec := serve(lb, req)
+		if want := "plain " + req.Method + " " + req.URL.Path; rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("%s %s = %d %q, want 200 %q", req.Method, req.URL.Path, rec.Code, rec.Body, want)
+		}
+	}
+}
+
+func TestGRPCTranscodingConfigValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{"no descriptor", "", "GRPC_TRANSCODING needs PROTOBUF_DESCRIPTOR_PATH"},
+		{"missing file", filepath.Join(t.TempDir(), "nope.pb"), "Invalid PROTOBUF_DESCRIPTOR_PATH"},
+		{"valid", helloDescriptorSet(t), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig("http://localhost:9001")
+			cfg.Port = "8080"
+			cfg.GRPCTranscoding = true
+			cfg.ProtobufDescriptorPath = tt.path
+			report := cfg.validate()
+			found := slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, "PROTOBUF_DESCRIPTOR_PATH") })
+			if tt.wantErr == "" {
+				if found {
+					t.Errorf("unexpected errors: %v", report.Errors)
+				}
+				return
+			}
+			if !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, tt.wantErr) }) {
+				t.Errorf("errors = %v, want one containing %q", report.Errors, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAutoLatencyFavoursFasterBackend(t *testing.T) {
+	slow, _ := sleepyBackend(t, "slow", 20*time.Millisecond)
+	fast := namedBackend(t, "fast")
+	cfg := testConfig(slow.URL, fast.URL)
+	cfg.Strategy = "auto_latency"
+	lb := NewLoadBalancer(cfg)
+
+	// Until weights are computed both take an equal share.
+	if got := picks(lb, 100); got[slow.URL] != 50 || got[fast.URL] != 50 {
+		t.Fatalf("picks before any update = %v, want an even split", got)
+	}
+	for range 10 {
+		if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d", rec.Code)
+		}
+	}
+	lb.updateLatencyWeights()
+
+	slowStats, fastStats := backendStats(t, lb, slow.URL), backendStats(t, lb, fast.URL)
+	if fastStats.LatencyWeight != autoLatencyMaxWeight {
+		t.Errorf("fast backend weight = %v, want %d", fastStats.LatencyWeight, autoLatencyMaxWeight)
+	}
+	if slowStats.LatencyWeight < 1 || slowStats.LatencyWeight >= fastStats.LatencyWeight/2 {
+		t.Errorf("slow backend weight = %v, want well under the fast one's %v", slowStats.LatencyWeight, fastStats.LatencyWeight)
+	}
+	if slowStats.AvgLatencyMs < 20 || fastStats.AvgLatencyMs >= slowStats.AvgLatencyMs {
+		t.Errorf("average latencies = %vms slow, %vms fast", slowStats.AvgLatencyMs, fastStats.AvgLatencyMs)
+	}
+
+	got := picks(lb, 1000)
+	if got[fast.URL] < 2*got[slow.URL] || got[slow.URL] == 0 {
+		t.Errorf("picks = %v, want most traffic on %s and some still on %s", got, fast.URL, slow.URL)
+	}
+
+	// An operator's weight overrides the computed one.
+	lb.getBackends()[0].adminWeight.Store(1000)
+	if got := picks(lb, 1000); got[slow.URL] <= got[fast.URL] {
+		t.Errorf("picks with an admin weight on %s = %v, want it favoured", slow.URL, got)
+	}
+}
+
+func TestAutoLatencyUnmeasuredBackendGetsFullWeight(t *testing.T) {
+	fast := namedBackend(t, "fast")
+	cfg := testConfig(fast.URL, "http://127.0.0.1:9002")
+	cfg.Strategy = "auto_latency"
+	lb := NewLoadBalancer(cfg)
+
+	// No samples at all leaves the weights alone.
+	lb.updateLatencyWeights()
+	if w := backendStats(t, lb, fast.URL).LatencyWeight; w != 0 {
+		t.Fatalf("weight with no samples = %v, want 0", w)
+	}
+
+	serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	lb.getBackends()[0].mux.Lock()
+	measured := lb.getBackends()[0].latencyCount > 0
+	lb.getBackends()[0].mux.Unlock()
+	if !measured {
+		t.Fatal("request to the first backend was not measured")
+	}
+	lb.updateLatencyWeights()
+	if w := backendStats(t, lb, "http://127.0.0.1:9002").LatencyWeight; w != autoLatencyMaxWeight {
+		t.Errorf("unmeasured backend weight = %v, want %d", w, autoLatencyMaxWeight)
+	}
+}
+
+func TestAutoLatencyIntervalValidation(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.Strategy = "auto_latency"
+	cfg.AutoLatencyInterval = 0
+	report := cfg.validate()
+	if report.Valid || !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, "AUTO_LATENCY_INTERVAL") }) {
+		t.Errorf("errors = %v, want AUTO_LATENCY_INTERVAL rejected", report.Errors)
+	}
+
+	// Only auto_latency needs the interval.
+	cfg.Strategy = "round_robin"
+	if report := cfg.validate(); slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, "AUTO_LATENCY_INTERVAL") }) {
+		t.Errorf("round_robin rejected AUTO_LATENCY_INTERVAL: %v", report.Errors)
+	}
+}
+
+func TestCrossZoneLatencyPenalty(t *testing.T) {
+	const local, remote = "http://127.0.0.1:9001", "http://127.0.0.1:9002"
+	newLB := func(strategy string, penaltyMs int) *LoadBalancer {
+		cfg := testConfig()
+		cfg.Strategy = strategy
+		cfg.LocalZone = "us-east-1a"
+		cfg.CrossZoneLatencyPenaltyMs = penaltyMs
+		cfg.Backends = []BackendConfig{
+			{URL: local, Zone: "us-east-1a"},
+			{URL: remote, Zone: "us-east-1b"},
+		}
+		lb := NewLoadBalancer(cfg)
+		// A slow local backend and a fast remote one.
+		for _, b := range lb.getBackends() {
+			b.mux.Lock()
+			b.avgLatency = map[string]time.Duration{local: 30 * time.Millisecond, remote: 5 * time.Millisecond}[b.URL]
+			b.mux.Unlock()
+		}
+		lb.updateLatencyWeights()
+		return lb
+	}
+
+	t.Run("penalty keeps traffic local", func(t *testing.T) {
+		lb := newLB("auto_latency", 50)
+		if got := picks(lb, 50); got[local] != 50 {
+			t.Errorf("picks = %v, want all on the local backend", got)
+		}
+		if w := backendStats(t, lb, remote).LatencyWeight; w >= backendStats(t, lb, local).LatencyWeight {
+			t.Errorf("remote weight %v not below the local one with the penalty", w)
+		}
+
+		// With the local zone down the remote backend takes over.
+		lb.getBackends()[0].SetAlive(false)
+		if got := picks(lb, 20); got[remote] != 20 {
+			t.Errorf("picks with the local zone down = %v, want all on the remote backend", got)
+		}
+	})
+
+	t.Run("remote still faster after penalty", func(t *testing.T) {
+		lb := newLB("auto_latency", 10)
+		got := picks(lb, 1000)
+		if got[remote] <= got[local] || got[local] == 0 {
+			t.Errorf("picks = %v, want both zones competing with the remote backend favoured", got)
+		}
+	})
+
+	t.Run("only under auto_latency", func(t *testing.T) {
+		lb := newLB("round_robin", 50)
+		if got := picks(lb, 50); got[local] != 25 || got[remote] != 25 {
+			t.Errorf("picks = %v, want round robin across zones", got)
+		}
+	})
+}
+
+func TestCrossZoneLatencyPenaltyWarning(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.CrossZoneLatencyPenaltyMs = 20
+	report := cfg.validate()
+	if !slices.ContainsFunc(report.Warnings, func(w string) bool { return strings.Contains(w, "CROSS_ZONE_LATENCY_PENALTY_MS") }) {
+		t.Errorf("warnings = %v, want the unused penalty flagged", report.Warnings)
+	}
+
+	cfg.Strategy = "auto_latency"
+	cfg.LocalZone = "us-east-1a"
+	report = cfg.validate()
+	if slices.ContainsFunc(report.Warnings, func(w string) bool { return strings.Contains(w, "CROSS_ZONE_LATENCY_PENALTY_MS") }) {
+		t.Errorf("warnings = %v, want none with auto_latency and LB_ZONE", report.Warnings)
+	}
+}
+
+// gatedBackend answers each request only once a value is sent on the
+// returned channel.
+func gatedBackend(t *testing.T) (*httptest.Server, chan struct{}, *atomic.Int64) {
+	t.Helper()
+	gate := make(chan struct{})
+	var served atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-gate:
+		case <-r.Context().Done():
+			return
+		}
+		served.Add(1)
+		io.WriteString(w, r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, gate, &served
+}
+
+func TestBackendWaitQueueDrains(t *testing.T) {
+	srv, gate, served := gatedBackend(t)
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: srv.URL, MaxConcurrentRequests: 1, MaxQueueLength: 2, QueueTimeout: 5 * time.Second}}
+	lb := NewLoadBalancer(cfg)
+	backend := lb.getBackends()[0]
+
+	codes := make(chan int, 3)
+	for i := range 3 {
+		go func() {
+			codes <- serve(lb, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%d", i), nil)).Code
+		}()
+		// Start them in order so the queue holds the later two.
+		if !waitFor(func() bool { return backend.active.Load() == 1 && backend.queued() == i }) {
+			t.Fatalf("request %d: active = %d, queued = %d", i, backend.active.Load(), backend.queued())
+		}
+	}
+
+	// The queue is full, so a fourth request is turned away at once.
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/overflow", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("overflow request = %d (Retry-After %q), want 503 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if got := counterValue(lb.metrics.backendQueueRejections, srv.URL, "queue_full"); got != 1 {
+		t.Errorf("queue_full rejections = %v, want 1", got)
+	}
+
+	// Each freed slot goes to the next waiter, one at a time.
+	for i := range 3 {
+		gate <- struct{}{}
+		if code := <-codes; code != http.StatusOK {
+			t.Fatalf("queued request finished with %d, want 200", code)
+		}
+		if want := max(1-i, 0); !waitFor(func() bool { return backend.queued() == want }) {
+			t.Errorf("after %d responses %d still queued, want %d", i+1, backend.queued(), want)
+		}
+	}
+	if served.Load() != 3 {
+		t.Errorf("backend served %d requests, want 3", served.Load())
+	}
+	if !waitFor(func() bool { return backend.active.Load() == 0 }) {
+		t.Errorf("active = %d after the queue drained, want 0", backend.active.Load())
+	}
+}
+
+func TestBackendWaitQueueTimeout(t *testing.T) {
+	srv, gate, _ := gatedBackend(t)
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: srv.URL, MaxConcurrentRequests: 1, MaxQueueLength: 1, QueueTimeout: 50 * time.Millisecond}}
+	lb := NewLoadBalancer(cfg)
+	backend := lb.getBackends()[0]
+
+	done := make(chan int, 1)
+	go func() { done <- serve(lb, httptest.NewRequest(http.MethodGet, "/held", nil)).Code }()
+	if !waitFor(func() bool { return backend.active.Load() == 1 }) {
+		t.Fatal("first request never reached the backend")
+	}
+
+	start := time.Now()
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/waits", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("queued request = %d, want 503 after the queue timeout", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("queued request rejected after %v, want it to wait out the 50ms queue timeout", elapsed)
+	}
+	if got := counterValue(lb.metrics.backendQueueRejections, srv.URL, "timeout"); got != 1 {
+		t.Errorf("timeout rejections = %v, want 1", got)
+	}
+	if n := backend.queued(); n != 0 {
+		t.Errorf("%d requests left in the queue after timing out", n)
+	}
+
+	gate <- struct{}{}
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("held request = %d, want 200", code)
+	}
+	if !waitFor(func() bool { return backend.active.Load() == 0 }) {
+		t.Errorf("active = %d, want the slot freed", backend.active.Load())
+	}
+}
+
+func TestBackendWaitQueueValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend BackendConfig
+		wantErr string
+	}{
+		{"negative length", BackendConfig{MaxConcurrentRequests: 1, MaxQueueLength: -1}, "negative max_queue_length"},
+		{"no concurrency limit", BackendConfig{MaxQueueLength: 2, QueueTimeout: time.Second}, "without max_concurrent_requests"},
+		{"no timeout", BackendConfig{MaxConcurrentRequests: 1, MaxQueueLength: 2}, "no positive queue_timeout"},
+		{"valid", BackendConfig{MaxConcurrentRequests: 1, MaxQueueLength: 2, QueueTimeout: time.Second}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Port = "8080"
+			tt.backend.URL = "http://127.0.0.1:9001"
+			cfg.Backends = []BackendConfig{tt.backend}
+			report := cfg.validate()
+			if tt.wantErr == "" {
+				if !report.Valid {
+					t.Errorf("errors = %v, want none", report.Errors)
+				}
+				return
+			}
+			if !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, tt.wantErr) }) {
+				t.Errorf("errors = %v, want one containing %q", report.Errors, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBackendURLValidation(t *testing.T) {
+	tests := []struct {
+		url   string
+		field string
+		value string
+	}{
+		{"http://127.0.0.1:%zz", "url", "http://127.0.0.1:%zz"},
+		{"ftp://127.0.0.1:9001", "scheme", "ftp"},
+		{"127.0.0.1:9001", "url", "127.0.0.1:9001"},
+		{"//127.0.0.1:9001", "scheme", ""},
+		{"http:///path", "host", ""},
+		{"http://:9001", "host", ":9001"},
+		{"http://127.0.0.1:0", "port", "0"},
+		{"http://127.0.0.1:65536", "port", "65536"},
+		{"https://example.com/api/../admin", "path", "/api/../admin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			_, err := parseBackendURL(tt.url)
+			var invalid *BackendValidationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("parseBackendURL(%q) = %v, want a *BackendValidationError", tt.url, err)
+			}
+			if invalid.Field != tt.field || invalid.Value != tt.value {
+				t.Errorf("field, value = %q, %q, want %q, %q", invalid.Field, invalid.Value, tt.field, tt.value)
+			}
+			if msg := err.Error(); !strings.Contains(msg, tt.field) || !strings.Contains(msg, strconv.Quote(tt.value)) {
+				t.Errorf("error %q doesn't name the field and value", msg)
+			}
+		})
+	}
+
+	for _, valid := range []string{"http://127.0.0.1", "https://example.com:65535/api/v1", "http://[::1]:9001/a..b"} {
+		if _, err := parseBackendURL(valid); err != nil {
+			t.Errorf("parseBackendURL(%q) = %v, want it accepted", valid, err)
+		}
+	}
+}
+
+func TestInvalidBackendURLRejected(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001", "http://127.0.0.1:70000")
+	cfg.Port = "8080"
+	cfg.AdminToken = "secret"
+	report := cfg.validate()
+	if report.Valid || !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, `port "70000"`) }) {
+		t.Errorf("validate errors = %v, want the port rejected", report.Errors)
+	}
+
+	// NewLoadBalancer skips the bad backend and keeps the rest.
+	lb := NewLoadBalancer(cfg)
+	if backends := lb.getBackends(); len(backends) != 1 || backends[0].URL != "http://127.0.0.1:9001" {
+		t.Errorf("backends = %d, want only the valid one", len(backends))
+	}
+
+	rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/backends", `{"url": "gopher://127.0.0.1:9002"}`))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("admin add status = %d, want 400: %s", rec.Code, rec.Body)
+	}
+	var got BackendValidationError
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("admin add body is not JSON: %v: %s", err, rec.Body)
+	}
+	want := BackendValidationError{URL: "gopher://127.0.0.1:9002", Field: "scheme", Value: "gopher", Reason: "must be http or https"}
+	if got != want {
+		t.Errorf("admin add error = %+v, want %+v", got, want)
+	}
+	if n := len(lb.getBackends()); n != 1 {
+		t.Errorf("%d backends after a rejected add, want 1", n)
+	}
+
+	rec = serve(lb, adminRequest(lb, http.MethodPost, "/admin/backends", `{"url": "http://127.0.0.1:9002"}`))
+	if rec.Code != http.StatusCreated {
+		t.Errorf("valid admin add status = %d, want 201: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestStatsEffectiveWeightsAndProbabilities(t *testing.T) {
+	cfg := testConfig()
+	cfg.Strategy = "weighted_round_robin"
+	cfg.Backends = []BackendConfig{
+		{URL: "http://127.0.0.1:9001", Weight: 4, SlowStartDuration: time.Hour},
+		{URL: "http://127.0.0.1:9002", Weight: 1},
+		{URL: "http://127.0.0.1:9003", Weight: 3},
+		{URL: "http://127.0.0.1:9004", Weight: 5},
+	}
+	lb := NewLoadBalancer(cfg)
+	backends := lb.getBackends()
+	ramping, overridden, plain, down := backends[0], backends[1], backends[2], backends[3]
+
+	// Half way through its slow start, weight 4 counts as 2; an operator
+	// weight of 6 replaces the configured 1; a down backend counts for nothing.
+	ramping.mux.Lock()
+	ramping.firstAliveAt = time.Now().Add(-30 * time.Minute)
+	ramping.mux.Unlock()
+	overridden.adminWeight.Store(6)
+	down.SetAlive(false)
+
+	check := func(want map[*Backend][2]float64) {
+		t.Helper()
+		for backend, w := range want {
+			bs := backendStats(t, lb, backend.URL)
+			if math.Abs(bs.EffectiveWeight-w[0]) > 0.01 || math.Abs(bs.SelectionProbability-w[1]) > 0.01 {
+				t.Errorf("%s: effective weight %.3f, probability %.3f, want %.3f, %.3f",
+					backend.URL, bs.EffectiveWeight, bs.SelectionProbability, w[0], w[1])
+			}
+		}
+	}
+	check(map[*Backend][2]float64{
+		ramping:    {2, 2.0 / 11},
+		overridden: {6, 6.0 / 11},
+		plain:      {3, 3.0 / 11},
+		down:       {0, 0},
+	})
+
+	// Draining keeps the weight but hands the share to the others.
+	plain.draining.Store(true)
+	check(map[*Backend][2]float64{
+		ramping:    {2, 2.0 / 8},
+		overridden: {6, 6.0 / 8},
+		plain:      {3, 0},
+	})
+
+	// The probabilities match what selection actually does.
+	ramping.mux.Lock()
+	ramping.firstAliveAt = time.Now().Add(-time.Hour)
+	ramping.mux.Unlock()
+	check(map[*Backend][2]float64{ramping: {4, 0.4}, overridden: {6, 0.6}})
+	if got := picks(lb, 100); got[ramping.URL] != 40 || got[overridden.URL] != 60 {
+		t.Errorf("picks = %v, want 40/60", got)
+	}
+
+	// Under round_robin weights don't matter.
+	lb.cfg.Strategy = "round_robin"
+	check(map[*Backend][2]float64{ramping: {4, 0.5}, overridden: {6, 0.5}})
+}
+
+func TestDirectorChainOrder(t *testing.T) {
+	step := func(name string) requestModifier {
+		return requestModifier{name: name, modify: func(req *http.Request, incoming *url.URL) {
+			req.Header.Add("X-Steps", name)
+			req.Header.Add("X-Incoming", incoming.Path)
+			req.URL.Path += "/" + name
+		}}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/start", nil)
+	directorChain(step("a"), step("b"), step("c"))(req)
+
+	if got := req.Header.Values("X-Steps"); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("modifiers ran as %v, want a, b, c", got)
+	}
+	if got := req.URL.Path; got != "/start/a/b/c" {
+		t.Errorf("path = %q, want each modifier to see the one before's changes", got)
+	}
+	// Every modifier gets the client's URL, however earlier ones changed it.
+	if got := req.Header.Values("X-Incoming"); !slices.Equal(got, []string{"/start", "/start", "/start"}) {
+		t.Errorf("incoming paths = %v, want /start each time", got)
+	}
+
+	// An empty chain leaves the request alone.
+	req = httptest.NewRequest(http.MethodGet, "/start", nil)
+	directorChain()(req)
+	if req.URL.Path != "/start" || len(req.Header) != 0 {
+		t.Errorf("empty chain changed the request to %s %v", req.URL, req.Header)
+	}
+}
+
+func TestRequestModifiersComposition(t *testing.T) {
+	base, _ := url.Parse("http://127.0.0.1:9001/api/")
+	tests := []struct {
+		name      string
+		backend   BackendConfig
+		modifiers []string
+		url       string
+		host      string
+	}{
+		{"defaults", BackendConfig{},
+			[]string{"target", "host_header"}, "http://127.0.0.1:9001/api/orders?id=7", "127.0.0.1:9001"},
+		{"forwarded path", BackendConfig{ForwardedPath: "/v2${path}"},
+			[]string{"target", "forwarded_path", "host_header"}, "http://127.0.0.1:9001/api/v2/orders?id=7", "127.0.0.1:9001"},
+		{"host header", BackendConfig{BackendHostHeader: "internal.example"},
+			[]string{"target", "host_header"}, "http://127.0.0.1:9001/api/orders?id=7", "internal.example"},
+		{"everything", BackendConfig{ForwardedPath: "/v2${path}", BackendHostHeader: "internal.example", Transport: "http1.0"},
+			[]string{"target", "forwarded_path", "host_header"}, "http://127.0.0.1:9001/api/v2/orders?id=7", "internal.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := httputil.NewSingleHostReverseProxy(base)
+			modifiers := requestModifiers(proxy.Director, base, tt.backend)
+			var names []string
+			for _, m := range modifiers {
+				names = append(names, m.name)
+			}
+			if !slices.Equal(names, tt.modifiers) {
+				t.Errorf("modifiers = %v, want %v", names, tt.modifiers)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/orders?id=7", nil)
+			req.Host = ""
+			directorChain(modifiers...)(req)
+			if req.URL.String() != tt.url || req.Host != tt.host {
+				t.Errorf("request became %s (Host %q), want %s (Host %q)", req.URL, req.Host, tt.url, tt.host)
+			}
+		})
+	}
+}
+
+func TestBackendDirectorUsesModifierChain(t *testing.T) {
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: "http://127.0.0.1:9001", BackendHostHeader: "internal.example"}}
+	lb := NewLoadBalancer(cfg)
+
+	backend := lb.getBackends()[0]
+	var names []string
+	for _, m := range backend.modifiers {
+		names = append(names, m.name)
+	}
+	if !slices.Equal(names, []string{"target", "host_header"}) {
+		t.Errorf("backend modifiers = %v, want target, host_header", names)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	backend.Proxy.Director(req)
+	if req.Host != "internal.example" || req.URL.Host != "127.0.0.1:9001" {
+		t.Errorf("Director sent the request to %s with Host %q", req.URL, req.Host)
+	}
+}
+
+// readTraceRecords parses the JSON lines in a request trace file.
+func readTraceRecords(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []map[string]any
+	for line := range strings.Lines(string(data)) {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("trace line %q is not JSON: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestRequestTraceRecords(t *testing.T) {
+	srv := namedBackend(t, "a")
+	cfg := testConfig(deadBackendURL(t), srv.URL)
+	cfg.MaxRetries = 1
+	cfg.RequestTraceEnabled = true
+	cfg.RequestTraceFile = filepath.Join(t.TempDir(), "trace.jsonl")
+	lb := NewLoadBalancer(cfg)
+	t.Cleanup(lb.requestTrace.close)
+
+	req := httptest.NewRequest(http.MethodGet, "/orders?id=7", nil)
+	req.RemoteAddr = "203.0.113.9:4567"
+	req.Header.Set("X-Request-ID", "trace-me")
+	if rec := serve(lb, req); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 after retrying the dead backend", rec.Code)
+	}
+
+	var records []map[string]any
+	if !waitFor(func() bool { records = readTraceRecords(t, cfg.RequestTraceFile); return len(records) == 1 }) {
+		t.Fatalf("%d trace records after the flush interval, want 1", len(records))
+	}
+	record := records[0]
+	want := []string{"ts", "request_id", "method", "path", "client_ip", "backend_url", "status", "duration_ms", "retry_count", "cache_hit"}
+	if got := slices.Sorted(maps.Keys(record)); !slices.Equal(got, slices.Sorted(slices.Values(want))) {
+		t.Errorf("record fields = %v, want %v", got, want)
+	}
+	for field, value := range map[string]any{
+		"request_id":  "trace-me",
+		"method":      "GET",
+		"path":        "/orders",
+		"client_ip":   "203.0.113.9",
+		"backend_url": srv.URL,
+		"status":      float64(200),
+		"retry_count": float64(1),
+		"cache_hit":   false,
+	} {
+		if record[field] != value {
+			t.Errorf("%s = %v, want %v", field, record[field], value)
+		}
+	}
+	if d, _ := record["duration_ms"].(float64); d <= 0 {
+		t.Errorf("duration_ms = %v, want positive", record["duration_ms"])
+	}
+	if ts, _ := record["ts"].(string); ts == "" {
+		t.Error("ts missing")
+	} else if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+		t.Errorf("ts %q is not RFC 3339: %v", ts, err)
+	}
+}
+
+func TestRequestTraceFlushedOnShutdown(t *testing.T) {
+	cfg := testConfig(namedBackend(t, "a").URL)
+	cfg.Listeners = []ListenerConfig{{Address: freeAddress(t)}}
+	cfg.RequestTraceEnabled = true
+	cfg.RequestTraceFile = filepath.Join(t.TempDir(), "trace.jsonl")
+	lb := NewLoadBalancer(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- lb.listenAndServe(ctx) }()
+	var resp *http.Response
+	if !waitFor(func() bool {
+		var err error
+		resp, err = http.Get("http://" + cfg.Listeners[0].Address + "/")
+		return err == nil
+	}) {
+		t.Fatal("listener never came up")
+	}
+	resp.Body.Close()
+
+	// Buffered records are written out on shutdown, not left to the ticker.
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("listenAndServe: %v", err)
+	}
+	if records := readTraceRecords(t, cfg.RequestTraceFile); len(records) != 1 {
+		t.Errorf("%d trace records after shutdown, want 1", len(records))
+	}
+
+	// Later records are dropped rather than written to a closed file.
+	serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	if records := readTraceRecords(t, cfg.RequestTraceFile); len(records) != 1 {
+		t.Errorf("%d trace records after a request past shutdown, want 1", len(records))
+	}
+}
+
+func TestRequestTraceRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	trace, err := newRequestTraceLog(path, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 6 {
+		record := &requestTraceRecord{TS: time.Now(), RequestID: fmt.Sprintf("req-%d", i), Method: "GET", Path: "/"}
+		trace.finish(record, &statusRecorder{status: http.StatusOK})
+	}
+	trace.close()
+
+	current, rotated := readTraceRecords(t, path), readTraceRecords(t, path+".1")
+	if len(current) == 0 || len(rotated) == 0 || len(current)+len(rotated) > 6 {
+		t.Fatalf("%d records in the file and %d rotated, want both used", len(current), len(rotated))
+	}
+	for _, p := range []string{path, path + ".1"} {
+		if info, err := os.Stat(p); err != nil || info.Size() > 400 {
+			t.Errorf("%s is %d bytes, want at most 400", p, info.Size())
+		}
+	}
+	// Only the newest rotation is kept; the last record is in the live file.
+	if got := current[len(current)-1]["request_id"]; got != "req-5" {
+		t.Errorf("last record = %v, want req-5", got)
+	}
+	if got := rotated[0]["cache_hit"]; got != true {
+		t.Errorf("record never forwarded has cache_hit %v, want true", got)
+	}
+}
+
+func TestRequestTraceValidation(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.RequestTraceEnabled = true
+	report := cfg.validate()
+	if !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, "REQUEST_TRACE_FILE") }) {
+		t.Errorf("errors = %v, want the missing trace file rejected", report.Errors)
+	}
+
+	cfg.RequestTraceFile = filepath.Join(t.TempDir(), "trace.jsonl")
+	cfg.RequestTraceMaxSizeMB = -1
+	report = cfg.validate()
+	if !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, "REQUEST_TRACE_MAX_SIZE_MB") }) {
+		t.Errorf("errors = %v, want the negative size rejected", report.Errors)
+	}
+}
+
+// drainBackend fails /healthz while healthy is false and holds /slow until
+// release is closed. It counts the connections closed on it.
+func drainBackend(t *testing.T) (srv *httptest.Server, healthy *atomic.Bool, release chan struct{}, closed *atomic.Int64) {
+	t.Helper()
+	healthy, release, closed = new(atomic.Bool), make(chan struct{}), new(atomic.Int64)
+	healthy.Store(true)
+	srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			if !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		case "/slow":
+			select {
+			case <-release:
+				io.WriteString(w, "finished")
+			case <-r.Context().Done():
+			}
+		default:
+			io.WriteString(w, "fast")
+		}
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	return srv, healthy, release, closed
+}
+
+func TestDownTransitionKeepsInFlightRequests(t *testing.T) {
+	srv, healthy, release, closed := drainBackend(t)
+	cfg := testConfig(srv.URL)
+	cfg.HealthCheckPath = "/healthz"
+	cfg.TransportMode = "isolated"
+	lb := NewLoadBalancer(cfg)
+	backend := lb.getBackends()[0]
+
+	// One connection left idle, one carrying a slow request.
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Body.String() != "fast" {
+		t.Fatalf("warm-up request got %d %q", rec.Code, rec.Body)
+	}
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- serve(lb, httptest.NewRequest(http.MethodGet, "/slow", nil)) }()
+	if !waitFor(func() bool { return backend.active.Load() == 1 }) {
+		t.Fatal("slow request never started")
+	}
+
+	healthy.Store(false)
+	if lb.checkBackend(backend) || backend.IsAlive() {
+		t.Fatal("failing health check left the backend up")
+	}
+
+	// The idle connection goes, the busy one stays.
+	if !waitFor(func() bool { return closed.Load() == 1 }) {
+		t.Errorf("%d connections closed on the down transition, want the idle one", closed.Load())
+	}
+	close(release)
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusOK || rec.Body.String() != "finished" {
+			t.Errorf("in-flight request got %d %q, want it to finish", rec.Code, rec.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight request never finished")
+	}
+}
+
+func TestForceDrainAbortsInFlightRequests(t *testing.T) {
+	bad, _, _, _ := drainBackend(t)
+	good := namedBackend(t, "good")
+	cfg := testConfig(bad.URL, good.URL)
+	cfg.AdminToken = "secret"
+	cfg.MaxRetries = 1
+	lb := NewLoadBalancer(cfg)
+	backend := lb.getBackends()[0]
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- serve(lb, httptest.NewRequest(http.MethodGet, "/slow", nil)) }()
+	if !waitFor(func() bool { return backend.active.Load() == 1 }) {
+		t.Fatal("slow request never reached the bad backend")
+	}
+
+	// A plain drain leaves it running.
+	body := fmt.Sprintf(`{"backend": %q, "draining": true}`, bad.URL)
+	if rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/backends/drain", body)); rec.Code != http.StatusOK {
+		t.Fatalf("drain returned %d: %s", rec.Code, rec.Body)
+	}
+	select {
+	case rec := <-done:
+		t.Fatalf("drain without force ended the request with %d", rec.Code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	body = fmt.Sprintf(`{"backend": %q, "draining": true, "force": true}`, bad.URL)
+	rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/backends/drain", body))
+	var result struct{ Aborted int }
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); rec.Code != http.StatusOK || err != nil || result.Aborted != 1 {
+		t.Fatalf("force drain returned %d %s, want one request aborted", rec.Code, rec.Body)
+	}
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusOK || rec.Body.String() != "good" {
+			t.Errorf("aborted request got %d %q, want it retried on the good backend", rec.Code, rec.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("force drain didn't abort the request")
+	}
+
+	// Force only makes sense while draining.
+	body = fmt.Sprintf(`{"backend": %q, "draining": false, "force": true}`, bad.URL)
+	if rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/backends/drain", body)); rec.Code != http.StatusBadRequest {
+		t.Errorf("force with draining false returned %d, want 400", rec.Code)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	cfg := testConfig(namedBackend(t, "a").URL)
+	cfg.RateLimitRPS = 1
+	cfg.RateLimitBurst = 3
+	lb := NewLoadBalancer(cfg)
+
+	request := func(client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = client + ":1234"
+		return serve(lb, req)
+	}
+	check := func(rec *httptest.ResponseRecorder, status int, remaining, reset string) {
+		t.Helper()
+		if rec.Code != status {
+			t.Errorf("status = %d, want %d", rec.Code, status)
+		}
+		for name, want := range map[string]string{
+			"X-RateLimit-Limit":     "3",
+			"X-RateLimit-Remaining": remaining,
+			"X-RateLimit-Reset":     reset,
+		} {
+			if got := rec.Header().Get(name); got != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+	}
+
+	// Each request uses a token; the bucket refills at one per second.
+	check(request("203.0.113.1"), http.StatusOK, "2", "1")
+	check(request("203.0.113.1"), http.StatusOK, "1", "2")
+	rec := request("203.0.113.1")
+	check(rec, http.StatusOK, "0", "3")
+	if got := rec.Header().Get("Retry-After"); got != "" {
+		t.Errorf("Retry-After = %q on an allowed request", got)
+	}
+
+	rec = request("203.0.113.1")
+	check(rec, http.StatusTooManyRequests, "0", "3")
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+
+	// Other clients have buckets of their own.
+	check(request("203.0.113.2"), http.StatusOK, "2", "1")
+}
+
+func TestRateLimitBurstDefaultsToRate(t *testing.T) {
+	cfg := testConfig(namedBackend(t, "a").URL)
+	cfg.RateLimitRPS = 2
+	lb := NewLoadBalancer(cfg)
+
+	var codes []int
+	for range 3 {
+		rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+		codes = append(codes, rec.Code)
+		if got := rec.Header().Get("X-RateLimit-Limit"); got != "2" {
+			t.Errorf("X-RateLimit-Limit = %q, want the rate", got)
+		}
+	}
+	if !slices.Equal(codes, []int{200, 200, 429}) {
+		t.Errorf("statuses = %v, want two allowed then 429", codes)
+	}
+
+	// Without a limit no headers are sent.
+	lb = NewLoadBalancer(testConfig(namedBackend(t, "b").URL))
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Header().Get("X-RateLimit-Limit") != "" {
+		t.Errorf("X-RateLimit-Limit = %q with rate limiting off", rec.Header().Get("X-RateLimit-Limit"))
+	}
+}
+
+func TestExcludeBackendsForPath(t *testing.T) {
+	a, b, c := namedBackend(t, "a"), namedBackend(t, "b"), namedBackend(t, "c")
+	cfg := testConfig(a.URL, b.URL, c.URL)
+	cfg.ExcludeBackendsForPath = map[string][]string{
+		"/reports/":        {c.URL},
+		"/reports/secret/": {b.URL},
+	}
+	lb := NewLoadBalancer(cfg)
+
+	served := func(path string, n int) map[string]int {
+		counts := make(map[string]int)
+		for range n {
+			rec := serve(lb, httptest.NewRequest(http.MethodGet, path, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("GET %s = %d", path, rec.Code)
+			}
+			counts[rec.Body.String()]++
+		}
+		return counts
+	}
+
+	if got := served("/reports/daily", 60); got["c"] != 0 || got["a"] != 30 || got["b"] != 30 {
+		t.Errorf("/reports/daily served by %v, want a and b evenly and never c", got)
+	}
+	// Prefixes that both match exclude both lists.
+	if got := served("/reports/secret/q3", 20); got["a"] != 20 {
+		t.Errorf("/reports/secret/q3 served by %v, want only a", got)
+	}
+	// Other paths, including ones that merely share a stem, reach everyone.
+	for _, path := range []string{"/orders", "/reports"} {
+		if got := served(path, 60); got["a"] != 20 || got["b"] != 20 || got["c"] != 20 {
+			t.Errorf("%s served by %v, want all three evenly", path, got)
+		}
+	}
+
+	// With the only allowed backend down there is nowhere to send it.
+	lb.getBackends()[0].SetAlive(false)
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/reports/secret/q3", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET with every allowed backend down = %d, want 503", rec.Code)
+	}
+}
+
+func TestExcludeBackendsForPathValidation(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.ExcludeBackendsForPath = map[string][]string{
+		"reports/":  {"http://127.0.0.1:9001"},
+		"/private/": {"http://127.0.0.1:9009"},
+	}
+	report := cfg.validate()
+	if !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, `"reports/" must start with /`) }) {
+		t.Errorf("errors = %v, want the relative prefix rejected", report.Errors)
+	}
+	if !slices.ContainsFunc(report.Warnings, func(w string) bool { return strings.Contains(w, "http://127.0.0.1:9009") }) {
+		t.Errorf("warnings = %v, want the unknown backend flagged", report.Warnings)
+	}
+}
+
+func TestMaxURLLength(t *testing.T) {
+	srv, hits := sleepyBackend(t, "a", 0)
+	cfg := testConfig(srv.URL)
+	cfg.MaxURLLength = 20
+	lb := NewLoadBalancer(cfg)
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/" + strings.Repeat("a", 19), http.StatusOK},
+		{"/" + strings.Repeat("a", 20), http.StatusRequestURITooLong},
+		{"/search?q=" + strings.Repeat("x", 10), http.StatusOK},
+		{"/search?q=" + strings.Repeat("x", 11), http.StatusRequestURITooLong},
+		// Escapes count as sent, not decoded.
+		{"/" + strings.Repeat("%41", 7), http.StatusRequestURITooLong},
+	}
+	for _, tt := range tests {
+		before := hits.Load()
+		rec := serve(lb, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if rec.Code != tt.status {
+			t.Errorf("GET %s (%d bytes) = %d, want %d", tt.target, len(tt.target), rec.Code, tt.status)
+		}
+		if reached := hits.Load() > before; reached != (tt.status == http.StatusOK) {
+			t.Errorf("GET %s reached the backend: %v", tt.target, reached)
+		}
+	}
+
+	// Unlimited by default.
+	lb = NewLoadBalancer(testConfig(srv.URL))
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/"+strings.Repeat("a", 4000), nil)); rec.Code != http.StatusOK {
+		t.Errorf("long URL with no limit = %d, want 200", rec.Code)
+	}
+
+	cfg = testConfig(srv.URL)
+	cfg.Port = "8080"
+	cfg.MaxURLLength = -1
+	if report := cfg.validate(); !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, "MAX_URL_LENGTH") }) {
+		t.Errorf("errors = %v, want a negative MAX_URL_LENGTH rejected", report.Errors)
+	}
+}
+
+func TestBackendHostHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	t.Cleanup(srv.Close)
+	backendHost := strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		name       string
+		override   string
+		clientHost string
+		want       string
+	}{
+		{"override", "app.internal.example", "public.example.com", "app.internal.example"},
+		{"override with port", "app.internal.example:8443", "public.example.com", "app.internal.example:8443"},
+		{"override without client host", "app.internal.example", "", "app.internal.example"},
+		// Without an override the backend URL's host is sent, whatever the
+		// client asked for.
+		{"default", "", "public.example.com", backendHost},
+		{"default without client host", "", "", backendHost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Backends = []BackendConfig{{URL: srv.URL, BackendHostHeader: tt.override}}
+			lb := NewLoadBalancer(cfg)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.clientHost
+			rec := serve(lb, req)
+			if rec.Code != http.StatusOK || rec.Body.String() != tt.want {
+				t.Errorf("backend saw Host %q (status %d), want %q", rec.Body, rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendHostHeaderValidation(t *testing.T) {
+	for _, host := range []string{"bad host", "host/path", "host\r\nX-Injected: 1"} {
+		cfg := testConfig()
+		cfg.Port = "8080"
+		cfg.Backends = []BackendConfig{{URL: "http://127.0.0.1:9001", BackendHostHeader: host}}
+		if report := cfg.validate(); !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, "backend_host_header") }) {
+			t.Errorf("backend_host_header %q accepted: %v", host, report.Errors)
+		}
+	}
+}
+
+// idempotentBackend numbers its responses so replays can be told apart.
+// /pay/status/N answers with status N, /pay/slow waits for release and
+// /pay/big sends a 2KB body.
+func idempotentBackend(t *testing.T) (*httptest.Server, *atomic.Int64, chan struct{}) {
+	t.Helper()
+	var hits atomic.Int64
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		status := http.StatusCreated
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/pay/status/"):
+			status, _ = strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/pay/status/"))
+		case r.URL.Path == "/pay/slow":
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		case r.URL.Path == "/pay/big":
+			w.WriteHeader(status)
+			io.WriteString(w, strings.Repeat("x", 2048))
+			return
+		}
+		w.Header().Set("X-Payment", strconv.FormatInt(n, 10))
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "payment %d", n)
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	return srv, &hits, release
+}
+
+func idempotencyConfig(backendURL string) *Config {
+	cfg := testConfig(backendURL)
+	cfg.Routes = []RouteConfig{{PathPattern: "/pay/*", Idempotency: true}}
+	return cfg
+}
+
+func idempotentPost(lb *LoadBalancer, path, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"amount": 10}`))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	return serve(lb, req)
+}
+
+func TestIdempotencyReplaysWithinTTL(t *testing.T) {
+	srv, hits, _ := idempotentBackend(t)
+	cfg := idempotencyConfig(srv.URL)
+	cfg.IdempotencyTTL = 100 * time.Millisecond
+	lb := NewLoadBalancer(cfg)
+
+	first := idempotentPost(lb, "/pay/order", "k1")
+	second := idempotentPost(lb, "/pay/order", "k1")
+	if first.Code != http.StatusCreated || first.Body.String() != "payment 1" {
+		t.Fatalf("first request = %d %q", first.Code, first.Body)
+	}
+	if second.Code != first.Code || second.Body.String() != first.Body.String() || second.Header().Get("X-Payment") != "1" {
+		t.Errorf("repeat = %d %q, want the stored %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Idempotent-Replayed = %q on the first, %q on the repeat", first.Header().Get("Idempotent-Replayed"), second.Header().Get("Idempotent-Replayed"))
+	}
+	if hits.Load() != 1 {
+		t.Errorf("backend hit %d times, want once", hits.Load())
+	}
+
+	// Another key, or another client's credentials, is a new request.
+	idempotentPost(lb, "/pay/order", "k2")
+	req := httptest.NewRequest(http.MethodPost, "/pay/order", nil)
+	req.Header.Set("Idempotency-Key", "k1")
+	req.Header.Set("Authorization", "Bearer someone-else")
+	serve(lb, req)
+	if hits.Load() != 3 {
+		t.Errorf("backend hit %d times, want a new key and a new client forwarded", hits.Load())
+	}
+
+	// Past the TTL the key is forgotten.
+	time.Sleep(150 * time.Millisecond)
+	if rec := idempotentPost(lb, "/pay/order", "k1"); rec.Header().Get("Idempotent-Replayed") != "" || hits.Load() != 4 {
+		t.Errorf("repeat after the TTL replayed = %q, hits = %d, want it forwarded", rec.Header().Get("Idempotent-Replayed"), hits.Load())
+	}
+}
+
+func TestIdempotencyConcurrentDuplicatesWait(t *testing.T) {
+	srv, hits, release := idempotentBackend(t)
+	lb := NewLoadBalancer(idempotencyConfig(srv.URL))
+
+	results := make(chan *httptest.ResponseRecorder, 3)
+	for range 3 {
+		go func() { results <- idempotentPost(lb, "/pay/slow", "k") }()
+	}
+	// Only one of them gets through while the others wait on it.
+	time.Sleep(100 * time.Millisecond)
+	if hits.Load() != 1 {
+		t.Fatalf("backend hit %d times with duplicates in flight, want once", hits.Load())
+	}
+	close(release)
+
+	replayed := 0
+	for range 3 {
+		rec := <-results
+		if rec.Code != http.StatusCreated || rec.Body.String() != "payment 1" {
+			t.Errorf("duplicate got %d %q, want the first's response", rec.Code, rec.Body)
+		}
+		if rec.Header().Get("Idempotent-Replayed") == "true" {
+			replayed++
+		}
+	}
+	if replayed != 2 || hits.Load() != 1 {
+		t.Errorf("%d replayed, backend hit %d times, want 2 and 1", replayed, hits.Load())
+	}
+}
+
+func TestIdempotencyDoesNotStoreRetryableStatuses(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusRequestTimeout, http.StatusTooManyRequests} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			srv, hits, _ := idempotentBackend(t)
+			lb := NewLoadBalancer(idempotencyConfig(srv.URL))
+			path := fmt.Sprintf("/pay/status/%d", status)
+			for range 2 {
+				if rec := idempotentPost(lb, path, "k"); rec.Code != status || rec.Header().Get("Idempotent-Replayed") != "" {
+					t.Errorf("response = %d (replayed %q), want a fresh %d", rec.Code, rec.Header().Get("Idempotent-Replayed"), status)
+				}
+			}
+			if hits.Load() != 2 {
+				t.Errorf("backend hit %d times, want the retry forwarded", hits.Load())
+			}
+		})
+	}
+
+	// A final 4xx is kept like a success.
+	srv, hits, _ := idempotentBackend(t)
+	lb := NewLoadBalancer(idempotencyConfig(srv.URL))
+	idempotentPost(lb, "/pay/status/422", "k")
+	if rec := idempotentPost(lb, "/pay/status/422", "k"); rec.Code != http.StatusUnprocessableEntity || hits.Load() != 1 {
+		t.Errorf("repeat of a 422 = %d with %d hits, want it replayed", rec.Code, hits.Load())
+	}
+}
+
+func TestIdempotencySizeCap(t *testing.T) {
+	srv, hits, release := idempotentBackend(t)
+	cfg := idempotencyConfig(srv.URL)
+	cfg.IdempotencyCacheBytes = 400 // room for one stored response
+	cfg.IdempotencyMaxResponseBytes = 1024
+	lb := NewLoadBalancer(cfg)
+	cache := lb.idempotency
+
+	// A request stuck in flight mustn't stop anything behind it from being
+	// evicted.
+	slow := make(chan *httptest.ResponseRecorder, 1)
+	go func() { slow <- idempotentPost(lb, "/pay/slow", "stuck") }()
+	if !waitFor(func() bool { return hits.Load() == 1 }) {
+		t.Fatal("slow request never reached the backend")
+	}
+
+	idempotentPost(lb, "/pay/a", "a")
+	idempotentPost(lb, "/pay/b", "b")
+	cache.mu.Lock()
+	stored, keys := cache.stored, len(cache.calls)
+	cache.mu.Unlock()
+	if stored > cfg.IdempotencyCacheBytes || keys != 2 {
+		t.Errorf("cache holds %d bytes in %d keys, want at most %d bytes: b and the call in flight", stored, keys, cfg.IdempotencyCacheBytes)
+	}
+	if rec := idempotentPost(lb, "/pay/b", "b"); rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("newest response was evicted")
+	}
+	before := hits.Load()
+	if rec := idempotentPost(lb, "/pay/a", "a"); rec.Header().Get("Idempotent-Replayed") != "" || hits.Load() != before+1 {
+		t.Error("oldest response was kept over the size cap")
+	}
+
+	close(release)
+	if rec := <-slow; rec.Code != http.StatusCreated {
+		t.Errorf("slow request = %d", rec.Code)
+	}
+
+	// Responses over the per-response limit go through but can't be
+	// replayed.
+	if rec := idempotentPost(lb, "/pay/big", "big"); rec.Code != http.StatusCreated || rec.Body.Len() != 2048 {
+		t.Fatalf("big response = %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if rec := idempotentPost(lb, "/pay/big", "big"); rec.Code != http.StatusConflict {
+		t.Errorf("repeat of an unstorable response = %d, want 409", rec.Code)
+	}
+}
+
+func TestIdempotencyIsPerRoute(t *testing.T) {
+	srv, hits, _ := idempotentBackend(t)
+	lb := NewLoadBalancer(idempotencyConfig(srv.URL))
+
+	// Outside the opted-in route, or without a key, nothing is deduplicated.
+	for _, tt := range []struct{ path, key string }{{"/orders", "k"}, {"/pay/order", ""}} {
+		before := hits.Load()
+		idempotentPost(lb, tt.path, tt.key)
+		if rec := idempotentPost(lb, tt.path, tt.key); rec.Header().Get("Idempotent-Replayed") != "" || hits.Load() != before+2 {
+			t.Errorf("POST %s with key %q was deduplicated", tt.path, tt.key)
+		}
+	}
+
+	// With no route opting in there is no cache at all.
+	if lb := NewLoadBalancer(testConfig(srv.URL)); lb.idempotency != nil {
+		t.Error("idempotency cache created with no route using it")
+	}
+}
+
+func TestRequestSizeHistogram(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		fmt.Fprintf(w, "%d %x %d", len(body), sum, r.ContentLength)
+	}))
+	defer backend.Close()
+	cfg := testConfig(backend.URL)
+	cfg.MetricsEnabled = true
+	lb := NewLoadBalancer(cfg)
+
+	payload := func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i % 251)
+		}
+		return string(b)
+	}
+	tests := []struct {
+		name     string
+		body     string
+		streamed bool
+	}{
+		{"empty", "", false},
+		{"small", payload(100), false},
+		{"medium", payload(2000), false},
+		// An io.Reader with no known length goes out chunked.
+		{"streamed", payload(5000), true},
+	}
+	for _, tt := range tests {
+		var body io.Reader = strings.NewReader(tt.body)
+		if tt.streamed {
+			body = io.MultiReader(body)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		if tt.streamed {
+			req.ContentLength = -1
+		}
+		rec := serve(lb, req)
+		sum := sha256.Sum256([]byte(tt.body))
+		wantLength := int64(len(tt.body))
+		if tt.streamed {
+			wantLength = -1
+		}
+		if want := fmt.Sprintf("%d %x %d", len(tt.body), sum, wantLength); rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("%s: backend got %q, want %q", tt.name, rec.Body, want)
+		}
+	}
+
+	checkSizeHistogram(t, scrapeMetrics(t, lb), "lb_request_size_bytes", backend.URL, map[string]string{
+		"512": "2", "1024": "2", "4096": "3", "16384": "4", "65536": "4", "+Inf": "4",
+	}, "7100")
+	if p95 := backendStats(t, lb, backend.URL).RequestSizeP95; p95 <= 4096 || p95 > 16384 {
+		t.Errorf("request_size_p95 = %v, want it in the 4KiB-16KiB bucket", p95)
+	}
+}
+
+func TestRequestSizeCountsAbortedUploads(t *testing.T) {
+	// The backend gives up on the body after reading part of it.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.CopyN(io.Discard, r.Body, 1000)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	}))
+	defer backend.Close()
+	cfg := testConfig(backend.URL)
+	cfg.MetricsEnabled = true
+	lb := NewLoadBalancer(cfg)
+
+	serve(lb, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 1<<20))))
+	samples := scrapeMetrics(t, lb)
+	if got := samples[`lb_request_size_bytes_count{backend="`+backend.URL+`"}`]; got != "1" {
+		t.Fatalf("request size count = %q, want the aborted upload observed", got)
+	}
+	sum, _ := strconv.ParseFloat(samples[`lb_request_size_bytes_sum{backend="`+backend.URL+`"}`], 64)
+	if sum < 1000 || sum > 1<<20 {
+		t.Errorf("request size sum = %v, want what was read before the abort", sum)
+	}
+
+	// A request that never reached a backend has nothing to observe.
+	lb = NewLoadBalancer(testConfig())
+	if rec := serve(lb, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("x"))); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("request with no backends = %d, want 503", rec.Code)
+	}
+}
+
+// proxyV2Header builds a PROXY protocol v2 header with the given command
+// and address family.
+func proxyV2Header(command, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := append(net.ParseIP("203.0.113.7").To4(), 10, 0, 0, 1)
+	ipv4 = binary.BigEndian.AppendUint16(ipv4, 51000)
+	ipv4 = binary.BigEndian.AppendUint16(ipv4, 443)
+	ipv6 := append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::1").To16()...)
+	ipv6 = binary.BigEndian.AppendUint16(ipv6, 51000)
+	ipv6 = binary.BigEndian.AppendUint16(ipv6, 443)
+
+	tests := []struct {
+		name    string
+		header  []byte
+		want    string // "" for no address
+		wantErr bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 443\r\n"), "203.0.113.7:51000", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51000 443\r\n"), "[2001:db8::7]:51000", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 bad address", []byte("PROXY TCP4 nonsense 10.0.0.1 51000 443\r\n"), "", true},
+		{"v1 without CRLF", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 443\n"), "", true},
+		{"v2 PROXY TCP4", proxyV2Header(0x1, 0x11, ipv4), "203.0.113.7:51000", false},
+		{"v2 PROXY TCP6", proxyV2Header(0x1, 0x21, ipv6), "[2001:db8::7]:51000", false},
+		{"v2 LOCAL", proxyV2Header(0x0, 0x00, nil), "", false},
+		{"v2 short address block", proxyV2Header(0x1, 0x11, ipv4[:8]), "", true},
+		{"v2 truncated payload", proxyV2Header(0x1, 0x11, ipv4)[:16+6], "", true},
+		{"missing header", []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"), "", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// The connection ends after a bad header, e.g. mid-payload.
+			input := string(tc.header)
+			if !tc.wantErr {
+				input += "GET / HTTP/1.1\r\n"
+			}
+			reader := bufio.NewReader(strings.NewReader(input))
+			addr, err := readProxyHeader(reader)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tc.want {
+				t.Errorf("address = %q, want %q", got, tc.want)
+			}
+			if rest, _ := io.ReadAll(reader); string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("left %q after the header, want the request untouched", rest)
+			}
+		})
+	}
+}
+
+// proxyProtocolServer serves clientIP(r.RemoteAddr) behind a PROXY protocol
+// listener trusting cidrs.
+func proxyProtocolServer(t *testing.T, cidrs ...string) string {
+	t.Helper()
+	trusted, err := parseCIDRs(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newProxyProtocolListener(inner, trusted)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, clientIP(r.RemoteAddr))
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return inner.Addr().String()
+}
+
+// proxyRoundTrip sends header followed by a GET and returns everything the
+// server writes back before closing the connection.
+func proxyRoundTrip(t *testing.T, addr string, header []byte) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(append(header, "GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n"...))
+	resp, _ := io.ReadAll(conn)
+	return string(resp)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	captureLog(t)
+	addr := proxyProtocolServer(t, "127.0.0.0/8")
+
+	tests := []struct {
+		name   string
+		header []byte
+		status string
+		body   string
+	}{
+		{"v1", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 443\r\n"), "200", "203.0.113.7"},
+		{"v2", proxyV2Header(0x1, 0x21, append(append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::1").To16()...), 0xc7, 0x38, 0x01, 0xbb)), "200", "2001:db8::7"},
+		{"v2 LOCAL keeps the peer", proxyV2Header(0x0, 0x00, nil), "200", "127.0.0.1"},
+		{"missing header", nil, "400", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := proxyRoundTrip(t, addr, tc.header)
+			if !strings.HasPrefix(resp, "HTTP/1.1 "+tc.status+" ") {
+				t.Fatalf("got %q, want status %s", resp, tc.status)
+			}
+			if _, body, _ := strings.Cut(resp, "\r\n\r\n"); body != tc.body {
+				t.Errorf("handler saw client %q, want %q", body, tc.body)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolListenerRejectsUntrustedPeer(t *testing.T) {
+	logs := captureLog(t)
+	addr := proxyProtocolServer(t, "10.0.0.0/8")
+
+	if resp := proxyRoundTrip(t, addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 443\r\n")); resp != "" {
+		t.Errorf("untrusted peer got %q, want the connection closed unanswered", resp)
+	}
+	if !strings.Contains(logs.String(), "untrusted PROXY protocol peer 127.0.0.1") {
+		t.Errorf("rejection not logged: %q", logs)
+	}
+}
+
+func TestDebugRequestHeaders(t *testing.T) {
+	echo, _ := headerEchoBackend(t)
+	dead := deadBackendURL(t)
+	tests := []struct {
+		name       string
+		adminToken string
+		token      string
+		wantDebug  bool
+	}{
+		{"valid token", "secret", "secret", true},
+		{"wrong token", "secret", "guess", false},
+		{"no token", "secret", "", false},
+		{"no admin token configured", "", "secret", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			captureLog(t)
+			cfg := testConfig()
+			cfg.AdminToken = tc.adminToken
+			cfg.Backends = []BackendConfig{{URL: echo.URL}, {URL: dead}}
+			lb := NewLoadBalancer(cfg)
+			lb.backends[1].SetAlive(false)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.token != "" {
+				req.Header.Set("X-LB-Debug", tc.token)
+			}
+			rec := serve(lb, req)
+			var seen http.Header
+			if err := json.NewDecoder(rec.Body).Decode(&seen); err != nil {
+				t.Fatalf("decoding backend headers: %v", err)
+			}
+			if _, ok := seen["X-Lb-Debug"]; ok {
+				t.Errorf("X-LB-Debug reached the backend: %q", seen["X-Lb-Debug"])
+			}
+
+			debug := map[string]string{
+				"X-LB-Debug-Route":      "none",
+				"X-LB-Debug-Strategy":   "round_robin; pool=default",
+				"X-LB-Debug-Candidates": "1; selected=" + echo.URL,
+				"X-LB-Debug-Skipped":    dead + " (down)",
+				"X-LB-Debug-Attempts":   "1 " + echo.URL,
+			}
+			for name, want := range debug {
+				got := rec.Header().Get(name)
+				if !tc.wantDebug {
+					want = ""
+				}
+				if got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if timing := rec.Header().Get("X-LB-Debug-Timing"); (timing != "") != tc.wantDebug {
+				t.Errorf("X-LB-Debug-Timing = %q, want it only on debug requests", timing)
+			}
+		})
+	}
+}
+
+func TestDebugRequestKeepsRouting(t *testing.T) {
+	a, b, c := namedBackend(t, "a"), namedBackend(t, "b"), namedBackend(t, "c")
+	cfg := testConfig()
+	cfg.AdminToken = "secret"
+	cfg.Backends = []BackendConfig{{URL: a.URL}, {URL: b.URL}, {URL: c.URL}}
+	lb := NewLoadBalancer(cfg)
+
+	// Debug requests take their turn in the rotation like any other.
+	var order []string
+	for i := range 6 {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if i%2 == 0 {
+			req.Header.Set("X-LB-Debug", "secret")
+		}
+		order = append(order, serve(lb, req).Body.String())
+	}
+	if want := []string{"a", "b", "c", "a", "b", "c"}; !slices.Equal(order, want) {
+		t.Errorf("mixed debug requests went to %v, want %v", order, want)
+	}
+}
+
+// rateLimitedBackend sends X-RateLimit-* headers of its own.
+func rateLimitedBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "1000")
+		w.Header().Set("X-RateLimit-Remaining", "999")
+		w.Header().Set("X-RateLimit-Reset", "60")
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestBackendRateLimit(t *testing.T) {
+	limited, open := rateLimitedBackend(t), namedBackend(t, "open")
+	cfg := testConfig()
+	cfg.Routes = []RouteConfig{{PathPattern: "/open/*", Pool: "open"}}
+	cfg.Backends = []BackendConfig{{URL: limited.URL, RateLimitRPS: 1, RateLimitBurst: 2}, {URL: open.URL, Pool: "open"}}
+	lb := NewLoadBalancer(cfg)
+	captureLog(t)
+
+	// The bucket is shared by all clients.
+	var rec *httptest.ResponseRecorder
+	for i, want := range []struct {
+		status           int
+		remaining, reset string
+	}{
+		{http.StatusOK, "1", "1"},
+		{http.StatusOK, "0", "2"},
+		{http.StatusTooManyRequests, "0", "2"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = fmt.Sprintf("203.0.113.%d:1234", i+1)
+		rec = serve(lb, req)
+		if rec.Code != want.status {
+			t.Errorf("request %d: status = %d, want %d", i+1, rec.Code, want.status)
+		}
+		for name, value := range map[string]string{
+			"X-RateLimit-Limit":     "2",
+			"X-RateLimit-Remaining": want.remaining,
+			"X-RateLimit-Reset":     want.reset,
+		} {
+			// The backend's own values must not come along.
+			if got := rec.Header().Values(name); len(got) != 1 || got[0] != value {
+				t.Errorf("request %d: %s = %q, want only %q", i+1, name, got, value)
+			}
+		}
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q on the rejected request, want 1", got)
+	}
+
+	// Other backends aren't limited by it.
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/open/x", nil)); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "" {
+		t.Errorf("unlimited backend got %d with X-RateLimit-Limit %q", rec.Code, rec.Header().Get("X-RateLimit-Limit"))
+	}
+}
+
+func TestClientRateLimitReplacesBackendHeaders(t *testing.T) {
+	cfg := testConfig(rateLimitedBackend(t).URL)
+	cfg.RateLimitRPS = 5
+	lb := NewLoadBalancer(cfg)
+
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := rec.Header().Values("X-RateLimit-Limit"); !slices.Equal(got, []string{"5"}) {
+		t.Errorf("X-RateLimit-Limit = %q, want only the balancer's", got)
+	}
+	if got := rec.Header().Values("X-RateLimit-Remaining"); !slices.Equal(got, []string{"4"}) {
+		t.Errorf("X-RateLimit-Remaining = %q, want only the balancer's", got)
+	}
+
+	// Without a limit of our own the backend's headers pass through.
+	lb = NewLoadBalancer(testConfig(rateLimitedBackend(t).URL))
+	if got := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)).Header().Get("X-RateLimit-Limit"); got != "1000" {
+		t.Errorf("X-RateLimit-Limit = %q without a balancer limit, want the backend's", got)
+	}
+}
+
+// forwardAuthLB sends /api/* through the auth service served by auth to
+// a backend echoing its request headers.
+func forwardAuthLB(t *testing.T, auth http.HandlerFunc, configure func(*Config)) (*LoadBalancer, *atomic.Int64) {
+	t.Helper()
+	authSrv := httptest.NewServer(auth)
+	t.Cleanup(authSrv.Close)
+	echo, hits := headerEchoBackend(t)
+	cfg := testConfig(echo.URL)
+	cfg.Routes = []RouteConfig{{PathPattern: "/api/*", ForwardAuthURL: authSrv.URL + "/check"}}
+	if configure != nil {
+		configure(cfg)
+	}
+	return NewLoadBalancer(cfg), hits
+}
+
+func TestForwardAuthAllowCopiesHeaders(t *testing.T) {
+	var seen atomic.Pointer[http.Request]
+	var authBody atomic.Int64
+	lb, hits := forwardAuthLB(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		authBody.Store(int64(len(body)))
+		seen.Store(r)
+		w.Header().Set("X-Auth-User", "alice")
+		w.Header().Set("X-Auth-Internal", "not copied")
+		w.WriteHeader(http.StatusNoContent)
+	}, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/orders?id=7", strings.NewReader("payload"))
+	req.Header.Set("Authorization", "Bearer t")
+	req.Header.Set("X-Auth-User", "mallory")
+	rec := serve(lb, req)
+	if rec.Code != http.StatusOK || hits.Load() != 1 {
+		t.Fatalf("allowed request got %d with %d backend hits, want 200 and 1", rec.Code, hits.Load())
+	}
+	var upstream http.Header
+	json.NewDecoder(rec.Body).Decode(&upstream)
+	if got := upstream.Values("X-Auth-User"); !slices.Equal(got, []string{"alice"}) {
+		t.Errorf("backend saw X-Auth-User %q, want only the auth service's", got)
+	}
+	if got := upstream.Get("X-Auth-Internal"); got != "" {
+		t.Errorf("backend saw unlisted auth header X-Auth-Internal %q", got)
+	}
+
+	auth := seen.Load()
+	for name, want := range map[string]string{
+		"Authorization":      "Bearer t",
+		"X-Forwarded-Method": "POST",
+		"X-Forwarded-Uri":    "/api/orders?id=7",
+		"X-Forwarded-Proto":  "http",
+	} {
+		if got := auth.Header.Get(name); got != want {
+			t.Errorf("auth subrequest %s = %q, want %q", name, got, want)
+		}
+	}
+	if auth.Method != http.MethodPost || authBody.Load() != 0 {
+		t.Errorf("auth subrequest was %s with a %d-byte body, want POST without the body", auth.Method, authBody.Load())
+	}
+}
+
+func TestForwardAuthDenyIsRelayed(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		lb, hits := forwardAuthLB(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			w.WriteHeader(status)
+			io.WriteString(w, "go away")
+		}, nil)
+		captureLog(t)
+
+		rec := serve(lb, httptest.NewRequest(http.MethodGet, "/api/orders", nil))
+		if rec.Code != status || rec.Body.String() != "go away" || rec.Header().Get("WWW-Authenticate") != `Bearer realm="api"` {
+			t.Errorf("denied with %d: client got %d %q (WWW-Authenticate %q), want the auth response verbatim",
+				status, rec.Code, rec.Body, rec.Header().Get("WWW-Authenticate"))
+		}
+		if hits.Load() != 0 {
+			t.Errorf("denied with %d: backend got %d requests, want none", status, hits.Load())
+		}
+	}
+}
+
+func TestForwardAuthFailurePolicy(t *testing.T) {
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}
+	broken := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	tests := []struct {
+		name       string
+		auth       http.HandlerFunc
+		failOpen   bool
+		wantStatus int
+		wantHits   int64
+	}{
+		{"timeout, fail closed", slow, false, http.StatusServiceUnavailable, 0},
+		{"timeout, fail open", slow, true, http.StatusOK, 1},
+		{"error status, fail closed", broken, false, http.StatusServiceUnavailable, 0},
+		{"error status, fail open", broken, true, http.StatusOK, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			captureLog(t)
+			lb, hits := forwardAuthLB(t, tc.auth, func(cfg *Config) {
+				cfg.ForwardAuthTimeout = 50 * time.Millisecond
+				cfg.ForwardAuthFailOpen = tc.failOpen
+			})
+			start := time.Now()
+			rec := serve(lb, httptest.NewRequest(http.MethodGet, "/api/orders", nil))
+			if rec.Code != tc.wantStatus || hits.Load() != tc.wantHits {
+				t.Errorf("got %d with %d backend hits, want %d and %d", rec.Code, hits.Load(), tc.wantStatus, tc.wantHits)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("request took %v, want the auth timeout to cut it short", elapsed)
+			}
+		})
+	}
+}
+
+func TestForwardAuthOnlyOnConfiguredRoutes(t *testing.T) {
+	var checks atomic.Int64
+	lb, hits := forwardAuthLB(t, func(w http.ResponseWriter, r *http.Request) {
+		checks.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+	}, nil)
+
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/public", nil)); rec.Code != http.StatusOK || checks.Load() != 0 || hits.Load() != 1 {
+		t.Errorf("request outside the route got %d after %d auth checks, want 200 without one", rec.Code, checks.Load())
+	}
+}
+
+func TestForwardAuthCachesPerToken(t *testing.T) {
+	var checks atomic.Int64
+	lb, _ := forwardAuthLB(t, func(w http.ResponseWriter, r *http.Request) {
+		checks.Add(1)
+		w.Header().Set("X-Auth-User", strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	}, func(cfg *Config) {
+		cfg.ForwardAuthCacheTTL = time.Minute
+	})
+
+	user := func(token string) string {
+		req := httptest.NewRequest(http.MethodGet, "/api/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		var upstream http.Header
+		json.NewDecoder(serve(lb, req).Body).Decode(&upstream)
+		return upstream.Get("X-Auth-User")
+	}
+	for _, token := range []string{"a", "a", "b", "a"} {
+		if got := user(token); got != token {
+			t.Errorf("token %s reached the backend as %q", token, got)
+		}
+	}
+	if checks.Load() != 2 {
+		t.Errorf("%d auth checks for two distinct tokens, want 2", checks.Load())
+	}
+}
+
+// coalesceWaiters reports how many requests wait on the in-flight call
+// for key, or -1 if there is none.
+func coalesceWaiters(c *coalescer, key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call, ok := c.calls[key]; ok {
+		return call.waiters
+	}
+	return -1
+}
+
+// coalesceRequests sends n identical GETs through lb, starting the rest
+// once the first is in flight, and returns their responses.
+func coalesceRequests(t *testing.T, lb *LoadBalancer, n int, release func()) []*httptest.ResponseRecorder {
+	t.Helper()
+	key := lb.coalescer.key(httptest.NewRequest(http.MethodGet, "/shared", nil))
+	recs := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i] = serve(lb, httptest.NewRequest(http.MethodGet, "/shared", nil))
+		}()
+		if i == 0 && !waitFor(func() bool { return coalesceWaiters(lb.coalescer, key) == 0 }) {
+			t.Fatal("first request never became the leader")
+		}
+	}
+	if !waitFor(func() bool {
+		return coalesceWaiters(lb.coalescer, key)+int(lb.coalescer.bypassed.Load()) == n-1
+	}) {
+		t.Fatalf("waiters = %d, want %d", coalesceWaiters(lb.coalescer, key), n-1)
+	}
+	release()
+	wg.Wait()
+	return recs
+}
+
+func TestCoalescingSharesOneBackendRequest(t *testing.T) {
+	srv, gate, served := gatedBackend(t)
+	cfg := testConfig(srv.URL)
+	cfg.CoalesceEnabled = true
+	lb := NewLoadBalancer(cfg)
+
+	recs := coalesceRequests(t, lb, 5, func() { close(gate) })
+	for i, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != "/shared" {
+			t.Errorf("request %d: %d %q, want 200 /shared", i, rec.Code, rec.Body.String())
+		}
+	}
+	if got := served.Load(); got != 1 {
+		t.Errorf("backend served %d requests, want 1", got)
+	}
+	if leaders, coalesced := lb.coalescer.leaders.Load(), lb.coalescer.coalesced.Load(); leaders != 1 || coalesced != 4 {
+		t.Errorf("leaders = %d, coalesced = %d; want 1 and 4", leaders, coalesced)
+	}
+}
+
+func TestCoalescingLimits(t *testing.T) {
+	t.Run("max waiters", func(t *testing.T) {
+		srv, gate, served := gatedBackend(t)
+		cfg := testConfig(srv.URL)
+		cfg.CoalesceEnabled = true
+		cfg.CoalesceMaxWaiters = 2
+		lb := NewLoadBalancer(cfg)
+
+		coalesceRequests(t, lb, 5, func() { close(gate) })
+		if got := served.Load(); got != 3 {
+			t.Errorf("backend served %d requests, want 3 (leader and 2 bypassed)", got)
+		}
+		if coalesced, bypassed := lb.coalescer.coalesced.Load(), lb.coalescer.bypassed.Load(); coalesced != 2 || bypassed != 2 {
+			t.Errorf("coalesced = %d, bypassed = %d; want 2 and 2", coalesced, bypassed)
+		}
+	})
+
+	t.Run("max body", func(t *testing.T) {
+		srv, gate, served := gatedBackend(t)
+		cfg := testConfig(srv.URL)
+		cfg.CoalesceEnabled = true
+		cfg.CoalesceMaxBodyBytes = 3
+		lb := NewLoadBalancer(cfg)
+
+		recs := coalesceRequests(t, lb, 3, func() { close(gate) })
+		for i, rec := range recs {
+			if rec.Body.String() != "/shared" {
+				t.Errorf("request %d body = %q, want /shared", i, rec.Body.String())
+			}
+		}
+		if got := served.Load(); got != 3 {
+			t.Errorf("backend served %d requests, want 3", got)
+		}
+		if got := lb.coalescer.oversized.Load(); got != 2 {
+			t.Errorf("oversized = %d, want 2", got)
+		}
+	})
+}
+
+func TestCoalescingSharesLeaderError(t *testing.T) {
+	gate := make(chan struct{})
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-gate
+		// Drop the connection so the attempt fails at the transport.
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+	cfg := testConfig(srv.URL)
+	cfg.CoalesceEnabled = true
+	cfg.MaxRetries = 2
+	lb := NewLoadBalancer(cfg)
+
+	recs := coalesceRequests(t, lb, 4, func() { close(gate) })
+	for i, rec := range recs {
+		if rec.Code != http.StatusBadGateway {
+			t.Errorf("request %d: status %d, want 502", i, rec.Code)
+		}
+	}
+	// Only the leader's attempts reach the backend; waiters don't retry.
+	if got := hits.Load(); got != 3 {
+		t.Errorf("backend hit %d times, want 3 (one request and 2 retries)", got)
+	}
+}
+
+func TestTotalRequestTimeoutBoundsRetries(t *testing.T) {
+	slow, hits := sleepyBackend(t, "slow", 200*time.Millisecond)
+	cfg := testConfig(slow.URL)
+	cfg.BackendTimeout = 100 * time.Millisecond
+	cfg.MaxRetries = 5
+	cfg.TotalRequestTimeout = 250 * time.Millisecond
+	lb := NewLoadBalancer(cfg)
+	logs := captureLog(t)
+
+	start := time.Now()
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	elapsed := time.Since(start)
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", rec.Code)
+	}
+	// Six attempts of 100ms each would take 600ms without the deadline.
+	if elapsed > 450*time.Millisecond {
+		t.Errorf("request took %v, want about 250ms", elapsed)
+	}
+	if got := hits.Load(); got > 3 {
+		t.Errorf("backend hit %d times, want at most 3", got)
+	}
+	if !strings.Contains(logs.String(), "Total request timeout (250ms) exceeded") ||
+		!strings.Contains(logs.String(), "attempt time:") {
+		t.Errorf("log does not record the timeout breakdown:\n%s", logs)
+	}
+}
+
+func TestTotalRequestTimeoutCoversQueueing(t *testing.T) {
+	srv, gate, _ := gatedBackend(t)
+	t.Cleanup(func() { close(gate) })
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: srv.URL, MaxConcurrentRequests: 1, MaxQueueLength: 1, QueueTimeout: 5 * time.Second}}
+	cfg.TotalRequestTimeout = 100 * time.Millisecond
+	lb := NewLoadBalancer(cfg)
+	backend := lb.getBackends()[0]
+	logs := captureLog(t)
+
+	// The first request holds the only slot until it times out.
+	go serve(lb, httptest.NewRequest(http.MethodGet, "/first", nil))
+	if !waitFor(func() bool { return backend.active.Load() == 1 }) {
+		t.Fatal("first request never reached the backend")
+	}
+	start := time.Now()
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/queued", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("queued request took %v, want about 100ms", elapsed)
+	}
+	// The access log splits the time between the queue and the attempt.
+	if !regexp.MustCompile(`GET /queued 504 .* \(queue: [^,]+, attempts: 1, attempt time: `).MatchString(logs.String()) {
+		t.Errorf("log does not break down the queued request's time:\n%s", logs)
+	}
+}
+
+func TestCompareCanary(t *testing.T) {
+	tests := []struct {
+		name           string
+		stable, canary PoolStats
+		want           string
+	}{
+		{"no stable traffic", PoolStats{}, PoolStats{Requests: 10, ErrorRate: 50}, "insufficient_data"},
+		{"no canary traffic", PoolStats{Requests: 10}, PoolStats{}, "insufficient_data"},
+		{"same error rate", PoolStats{Requests: 10, ErrorRate: 10}, PoolStats{Requests: 10, ErrorRate: 10}, "pass"},
+		{"within margin", PoolStats{Requests: 10, ErrorRate: 10}, PoolStats{Requests: 10, ErrorRate: 12}, "pass"},
+		{"over margin", PoolStats{Requests: 10, ErrorRate: 10}, PoolStats{Requests: 10, ErrorRate: 12.5}, "fail"},
+		{"canary better", PoolStats{Requests: 10, ErrorRate: 30}, PoolStats{Requests: 10}, "pass"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := compareCanary(tt.stable, tt.canary, 2)
+			if report.Verdict != tt.want {
+				t.Errorf("verdict = %q, want %q", report.Verdict, tt.want)
+			}
+			if report.ErrorRateDelta != tt.canary.ErrorRate-tt.stable.ErrorRate || report.MaxErrorRateDelta != 2 {
+				t.Errorf("delta = %v, max = %v", report.ErrorRateDelta, report.MaxErrorRateDelta)
+			}
+		})
+	}
+}
+
+func TestSummarizePool(t *testing.T) {
+	var samples []requestSample
+	for i := 1; i <= 100; i++ {
+		samples = append(samples, requestSample{duration: time.Duration(i) * time.Millisecond, failed: i%4 == 0})
+	}
+	stats := summarizePool("stable", samples)
+	want := PoolStats{Pool: "stable", Requests: 100, Errors: 25, ErrorRate: 25, P50Ms: 50, P90Ms: 90, P99Ms: 99}
+	if stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+// newCanaryLB returns a balancer sending half its traffic to a canary pool
+// whose backend answers with canaryStatus. configure, if set, adjusts the
+// configuration first.
+func newCanaryLB(t *testing.T, canaryStatus int, configure func(*Config)) *LoadBalancer {
+	t.Helper()
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(canaryStatus)
+	}))
+	t.Cleanup(canary.Close)
+	cfg := testConfig()
+	cfg.AdminToken = "secret"
+	cfg.Backends = []BackendConfig{{URL: namedBackend(t, "stable").URL}, {URL: canary.URL, Pool: "canary"}}
+	cfg.CanaryWeight = 50
+	if configure != nil {
+		configure(cfg)
+	}
+	return NewLoadBalancer(cfg)
+}
+
+func TestCanaryReportEndpoint(t *testing.T) {
+	lb := newCanaryLB(t, http.StatusInternalServerError, nil)
+	for range 200 {
+		serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	rec := serve(lb, adminRequest(lb, http.MethodGet, "/admin/canary/report?window=1m", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var report CanaryReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Window != "1m0s" || report.Verdict != "fail" {
+		t.Errorf("window = %q, verdict = %q; want 1m0s and fail", report.Window, report.Verdict)
+	}
+	if report.Stable.Pool != "default" || report.Canary.Pool != "canary" ||
+		report.Stable.Requests+report.Canary.Requests != 200 || report.Stable.Requests == 0 || report.Canary.Requests == 0 {
+		t.Errorf("stable = %+v, canary = %+v; want 200 requests split between both", report.Stable, report.Canary)
+	}
+	if report.Stable.ErrorRate != 0 || report.Canary.ErrorRate != 100 || report.ErrorRateDelta != 100 {
+		t.Errorf("error rates: stable %v, canary %v, delta %v", report.Stable.ErrorRate, report.Canary.ErrorRate, report.ErrorRateDelta)
+	}
+
+	if rec := serve(lb, adminRequest(lb, http.MethodGet, "/admin/canary/report?window=soon", "")); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid window: status %d, want 400", rec.Code)
+	}
+}
+
+func auditActions(lb *LoadBalancer) []string {
+	lb.auditMu.Lock()
+	defer lb.auditMu.Unlock()
+	var actions []string
+	for _, entry := range lb.auditLog {
+		actions = append(actions, entry.Actor+" "+entry.Action)
+	}
+	return actions
+}
+
+func TestCanaryAutoRollback(t *testing.T) {
+	alerts := make(chan map[string]any, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert map[string]any
+		json.NewDecoder(r.Body).Decode(&alert)
+		alerts <- alert
+	}))
+	defer webhook.Close()
+	lb := newCanaryLB(t, http.StatusInternalServerError, func(cfg *Config) {
+		cfg.CanaryAutoRollback = true
+		cfg.CanaryRollbackSustain = 50 * time.Millisecond
+		cfg.AlertWebhookURL = webhook.URL
+	})
+	for range 100 {
+		serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	// The first failing evaluation only starts the sustain period.
+	lb.evaluateCanary()
+	if got := lb.getCanaryWeight(); got != 50 {
+		t.Fatalf("weight = %v right after the canary started failing, want 50", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	lb.evaluateCanary()
+	if got := lb.getCanaryWeight(); got != 0 {
+		t.Fatalf("weight = %v after sustained failure, want 0", got)
+	}
+	if got := auditActions(lb); !slices.Contains(got, "auto-rollback canary_rollback") {
+		t.Errorf("audit log = %v, want an auto-rollback entry", got)
+	}
+	select {
+	case alert := <-alerts:
+		if alert["event"] != "canary_rollback" {
+			t.Errorf("alert = %v, want canary_rollback", alert)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("no alert for the rollback")
+	}
+
+	// Traffic all goes to stable and the weight can't be raised again
+	// without re-enabling first.
+	for i := range 20 {
+		if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Body.String() != "stable" {
+			t.Fatalf("request %d after rollback served by %q", i, rec.Body)
+		}
+	}
+	if rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/canary/weight", `{"weight": 10}`)); rec.Code != http.StatusConflict {
+		t.Errorf("weight change while rolled back: status %d, want 409", rec.Code)
+	}
+	rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/canary/reenable", ""))
+	if rec.Code != http.StatusOK || lb.getCanaryWeight() != 50 {
+		t.Errorf("re-enable: status %d, weight %v; want 200 and 50", rec.Code, lb.getCanaryWeight())
+	}
+	if rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/canary/reenable", "")); rec.Code != http.StatusConflict {
+		t.Errorf("second re-enable: status %d, want 409", rec.Code)
+	}
+	if got := auditActions(lb); !slices.Contains(got, "admin canary_reenable") {
+		t.Errorf("audit log = %v, want the admin re-enable", got)
+	}
+}
+
+func TestCanaryAutoRollbackDryRun(t *testing.T) {
+	lb := newCanaryLB(t, http.StatusInternalServerError, func(cfg *Config) {
+		cfg.CanaryAutoRollback = true
+		cfg.CanaryRollbackDryRun = true
+		cfg.CanaryRollbackSustain = 0
+	})
+	for range 100 {
+		serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	lb.evaluateCanary()
+	if got := lb.getCanaryWeight(); got != 50 {
+		t.Errorf("weight = %v in dry-run mode, want 50", got)
+	}
+	if got := auditActions(lb); !slices.Equal(got, []string{"auto-rollback canary_rollback_dry_run"}) {
+		t.Errorf("audit log = %v, want only the dry-run entry", got)
+	}
+}
+
+func TestCanaryAutoRollbackNeedsEvidence(t *testing.T) {
+	t.Run("healthy canary", func(t *testing.T) {
+		lb := newCanaryLB(t, http.StatusOK, func(cfg *Config) {
+			cfg.CanaryAutoRollback = true
+			cfg.CanaryRollbackSustain = 0
+		})
+		for range 100 {
+			serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+		lb.evaluateCanary()
+		if got := lb.getCanaryWeight(); got != 50 {
+			t.Errorf("weight = %v, want 50", got)
+		}
+	})
+
+	t.Run("too few requests", func(t *testing.T) {
+		lb := newCanaryLB(t, http.StatusInternalServerError, func(cfg *Config) {
+			cfg.CanaryAutoRollback = true
+			cfg.CanaryRollbackSustain = 0
+		})
+		for range 10 {
+			serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+		lb.evaluateCanary()
+		if got := lb.getCanaryWeight(); got != 50 {
+			t.Errorf("weight = %v with under CANARY_ROLLBACK_MIN_REQUESTS requests, want 50", got)
+		}
+	})
+}
+
+// keepAliveGet sends a GET on conn and returns the response status,
+// leaving the connection open.
+func keepAliveGet(t *testing.T, conn net.Conn, r *bufio.Reader) int {
+	t.Helper()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: lb\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func connLimitStats(t *testing.T, lb *LoadBalancer) ConnStats {
+	t.Helper()
+	var stats Stats
+	rec := serve(lb, adminRequest(lb, http.MethodGet, "/admin/stats", ""))
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil || stats.Connections == nil {
+		t.Fatalf("stats without connections (%v): %s", err, rec.Body)
+	}
+	return *stats.Connections
+}
+
+func TestMaxConnsPerClient(t *testing.T) {
+	cfg := testConfig(namedBackend(t, "backend").URL)
+	cfg.Listeners = []ListenerConfig{{Address: freeAddress(t)}}
+	cfg.AdminToken = "secret"
+	cfg.MaxConnsPerClient = 2
+	lb := NewLoadBalancer(cfg)
+	startListeners(t, lb)
+	address := cfg.Listeners[0].Address
+	// startListeners' probe connection may still be being released.
+	waitFor(func() bool { return connLimitStats(t, lb).Open == 0 })
+
+	var conns []net.Conn
+	for i := range 3 {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		want := http.StatusOK
+		if i == 2 {
+			want = http.StatusTooManyRequests
+		}
+		if got := keepAliveGet(t, conn, bufio.NewReader(conn)); got != want {
+			t.Errorf("connection %d: status %d, want %d", i+1, got, want)
+		}
+		conns = append(conns, conn)
+	}
+
+	// The rejected connection is closed, leaving the two allowed ones.
+	if !waitFor(func() bool { return connLimitStats(t, lb).Open == 2 }) {
+		t.Errorf("open connections = %d, want 2", connLimitStats(t, lb).Open)
+	}
+	stats := connLimitStats(t, lb)
+	if stats.Limit != 2 || stats.Rejected != 1 {
+		t.Errorf("limit = %d, rejected = %d; want 2 and 1", stats.Limit, stats.Rejected)
+	}
+	if len(stats.TopClients) != 1 || stats.TopClients[0] != (ClientConnCount{Client: "127.0.0.1", Connections: 2}) {
+		t.Errorf("top clients = %+v, want 127.0.0.1 with 2", stats.TopClients)
+	}
+
+	// Closing one makes room for another.
+	conns[0].Close()
+	if !waitFor(func() bool { return connLimitStats(t, lb).Open == 1 }) {
+		t.Fatal("closed connection never released")
+	}
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := keepAliveGet(t, conn, bufio.NewReader(conn)); got != http.StatusOK {
+		t.Errorf("connection after one closed: status %d, want 200", got)
+	}
+}
+
+func TestMaxConnsPerClientExemptCIDRs(t *testing.T) {
+	cfg := testConfig(namedBackend(t, "backend").URL)
+	cfg.Listeners = []ListenerConfig{{Address: freeAddress(t)}}
+	cfg.MaxConnsPerClient = 1
+	cfg.ConnLimitExemptCIDRs = []string{"127.0.0.0/8"}
+	lb := NewLoadBalancer(cfg)
+	startListeners(t, lb)
+
+	for i := range 3 {
+		conn, err := net.Dial("tcp", cfg.Listeners[0].Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if got := keepAliveGet(t, conn, bufio.NewReader(conn)); got != http.StatusOK {
+			t.Errorf("exempt connection %d: status %d, want 200", i+1, got)
+		}
+	}
+}
+
+// sizedBackend answers with size bytes of the content type named by the
+// type query parameter, streamed without a Content-Length if chunked is set.
+func sizedBackend(t *testing.T, size int) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		if r.URL.Query().Get("chunked") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+		}
+		for range size / 100 {
+			w.Write([]byte(strings.Repeat("x", 100)))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestMaxResponseBodyBytes(t *testing.T) {
+	backend, hits := sizedBackend(t, 1000)
+	cfg := testConfig(backend.URL)
+	cfg.MaxResponseBodyBytes = 500
+	cfg.MaxRetries = 2
+	cfg.ResponseLimitExemptPaths = []string{"/downloads/*"}
+	lb := NewLoadBalancer(cfg)
+	front := httptest.NewServer(lb)
+	defer front.Close()
+	logs := captureLog(t)
+
+	get := func(target string) (*http.Response, []byte, error) {
+		resp, err := http.Get(front.URL + target)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, body, err
+	}
+
+	t.Run("known length fails the request", func(t *testing.T) {
+		hits.Store(0)
+		resp, body, err := get("/report?type=application/json")
+		if err != nil || resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("got %v, %v; want 502", resp, err)
+		}
+		if strings.Contains(string(body), "xxx") {
+			t.Errorf("partial backend body reached the client: %q", body)
+		}
+		if got := hits.Load(); got != 1 {
+			t.Errorf("backend hit %d times, want 1 (an oversized response isn't retried)", got)
+		}
+	})
+
+	t.Run("streamed body is cut, not truncated silently", func(t *testing.T) {
+		_, body, err := get("/report?type=application/json&chunked=1")
+		if err == nil {
+			t.Fatalf("read %d bytes without error, want the connection aborted", len(body))
+		}
+		if len(body) > 500 {
+			t.Errorf("client got %d bytes, over the 500 byte limit", len(body))
+		}
+	})
+
+	for _, target := range []string{"/events?type=text/event-stream&chunked=1", "/downloads/dump?type=application/octet-stream"} {
+		t.Run("exempt "+target, func(t *testing.T) {
+			resp, body, err := get(target)
+			if err != nil || resp.StatusCode != http.StatusOK || len(body) != 1000 {
+				t.Errorf("got %d bytes (%v), want the full 1000", len(body), err)
+			}
+		})
+	}
+
+	if got := lb.oversizedResponses.Load(); got != 2 {
+		t.Errorf("oversized responses = %d, want 2", got)
+	}
+	if !strings.Contains(logs.String(), "Cutting response from "+backend.URL+" for /report at 500 bytes") {
+		t.Errorf("log does not name the backend and path:\n%s", logs)
+	}
+}
+
+func TestRewriteLocationEdgeCases(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", r.URL.Query().Get("to"))
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	cfg := testConfig(srv.URL)
+	cfg.RewriteLocationHeaders = true
+	cfg.LocationInternalHosts = []string{"Internal-Backend:8080"}
+	lb := NewLoadBalancer(cfg)
+	self := strings.TrimPrefix(srv.URL, "http://")
+	_, port, _ := net.SplitHostPort(self)
+
+	tests := []struct {
+		name, to string
+		status   int
+		want     string
+	}{
+		{"query and fragment kept", "http://" + self + "/a/b?x=1&y=2#frag", http.StatusMovedPermanently, "http://public.example:8443/a/b?x=1&y=2#frag"},
+		{"host case ignored", "http://INTERNAL-backend:8080/login", http.StatusFound, "http://public.example:8443/login"},
+		{"scheme-relative", "//" + self + "/login", http.StatusSeeOther, "http://public.example:8443/login"},
+		{"path-relative", "../login?next=/", http.StatusFound, "../login?next=/"},
+		{"third party on the backend's port", "http://other.example:" + port + "/x", http.StatusFound, "http://other.example:" + port + "/x"},
+		{"not a redirect", "http://" + self + "/items/1", http.StatusCreated, "http://" + self + "/items/1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			target := "http://public.example:8443/old?status=" + strconv.Itoa(tc.status) + "&to=" + url.QueryEscape(tc.to)
+			rec := serve(lb, httptest.NewRequest(http.MethodGet, target, nil))
+			if rec.Code != tc.status {
+				t.Fatalf("status %d, want %d", rec.Code, tc.status)
+			}
+			if got := rec.Header().Get("Location"); got != tc.want {
+				t.Errorf("Location = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+type requestTraceResponse struct {
+	RequestID string       `json:"request_id"`
+	Events    []TraceEvent `json:"events"`
+}
+
+func TestRetriedRequestLogLinesNameAttempt(t *testing.T) {
+	dead, live := deadBackendURL(t), namedBackend(t, "live").URL
+	cfg := testConfig(dead, live)
+	cfg.MaxRetries = 1
+	cfg.AdminToken = "secret"
+	lb := NewLoadBalancer(cfg)
+	logs := captureLog(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	req.Header.Set("X-Request-ID", "trace-me")
+	if rec := serve(lb, req); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 after retrying", rec.Code)
+	}
+
+	// Every line of the request names it, its attempt and its backend.
+	var lines []string
+	for line := range strings.Lines(logs.String()) {
+		if strings.Contains(line, "trace-me") {
+			lines = append(lines, line)
+		}
+	}
+	prefix := regexp.MustCompile(`\[request_id=trace-me attempt=(\d) backend=(\S+)\]`)
+	attempts := map[string]string{}
+	for _, line := range lines {
+		m := prefix.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("log line lacks the request prefix: %q", line)
+			continue
+		}
+		if m[1] != "0" {
+			attempts[m[1]] = m[2]
+		}
+	}
+	if attempts["1"] != dead || attempts["2"] != live {
+		t.Errorf("attempt backends = %v, want 1 on %s and 2 on %s", attempts, dead, live)
+	}
+
+	rec := serve(lb, adminRequest(lb, http.MethodGet, "/admin/requests/trace-me", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("trace status = %d: %s", rec.Code, rec.Body)
+	}
+	var trace requestTraceResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	if trace.RequestID != "trace-me" || len(trace.Events) != len(lines) {
+		t.Fatalf("trace has %d events for %q, want the %d log lines", len(trace.Events), trace.RequestID, len(lines))
+	}
+	last := trace.Events[len(trace.Events)-1]
+	if last.Attempt != 2 || last.Backend != live || !strings.HasPrefix(last.Message, "Request completed") {
+		t.Errorf("last event = %+v, want the completion on attempt 2", last)
+	}
+
+	if rec := serve(lb, adminRequest(lb, http.MethodGet, "/admin/requests/unknown", "")); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown request: status %d, want 404", rec.Code)
+	}
+}
+
+func TestRequestTraceBounded(t *testing.T) {
+	t.Run("capacity", func(t *testing.T) {
+		cfg := testConfig(namedBackend(t, "a").URL)
+		cfg.DebugTraceCapacity = 3
+		lb := NewLoadBalancer(cfg)
+		for range 5 {
+			serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+		lb.traceMu.Lock()
+		n := len(lb.traceEvents)
+		lb.traceMu.Unlock()
+		if n != 3 {
+			t.Errorf("%d trace events kept, want 3", n)
+		}
+	})
+
+	t.Run("window", func(t *testing.T) {
+		cfg := testConfig(namedBackend(t, "a").URL)
+		cfg.AdminToken = "secret"
+		cfg.DebugTraceWindow = 50 * time.Millisecond
+		lb := NewLoadBalancer(cfg)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Request-ID", "short-lived")
+		serve(lb, req)
+		if rec := serve(lb, adminRequest(lb, http.MethodGet, "/admin/requests/short-lived", "")); rec.Code != http.StatusOK {
+			t.Fatalf("fresh trace: status %d, want 200", rec.Code)
+		}
+		time.Sleep(60 * time.Millisecond)
+		if rec := serve(lb, adminRequest(lb, http.MethodGet, "/admin/requests/short-lived", "")); rec.Code != http.StatusNotFound {
+			t.Errorf("expired trace: status %d, want 404", rec.Code)
+		}
+	})
+}
+
+func TestDialFailureCacheSkipsBackend(t *testing.T) {
+	dead, live := deadBackendURL(t), namedBackend(t, "live").URL
+	cfg := testConfig(dead, live)
+	cfg.MaxRetries = 1
+	cfg.DialFailureCacheTTL = 200 * time.Millisecond
+	lb := NewLoadBalancer(cfg)
+	logs := captureLog(t)
+	dialFailures := func() int { return strings.Count(logs.String(), "Dial to "+dead+" failed") }
+
+	// The first request pays for the failed dial and retries.
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 after retrying", rec.Code)
+	}
+	if got := dialFailures(); got != 1 {
+		t.Fatalf("%d dial failures logged, want 1", got)
+	}
+
+	// Until the entry expires the dead backend isn't even tried.
+	for i := range 4 {
+		rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "live" {
+			t.Fatalf("request %d: %d %q, want 200 from live", i, rec.Code, rec.Body)
+		}
+	}
+	if got := dialFailures(); got != 1 {
+		t.Errorf("%d dial failures logged while cached, want still 1", got)
+	}
+	if got := backendStats(t, lb, dead).DialFailureSkips; got == 0 {
+		t.Error("stats report no dial failure skips")
+	}
+	if got := counterValue(lb.metrics.dialFailureSkips, dead); got == 0 {
+		t.Error("lb_dial_failure_skips_total not incremented")
+	}
+	if got := backendStats(t, lb, dead).Alive; !got {
+		t.Error("a dial failure marked the backend down; only health checks should")
+	}
+
+	// Once it expires the backend is tried again.
+	time.Sleep(250 * time.Millisecond)
+	for range 2 {
+		serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	if got := dialFailures(); got != 2 {
+		t.Errorf("%d dial failures logged after the entry expired, want 2", got)
+	}
+}
+
+func TestDialFailureCacheKeepsLastCandidates(t *testing.T) {
+	dead := deadBackendURL(t)
+	cfg := testConfig(dead)
+	cfg.DialFailureCacheTTL = time.Minute
+	lb := NewLoadBalancer(cfg)
+
+	serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	// With nothing else to pick, the failing backend is still tried
+	// rather than answering 503.
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502 from another attempt", rec.Code)
+	}
+	if got := backendStats(t, lb, dead).DialFailureSkips; got != 0 {
+		t.Errorf("dial failure skips = %d, want 0", got)
+	}
+}
+
+// suppress puts backend in every state a health reset clears.
+func suppress(backend *Backend) {
+	backend.SetAlive(false)
+	backend.markDialFailure(time.Minute)
+	backend.backOff(time.Minute)
+	backend.mux.Lock()
+	backend.ejectedUntil = time.Now().Add(time.Minute)
+	backend.ejectionReason = "latency"
+	backend.mux.Unlock()
+}
+
+func suppressed(backend *Backend) bool {
+	now := time.Now()
+	return backend.isEjected() || backend.dialFailing(now) || backend.backingOff(now)
+}
+
+func healthSweep(t *testing.T, lb *LoadBalancer, target string) []HealthCheckResult {
+	t.Helper()
+	rec := serve(lb, adminRequest(lb, http.MethodPost, target, ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST %s: status %d: %s", target, rec.Code, rec.Body)
+	}
+	var results []HealthCheckResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestHealthReset(t *testing.T) {
+	a, b := namedBackend(t, "a"), namedBackend(t, "b")
+	cfg := testConfig(a.URL, b.URL)
+	cfg.AdminToken = "secret"
+	lb := NewLoadBalancer(cfg)
+	backendA, backendB := lb.backends[0], lb.backends[1]
+
+	suppress(backendA)
+	suppress(backendB)
+	results := healthSweep(t, lb, "/admin/health/reset?backend="+url.QueryEscape(a.URL))
+	if len(results) != 1 || results[0] != (HealthCheckResult{URL: a.URL, Alive: true}) {
+		t.Errorf("results = %+v, want a alone, alive", results)
+	}
+	if !backendA.available() || suppressed(backendA) {
+		t.Error("reset left a suppressed")
+	}
+	if backendB.IsAlive() || !suppressed(backendB) {
+		t.Error("resetting a touched b")
+	}
+
+	results = healthSweep(t, lb, "/admin/health/reset")
+	if len(results) != 2 || !results[0].Alive || !results[1].Alive {
+		t.Errorf("results = %+v, want both alive", results)
+	}
+	if !backendB.available() || suppressed(backendB) {
+		t.Error("global reset left b suppressed")
+	}
+	if got := auditActions(lb); !slices.Equal(got, []string{"admin health_reset", "admin health_reset"}) {
+		t.Errorf("audit log = %v, want both resets", got)
+	}
+
+	if rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/health/reset?backend=http://nowhere", "")); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown backend: status %d, want 404", rec.Code)
+	}
+}
+
+func TestHealthRunKeepsState(t *testing.T) {
+	srv, healthy := toggleHealthBackend(t)
+	cfg := testConfig(srv.URL)
+	cfg.AdminToken = "secret"
+	lb := NewLoadBalancer(cfg)
+	backend := lb.backends[0]
+
+	suppress(backend)
+	results := healthSweep(t, lb, "/admin/health/run")
+	if len(results) != 1 || !results[0].Alive || !backend.IsAlive() {
+		t.Errorf("results = %+v, want the backend probed alive", results)
+	}
+	if !suppressed(backend) {
+		t.Error("run cleared ejection, dial failure or backoff state")
+	}
+
+	healthy.Store(false)
+	results = healthSweep(t, lb, "/admin/health/run")
+	if results[0].Alive || results[0].Error == "" || backend.IsAlive() {
+		t.Errorf("results = %+v, want the failing probe reported", results)
+	}
+}
+
+func TestHealthSweepDuringScheduledCheck(t *testing.T) {
+	srv, release, running, maxRunning := blockingProbeBackend(t)
+	cfg := testConfig(srv.URL)
+	cfg.AdminToken = "secret"
+	cfg.HealthCheckPath = "/healthz"
+	cfg.HealthCheckTimeout = 5 * time.Second
+	lb := NewLoadBalancer(cfg)
+	backend := lb.backends[0]
+
+	done := make(chan bool)
+	go func() { done <- lb.checkBackend(backend) }()
+	if !waitFor(func() bool { return running.Load() == 1 }) {
+		t.Fatal("scheduled probe never reached the backend")
+	}
+	for _, target := range []string{"/admin/health/run", "/admin/health/reset"} {
+		start := time.Now()
+		results := healthSweep(t, lb, target)
+		if len(results) != 1 || !results[0].Alive {
+			t.Errorf("%s during a sweep: results = %+v, want the current state", target, results)
+		}
+		if took := time.Since(start); took > time.Second {
+			t.Errorf("%s waited %v for the scheduled sweep", target, took)
+		}
+	}
+	close(release)
+	<-done
+	if maxRunning.Load() != 1 {
+		t.Errorf("%d probes ran at once, want 1", maxRunning.Load())
+	}
+}
+
+func TestLBListenEnv(t *testing.T) {
+	t.Setenv("LB_LISTEN", "127.0.0.1:9001, [::1]:9002")
+	cfg := envConfig()
+	want := []ListenerConfig{{Address: "127.0.0.1:9001"}, {Address: "[::1]:9002"}}
+	if !slices.Equal(cfg.Listeners, want) {
+		t.Errorf("listeners = %+v, want %+v", cfg.Listeners, want)
+	}
+
+	cfg = testConfig("http://127.0.0.1:9000")
+	cfg.Port = "8080"
+	if report := cfg.validate(); !report.Valid {
+		t.Fatalf("validate: %v", report.Errors)
+	}
+	if want := []ListenerConfig{{Address: ":8080"}}; !slices.Equal(cfg.Listeners, want) {
+		t.Errorf("listeners without LB_LISTEN = %+v, want %+v", cfg.Listeners, want)
+	}
+
+	cfg = testConfig("http://127.0.0.1:9000")
+	cfg.Listeners = []ListenerConfig{{Address: "127.0.0.1:9001"}, {Address: "127.0.0.1:9001"}}
+	if report := cfg.validate(); report.Valid {
+		t.Error("validate accepted the same address twice")
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	cfg := testConfig()
+	cfg.AdminToken = "secret"
+	cfg.Backends = []BackendConfig{{URL: namedBackend(t, "public").URL}, {URL: namedBackend(t, "ops").URL, Pool: "ops"}}
+	cfg.Listeners = []ListenerConfig{{Address: freeAddress(t)}, {Address: freeAddress(t), DefaultPool: "ops", Internal: true}}
+	lb := NewLoadBalancer(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- lb.listenAndServe(ctx) }()
+	external, internal := "http://"+cfg.Listeners[0].Address, "http://"+cfg.Listeners[1].Address
+	if !waitFor(func() bool {
+		resp, err := http.Get(internal + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil
+	}) {
+		t.Fatal("listeners never came up")
+	}
+
+	get := func(target string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	// Each listener has its own default pool over the shared backends.
+	if _, body := get(external + "/"); body != "public" {
+		t.Errorf("external listener served %q, want public", body)
+	}
+	if _, body := get(internal + "/"); body != "ops" {
+		t.Errorf("internal listener served %q, want ops", body)
+	}
+	// Only the internal one skips the admin token.
+	if code, _ := get(external + "/admin/stats"); code != http.StatusUnauthorized {
+		t.Errorf("external admin request without a token: status %d, want 401", code)
+	}
+	if code, _ := get(internal + "/admin/stats"); code != http.StatusOK {
+		t.Errorf("internal admin request without a token: status %d, want 200", code)
+	}
+
+	// Both shut down together.
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("listenAndServe: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listenAndServe didn't return after shutdown")
+	}
+	for _, listener := range cfg.Listeners {
+		if conn, err := net.Dial("tcp", listener.Address); err == nil {
+			conn.Close()
+			t.Errorf("%s still accepts connections after shutdown", listener.Address)
+		}
+	}
+}
+
+func TestListenerBindFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	free := freeAddress(t)
+	cfg := testConfig(namedBackend(t, "a").URL)
+	cfg.Listeners = []ListenerConfig{{Address: free}, {Address: taken.Addr().String()}}
+	lb := NewLoadBalancer(cfg)
+
+	errc := make(chan error, 1)
+	go func() { errc <- lb.listenAndServe(context.Background()) }()
+	select {
+	case err := <-errc:
+		if err == nil || !strings.Contains(err.Error(), "listening on "+taken.Addr().String()) {
+			t.Errorf("error = %v, want one naming %s", err, taken.Addr())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listenAndServe kept running with an address it couldn't bind")
+	}
+	// The listener bound before the failure was released.
+	ln, err := net.Listen("tcp", free)
+	if err != nil {
+		t.Errorf("%s still bound after the failed start: %v", free, err)
+	} else {
+		ln.Close()
+	}
+}
+
+func TestUtilityPaths(t *testing.T) {
+	backend, hits := headerEchoBackend(t)
+	cfg := testConfig(backend.URL)
+	cfg.Port = "8080"
+	cfg.UtilityPaths = []UtilityPath{
+		{PathPattern: "/robots.txt", Proxy: true},
+		{PathPattern: "/.well-known/security.txt", ResponseBody: "Contact: mailto:security@example.com\n"},
+	}
+	if report := cfg.validate(); !report.Valid {
+		t.Fatalf("validate: %v", report.Errors)
+	}
+	lb := NewLoadBalancer(cfg)
+
+	tests := []struct {
+		path    string
+		status  int
+		body    string
+		proxied bool
+	}{
+		{"/favicon.ico", http.StatusNoContent, "", false},
+		{"/.well-known/security.txt", http.StatusOK, "Contact: mailto:security@example.com\n", false},
+		{"/robots.txt", http.StatusOK, "", true},
+		{"/.well-known/acme-challenge/token", http.StatusOK, "", true},
+		{"/favicon.ico/not", http.StatusOK, "", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			before := hits.Load()
+			rec := serve(lb, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if proxied := hits.Load() > before; proxied != tc.proxied {
+				t.Errorf("proxied = %t, want %t", proxied, tc.proxied)
+			}
+			if rec.Code != tc.status {
+				t.Errorf("status = %d, want %d", rec.Code, tc.status)
+			}
+			if !tc.proxied && rec.Body.String() != tc.body {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tc.body)
+			}
+		})
+	}
+}
+
+func TestUtilityPathDefaults(t *testing.T) {
+	backend, hits := headerEchoBackend(t)
+	lb := NewLoadBalancer(testConfig(backend.URL))
+
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/robots.txt", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "User-agent: *\nDisallow: /\n" {
+		t.Errorf("robots.txt: %d %q, want the deny-all file", rec.Code, rec.Body)
+	}
+	rec = serve(lb, httptest.NewRequest(http.MethodGet, "/favicon.ico", nil))
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Cache-Control") == "" {
+		t.Errorf("favicon.ico: %d, Cache-Control %q; want a cacheable 204", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	if hits.Load() != 0 {
+		t.Errorf("backend hit %d times, want 0", hits.Load())
+	}
+
+	lb.cfg.UtilityPathsEnabled = false
+	for _, path := range []string{"/robots.txt", "/favicon.ico"} {
+		serve(lb, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if hits.Load() != 2 {
+		t.Errorf("backend hit %d times with utility paths disabled, want 2", hits.Load())
+	}
+}
+
+func TestUtilityPathACMEReserved(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9000")
+	cfg.Port = "8080"
+	cfg.UtilityPaths = []UtilityPath{{PathPattern: "/.well-known/acme-challenge/*", ResponseStatus: http.StatusNotFound}}
+	report := cfg.validate()
+	if report.Valid || !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, "reserved for ACME challenges") }) {
+		t.Errorf("errors = %v, want the ACME prefix rejected", report.Errors)
+	}
+}
+
+// newTenantLB balances three named backends on X-Tenant-ID.
+func newTenantLB(t *testing.T, overrides map[string]string) (*LoadBalancer, map[string]string) {
+	t.Helper()
+	urls := map[string]string{}
+	cfg := testConfig()
+	for _, name := range []string{"a", "b", "c"} {
+		urls[name] = namedBackend(t, name).URL
+		cfg.Backends = append(cfg.Backends, BackendConfig{URL: urls[name]})
+	}
+	cfg.Strategy = "consistent_hash_header"
+	cfg.AdminToken = "secret"
+	cfg.HashOverrides = map[string]string{}
+	for tenant, name := range overrides {
+		cfg.HashOverrides[tenant] = urls[name]
+	}
+	return NewLoadBalancer(cfg), urls
+}
+
+func tenantBackend(lb *LoadBalancer, tenant string) string {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Tenant-ID", tenant)
+	return serve(lb, r).Body.String()
+}
+
+func TestHashHeaderStrategy(t *testing.T) {
+	lb, _ := newTenantLB(t, nil)
+
+	owners := map[string]string{}
+	for i := range 20 {
+		tenant := fmt.Sprintf("tenant-%d", i)
+		owners[tenant] = tenantBackend(lb, tenant)
+		for range 3 {
+			if got := tenantBackend(lb, tenant); got != owners[tenant] {
+				t.Fatalf("%s went to %s, then %s", tenant, owners[tenant], got)
+			}
+		}
+	}
+	if n := len(slices.Compact(slices.Sorted(maps.Values(owners)))); n < 2 {
+		t.Errorf("20 tenants all hashed to one backend")
+	}
+
+	// When a tenant's backend goes down it moves, and only it moves.
+	lb.backends[0].SetAlive(false)
+	for tenant, owner := range owners {
+		got := tenantBackend(lb, tenant)
+		if owner == "a" && got == "a" {
+			t.Errorf("%s still sent to the down backend", tenant)
+		}
+		if owner != "a" && got != owner {
+			t.Errorf("%s moved from %s to %s though its backend is up", tenant, owner, got)
+		}
+	}
+}
+
+func TestHashOverrides(t *testing.T) {
+	// Pin acme away from the backend the ring gives it.
+	unpinned, _ := newTenantLB(t, nil)
+	pin := "a"
+	if tenantBackend(unpinned, "acme") == "a" {
+		pin = "b"
+	}
+	lb, urls := newTenantLB(t, map[string]string{"acme": pin})
+
+	for range 5 {
+		if got := tenantBackend(lb, "acme"); got != pin {
+			t.Fatalf("acme went to %s, want the pinned %s", got, pin)
+		}
+	}
+	// A pinned backend that is down falls back to the ring.
+	for _, backend := range lb.backends {
+		if backend.URL == urls[pin] {
+			backend.SetAlive(false)
+		}
+	}
+	if got := tenantBackend(lb, "acme"); got == pin || got == "" {
+		t.Errorf("acme went to %q with its pinned backend down, want another", got)
+	}
+}
+
+func TestHashOverridesAdminAPI(t *testing.T) {
+	lb, urls := newTenantLB(t, map[string]string{"acme": "c"})
+
+	rec := serve(lb, adminRequest(lb, http.MethodPut, "/admin/hash-overrides/globex", `{"backend": "`+urls["a"]+`"}`))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT: status %d: %s", rec.Code, rec.Body)
+	}
+	if got := tenantBackend(lb, "globex"); got != "a" {
+		t.Errorf("globex went to %s after pinning it to a", got)
+	}
+
+	var overrides map[string]string
+	rec = serve(lb, adminRequest(lb, http.MethodGet, "/admin/hash-overrides", ""))
+	if err := json.Unmarshal(rec.Body.Bytes(), &overrides); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"acme": urls["c"], "globex": urls["a"]}; !maps.Equal(overrides, want) {
+		t.Errorf("overrides = %v, want %v", overrides, want)
+	}
+
+	if rec := serve(lb, adminRequest(lb, http.MethodDelete, "/admin/hash-overrides/acme", "")); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE: status %d, want 204", rec.Code)
+	}
+	if rec := serve(lb, adminRequest(lb, http.MethodDelete, "/admin/hash-overrides/acme", "")); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE: status %d, want 404", rec.Code)
+	}
+	if rec := serve(lb, adminRequest(lb, http.MethodPut, "/admin/hash-overrides/initech", `{"backend": "http://nowhere"}`)); rec.Code != http.StatusNotFound {
+		t.Errorf("PUT unknown backend: status %d, want 404", rec.Code)
+	}
+	if rec := serve(lb, adminRequest(lb, http.MethodPut, "/admin/hash-overrides/initech", `{}`)); rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT without backend: status %d, want 400", rec.Code)
+	}
+	if got := auditActions(lb); !slices.Equal(got, []string{"admin hash_override", "admin hash_override"}) {
+		t.Errorf("audit log = %v, want the pin and the removal", got)
+	}
+}
+
+func TestValidateHashOverrides(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9000")
+	cfg.Port = "8080"
+	cfg.Strategy = "consistent_hash_header"
+	cfg.HashOverrides = map[string]string{"acme": "http://127.0.0.1:9999"}
+	report := cfg.validate()
+	if report.Valid || !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, `"acme" pins unknown backend`) }) {
+		t.Errorf("errors = %v, want the unknown backend rejected", report.Errors)
+	}
+
+	cfg.Strategy = "round_robin"
+	cfg.HashOverrides = map[string]string{"acme": "http://127.0.0.1:9000"}
+	report = cfg.validate()
+	if !report.Valid || len(report.Warnings) == 0 {
+		t.Errorf("valid = %t, warnings = %v; want a warning that overrides don't apply", report.Valid, report.Warnings)
+	}
+}
+
+func TestScheduleRuleActive(t *testing.T) {
+	ptr := func(b bool) *bool { return &b }
+	tests := []struct {
+		name string
+		rule ScheduleRule
+		at   string
+		want bool
+	}{
+		{"inside day window", ScheduleRule{Start: "09:00", End: "17:00", Enabled: ptr(false)}, "2026-10-14T12:00:00Z", true},
+		{"end is exclusive", ScheduleRule{Start: "09:00", End: "17:00", Enabled: ptr(false)}, "2026-10-14T17:00:00Z", false},
+		{"overnight before midnight", ScheduleRule{Start: "22:00", End: "06:00", Enabled: ptr(false)}, "2026-10-14T23:30:00Z", true},
+		{"overnight after midnight", ScheduleRule{Start: "22:00", End: "06:00", Enabled: ptr(false)}, "2026-10-15T05:59:00Z", true},
+		{"overnight daytime", ScheduleRule{Start: "22:00", End: "06:00", Enabled: ptr(false)}, "2026-10-15T12:00:00Z", false},
+		// 2026-10-14 is a Wednesday.
+		{"other day", ScheduleRule{Start: "09:00", End: "17:00", Days: []string{"mon"}, Enabled: ptr(false)}, "2026-10-14T12:00:00Z", false},
+		{"overnight from the day before", ScheduleRule{Start: "22:00", End: "06:00", Days: []string{"Tue"}, Enabled: ptr(false)}, "2026-10-14T03:00:00Z", true},
+		{"timezone", ScheduleRule{Start: "09:00", End: "17:00", Timezone: "America/New_York", Enabled: ptr(false)}, "2026-10-14T12:00:00Z", false},
+		{"timezone inside", ScheduleRule{Start: "09:00", End: "17:00", Timezone: "America/New_York", Enabled: ptr(false)}, "2026-10-14T14:00:00Z", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.rule.parse(); err != nil {
+				t.Fatal(err)
+			}
+			at, _ := time.Parse(time.RFC3339, tc.at)
+			if got := tc.rule.active(at); got != tc.want {
+				t.Errorf("active(%s) = %t, want %t", tc.at, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestScheduleValidation(t *testing.T) {
+	weight := func(w int) *int { return &w }
+	off := false
+	tests := []struct {
+		name      string
+		schedules []ScheduleRule
+		want      string
+	}{
+		{"overlap", []ScheduleRule{
+			{Backend: "http://127.0.0.1:9000", Start: "08:00", End: "12:00", Weight: weight(2)},
+			{Backend: "http://127.0.0.1:9000", Start: "11:00", End: "13:00", Enabled: &off},
+		}, "Conflicting schedules"},
+		{"overlap across timezones", []ScheduleRule{
+			{Backend: "http://127.0.0.1:9000", Start: "08:00", End: "12:00", Weight: weight(2)},
+			{Backend: "http://127.0.0.1:9000", Start: "05:00", End: "06:00", Timezone: "America/New_York", Enabled: &off},
+		}, "Conflicting schedules"},
+		{"unknown backend", []ScheduleRule{{Backend: "http://127.0.0.1:9999", Start: "08:00", End: "12:00", Weight: weight(2)}}, "unknown backend"},
+		{"bad clock", []ScheduleRule{{Backend: "http://127.0.0.1:9000", Start: "8am", End: "12:00", Weight: weight(2)}}, "is not HH:MM"},
+		{"no change", []ScheduleRule{{Backend: "http://127.0.0.1:9000", Start: "08:00", End: "12:00"}}, "sets neither weight nor enabled"},
+		{"bad timezone", []ScheduleRule{{Backend: "http://127.0.0.1:9000", Start: "08:00", End: "12:00", Timezone: "Mars/Olympus", Weight: weight(2)}}, "Schedule 0"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig("http://127.0.0.1:9000", "http://127.0.0.1:9001")
+			cfg.Port = "8080"
+			cfg.Schedules = tc.schedules
+			report := cfg.validate()
+			if report.Valid || !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, tc.want) }) {
+				t.Errorf("errors = %v, want one containing %q", report.Errors, tc.want)
+			}
+		})
+	}
+
+	// Back-to-back windows and windows for different backends are fine.
+	cfg := testConfig("http://127.0.0.1:9000", "http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.Schedules = []ScheduleRule{
+		{Backend: "http://127.0.0.1:9000", Start: "08:00", End: "12:00", Weight: weight(2)},
+		{Backend: "http://127.0.0.1:9000", Start: "12:00", End: "13:00", Enabled: &off},
+		{Backend: "http://127.0.0.1:9001", Start: "08:00", End: "12:00", Enabled: &off},
+	}
+	if report := cfg.validate(); !report.Valid {
+		t.Errorf("errors = %v, want none", report.Errors)
+	}
+}
+
+func TestApplySchedules(t *testing.T) {
+	batch, api := namedBackend(t, "batch").URL, namedBackend(t, "api").URL
+	off, weight := false, 5
+	cfg := testConfig()
+	cfg.Port = "8080"
+	cfg.Backends = []BackendConfig{{URL: batch, Weight: 1}, {URL: api, Weight: 1}}
+	cfg.Schedules = []ScheduleRule{
+		{Backend: batch, Start: "06:00", End: "22:00", Enabled: &off},
+		{Backend: api, Start: "22:00", End: "06:00", Weight: &weight},
+	}
+	if report := cfg.validate(); !report.Valid {
+		t.Fatalf("validate: %v", report.Errors)
+	}
+	lb := NewLoadBalancer(cfg)
+	batchBackend, apiBackend := lb.backends[0], lb.backends[1]
+
+	day, _ := time.Parse(time.RFC3339, "2026-10-14T12:00:00Z")
+	lb.applySchedules(day)
+	if !batchBackend.draining.Load() || apiBackend.weight() != 1 {
+		t.Errorf("daytime: batch draining %t, api weight %d; want true and 1", batchBackend.draining.Load(), apiBackend.weight())
+	}
+	for i := range 4 {
+		if body := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)).Body.String(); body != "api" {
+			t.Fatalf("daytime request %d served by %q, want api", i, body)
+		}
+	}
+	// Stats show the next change as of now; at noon it is the evening's.
+	if backendStats(t, lb, batch).NextScheduledChange == nil {
+		t.Error("stats show no next scheduled change")
+	}
+	next := lb.nextScheduledChange(batchBackend, day)
+	if want := time.Date(2026, 10, 14, 22, 0, 0, 0, time.UTC); next == nil || !next.At.Equal(want) || !next.Enabled {
+		t.Errorf("batch next change = %+v, want enabled at %v", next, want)
+	}
+
+	lb.applySchedules(day.Add(11 * time.Hour))
+	if batchBackend.draining.Load() || apiBackend.weight() != 5 {
+		t.Errorf("night: batch draining %t, api weight %d; want false and 5", batchBackend.draining.Load(), apiBackend.weight())
+	}
+	// Batch at noon, then both at night.
+	if got := auditActions(lb); len(got) != 3 || !slices.Equal(slices.Compact(got), []string{"scheduler schedule"}) {
+		t.Errorf("audit log = %v, want a scheduler entry per change", got)
+	}
+
+	// Applying again within the same window changes nothing.
+	lb.applySchedules(day.Add(12 * time.Hour))
+	if got := len(auditActions(lb)); got != 3 {
+		t.Errorf("%d audit entries after re-applying, want 3", got)
+	}
+}
+
+func TestReplaceErrorBodies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("ETag", `"junk"`)
+		w.WriteHeader(status)
+		io.WriteString(w, "<html><body><h1>Internal Server Error</h1><pre>stack trace...</pre></body></html>")
+	}))
+	defer backend.Close()
+	off := false
+	cfg := testConfig(backend.URL)
+	cfg.ReplaceErrorBodies = true
+	cfg.Routes = []RouteConfig{
+		{PathPattern: "/legacy/*", ReplaceErrorBodies: &off},
+		{PathPattern: "/api/*", ReplaceErrorStatuses: []string{"404"}},
+	}
+	lb := NewLoadBalancer(cfg)
+	front := httptest.NewServer(lb)
+	defer front.Close()
+
+	tests := []struct {
+		target   string
+		status   int
+		replaced bool
+	}{
+		{"/page?status=500", 500, true},
+		{"/page?status=503", 503, true},
+		{"/page?status=404", 404, false},
+		{"/legacy/page?status=500", 500, false},
+		{"/api/items?status=404", 404, true},
+		{"/api/items?status=500", 500, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.target, func(t *testing.T) {
+			resp, err := http.Get(front.URL + tc.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.status)
+			}
+			if !tc.replaced {
+				if !strings.HasPrefix(string(body), "<html>") || resp.Header.Get("ETag") == "" {
+					t.Errorf("body = %q, want the backend's untouched", body)
+				}
+				return
+			}
+			var envelope ErrorResponse
+			if err := json.Unmarshal(body, &envelope); err != nil {
+				t.Fatalf("body %q is not the envelope: %v", body, err)
+			}
+			want := ErrorResponse{Error: http.StatusText(tc.status), Status: tc.status, RequestID: resp.Header.Get("X-Request-ID")}
+			if envelope != want || want.RequestID == "" {
+				t.Errorf("envelope = %+v, want %+v", envelope, want)
+			}
+			if resp.Header.Get("Content-Type") != "application/json" || resp.ContentLength != int64(len(body)) || resp.Header.Get("ETag") != "" {
+				t.Errorf("headers = %v (length %d for %d bytes), want JSON headers for the new body", resp.Header, resp.ContentLength, len(body))
+			}
+		})
+	}
+	if got := counterValue(lb.metrics.replacedErrorBodies, backend.URL); got != 3 {
+		t.Errorf("lb_replaced_error_bodies_total = %v, want 3", got)
+	}
+}
+
+func TestParseStatusRange(t *testing.T) {
+	tests := []struct {
+		value     string
+		low, high int
+		ok        bool
+	}{
+		{"503", 503, 503, true},
+		{"500-599", 500, 599, true},
+		{" 500 - 504 ", 500, 504, true},
+		{"599-500", 0, 0, false},
+		{"5xx", 0, 0, false},
+		{"50-99", 0, 0, false},
+		{"500-1000", 0, 0, false},
+	}
+	for _, tc := range tests {
+		low, high, err := parseStatusRange(tc.value)
+		if (err == nil) != tc.ok || low != tc.low || high != tc.high {
+			t.Errorf("parseStatusRange(%q) = %d, %d, %v", tc.value, low, high, err)
+		}
+	}
+}
+
+// timedGet serves a GET for target through lb and returns how long it took
+// and how many body bytes came back.
+func timedGet(lb *LoadBalancer, target string) (time.Duration, int) {
+	start := time.Now()
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, target, nil))
+	return time.Since(start), rec.Body.Len()
+}
+
+func TestBandwidthThrottling(t *testing.T) {
+	backend, _ := sizedBackend(t, 40000)
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: backend.URL, BandwidthLimit: 100000, BandwidthBurst: 10000}}
+	cfg.Routes = []RouteConfig{{PathPattern: "/fast/*", BandwidthLimit: 1 << 30}}
+	lb := NewLoadBalancer(cfg)
+
+	// 30000 bytes past the burst at 100000 bytes a second.
+	elapsed, n := timedGet(lb, "/download")
+	if n != 40000 {
+		t.Fatalf("got %d bytes, want 40000", n)
+	}
+	if elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("throttled download took %v, want about 300ms", elapsed)
+	}
+	if got := counterValue(lb.metrics.throttledBytes, backend.URL); got != 40000 {
+		t.Errorf("lb_throttled_response_bytes_total = %v, want 40000", got)
+	}
+	if got := counterValue(lb.metrics.bandwidthLimit, backend.URL); got != 100000 {
+		t.Errorf("lb_bandwidth_limit_bytes_per_second = %v, want 100000", got)
+	}
+
+	// A route's own limit takes precedence over the backend's.
+	if elapsed, _ := timedGet(lb, "/fast/download"); elapsed > 200*time.Millisecond {
+		t.Errorf("route with a high limit took %v", elapsed)
+	}
+}
+
+func TestBandwidthThrottlingSkipsUnlimited(t *testing.T) {
+	backend, _ := sizedBackend(t, 40000)
+	lb := NewLoadBalancer(testConfig(backend.URL))
+
+	if elapsed, n := timedGet(lb, "/download"); n != 40000 || elapsed > 200*time.Millisecond {
+		t.Errorf("unthrottled download: %d bytes in %v", n, elapsed)
+	}
+	if got := counterValue(lb.metrics.throttledBytes, backend.URL); got != 0 {
+		t.Errorf("lb_throttled_response_bytes_total = %v for an unthrottled backend, want 0", got)
+	}
+}
+
+func TestBandwidthAggregateLimit(t *testing.T) {
+	backend, _ := sizedBackend(t, 20000)
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{{URL: backend.URL, BandwidthLimit: 1 << 30}}
+	cfg.BandwidthAggregateLimit = 100000
+	cfg.BandwidthAggregateBurst = 10000
+	lb := NewLoadBalancer(cfg)
+
+	// Each response alone is barely limited, but together they share
+	// 100000 bytes a second.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, n := timedGet(lb, "/download"); n != 20000 {
+				t.Errorf("got %d bytes, want 20000", n)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("two downloads took %v, want about 300ms under the aggregate limit", elapsed)
+	}
+	if got := counterValue(lb.metrics.bandwidthLimit, "aggregate"); got != 100000 {
+		t.Errorf("aggregate limit gauge = %v, want 100000", got)
+	}
+}
+
+func validateConfigRequest(t *testing.T, lb *LoadBalancer, target, body string) (int, ConfigReport) {
+	t.Helper()
+	rec := serve(lb, adminRequest(lb, http.MethodPost, target, body))
+	var report ConfigReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("status %d, body %q: %v", rec.Code, rec.Body, err)
+	}
+	return rec.Code, report
+}
+
+func TestValidateConfigEndpoint(t *testing.T) {
+	running := namedBackend(t, "running").URL
+	cfg := testConfig(running)
+	cfg.AdminToken = "secret"
+	lb := NewLoadBalancer(cfg)
+	certFile, keyFile, _ := writeTestCert(t, t.TempDir())
+
+	tests := []struct {
+		name   string
+		doc    string
+		errors []string
+	}{
+		{"valid", `{"port": "8080", "backends": [{"url": "` + running + `"}, {"url": "http://127.0.0.1:9001"}],
+			"routes": [{"path_pattern": "/api/*"}], "tls_cert_file": "` + certFile + `", "tls_key_file": "` + keyFile + `"}`, nil},
+		{"parse error", `{"port": 8080`, []string{"Failed to parse config"}},
+		{"duplicate backend", `{"port": "8080", "backends": [{"url": "http://127.0.0.1:9001"}, {"url": "http://127.0.0.1:9001"}]}`,
+			[]string{"listed more than once"}},
+		{"bad route", `{"port": "8080", "backends": [{"url": "http://127.0.0.1:9001"}], "routes": [{"path_pattern": "/api/[*"}]}`,
+			[]string{"invalid path_pattern"}},
+		{"missing TLS files", `{"port": "8080", "backends": [{"url": "http://127.0.0.1:9001"}],
+			"tls_cert_file": "/nonexistent/cert.pem", "tls_key_file": "/nonexistent/key.pem"}`, []string{"loading TLS_CERT_FILE and TLS_KEY_FILE"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code, report := validateConfigRequest(t, lb, "/admin/config/validate", tc.doc)
+			if tc.errors == nil {
+				if code != http.StatusOK || !report.Valid {
+					t.Errorf("status %d, errors %v; want a valid config", code, report.Errors)
+				}
+				return
+			}
+			if code != http.StatusUnprocessableEntity || report.Valid {
+				t.Errorf("status %d, valid %t; want 422", code, report.Valid)
+			}
+			for _, want := range tc.errors {
+				if !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.Contains(e, want) }) {
+					t.Errorf("errors = %v, want one containing %q", report.Errors, want)
+				}
+			}
+		})
+	}
+
+	// Nothing about the running balancer changed.
+	if backends := lb.getBackends(); len(backends) != 1 || backends[0].URL != running || lb.cfg.TLSCertFile != "" {
+		t.Errorf("validation changed the running config")
+	}
+}
+
+func TestValidateConfigProbesNewBackends(t *testing.T) {
+	running, _ := probeCountingBackend(t)
+	fresh, freshProbes := probeCountingBackend(t)
+	cfg := testConfig(running.URL)
+	cfg.AdminToken = "secret"
+	lb := NewLoadBalancer(cfg)
+	dead := deadBackendURL(t)
+	doc := `{"port": "8080", "health_check_path": "/healthz", "backends": [{"url": "` + running.URL + `"}, {"url": "` + fresh.URL + `"}, {"url": "` + dead + `"}]}`
+
+	code, report := validateConfigRequest(t, lb, "/admin/config/validate", doc)
+	if code != http.StatusOK || len(report.Probed) != 0 || freshProbes.Load() != 0 {
+		t.Errorf("without ?probe: status %d, probed %v; want no probes", code, report.Probed)
+	}
+
+	code, report = validateConfigRequest(t, lb, "/admin/config/validate?probe=true", doc)
+	if code != http.StatusOK || !report.Valid {
+		t.Fatalf("status %d, errors %v; a failed probe should only warn", code, report.Errors)
+	}
+	if want := slices.Sorted(slices.Values([]string{fresh.URL, dead})); !slices.Equal(report.Probed, want) {
+		t.Errorf("probed = %v, want only the new backends %v", report.Probed, want)
+	}
+	if freshProbes.Load() != 1 {
+		t.Errorf("new backend probed %d times, want 1", freshProbes.Load())
+	}
+	if len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0], dead+" failed its health check") {
+		t.Errorf("warnings = %v, want one for the dead backend", report.Warnings)
+	}
+}
+
+func TestStatePersistedAcrossRestarts(t *testing.T) {
+	backend := namedBackend(t, "a").URL
+	dir := t.TempDir()
+	cfg := testConfig(backend)
+	cfg.StateFile = filepath.Join(dir, "state.json")
+
+	first := NewLoadBalancer(cfg)
+	first.restoreState()
+	for range 3 {
+		serve(first, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	first.backends[0].upToDown.Add(1)
+	if err := first.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("state directory holds %d files, want only the state file", len(entries))
+	}
+
+	second := NewLoadBalancer(cfg)
+	second.restoreState()
+	for range 2 {
+		serve(second, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	stats := second.collectStats()
+	if stats.LB.Restored == nil || stats.LB.Restored.Requests != 3 || stats.LB.RestoredAt == nil {
+		t.Fatalf("restored = %+v, want the 3 requests from before", stats.LB.Restored)
+	}
+	if stats.LB.Totals.Requests != 5 {
+		t.Errorf("total requests = %d, want 5 (3 restored and 2 live)", stats.LB.Totals.Requests)
+	}
+	bs := backendStats(t, second, backend)
+	if bs.Restored == nil || bs.Restored.Requests != 3 || bs.Restored.UpToDown != 1 {
+		t.Errorf("backend restored = %+v, want 3 requests and a transition", bs.Restored)
+	}
+	if bs.Totals.Requests != 5 || bs.Totals.UpToDown != 1 {
+		t.Errorf("backend totals = %+v, want 5 requests and a transition", bs.Totals)
+	}
+
+	// Saving again carries the restored counters forward.
+	if err := second.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	third := NewLoadBalancer(cfg)
+	third.restoreState()
+	if got := third.restored.LB.Requests; got != 5 {
+		t.Errorf("requests after a second restart = %d, want 5", got)
+	}
+}
+
+func TestStateFileProblems(t *testing.T) {
+	backend := namedBackend(t, "a").URL
+	dir := t.TempDir()
+
+	t.Run("missing", func(t *testing.T) {
+		cfg := testConfig(backend)
+		cfg.StateFile = filepath.Join(dir, "missing.json")
+		lb := NewLoadBalancer(cfg)
+		lb.restoreState()
+		if lb.restored != nil || lb.collectStats().LB.Restored != nil {
+			t.Error("restored counters from a missing file")
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		cfg := testConfig(backend)
+		cfg.StateFile = filepath.Join(dir, "corrupt.json")
+		os.WriteFile(cfg.StateFile, []byte(`{"lb": {"requests": `), 0o644)
+		lb := NewLoadBalancer(cfg)
+		logs := captureLog(t)
+		lb.restoreState()
+		if lb.restored != nil || !strings.Contains(logs.String(), "Ignoring state file") {
+			t.Errorf("corrupt file: restored %+v, log %q", lb.restored, logs)
+		}
+	})
+
+	t.Run("unwritable", func(t *testing.T) {
+		cfg := testConfig(backend)
+		cfg.StateFile = filepath.Join(dir, "no-such-dir", "state.json")
+		lb := NewLoadBalancer(cfg)
+		if err := lb.saveState(); err == nil {
+			t.Error("saveState into a missing directory succeeded")
+		}
+		if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusOK {
+			t.Errorf("status = %d after a failed save, want 200", rec.Code)
+		}
+	})
+}
+
+func TestValidateStateSaveInterval(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9000")
+	cfg.Port = "8080"
+	cfg.StateFile = "/tmp/state.json"
+	cfg.StateSaveInterval = 100 * time.Millisecond
+	if report := cfg.validate(); report.Valid {
+		t.Error("validate accepted a state save interval under 1s")
+	}
+}
+
+// registryRecorder records the requests a registry receives, answering
+// each with the status in fail (200 when zero).
+type registryRecorder struct {
+	mu     sync.Mutex
+	events []string
+	bodies []map[string]any
+	fail   atomic.Int32
+}
+
+func (r *registryRecorder) serve(t *testing.T, event func(*http.Request, map[string]any) string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]any
+		json.NewDecoder(req.Body).Decode(&body)
+		r.mu.Lock()
+		r.events = append(r.events, event(req, body))
+		r.bodies = append(r.bodies, body)
+		r.mu.Unlock()
+		if status := r.fail.Load(); status != 0 {
+			w.WriteHeader(int(status))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (r *registryRecorder) seen() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.events)
+}
+
+func newRegisteringLB(t *testing.T, configure func(*Config)) *LoadBalancer {
+	t.Helper()
+	cfg := testConfig(namedBackend(t, "backend").URL)
+	cfg.Port = "8080"
+	cfg.Listeners = []ListenerConfig{{Address: freeAddress(t)}}
+	cfg.RegisterServiceName = "edge"
+	cfg.RegisterAddress = "10.0.0.5"
+	cfg.RegisterTags = []string{"blue"}
+	cfg.RegisterHeartbeatInterval = 20 * time.Millisecond
+	configure(cfg)
+	if report := cfg.validate(); !report.Valid {
+		t.Fatalf("invalid config: %v", report.Errors)
+	}
+	lb := NewLoadBalancer(cfg)
+	lb.registrar = newRegistrar(cfg)
+	return lb
+}
+
+func TestSelfRegisterWebhook(t *testing.T) {
+	rec := &registryRecorder{}
+	hook := rec.serve(t, func(_ *http.Request, body map[string]any) string { return fmt.Sprint(body["event"]) })
+	lb := newRegisteringLB(t, func(cfg *Config) {
+		cfg.SelfRegister = "webhook"
+		cfg.RegisterWebhookURL = hook.URL
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- lb.listenAndServe(ctx) }()
+	if !waitFor(func() bool { return slices.Contains(rec.seen(), "heartbeat") }) {
+		cancel()
+		t.Fatalf("events = %v, want a register then heartbeats", rec.seen())
+	}
+	registration := lb.collectStats().Registration
+	if registration == nil || !registration.Registered || registration.LastHeartbeat == nil || registration.Registry != "webhook" {
+		t.Errorf("registration stats = %+v, want registered with a heartbeat", registration)
+	}
+	_, port, _ := net.SplitHostPort(lb.cfg.Listeners[0].Address)
+	if want := "edge-10.0.0.5-" + port; registration.Instance.ID != want {
+		t.Errorf("instance id = %q, want %q", registration.Instance.ID, want)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	events := rec.seen()
+	if events[0] != "register" || events[len(events)-1] != "deregister" {
+		t.Errorf("events = %v, want register first and deregister last", events)
+	}
+	rec.mu.Lock()
+	inst, _ := rec.bodies[0]["instance"].(map[string]any)
+	rec.mu.Unlock()
+	if inst["service"] != "edge" || inst["address"] != "10.0.0.5" || fmt.Sprint(inst["tags"]) != "[blue]" {
+		t.Errorf("registered instance = %v", inst)
+	}
+	if lb.collectStats().Registration.Registered {
+		t.Error("still reported registered after deregistering")
+	}
+}
+
+func TestSelfRegisterConsul(t *testing.T) {
+	rec := &registryRecorder{}
+	var token atomic.Value
+	consul := rec.serve(t, func(req *http.Request, _ map[string]any) string {
+		token.Store(req.Header.Get("X-Consul-Token"))
+		return req.Method + " " + req.URL.EscapedPath()
+	})
+	lb := newRegisteringLB(t, func(cfg *Config) {
+		cfg.SelfRegister = "consul"
+		cfg.ConsulAddr = consul.URL + "/"
+		cfg.ConsulToken = "secret"
+	})
+	id := lb.registrar.instance.ID
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go lb.registrar.run(ctx)
+	pass := "PUT /v1/agent/check/pass/" + id + "-ttl"
+	if !waitFor(func() bool { return slices.Contains(rec.seen(), pass) }) {
+		t.Fatalf("requests = %v, want %q", rec.seen(), pass)
+	}
+	cancel()
+	lb.registrar.deregister()
+
+	events := rec.seen()
+	if events[0] != "PUT /v1/agent/service/register" {
+		t.Errorf("first request = %q, want the service registration", events[0])
+	}
+	if want := "PUT /v1/agent/service/deregister/" + id; events[len(events)-1] != want {
+		t.Errorf("last request = %q, want %q", events[len(events)-1], want)
+	}
+	if token.Load() != "secret" {
+		t.Errorf("X-Consul-Token = %v, want the configured token", token.Load())
+	}
+	rec.mu.Lock()
+	check, _ := rec.bodies[0]["Check"].(map[string]any)
+	rec.mu.Unlock()
+	if check["TTL"] != "60ms" || check["CheckID"] != id+"-ttl" {
+		t.Errorf("registered check = %v, want a 60ms TTL check", check)
+	}
+}
+
+func TestSelfRegisterFailureKeepsServing(t *testing.T) {
+	logs := captureLog(t)
+	rec := &registryRecorder{}
+	rec.fail.Store(http.StatusServiceUnavailable)
+	hook := rec.serve(t, func(_ *http.Request, body map[string]any) string { return fmt.Sprint(body["event"]) })
+	lb := newRegisteringLB(t, func(cfg *Config) {
+		cfg.SelfRegister = "webhook"
+		cfg.RegisterWebhookURL = hook.URL
+	})
+	startListeners(t, lb)
+
+	if !waitFor(func() bool { return len(rec.seen()) >= 2 }) {
+		t.Fatalf("events = %v, want registration retried", rec.seen())
+	}
+	if events := rec.seen(); events[0] != "register" || events[1] != "register" {
+		t.Errorf("events = %v, want register retried on each heartbeat", events)
+	}
+	resp, err := http.Get("http://" + lb.cfg.Listeners[0].Address + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "backend" {
+		t.Errorf("got %q while unregistered, want the backend", body)
+	}
+	registration := lb.collectStats().Registration
+	if registration.Registered || registration.LastError != "webhook returned status 503" {
+		t.Errorf("registration stats = %+v, want unregistered with the webhook error", registration)
+	}
+	if !strings.Contains(logs.String(), "[WARN] Failed to register with webhook") {
+		t.Errorf("no warning logged:\n%s", logs)
+	}
+
+	rec.fail.Store(0)
+	if !waitFor(func() bool { return lb.collectStats().Registration.Registered }) {
+		t.Error("never registered once the webhook recovered")
+	}
+	if lb.collectStats().Registration.LastError != "" {
+		t.Error("last error kept after registering")
+	}
+}
+
+func TestValidateSelfRegister(t *testing.T) {
+	for _, tc := range []struct {
+		configure func(*Config)
+		want      string
+	}{
+		{func(cfg *Config) { cfg.SelfRegister = "etcd" }, `Unknown SELF_REGISTER "etcd"`},
+		{func(cfg *Config) { cfg.SelfRegister = "webhook" }, "SELF_REGISTER=webhook requires REGISTER_WEBHOOK_URL"},
+		{func(cfg *Config) { cfg.SelfRegister = "consul"; cfg.RegisterHeartbeatInterval = 0 }, "REGISTER_HEARTBEAT_INTERVAL must be positive"},
+	} {
+		cfg := testConfig("http://127.0.0.1:9001")
+		cfg.Port = "8080"
+		tc.configure(cfg)
+		report := cfg.validate()
+		if report.Valid || !slices.Contains(report.Errors, tc.want) {
+			t.Errorf("errors = %v, want %q", report.Errors, tc.want)
+		}
+	}
+}
+
+// readCapture waits for the latest capture to finish writing and returns
+// its records.
+func readCapture(t *testing.T, lb *LoadBalancer) []CapturedRequest {
+	t.Helper()
+	c := lb.capture.Load()
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("capture file never finished")
+	}
+	f, err := os.Open(c.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []CapturedRequest
+	dec := json.NewDecoder(f)
+	for {
+		var rec CapturedRequest
+		if err := dec.Decode(&rec); err == io.EOF {
+			return records
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func newCaptureLB(t *testing.T) *LoadBalancer {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	t.Cleanup(backend.Close)
+	cfg := testConfig(backend.URL)
+	cfg.AdminToken = "secret"
+	cfg.CaptureDir = t.TempDir()
+	return NewLoadBalancer(cfg)
+}
+
+func TestCaptureRecordsMatchingRequests(t *testing.T) {
+	lb := newCaptureLB(t)
+	rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/capture", `{"path_prefix": "/api/", "max_count": 2, "max_body_bytes": 5}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("start capture: status %d: %s", rec.Code, rec.Body)
+	}
+
+	for _, target := range []string{"/other", "/api/orders?id=7", "/api/users", "/api/late"} {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader("hello world"))
+		r.Header.Set("Authorization", "Bearer user-token")
+		r.Header.Set("Cookie", "session=abc")
+		r.Header.Set("X-Trace", "t-1")
+		if rec := serve(lb, r); rec.Body.String() != "hello world" {
+			t.Errorf("%s: backend got body %q, want the whole body", target, rec.Body)
+		}
+	}
+
+	records := readCapture(t, lb)
+	if len(records) != 2 || records[0].URL != "/api/orders?id=7" || records[1].URL != "/api/users" {
+		t.Fatalf("captured %+v, want the first two /api/ requests", records)
+	}
+	first := records[0]
+	if first.Method != http.MethodPost || string(first.Body) != "hello" || !first.BodyTruncated {
+		t.Errorf("captured %s with body %q (truncated %v), want POST with 5 body bytes", first.Method, first.Body, first.BodyTruncated)
+	}
+	if first.Headers.Get("Authorization") != "[REDACTED]" || first.Headers.Get("Cookie") != "[REDACTED]" {
+		t.Errorf("sensitive headers not redacted: %v", first.Headers)
+	}
+	if first.Headers.Get("X-Trace") != "t-1" {
+		t.Errorf("X-Trace = %q, want it kept", first.Headers.Get("X-Trace"))
+	}
+
+	rec = serve(lb, adminRequest(lb, http.MethodGet, "/admin/capture", ""))
+	var status CaptureStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	if status.Active || status.StopReason != "max_count" || status.Captured != 2 {
+		t.Errorf("status = %+v, want stopped at max_count after 2", status)
+	}
+	if info, err := os.Stat(status.File); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0o600 {
+		t.Errorf("capture file mode = %v, want 0600", info.Mode().Perm())
+	}
+	if !slices.Contains(auditActions(lb), "admin capture_start") {
+		t.Errorf("audit = %v, want the capture start", auditActions(lb))
+	}
+}
+
+func TestCaptureStopAndConflicts(t *testing.T) {
+	lb := newCaptureLB(t)
+	if rec := serve(lb, adminRequest(lb, http.MethodGet, "/admin/capture", "")); rec.Code != http.StatusNotFound {
+		t.Errorf("status before any capture: %d, want 404", rec.Code)
+	}
+	if rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/capture", `{"sample_rate": 2}`)); rec.Code != http.StatusBadRequest {
+		t.Errorf("sample_rate 2: status %d, want 400", rec.Code)
+	}
+	if rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/capture", "")); rec.Code != http.StatusCreated {
+		t.Fatalf("start capture: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/capture", "")); rec.Code != http.StatusConflict {
+		t.Errorf("second capture: status %d, want 409", rec.Code)
+	}
+	serve(lb, httptest.NewRequest(http.MethodGet, "/anything", nil))
+
+	rec := serve(lb, adminRequest(lb, http.MethodDelete, "/admin/capture", ""))
+	var status CaptureStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	if rec.Code != http.StatusOK || status.Active || status.StopReason != "stopped" || status.Captured != 1 {
+		t.Errorf("stop: status %d %+v, want stopped after 1 request", rec.Code, status)
+	}
+	if status.Filter.SampleRate != 1 || status.Filter.MaxCount != 100 || status.Filter.MaxBodyBytes != 64<<10 {
+		t.Errorf("filter = %+v, want the defaults", status.Filter)
+	}
+	serve(lb, httptest.NewRequest(http.MethodGet, "/after", nil))
+	if records := readCapture(t, lb); len(records) != 1 || records[0].URL != "/anything" {
+		t.Errorf("captured %+v, want only the request before the stop", records)
+	}
+	if rec := serve(lb, adminRequest(lb, http.MethodDelete, "/admin/capture", "")); rec.Code != http.StatusNotFound {
+		t.Errorf("stopping twice: status %d, want 404", rec.Code)
+	}
+}
+
+func TestCaptureRedactHeadersConfigurable(t *testing.T) {
+	lb := newCaptureLB(t)
+	lb.cfg.CaptureRedactHeaders = []string{"x-api-key"}
+	serve(lb, adminRequest(lb, http.MethodPost, "/admin/capture", `{"max_count": 1}`))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Api-Key", "k-123")
+	r.Header.Set("Authorization", "Bearer user-token")
+	serve(lb, r)
+
+	records := readCapture(t, lb)
+	if len(records) != 1 {
+		t.Fatalf("captured %d requests, want 1", len(records))
+	}
+	if got := records[0].Headers.Get("X-Api-Key"); got != "[REDACTED]" {
+		t.Errorf("X-Api-Key = %q, want it redacted", got)
+	}
+	if got := records[0].Headers.Get("Authorization"); got != "Bearer user-token" {
+		t.Errorf("Authorization = %q, want it kept when not listed", got)
+	}
+}
+
+// bodyEchoBackend answers with its name and the request body it received.
+func bodyEchoBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s:%s", name, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newBodyRouteLB(t *testing.T) *LoadBalancer {
+	t.Helper()
+	cfg := testConfig()
+	cfg.Port = "8080"
+	cfg.Backends = []BackendConfig{
+		{URL: bodyEchoBackend(t, "default").URL},
+		{URL: bodyEchoBackend(t, "orders").URL, Pool: "orders"},
+		{URL: bodyEchoBackend(t, "users").URL, Pool: "users"},
+	}
+	cfg.Routes = []RouteConfig{
+		{PathPattern: "/soap", Pool: "orders", BodyMatch: &BodyMatch{JSONPath: "$.op.name", Regex: "^Order"}},
+		{PathPattern: "/soap", Pool: "users", BodyMatch: &BodyMatch{Regex: "<op>User", MaxBytes: 64}},
+		{PathPattern: "/soap"},
+	}
+	if report := cfg.validate(); !report.Valid {
+		t.Fatalf("invalid config: %v", report.Errors)
+	}
+	return NewLoadBalancer(cfg)
+}
+
+func TestBodyMatchRouting(t *testing.T) {
+	lb := newBodyRouteLB(t)
+	long := "<op>User</op>" + strings.Repeat(" ", 64)
+	for _, tc := range []struct {
+		name, body, want string
+		chunked          bool
+	}{
+		{"json path", `{"op": {"name": "OrderCreate"}}`, "orders", false},
+		{"json path miss", `{"op": {"name": "Ping"}}`, "default", false},
+		{"raw regex", "<op>UserGet</op>", "users", false},
+		{"over the cap", long, "default", false},
+		{"over the cap, no length", long, "default", true},
+		{"no body", "", "default", false},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/soap", strings.NewReader(tc.body))
+		if tc.chunked {
+			r.ContentLength = -1
+		}
+		want := tc.want + ":" + tc.body
+		if rec := serve(lb, r); rec.Body.String() != want {
+			t.Errorf("%s: got %q, want %q", tc.name, rec.Body, want)
+		}
+	}
+}
+
+func TestBodyMatchSkipsOtherRoutes(t *testing.T) {
+	lb := newBodyRouteLB(t)
+	r := httptest.NewRequest(http.MethodPost, "/rest", strings.NewReader(`{"op": {"name": "OrderCreate"}}`))
+	body := r.Body
+	if got := lb.inspectBody(r); got != r || r.Body != body {
+		t.Error("body inspected for a path without a body_match route")
+	}
+
+	plain := NewLoadBalancer(testConfig(namedBackend(t, "backend").URL))
+	if plain.bodyRoutes {
+		t.Error("bodyRoutes set without any body_match route")
+	}
+}
+
+func TestLookupJSONPath(t *testing.T) {
+	var doc any
+	json.Unmarshal([]byte(`{"items": [{"type": "a"}, {"type": "b", "n": 2}]}`), &doc)
+	for path, want := range map[string]any{
+		"$.items[1].type": "b",
+		"items[0].type":   "a",
+		"$.items[1].n":    2.0,
+	} {
+		if got, ok := lookupJSONPath(doc, path); !ok || got != want {
+			t.Errorf("lookupJSONPath(%q) = %v, %v, want %v", path, got, ok, want)
+		}
+	}
+	for _, path := range []string{"$.items[2].type", "$.items.type", "$.missing", "$.items[0].type.deeper"} {
+		if got, ok := lookupJSONPath(doc, path); ok {
+			t.Errorf("lookupJSONPath(%q) = %v, want no value", path, got)
+		}
+	}
+}
+
+func TestValidateBodyMatch(t *testing.T) {
+	for match, want := range map[BodyMatch]string{
+		{}:                               "Route /soap has a body_match without json_path or regex",
+		{Regex: "(["}:                    "Route /soap has invalid body_match regex",
+		{JSONPath: "$.op", MaxBytes: -1}: "Route /soap has negative body_match max_bytes",
+	} {
+		cfg := testConfig("http://127.0.0.1:9001")
+		cfg.Port = "8080"
+		cfg.Routes = []RouteConfig{{PathPattern: "/soap", BodyMatch: &match}}
+		report := cfg.validate()
+		if report.Valid || !slices.ContainsFunc(report.Errors, func(e string) bool { return strings.HasPrefix(e, want) }) {
+			t.Errorf("%+v: errors = %v, want %q", match, report.Errors, want)
+		}
+	}
+}
+
+func TestRuntimeStats(t *testing.T) {
+	cfg := testConfig(namedBackend(t, "backend").URL)
+	cfg.AdminToken = "secret"
+	lb := NewLoadBalancer(cfg)
+	runtime.GC()
+
+	var stats Stats
+	rec := serve(lb, adminRequest(lb, http.MethodGet, "/admin/stats", ""))
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	rt := stats.Runtime
+	if rt.SampledAt.IsZero() || rt.Goroutines == 0 || rt.HeapInUseBytes == 0 || rt.SysBytes == 0 || rt.NumGC == 0 {
+		t.Errorf("runtime stats = %+v, want them filled in", rt)
+	}
+	if _, err := os.Stat("/proc/self/stat"); err == nil {
+		if rt.OpenFDs == nil || *rt.OpenFDs == 0 || rt.CPUUserSeconds == nil || rt.CPUSystemSeconds == nil {
+			t.Errorf("runtime stats = %+v, want descriptor and CPU figures from /proc", rt)
+		}
+	}
+}
+
+func TestRuntimeStatsCached(t *testing.T) {
+	lb := NewLoadBalancer(testConfig(namedBackend(t, "backend").URL))
+	first := lb.runtimeStats()
+	runtime.GC()
+	if again := lb.runtimeStats(); !again.SampledAt.Equal(first.SampledAt) || again.NumGC != first.NumGC {
+		t.Errorf("stats resampled within %v: %+v then %+v", runtimeStatsTTL, first, again)
+	}
+
+	lb.runtimeMu.Lock()
+	lb.runtime.SampledAt = time.Now().Add(-runtimeStatsTTL)
+	lb.runtimeMu.Unlock()
+	if fresh := lb.runtimeStats(); !fresh.SampledAt.After(first.SampledAt) || fresh.NumGC <= first.NumGC {
+		t.Errorf("stale stats not refreshed: %+v", fresh)
+	}
+}
+
+func TestProcCPUTime(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no /proc on this system")
+	}
+	user, system, err := procCPUTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user < 0 || system < 0 {
+		t.Fatalf("CPU time = %vs user, %vs system", user, system)
+	}
+
+	// Burn a few clock ticks' worth of CPU.
+	sum := 0
+	for start := time.Now(); time.Since(start) < 100*time.Millisecond; {
+		sum++
+	}
+	user2, system2, _ := procCPUTime()
+	if user2+system2 <= user+system {
+		t.Errorf("CPU time stayed at %vs after spinning %d times", user2+system2, sum)
+	}
+}
+
+// stallingBackend sends "part", then waits stall before sending "-rest".
+func stallingBackend(t *testing.T, stall time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "part")
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(stall):
+		case <-r.Context().Done():
+			return
+		}
+		io.WriteString(w, "-rest")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPhaseTimeoutClasses(t *testing.T) {
+	// A listener that accepts connections but never speaks TLS.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { silent.Close() })
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	slowHeaders, _ := sleepyBackend(t, "slow", 300*time.Millisecond)
+
+	for _, tc := range []struct {
+		class     string
+		backend   string
+		configure func(*Config)
+	}{
+		{"tls_handshake", "https://" + silent.Addr().String(), func(cfg *Config) { cfg.TLSHandshakeTimeout = 50 * time.Millisecond }},
+		{"response_header", slowHeaders.URL, func(cfg *Config) { cfg.ResponseHeaderTimeout = 50 * time.Millisecond }},
+	} {
+		logs := captureLog(t)
+		cfg := testConfig(tc.backend)
+		cfg.MaxRetries = 0
+		tc.configure(cfg)
+		lb := NewLoadBalancer(cfg)
+
+		start := time.Now()
+		if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusGatewayTimeout {
+			t.Errorf("%s: status %d, want 504", tc.class, rec.Code)
+		}
+		if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+			t.Errorf("%s: gave up after %v, want about 50ms", tc.class, elapsed)
+		}
+		if got := counterValue(lb.metrics.backendTimeouts, tc.backend, tc.class); got != 1 {
+			t.Errorf("%s: lb_backend_timeouts_total = %v, want 1", tc.class, got)
+		}
+		if want := "(" + tc.class + " timeout)"; !strings.Contains(logs.String(), want) {
+			t.Errorf("%s: log doesn't name the timeout:\n%s", tc.class, logs)
+		}
+	}
+}
+
+func TestBodyIdleTimeout(t *testing.T) {
+	logs := captureLog(t)
+	stalling := stallingBackend(t, 300*time.Millisecond)
+	cfg := testConfig()
+	cfg.Backends = []BackendConfig{
+		{URL: stalling.URL, BodyIdleTimeout: 50 * time.Millisecond},
+		{URL: stalling.URL + "/"},
+	}
+	lb := NewLoadBalancer(cfg)
+	front := httptest.NewServer(lb)
+	defer front.Close()
+
+	// The first backend gives up on the stalled body; the second, with no
+	// body_idle_timeout, waits it out.
+	resp, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil || string(body) != "part" {
+		t.Errorf("stalled body read %q, %v; want it cut off after \"part\"", body, err)
+	}
+	if got := counterValue(lb.metrics.backendTimeouts, stalling.URL, "body_idle"); got != 1 {
+		t.Errorf("body_idle timeouts = %v, want 1", got)
+	}
+	if !strings.Contains(logs.String(), "timed out (body_idle timeout)") {
+		t.Errorf("log doesn't name the body_idle timeout:\n%s", logs)
+	}
+
+	resp, err = http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "part-rest" {
+		t.Errorf("backend without body_idle_timeout: read %q, %v", body, err)
+	}
+}
+
+func TestBodyIdleTimeoutOnlyCountsBackendWaits(t *testing.T) {
+	pr, pw := io.Pipe()
+	var fired atomic.Bool
+	body := newIdleTimeoutBody(pr, 50*time.Millisecond, func() { fired.Store(true) })
+	go func() {
+		pw.Write([]byte("a"))
+		pw.Write([]byte("b"))
+		pw.Close()
+	}()
+
+	buf := make([]byte, 1)
+	if _, err := body.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	// A slow reader isn't the backend's fault.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := body.Read(buf); err != nil || fired.Load() {
+		t.Errorf("read after a slow client: %v (fired %v), want no timeout", err, fired.Load())
+	}
+	body.Close()
+
+	pr, pw = io.Pipe()
+	defer pw.Close()
+	body = newIdleTimeoutBody(pr, 50*time.Millisecond, func() { fired.Store(true) })
+	if _, err := body.Read(buf); !errors.Is(err, errBodyIdleTimeout) || !fired.Load() {
+		t.Errorf("read from a silent backend: %v (fired %v), want errBodyIdleTimeout", err, fired.Load())
+	}
+}
+
+func TestTimeoutClass(t *testing.T) {
+	live := context.Background()
+	expired, cancel := context.WithDeadline(live, time.Now().Add(-time.Second))
+	defer cancel()
+	dialTimeout := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}
+	for _, tc := range []struct {
+		ctx  context.Context
+		err  error
+		want string
+	}{
+		{live, dialTimeout, "dial"},
+		{live, errors.New("net/http: TLS handshake timeout"), "tls_handshake"},
+		{live, errors.New("net/http: timeout awaiting response headers"), "response_header"},
+		{live, fmt.Errorf("copy: %w", errBodyIdleTimeout), "body_idle"},
+		{expired, dialTimeout, "attempt"},
+		{live, context.DeadlineExceeded, "attempt"},
+		{live, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, ""},
+		{live, io.ErrUnexpectedEOF, ""},
+	} {
+		if got := timeoutClass(tc.ctx, tc.err); got != tc.want {
+			t.Errorf("timeoutClass(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestPhaseTimeoutOverrides(t *testing.T) {
+	cfg := testConfig()
+	cfg.DialTimeout = 300 * time.Millisecond
+	cfg.BodyIdleTimeout = 30 * time.Second
+	cfg.Backends = []BackendConfig{
+		{URL: "http://127.0.0.1:9001"},
+		{URL: "http://127.0.0.1:9002", DialTimeout: time.Second, BodyIdleTimeout: time.Minute},
+	}
+	lb := NewLoadBalancer(cfg)
+	inherited, own := lb.backends[0].Config, lb.backends[1].Config
+	if inherited.DialTimeout != 300*time.Millisecond || inherited.BodyIdleTimeout != 30*time.Second {
+		t.Errorf("backend without overrides: dial %v, body idle %v; want the global timeouts", inherited.DialTimeout, inherited.BodyIdleTimeout)
+	}
+	if own.DialTimeout != time.Second || own.BodyIdleTimeout != time.Minute {
+		t.Errorf("backend with overrides: dial %v, body idle %v; want its own", own.DialTimeout, own.BodyIdleTimeout)
+	}
+
+	cfg = testConfig("http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.Backends[0].BodyIdleTimeout = -time.Second
+	if report := cfg.validate(); report.Valid {
+		t.Error("negative per-backend body_idle_timeout accepted")
+	}
+}
+
+// requestEchoBackend answers with the request line and Host it received.
+func requestEchoBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RequestURI(), r.Host)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newRewriteTestLB(t *testing.T) (*LoadBalancer, string, string) {
+	t.Helper()
+	main, open := requestEchoBackend(t), requestEchoBackend(t)
+	cfg := testConfig()
+	cfg.AdminToken = "secret"
+	cfg.Routes = []RouteConfig{{PathPattern: "/open/*", Pool: "open"}}
+	cfg.Backends = []BackendConfig{
+		{URL: main.URL + "/base", ForwardedPath: "/v2${path}?src=lb&${query}", BackendHostHeader: "api.internal"},
+		{URL: open.URL, Pool: "open"},
+	}
+	return NewLoadBalancer(cfg), main.URL + "/base", open.URL
+}
+
+func rewriteTest(t *testing.T, lb *LoadBalancer, body string) (int, RewriteResult) {
+	t.Helper()
+	rec := serve(lb, adminRequest(lb, http.MethodPost, "/admin/rewrite/test", body))
+	var result RewriteResult
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, result
+}
+
+func TestRewriteTestEndpoint(t *testing.T) {
+	lb, mainURL, _ := newRewriteTestLB(t)
+	code, result := rewriteTest(t, lb, `{"method": "POST", "host": "shop.example.com", "path": "/orders?id=7", "headers": {"X-Trace": "t-1"}}`)
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	mainHost := strings.TrimPrefix(strings.TrimSuffix(mainURL, "/base"), "http://")
+	want := RewriteResult{
+		Pool:    "default",
+		Backend: mainURL,
+		Method:  http.MethodPost,
+		URL:     "http://" + mainHost + "/base/v2/orders?src=lb&id=7",
+		Host:    "api.internal",
+		Proto:   "HTTP/1.1",
+		Headers: http.Header{"X-Trace": {"t-1"}},
+		Steps: []RewriteStep{
+			{Modifier: "target", Changed: true, URL: "http://" + mainHost + "/base/orders?id=7"},
+			{Modifier: "forwarded_path", Changed: true, URL: "http://" + mainHost + "/base/v2/orders?src=lb&id=7"},
+			{Modifier: "host_header", Changed: true, URL: "http://" + mainHost + "/base/v2/orders?src=lb&id=7"},
+		},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("result =\n%+v\nwant\n%+v", result, want)
+	}
+
+	// The same request, proxied, reaches the backend as described.
+	r := httptest.NewRequest(http.MethodPost, "/orders?id=7", nil)
+	r.Host = "shop.example.com"
+	if rec := serve(lb, r); rec.Body.String() != "POST /base/v2/orders?src=lb&id=7 api.internal" {
+		t.Errorf("backend received %q", rec.Body)
+	}
+}
+
+func TestRewriteTestRoutesAndBackends(t *testing.T) {
+	lb, mainURL, openURL := newRewriteTestLB(t)
+	lb.canaryMu.Lock()
+	lb.canaryWeight = 25
+	lb.canaryMu.Unlock()
+
+	code, result := rewriteTest(t, lb, `{"path": "/open/docs"}`)
+	if code != http.StatusOK || result.Pool != "open" || result.Route != "/open/*" || result.Backend != openURL || result.CanaryWeight != 0 {
+		t.Errorf("routed request: status %d %+v, want the open pool's backend", code, result)
+	}
+	if result.Method != http.MethodGet || result.Host != strings.TrimPrefix(openURL, "http://") || len(result.Steps) != 2 {
+		t.Errorf("routed request: %s with Host %q, steps %+v; want GET to the backend's own host", result.Method, result.Host, result.Steps)
+	}
+
+	code, result = rewriteTest(t, lb, `{"path": "/orders"}`)
+	if code != http.StatusOK || result.Pool != "default" || result.CanaryWeight != 25 {
+		t.Errorf("unrouted request: status %d %+v, want the default pool with the canary weight", code, result)
+	}
+
+	code, result = rewriteTest(t, lb, fmt.Sprintf(`{"path": "/orders", "backend": %q}`, openURL))
+	if code != http.StatusOK || result.Backend != openURL {
+		t.Errorf("chosen backend: status %d %+v", code, result)
+	}
+
+	lb.backends[1].SetAlive(false)
+	for body, want := range map[string]int{
+		`{"path": "/open/docs"}`:                           http.StatusUnprocessableEntity,
+		`{"path": "/orders", "backend": "http://nowhere"}`: http.StatusNotFound,
+		`{"method": "GET"}`:                                http.StatusBadRequest,
+		`{"path": "orders"}`:                               http.StatusBadRequest,
+		`{"method": "BAD METHOD", "path": "/"}`:            http.StatusBadRequest,
+		`not json`:                                         http.StatusBadRequest,
+	} {
+		if code, _ := rewriteTest(t, lb, body); code != want {
+			t.Errorf("%s: status %d, want %d", body, code, want)
+		}
+	}
+	if len(lb.getBackends()) != 2 || lb.backends[0].URL != mainURL {
+		t.Error("rewrite test changed the backends")
+	}
+}
+
+func TestFallbackServesWhenPoolIsDown(t *testing.T) {
+	logs := captureLog(t)
+	primary, fallback := namedBackend(t, "primary"), namedBackend(t, "fallback")
+	open := namedBackend(t, "open")
+	cfg := testConfig()
+	cfg.AdminToken = "secret"
+	cfg.Routes = []RouteConfig{{PathPattern: "/open/*", Pool: "open"}}
+	cfg.Backends = []BackendConfig{
+		{URL: primary.URL},
+		{URL: fallback.URL, Fallback: true},
+		{URL: open.URL, Pool: "open"},
+	}
+	lb := NewLoadBalancer(cfg)
+	if got := len(lb.getBackends()); got != 2 {
+		t.Fatalf("%d backends in rotation, want the fallback left out", got)
+	}
+
+	for range 3 {
+		rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Body.String() != "primary" || rec.Header().Get("X-Served-By") != "" {
+			t.Fatalf("pool up: got %q (X-Served-By %q), want the primary", rec.Body, rec.Header().Get("X-Served-By"))
+		}
+	}
+
+	lb.backends[0].SetAlive(false)
+	rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "fallback" || rec.Header().Get("X-Served-By") != "fallback" {
+		t.Errorf("pool down: %d %q (X-Served-By %q), want the fallback", rec.Code, rec.Body, rec.Header().Get("X-Served-By"))
+	}
+	if got := counterValue(lb.metrics.fallbackResponses, "default"); got != 1 {
+		t.Errorf("lb_fallback_responses_total = %v, want 1", got)
+	}
+	if !strings.Contains(logs.String(), "No backend available in pool default, using its fallback") {
+		t.Errorf("fallback not logged:\n%s", logs)
+	}
+	stats := lb.collectStats()
+	if len(stats.Fallbacks) != 1 || stats.Fallbacks[0].Pool != "default" || stats.Fallbacks[0].Requests != 1 || !stats.Fallbacks[0].Alive {
+		t.Errorf("fallback stats = %+v, want one request to the default pool's fallback", stats.Fallbacks)
+	}
+	if stats.TotalBackends != 2 || stats.Alive != 1 {
+		t.Errorf("backend counts = %d total, %d alive; want the fallback left out", stats.TotalBackends, stats.Alive)
+	}
+
+	// Only the pool with a fallback gets one.
+	lb.backends[1].SetAlive(false)
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/open/x", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("open pool down: status %d, want 503", rec.Code)
+	}
+
+	lb.fallbacks["default"].SetAlive(false)
+	if rec := serve(lb, httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("fallback down too: status %d, want 503", rec.Code)
+	}
+}
+
+func TestFallbackProbe(t *testing.T) {
+	logs := captureLog(t)
+	primary := namedBackend(t, "primary")
+	fallback, healthy := toggleHealthBackend(t)
+	cfg := testConfig()
+	cfg.HealthCheckInterval = 20 * time.Millisecond
+	cfg.Backends = []BackendConfig{{URL: primary.URL}, {URL: fallback.URL, Fallback: true}}
+	lb := NewLoadBalancer(cfg)
+	startTestHealthChecks(t, lb)
+
+	healthy.Store(false)
+	if !waitFor(func() bool { return !lb.fallbacks["default"].IsAlive() }) {
+		t.Fatal("fallback answering 503 still up")
+	}
+	stats := lb.collectStats()
+	if stats.Fallbacks[0].LastProbeError != "status 503" || stats.Fallbacks[0].LastProbeErrorAt == nil {
+		t.Errorf("fallback stats = %+v, want the probe error", stats.Fallbacks[0])
+	}
+	if !strings.Contains(logs.String(), "[WARN] Fallback "+fallback.URL+" for pool default is down: status 503") {
+		t.Errorf("fallback going down not logged:\n%s", logs)
+	}
+	// The probe stays out of the health metrics of the backends in rotation.
+	if got := counterValue(lb.metrics.healthChecks, fallback.URL, "fail"); got != 0 {
+		t.Errorf("health check metrics count the fallback probe: %v", got)
+	}
+
+	healthy.Store(true)
+	if !waitFor(func() bool { return lb.fallbacks["default"].IsAlive() }) {
+		t.Fatal("fallback never came back up")
+	}
+	if !strings.Contains(logs.String(), "[INFO] Fallback "+fallback.URL+" for pool default is up again") {
+		t.Errorf("fallback recovery not logged:\n%s", logs)
+	}
+}
+
+func TestFallbackValidation(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:9001")
+	cfg.Port = "8080"
+	cfg.Backends = append(cfg.Backends,
+		BackendConfig{URL: "http://127.0.0.1:9002", Fallback: true},
+		BackendConfig{URL: "http://127.0.0.1:9003", Fallback: true})
+	report := cfg.validate()
+	want := "Pool default has two fallback backends, http://127.0.0.1:9002 and http://127.0.0.1:9003"
+	if report.Valid || !slices.Contains(report.Errors, want) {
+		t.Errorf("errors = %v, want %q", report.Errors, want)
+	}
+
+	lb := NewLoadBalancer(testConfig("http://127.0.0.1:9001"))
+	if _, err := lb.AddBackend(BackendConfig{URL: "http://127.0.0.1:9002", Fallback: true}); err == nil {
+		t.Error("fallback backend added at runtime")
+	}
+}